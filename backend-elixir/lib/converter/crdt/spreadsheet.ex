@@ -32,13 +32,31 @@ defmodule Converter.CRDT.Spreadsheet do
   end
 
   def update_cell(spreadsheet_id, row, col, value, user_id) do
-    GenServer.cast(via_tuple(spreadsheet_id), {:update_cell, row, col, value, user_id})
+    patch_cell(spreadsheet_id, row, col, %{value: value}, user_id)
+  end
+
+  @doc """
+  Updates the `:value` and/or `:style` of a cell; fields missing from
+  `changes` keep what the cell had. A style is the cell's whole style.
+  """
+  def patch_cell(spreadsheet_id, row, col, changes, user_id) when is_map(changes) do
+    GenServer.cast(via_tuple(spreadsheet_id), {:update_cell, row, col, changes, user_id})
   end
 
   def merge_remote_state(spreadsheet_id, remote_crdt) do
     GenServer.cast(via_tuple(spreadsheet_id), {:merge, remote_crdt})
   end
 
+  @doc """
+  Shifts cells after rows or columns were inserted, deleted or moved.
+  `map_index` takes an old row/column index and returns the new one, or nil
+  for a deleted one.
+  """
+  def shift(spreadsheet_id, dimension, map_index, event)
+      when dimension in [:rows, :columns] and is_function(map_index, 1) do
+    GenServer.call(via_tuple(spreadsheet_id), {:shift, dimension, map_index, event}, 15_000)
+  end
+
   ## Server Callbacks
 
   @impl true
@@ -78,18 +96,50 @@ defmodule Converter.CRDT.Spreadsheet do
   end
 
   @impl true
-  def handle_cast({:update_cell, row, col, value, user_id}, state) do
+  def handle_call({:shift, dimension, map_index, event}, _from, state) do
+    new_crdt =
+      Enum.reduce(state.crdt, %{}, fn {cell_key, cell_data}, acc ->
+        [row, col] = cell_key |> String.split(":") |> Enum.map(&String.to_integer/1)
+
+        moved =
+          case dimension do
+            :rows -> {map_index.(row), col}
+            :columns -> {row, map_index.(col)}
+          end
+
+        case moved do
+          {nil, _} -> acc
+          {_, nil} -> acc
+          {new_row, new_col} -> Map.put(acc, "#{new_row}:#{new_col}", cell_data)
+        end
+      end)
+
+    Phoenix.PubSub.broadcast(
+      Converter.PubSub,
+      "crdt:#{state.spreadsheet_id}",
+      {:structure_change, event}
+    )
+
+    {:reply, {:ok, map_size(new_crdt)}, %{state |
+      crdt: new_crdt,
+      last_activity: now(),
+      dirty: true
+    }}
+  end
+
+  @impl true
+  def handle_cast({:update_cell, row, col, changes, user_id}, state) do
     start_time = System.monotonic_time(:microsecond)
 
     # Create cell key
     cell_key = "#{row}:#{col}"
 
-    # Update CRDT with cell value and metadata
-    cell_data = %{
-      value: value,
-      user_id: user_id,
-      timestamp: System.system_time(:millisecond)
-    }
+    # Update CRDT with the changed fields and metadata
+    cell_data =
+      state.crdt
+      |> Map.get(cell_key, %{value: ""})
+      |> Map.merge(changes)
+      |> Map.merge(%{user_id: user_id, timestamp: System.system_time(:millisecond)})
 
     new_crdt = Map.put(state.crdt, cell_key, cell_data)
 
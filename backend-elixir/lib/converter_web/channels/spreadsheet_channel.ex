@@ -66,18 +66,33 @@ defmodule ConverterWeb.SpreadsheetChannel do
 
     # Only broadcast if not from this socket's user
     if cell_data.user_id != socket.assigns.user_id do
-      push(socket, "cell_update", %{
-        row: String.to_integer(row),
-        col: String.to_integer(col),
-        value: cell_data.value,
-        user_id: cell_data.user_id,
-        timestamp: cell_data.timestamp
-      })
+      push(
+        socket,
+        "cell_update",
+        Map.merge(
+          %{
+            row: String.to_integer(row),
+            col: String.to_integer(col),
+            value: cell_data.value,
+            user_id: cell_data.user_id,
+            timestamp: cell_data.timestamp
+          },
+          Map.take(cell_data, [:style])
+        )
+      )
     end
 
     {:noreply, socket}
   end
 
+  # Rows or columns were inserted, deleted or moved through the REST API;
+  # clients shift their grid the same way.
+  @impl true
+  def handle_info({:structure_change, event}, socket) do
+    push(socket, "structure_change", Map.put(event, :timestamp, System.system_time(:millisecond)))
+    {:noreply, socket}
+  end
+
   # Handle cell edit from user
   @impl true
   def handle_in("cell_edit", %{"row" => row, "col" => col, "value" => value}, socket) do
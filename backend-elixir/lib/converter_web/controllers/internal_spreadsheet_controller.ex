@@ -32,6 +32,26 @@ defmodule ConverterWeb.InternalSpreadsheetController do
     end
   end
 
+  def structure(conn, %{"spreadsheet_id" => spreadsheet_id} = params) when is_binary(spreadsheet_id) do
+    with :ok <- authorize(conn),
+         {:ok, dimension, map_index} <- normalize_structure(params),
+         :ok <- ensure_crdt_process(spreadsheet_id),
+         {:ok, cells} <-
+           SpreadsheetCRDT.shift(spreadsheet_id, dimension, map_index, structure_event(params)) do
+      json(conn, %{ok: true, cells: cells})
+    else
+      {:error, :unauthorized} ->
+        conn |> put_status(:unauthorized) |> json(%{error: "unauthorized"})
+
+      {:error, :bad_request, message} ->
+        conn |> put_status(:bad_request) |> json(%{error: message})
+
+      error ->
+        Logger.error("internal structure failed: #{inspect(error)}")
+        conn |> put_status(:internal_server_error) |> json(%{error: "internal_error"})
+    end
+  end
+
   defp authorize(conn) do
     expected = System.get_env("INTERNAL_API_SECRET")
     provided = conn |> get_req_header("x-internal-secret") |> List.first()
@@ -65,9 +85,9 @@ defmodule ConverterWeb.InternalSpreadsheetController do
 
     Enum.reduce_while(Enum.with_index(edits), {:ok, 0}, fn {edit, idx}, {:ok, applied} ->
       case normalize_edit(edit) do
-        {:ok, row, col, value} ->
+        {:ok, row, col, changes} ->
           # Use user_id=0 for "system" updates (not tied to any connected socket).
-          SpreadsheetCRDT.update_cell(spreadsheet_id, row, col, value, 0)
+          SpreadsheetCRDT.patch_cell(spreadsheet_id, row, col, changes, 0)
           {:cont, {:ok, applied + 1}}
 
         {:error, message} ->
@@ -76,22 +96,79 @@ defmodule ConverterWeb.InternalSpreadsheetController do
     end)
   end
 
+  # An edit without "value" only changes the style; "style" is the cell's
+  # whole style, where %{} clears it.
   defp normalize_edit(%{"row" => row, "col" => col} = edit) when is_integer(row) and is_integer(col) do
+    style = Map.get(edit, "style")
+
     cond do
       row < 0 or col < 0 ->
         {:error, "row/col must be >= 0"}
 
+      not (is_nil(style) or is_map(style)) ->
+        {:error, "style must be an object"}
+
       true ->
-        value =
-          case Map.get(edit, "value") do
-            nil -> ""
-            v -> to_string(v)
+        changes =
+          case {Map.get(edit, "value"), style} do
+            {nil, nil} -> %{value: ""}
+            {nil, style} -> %{style: style}
+            {value, nil} -> %{value: to_string(value)}
+            {value, style} -> %{value: to_string(value), style: style}
           end
 
-        {:ok, row, col, value}
+        {:ok, row, col, changes}
     end
   end
 
   defp normalize_edit(_), do: {:error, "invalid edit shape"}
-end
 
+  # Index maps mirror the Go API: indexes are 0-based, a deleted index maps
+  # to nil and a move puts the block in front of the index "to" had before.
+  defp normalize_structure(%{"op" => op, "dimension" => dimension, "index" => index, "count" => count} = params)
+       when dimension in ["rows", "columns"] and is_integer(index) and is_integer(count) and
+              index >= 0 and count >= 1 do
+    start = index
+    finish = index + count
+    dimension = if dimension == "rows", do: :rows, else: :columns
+
+    case {op, Map.get(params, "to", 0)} do
+      {"insert", _} ->
+        {:ok, dimension, fn i -> if i >= start, do: i + count, else: i end}
+
+      {"delete", _} ->
+        {:ok, dimension,
+         fn
+           i when i >= finish -> i - count
+           i when i >= start -> nil
+           i -> i
+         end}
+
+      {"move", to} when is_integer(to) and to >= 0 and (to <= start or to >= finish) ->
+        {:ok, dimension,
+         fn
+           i when i >= start and i < finish and to > start -> i + to - finish
+           i when i >= start and i < finish -> i - start + to
+           i when to > start and i >= finish and i < to -> i - count
+           i when to < start and i >= to and i < start -> i + count
+           i -> i
+         end}
+
+      _ ->
+        {:error, :bad_request, "invalid structure operation"}
+    end
+  end
+
+  defp normalize_structure(_), do: {:error, :bad_request, "invalid structure operation"}
+
+  defp structure_event(params) do
+    %{
+      op: params["op"],
+      dimension: params["dimension"],
+      index: params["index"],
+      count: params["count"],
+      to: params["to"],
+      revision: params["revision"]
+    }
+  end
+end
@@ -11,5 +11,6 @@ defmodule ConverterWeb.Router do
     get "/health", HealthController, :index
     get "/metrics", MetricsController, :index
     post "/internal/spreadsheets/:spreadsheet_id/batch_edit", InternalSpreadsheetController, :batch_edit
+    post "/internal/spreadsheets/:spreadsheet_id/structure", InternalSpreadsheetController, :structure
   end
 end
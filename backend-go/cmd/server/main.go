@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"converter-backend/internal/handlers"
 	"converter-backend/internal/models"
 	"converter-backend/internal/services"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -40,14 +42,25 @@ func main() {
 	service.DB.AutoMigrate(&models.User{}, &models.SheetFileShare{})
 	fileHandler := handlers.NewFileHandler(service)
 
+	jobDir := os.Getenv("JOB_DIR")
+	if jobDir == "" {
+		jobDir = filepath.Join(os.TempDir(), "converter-jobs")
+	}
+	jobQueue, err := services.NewJobQueue(service, jobDir, 2)
+	if err != nil {
+		log.Fatalf("Job queue failed to start: %v", err)
+	}
+	jobQueue.Start(context.Background())
+	fileHandler.Jobs = jobQueue
+
 	r := gin.Default()
 
 	// CORS
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key"},
-		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "X-Db-Saved"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "If-Match"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "ETag", "Location", "X-Db-Saved"},
 		AllowCredentials: true,
 	}))
 
@@ -75,13 +88,43 @@ func main() {
 		{
 			api.GET("/files", fileHandler.List)
 			api.POST("/files", fileHandler.Save)
+			api.POST("/files/import", fileHandler.Import)
 			api.GET("/files/:id", fileHandler.Get)
 			api.DELETE("/files/:id", fileHandler.Delete)
+			api.GET("/files/:id/export", fileHandler.Export)
+			api.GET("/files/:id/records", fileHandler.GetRecords)
+			api.GET("/files/:id/query", fileHandler.QueryRecords)
+			api.POST("/files/:id/structure", fileHandler.ApplyStructure)
+			api.POST("/files/:id/ranges/:a1/ops", fileHandler.ApplyRangeOp)
+			api.PATCH("/files/:id/ranges/:a1/style", fileHandler.PatchRangeStyle)
+			api.GET("/files/:id/names", fileHandler.ListNames)
+			api.POST("/files/:id/names", fileHandler.CreateName)
+			api.GET("/files/:id/names/:name", fileHandler.GetName)
+			api.PUT("/files/:id/names/:name", fileHandler.UpdateName)
+			api.DELETE("/files/:id/names/:name", fileHandler.DeleteName)
+			api.POST("/sql", fileHandler.QuerySQL)
+			api.POST("/files/:id/records", fileHandler.AppendRecords)
+			api.PUT("/files/:id/records", fileHandler.UpsertRecords)
+			api.DELETE("/files/:id/records", fileHandler.DeleteRecords)
 			api.PATCH("/files/:id/cells", fileHandler.PatchCells)
+			api.GET("/files/:id/versions", fileHandler.ListVersions)
+			api.GET("/files/:id/versions/diff", fileHandler.DiffVersions)
+			api.GET("/files/:id/versions/:version", fileHandler.GetVersion)
+			api.POST("/files/:id/versions/:version/restore", fileHandler.RestoreVersion)
+			api.GET("/files/:id/branches", fileHandler.ListBranches)
+			api.POST("/files/:id/branches", fileHandler.CreateBranch)
+			api.GET("/files/:id/branches/:branch", fileHandler.GetBranch)
+			api.DELETE("/files/:id/branches/:branch", fileHandler.DeleteBranch)
+			api.GET("/files/:id/branches/:branch/cells", fileHandler.GetBranchCells)
+			api.PATCH("/files/:id/branches/:branch/cells", fileHandler.PatchBranchCells)
+			api.POST("/files/:id/branches/:branch/merge", fileHandler.MergeBranch)
 			api.POST("/files/:id/realtime/token", fileHandler.FileRealtimeToken)
 			api.GET("/files/:id/shares", fileHandler.ListShares)
 			api.POST("/files/:id/shares", fileHandler.CreateShare)
 			api.DELETE("/files/:id/shares/:userId", fileHandler.DeleteShare)
+			api.POST("/jobs/import", fileHandler.CreateImportJob)
+			api.GET("/jobs/:id", fileHandler.GetJob)
+			api.GET("/jobs/:id/download", fileHandler.DownloadJobResult)
 		}
 	}
 
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -15,6 +16,9 @@ type Config struct {
 	FileUpload     FileUploadConfig
 	RateLimit      RateLimitConfig
 	Email          EmailConfig
+	History        HistoryConfig
+	Jobs           JobsConfig
+	State          StateConfig
 }
 
 type DatabaseConfig struct {
@@ -30,12 +34,32 @@ type ServerConfig struct {
 
 type FileUploadConfig struct {
 	MaxSizeMB int64
+	// ConvertMaxSizeMB limits /convert, which streams rows instead of
+	// building a file state and can take much larger files.
+	ConvertMaxSizeMB int64
 }
 
 type RateLimitConfig struct {
 	RequestsPerMinute int
 }
 
+type HistoryConfig struct {
+	MaxVersionsPerFile int
+}
+
+// StateConfig limits the file states clients save.
+type StateConfig struct {
+	MaxCells       int
+	MaxValueLength int
+}
+
+// JobsConfig sets up the background import queue. Dir must outlive the
+// process (a volume in Docker) for queued uploads to survive restarts.
+type JobsConfig struct {
+	Workers int
+	Dir     string
+}
+
 type EmailConfig struct {
 	SMTPHost     string
 	SMTPPort     int
@@ -59,11 +83,23 @@ func LoadConfig() (*Config, error) {
 		},
 		JWTSecret: getEnv("JWT_SECRET", ""),
 		FileUpload: FileUploadConfig{
-			MaxSizeMB: int64(getEnvInt("MAX_UPLOAD_SIZE_MB", 10)),
+			MaxSizeMB:        int64(getEnvInt("MAX_UPLOAD_SIZE_MB", 10)),
+			ConvertMaxSizeMB: int64(getEnvInt("MAX_CONVERT_SIZE_MB", 500)),
 		},
 		RateLimit: RateLimitConfig{
 			RequestsPerMinute: getEnvInt("RATE_LIMIT_PER_MINUTE", 60),
 		},
+		History: HistoryConfig{
+			MaxVersionsPerFile: getEnvInt("MAX_VERSIONS_PER_FILE", 50),
+		},
+		State: StateConfig{
+			MaxCells:       getEnvInt("MAX_STATE_CELLS", 500000),
+			MaxValueLength: getEnvInt("MAX_CELL_VALUE_LENGTH", 32767),
+		},
+		Jobs: JobsConfig{
+			Workers: getEnvInt("JOB_WORKERS", 2),
+			Dir:     getEnv("JOB_DIR", filepath.Join(os.TempDir(), "converter-jobs")),
+		},
 		Email: EmailConfig{
 			SMTPHost:     getEnv("SMTP_HOST", "smtp.gmail.com"),
 			SMTPPort:     getEnvInt("SMTP_PORT", 587),
@@ -0,0 +1,253 @@
+package formula
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RefMap tells AdjustReferences where rows and columns went after a
+// structural edit. Row and Col return the new 0-based index of an old one,
+// or -1 when it was deleted; a nil function leaves that dimension alone.
+type RefMap struct {
+	Row func(int) int
+	Col func(int) int
+}
+
+func (m RefMap) row(r int) int {
+	if m.Row == nil {
+		return r
+	}
+	if r = m.Row(r); r > MaxRow {
+		return -1
+	}
+	return r
+}
+
+func (m RefMap) col(c int) int {
+	if m.Col == nil {
+		return c
+	}
+	return m.Col(c)
+}
+
+// AdjustReferences rewrites the cell references of a formula to follow
+// moved rows and columns, keeping their '$' anchors: anchors only matter
+// when a formula is copied, not when the cells it reads move. A reference
+// to a deleted cell becomes #REF!; a range shrinks to the cells left of it
+// and becomes #REF! when none are. Values that are not formulas, or do not
+// tokenize, come back unchanged.
+func AdjustReferences(raw string, m RefMap) string {
+	return rewriteReferences(raw, refRewriter{
+		cell: func(ref CellRef) (CellRef, bool) {
+			ref.Row, ref.Col = m.row(ref.Row), m.col(ref.Col)
+			return ref, ref.Row >= 0 && ref.Col >= 0
+		},
+		rng: func(a, b CellRef, whole bool) (CellRef, CellRef, bool) {
+			var okCols, okRows bool
+			a.Col, b.Col, okCols = adjustSpan(a.Col, b.Col, m.col)
+			if whole {
+				return a, b, okCols
+			}
+			a.Row, b.Row, okRows = adjustSpan(a.Row, b.Row, m.row)
+			return a, b, okCols && okRows
+		},
+	})
+}
+
+// OffsetReferences shifts the relative parts of a formula's references by
+// rows and cols, as copying the cell does; '$'-anchored parts stay. A
+// reference pushed off the sheet becomes #REF!.
+func OffsetReferences(raw string, rows, cols int) string {
+	shift := func(ref CellRef) (CellRef, bool) {
+		if !ref.AbsRow {
+			ref.Row += rows
+		}
+		if !ref.AbsCol {
+			ref.Col += cols
+		}
+		return ref, ref.Row >= 0 && ref.Row <= MaxRow && ref.Col >= 0
+	}
+	return rewriteReferences(raw, refRewriter{
+		cell: shift,
+		rng: func(a, b CellRef, whole bool) (CellRef, CellRef, bool) {
+			if whole {
+				a.AbsRow, b.AbsRow = true, true
+			}
+			a, okA := shift(a)
+			b, okB := shift(b)
+			return a, b, okA && okB
+		},
+	})
+}
+
+// MoveReferences points the references to cells of src at where a move
+// put them, rows and cols away; ranges follow when they lie inside src.
+// References to other cells of the destination, which the move overwrote,
+// become #REF!.
+func MoveReferences(raw string, src Range, rows, cols int) string {
+	dst := Range{StartRow: src.StartRow + rows, StartCol: src.StartCol + cols, EndRow: src.EndRow + rows, EndCol: src.EndCol + cols}
+	move := func(ref CellRef) (CellRef, bool) {
+		switch {
+		case src.contains(ref.Row, ref.Col):
+			ref.Row += rows
+			ref.Col += cols
+		case dst.contains(ref.Row, ref.Col):
+			return ref, false
+		}
+		return ref, true
+	}
+	return rewriteReferences(raw, refRewriter{
+		cell: move,
+		rng: func(a, b CellRef, whole bool) (CellRef, CellRef, bool) {
+			if whole || !src.contains(a.Row, a.Col) || !src.contains(b.Row, b.Col) {
+				return a, b, true
+			}
+			a, _ = move(a)
+			b, _ = move(b)
+			return a, b, true
+		},
+	})
+}
+
+func (r Range) contains(row, col int) bool {
+	return row >= r.StartRow && row <= r.EndRow && col >= r.StartCol && col <= r.EndCol
+}
+
+// refRewriter maps the references of a formula. cell maps a single
+// reference and rng the ends of a range, whose rows are ignored when whole
+// is set (a whole-column range such as A:C); false turns the reference
+// into #REF!.
+type refRewriter struct {
+	cell func(CellRef) (CellRef, bool)
+	rng  func(a, b CellRef, whole bool) (CellRef, CellRef, bool)
+}
+
+// rewriteReferences rebuilds a formula with the references mapped by rw,
+// leaving the rest of its text as written. Values that are not formulas, or
+// do not tokenize, come back unchanged.
+func rewriteReferences(raw string, rw refRewriter) string {
+	if !IsFormula(raw) {
+		return raw
+	}
+	src := raw[1:]
+	tokens, err := tokenize(src)
+	if err != nil {
+		return raw
+	}
+
+	var sb strings.Builder
+	last := 0
+	replace := func(from, to int, text string) {
+		sb.WriteString(src[last:from])
+		sb.WriteString(text)
+		last = to
+	}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind != tokIdent || tokens[i+1].kind == tokLParen {
+			continue
+		}
+		if tokens[i+1].kind == tokColon && tokens[i+2].kind == tokIdent {
+			end := tokens[i+2]
+			if text, ok := rewriteRange(t.text, end.text, rw); ok {
+				replace(t.pos, end.end, text)
+			}
+			i += 2
+			continue
+		}
+		ref, ok := parseCellRef(t.text)
+		if !ok {
+			continue
+		}
+		switch mapped, ok := rw.cell(ref); {
+		case !ok:
+			replace(t.pos, t.end, ErrRef)
+		case mapped != ref:
+			replace(t.pos, t.end, formatCellRef(mapped))
+		}
+	}
+	if last == 0 {
+		return raw
+	}
+	sb.WriteString(src[last:])
+	return "=" + sb.String()
+}
+
+// rewriteRange rewrites the range start:end, reporting false when it is
+// not a range or did not move.
+func rewriteRange(start, end string, rw refRewriter) (string, bool) {
+	if a, ok := parseCellRef(start); ok {
+		b, ok := parseCellRef(end)
+		if !ok {
+			return "", false
+		}
+		na, nb, ok := rw.rng(a, b, false)
+		switch {
+		case !ok:
+			return ErrRef, true
+		case na == a && nb == b:
+			return "", false
+		}
+		return formatCellRef(na) + ":" + formatCellRef(nb), true
+	}
+
+	c1, ok1 := parseColumnRef(start)
+	c2, ok2 := parseColumnRef(end)
+	if !ok1 || !ok2 {
+		return "", false
+	}
+	a := CellRef{Col: c1, AbsCol: strings.HasPrefix(start, "$")}
+	b := CellRef{Col: c2, AbsCol: strings.HasPrefix(end, "$")}
+	na, nb, ok := rw.rng(a, b, true)
+	switch {
+	case !ok:
+		return ErrRef, true
+	case na.Col == a.Col && nb.Col == b.Col:
+		return "", false
+	}
+	return columnAnchor(na) + ColumnLabel(na.Col) + ":" + columnAnchor(nb) + ColumnLabel(nb.Col), true
+}
+
+// adjustSpan maps the ends of the span from..to (in either order, as
+// written) to the nearest indexes inside it that still exist.
+func adjustSpan(from, to int, mapIndex func(int) int) (int, int, bool) {
+	lo, hi := min(from, to), max(from, to)
+	first, last := -1, -1
+	for i := lo; i <= hi; i++ {
+		if first = mapIndex(i); first >= 0 {
+			break
+		}
+	}
+	if first < 0 {
+		return 0, 0, false
+	}
+	for i := hi; i >= lo; i-- {
+		if last = mapIndex(i); last >= 0 {
+			break
+		}
+	}
+	if from > to {
+		first, last = last, first
+	}
+	return first, last, true
+}
+
+func columnAnchor(ref CellRef) string {
+	if ref.AbsCol {
+		return "$"
+	}
+	return ""
+}
+
+func formatCellRef(ref CellRef) string {
+	var sb strings.Builder
+	if ref.AbsCol {
+		sb.WriteByte('$')
+	}
+	sb.WriteString(ColumnLabel(ref.Col))
+	if ref.AbsRow {
+		sb.WriteByte('$')
+	}
+	sb.WriteString(strconv.Itoa(ref.Row + 1))
+	return sb.String()
+}
@@ -0,0 +1,268 @@
+package formula
+
+import (
+	"math"
+	"strings"
+)
+
+// maxRangeCells bounds how many cells a single range argument may expand to.
+const maxRangeCells = 2000000
+
+// smallRangeCells is the largest range that is expanded to its literal
+// shape. Bigger ranges (including whole columns) are clamped to the used
+// bounds of the sheet, since every cell beyond them is empty.
+const smallRangeCells = 65536
+
+// Context supplies cell values to the evaluator.
+type Context interface {
+	// Value returns the current value of the cell at row/col (0-based).
+	Value(row, col int) Value
+	// Bounds returns the number of used rows and columns; large and
+	// whole-column ranges are clamped to it.
+	Bounds() (rows, cols int)
+}
+
+// Eval evaluates the expression against ctx and returns a scalar result.
+func (e *Expr) Eval(ctx Context) Value {
+	ev := &evaluator{ctx: ctx}
+	v := ev.eval(e.root)
+	if v.Kind == KindArray {
+		if len(v.Array) == 1 && len(v.Array[0]) == 1 {
+			v = v.Array[0][0]
+		} else {
+			return Error(ErrValue)
+		}
+	}
+	if v.Kind == KindEmpty {
+		return Number(0)
+	}
+	return v
+}
+
+type evaluator struct {
+	ctx Context
+}
+
+func (ev *evaluator) eval(n node) Value {
+	switch t := n.(type) {
+	case nil:
+		return emptyValue
+	case numberNode:
+		return Number(t.val)
+	case stringNode:
+		return String(t.val)
+	case boolNode:
+		return Bool(t.val)
+	case errorNode:
+		return Error(t.code)
+	case nameNode:
+		return Error(ErrName)
+	case refNode:
+		return ev.ctx.Value(t.ref.Row, t.ref.Col)
+	case rangeNode:
+		return ev.evalRange(t.rng)
+	case unaryNode:
+		x := ev.scalar(ev.eval(t.x))
+		f, errv := x.ToNumber()
+		if errv != nil {
+			return *errv
+		}
+		if t.op == "-" {
+			return Number(-f)
+		}
+		return Number(f)
+	case postfixNode:
+		x := ev.scalar(ev.eval(t.x))
+		f, errv := x.ToNumber()
+		if errv != nil {
+			return *errv
+		}
+		return Number(f / 100)
+	case binaryNode:
+		return ev.evalBinary(t)
+	case callNode:
+		return ev.evalCall(t)
+	}
+	return Error(ErrParse)
+}
+
+func (ev *evaluator) evalRange(r Range) Value {
+	if (r.EndRow-r.StartRow+1)*(r.EndCol-r.StartCol+1) > smallRangeCells {
+		rows, cols := ev.ctx.Bounds()
+		r.EndRow = min(r.EndRow, rows-1)
+		r.EndCol = min(r.EndCol, cols-1)
+		if r.EndRow < r.StartRow || r.EndCol < r.StartCol {
+			return Value{Kind: KindArray, Array: [][]Value{}}
+		}
+	}
+	height := r.EndRow - r.StartRow + 1
+	width := r.EndCol - r.StartCol + 1
+	if height*width > maxRangeCells {
+		return Error(ErrRef)
+	}
+	rows := make([][]Value, height)
+	for i := 0; i < height; i++ {
+		row := make([]Value, width)
+		for j := 0; j < width; j++ {
+			row[j] = ev.ctx.Value(r.StartRow+i, r.StartCol+j)
+		}
+		rows[i] = row
+	}
+	return Value{Kind: KindArray, Array: rows}
+}
+
+// scalar reduces a single-cell range to its value; larger ranges are #VALUE!.
+func (ev *evaluator) scalar(v Value) Value {
+	if v.Kind != KindArray {
+		return v
+	}
+	if len(v.Array) == 1 && len(v.Array[0]) == 1 {
+		return v.Array[0][0]
+	}
+	return Error(ErrValue)
+}
+
+func (ev *evaluator) evalBinary(b binaryNode) Value {
+	l := ev.scalar(ev.eval(b.l))
+	r := ev.scalar(ev.eval(b.r))
+
+	switch b.op {
+	case "&":
+		if l.IsError() {
+			return l
+		}
+		if r.IsError() {
+			return r
+		}
+		return String(l.String() + r.String())
+	case "=", "<>", "<", ">", "<=", ">=":
+		if l.IsError() {
+			return l
+		}
+		if r.IsError() {
+			return r
+		}
+		c := compareValues(l, r)
+		switch b.op {
+		case "=":
+			return Bool(c == 0)
+		case "<>":
+			return Bool(c != 0)
+		case "<":
+			return Bool(c < 0)
+		case ">":
+			return Bool(c > 0)
+		case "<=":
+			return Bool(c <= 0)
+		default:
+			return Bool(c >= 0)
+		}
+	}
+
+	x, errv := l.ToNumber()
+	if errv != nil {
+		return *errv
+	}
+	y, errv := r.ToNumber()
+	if errv != nil {
+		return *errv
+	}
+	switch b.op {
+	case "+":
+		return numberResult(x + y)
+	case "-":
+		return numberResult(x - y)
+	case "*":
+		return numberResult(x * y)
+	case "/":
+		if y == 0 {
+			return Error(ErrDiv0)
+		}
+		return numberResult(x / y)
+	case "^":
+		return numberResult(math.Pow(x, y))
+	}
+	return Error(ErrParse)
+}
+
+func numberResult(f float64) Value {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Error(ErrNum)
+	}
+	return Number(f)
+}
+
+// compareValues orders two scalars: numbers < text < booleans, text is
+// compared case-insensitively and empty cells match 0, "" and FALSE.
+func compareValues(a, b Value) int {
+	if a.Kind == KindEmpty {
+		a = emptyLike(b)
+	}
+	if b.Kind == KindEmpty {
+		b = emptyLike(a)
+	}
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch a.Kind {
+	case KindNumber:
+		switch {
+		case a.Num < b.Num:
+			return -1
+		case a.Num > b.Num:
+			return 1
+		}
+		return 0
+	case KindBool:
+		if a.Bool == b.Bool {
+			return 0
+		}
+		if !a.Bool {
+			return -1
+		}
+		return 1
+	default:
+		return strings.Compare(strings.ToLower(a.Str), strings.ToLower(b.Str))
+	}
+}
+
+func emptyLike(v Value) Value {
+	switch v.Kind {
+	case KindString:
+		return String("")
+	case KindBool:
+		return Bool(false)
+	}
+	return Number(0)
+}
+
+func typeRank(v Value) int {
+	switch v.Kind {
+	case KindNumber, KindEmpty:
+		return 0
+	case KindString:
+		return 1
+	case KindBool:
+		return 2
+	}
+	return 3
+}
+
+func (ev *evaluator) evalCall(c callNode) Value {
+	if fn, ok := lazyFunctions[c.name]; ok {
+		return fn(ev, c.args)
+	}
+	fn, ok := functions[c.name]
+	if !ok {
+		return Error(ErrName)
+	}
+	args := make([]Value, len(c.args))
+	for i, a := range c.args {
+		args[i] = ev.eval(a)
+	}
+	return fn(args)
+}
@@ -0,0 +1,377 @@
+package formula
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type gridContext map[cellKey]string
+
+func (g gridContext) Value(row, col int) Value {
+	raw, ok := g[cellKey{row, col}]
+	if !ok {
+		return emptyValue
+	}
+	return LiteralValue(raw)
+}
+
+func (g gridContext) Bounds() (int, int) {
+	rows, cols := 0, 0
+	for k := range g {
+		rows = maxInt(rows, k.row+1)
+		cols = maxInt(cols, k.col+1)
+	}
+	return rows, cols
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func evalString(t *testing.T, src string, ctx Context) string {
+	t.Helper()
+	expr, err := Parse(src)
+	if !assert.NoError(t, err, src) {
+		return ""
+	}
+	return expr.Eval(ctx).String()
+}
+
+func Test_Eval(t *testing.T) {
+	ctx := gridContext{
+		{0, 0}: "10", {1, 0}: "20", {2, 0}: "30",
+		{0, 1}: "apple", {1, 1}: "banana", {2, 1}: "cherry",
+	}
+	cases := map[string]string{
+		"=1+2*3":                                "7",
+		"=(1+2)*3":                              "9",
+		"=2^3^2":                                "64",
+		"=-2^2":                                 "4",
+		"=10%":                                  "0.1",
+		"=A1+A2":                                "30",
+		"=SUM(A1:A3)":                           "60",
+		"=SUM(A:A)":                             "60",
+		"=AVERAGE(A1:A3)":                       "20",
+		"=MAX(A1:A3)-MIN(A1:A3)":                "20",
+		"=IF(A1>5,\"big\",\"small\")":           "big",
+		"=A1/0":                                 ErrDiv0,
+		"=IFERROR(A1/0,0)":                      "0",
+		"=\"a\"&\"b\"":                          "ab",
+		"=VLOOKUP(20,A1:B3,2,FALSE)":            "banana",
+		"=VLOOKUP(25,A1:B3,2)":                  ErrNA,
+		"=INDEX(B1:B3,MATCH(30,A1:A3))":         "cherry",
+		"=COUNTIF(A1:A3,\">15\")":               "2",
+		"=SUMIF(B1:B3,\"b*\",A1:A3)":            "20",
+		"=ROUND(2.345,2)":                       "2.35",
+		"=UPPER(LEFT(B1,3))":                    "APP",
+		"=DATE(2024,1,31)":                      "2024-01-31",
+		"=TEXT(DATE(2024,1,31),\"yyyy-mm-dd\")": "2024-01-31",
+		"=NOSUCHFN(1)":                          ErrName,
+		"=A1+B1":                                ErrValue,
+	}
+	for src, want := range cases {
+		assert.Equal(t, want, evalString(t, src, ctx), src)
+	}
+}
+
+func Test_Parse_Errors(t *testing.T) {
+	for _, src := range []string{"=1+", "=SUM(1,2", "=)", "=A1:"} {
+		_, err := Parse(src)
+		assert.Error(t, err, src)
+	}
+}
+
+func Test_References(t *testing.T) {
+	expr, err := Parse("=SUM(A1:B2)+$C$3")
+	assert.NoError(t, err)
+	refs := expr.References()
+	assert.Equal(t, []Range{
+		{StartRow: 0, StartCol: 0, EndRow: 1, EndCol: 1},
+		{StartRow: 2, StartCol: 2, EndRow: 2, EndCol: 2},
+	}, refs)
+}
+
+func Test_ParseRange(t *testing.T) {
+	r, ok := ParseRange("$C$200:b2")
+	assert.True(t, ok)
+	assert.Equal(t, Range{StartRow: 1, StartCol: 1, EndRow: 199, EndCol: 2}, r)
+	assert.Equal(t, "B2:C200", r.A1())
+	r, ok = ParseRange("AA10")
+	assert.True(t, ok)
+	assert.Equal(t, "AA10", r.A1())
+	for _, bad := range []string{"", "A0", "A1:", "Revenue", "A1:B2:C3", "Sheet1!A1"} {
+		_, ok := ParseRange(bad)
+		assert.False(t, ok, bad)
+	}
+}
+
+func Test_AdjustReferences(t *testing.T) {
+	// Two rows inserted in front of row 3, rows 5..6 deleted, and column B
+	// moved in front of column E.
+	insertRows := RefMap{Row: func(r int) int {
+		if r >= 2 {
+			return r + 2
+		}
+		return r
+	}}
+	deleteRows := RefMap{Row: func(r int) int {
+		switch {
+		case r >= 6:
+			return r - 2
+		case r >= 4:
+			return -1
+		}
+		return r
+	}}
+	moveCol := RefMap{Col: func(c int) int {
+		switch {
+		case c == 1:
+			return 3
+		case c >= 2 && c < 4:
+			return c - 1
+		}
+		return c
+	}}
+
+	cases := []struct {
+		m        RefMap
+		src, out string
+	}{
+		{insertRows, "=A1+A3*$B$4", "=A1+A5*$B$6"},
+		{insertRows, "=SUM(A1:B10)", "=SUM(A1:B12)"},
+		{insertRows, `=IF(A3>0,"A3",LOG10(A3))`, `=IF(A5>0,"A3",LOG10(A5))`},
+		{insertRows, "=SUM(A:A)", "=SUM(A:A)"},
+		{insertRows, "plain A3", "plain A3"},
+		{deleteRows, "=A5+A7", "=#REF!+A5"},
+		{deleteRows, "=SUM(A3:A10)", "=SUM(A3:A8)"},
+		{deleteRows, "=SUM(A5:A6)", "=SUM(#REF!)"},
+		{deleteRows, "=SUM(A5:B8)", "=SUM(A5:B6)"},
+		{moveCol, "=B1+C1+E1", "=D1+B1+E1"},
+		{moveCol, "=SUM(A1:E1)", "=SUM(A1:E1)"},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.out, AdjustReferences(tc.src, tc.m), tc.src)
+	}
+
+	// Adjusted formulas still parse.
+	_, err := Parse(AdjustReferences("=A5+SUM(A5:A6)", deleteRows))
+	assert.NoError(t, err)
+}
+
+func Test_OffsetReferences(t *testing.T) {
+	assert.Equal(t, "=B3+$A$1+$A3+B$1", OffsetReferences("=A1+$A$1+$A1+A$1", 2, 1))
+	assert.Equal(t, "=SUM(B3:C4)+SUM(B:B)", OffsetReferences("=SUM(A1:B2)+SUM(A:A)", 2, 1))
+	assert.Equal(t, "=#REF!+1", OffsetReferences("=A1+1", -1, 0))
+	assert.Equal(t, "12", OffsetReferences("12", 5, 5))
+}
+
+func Test_MoveReferences(t *testing.T) {
+	// A1:B2 moves to D5:E6.
+	src := Range{StartRow: 0, StartCol: 0, EndRow: 1, EndCol: 1}
+	assert.Equal(t, "=D5+E6+C1", MoveReferences("=A1+B2+C1", src, 4, 3))
+	assert.Equal(t, "=SUM(D5:E6)+SUM(A1:C3)", MoveReferences("=SUM(A1:B2)+SUM(A1:C3)", src, 4, 3))
+	// D5 was overwritten by the move.
+	assert.Equal(t, "=#REF!*2", MoveReferences("=D5*2", Range{StartRow: 0, StartCol: 0, EndRow: 0, EndCol: 0}, 4, 3))
+}
+
+func Test_Recalculate(t *testing.T) {
+	data := map[string]any{
+		"0,0": map[string]any{"value": "5"},
+		"0,1": map[string]any{"value": "=A1*2"},
+		"0,2": map[string]any{"value": "=B1+A1"},
+		"1,0": map[string]any{"value": "label"},
+		"2,0": map[string]any{"value": "=A4"},
+		"3,0": map[string]any{"value": "=A3"},
+		"4,0": map[string]any{"value": "=SUM("},
+	}
+	Recalculate(data)
+
+	computed := func(id string) any { return data[id].(map[string]any)["computed"] }
+	assert.Equal(t, float64(5), computed("0,0"))
+	assert.Equal(t, float64(10), computed("0,1"))
+	assert.Equal(t, float64(15), computed("0,2"))
+	assert.Equal(t, "label", computed("1,0"))
+	assert.Equal(t, ErrCircular, computed("2,0"))
+	assert.Equal(t, ErrCircular, computed("3,0"))
+	assert.Equal(t, ErrParse, computed("4,0"))
+}
+
+func cellData(values map[string]string) map[string]any {
+	data := make(map[string]any, len(values))
+	for id, v := range values {
+		data[id] = map[string]any{"value": v}
+	}
+	return data
+}
+
+func computedOf(data map[string]any) map[string]any {
+	out := make(map[string]any, len(data))
+	for id, cell := range data {
+		out[id] = cell.(map[string]any)["computed"]
+	}
+	return out
+}
+
+func Test_Graph_Recalculate_MatchesFull(t *testing.T) {
+	values := map[string]string{
+		"0,0": "1", "0,1": "2", "0,2": "3",
+		"0,3": "=SUM(A1:C1)",
+		"1,0": "=D1*2",
+		"2,5": "=SUM(A:A)",
+		"3,4": "=E5+1",
+		"4,4": "7",
+		"5,5": "untouched",
+	}
+	incremental := cellData(values)
+	g := BuildGraph(incremental)
+	g.RecalculateAll(incremental)
+
+	edits := map[string]string{"0,1": "20", "4,4": "=A1*100"}
+	changed := make([]string, 0, len(edits))
+	for id, v := range edits {
+		incremental[id].(map[string]any)["value"] = v
+		values[id] = v
+		changed = append(changed, id)
+	}
+	updated := g.Recalculate(incremental, changed)
+
+	full := cellData(values)
+	Recalculate(full)
+	assert.Equal(t, computedOf(full), computedOf(incremental))
+	assert.Equal(t, float64(24), computedOf(incremental)["0,3"])
+	assert.Equal(t, float64(49), computedOf(incremental)["2,5"])
+	assert.NotContains(t, updated, "5,5")
+	assert.Contains(t, updated, "3,4")
+}
+
+func Test_Graph_Dependents(t *testing.T) {
+	g := BuildGraph(cellData(map[string]string{
+		"0,3":  "=SUM(A1:C1)",
+		"1,3":  "=D1+1",
+		"2,0":  "=SUM(B:B)",
+		"3,0":  "=A3",
+		"9,9":  "=SUM(A1:BZ1)",
+		"10,9": "=Z99",
+	}))
+	assert.Equal(t, []string{"0,3", "1,3", "9,9"}, g.Dependents("0,0"))
+	assert.Equal(t, []string{"2,0", "3,0"}, g.Dependents("500,1"))
+	assert.Empty(t, g.Dependents("50,50"))
+}
+
+func Test_Graph_Recalculate_OnlyDirtyCells(t *testing.T) {
+	data := cellData(map[string]string{"0,0": "1", "1,0": "=A1+1", "0,1": "=5*5"})
+	g := BuildGraph(data)
+	g.RecalculateAll(data)
+	// A stale value on a clean formula proves it is not re-evaluated.
+	data["0,1"].(map[string]any)["computed"] = "stale"
+
+	data["0,0"].(map[string]any)["value"] = "10"
+	assert.Equal(t, []string{"0,0", "1,0"}, g.Recalculate(data, []string{"0,0"}))
+	assert.Equal(t, float64(11), computedOf(data)["1,0"])
+	assert.Equal(t, "stale", computedOf(data)["0,1"])
+}
+
+func Test_Graph_RecalculatePart(t *testing.T) {
+	g := BuildGraph(cellData(map[string]string{"0,1": "=SUM(A:A)", "1,1": "=B1*2", "5,3": "=A1"}))
+	assert.Equal(t, []Range{{StartRow: 0, StartCol: 0, EndRow: MaxRow, EndCol: 0}}, g.References("0,1", "5,5"))
+
+	// Only the edited cell, its dependents and what they read are loaded;
+	// the whole column is bounded by the sheet, not by the partial data.
+	data := cellData(map[string]string{"0,0": "1", "1,0": "2", "2,0": "4", "0,1": "=SUM(A:A)", "1,1": "=B1*2", "5,3": "=A1"})
+	delete(data, "5,3")
+	data["2,0"].(map[string]any)["value"] = "40"
+	calls := 0
+	updated := g.RecalculatePart(data, []string{"2,0"}, func() (int, int) {
+		calls++
+		return 6, 4
+	})
+	assert.Equal(t, []string{"0,1", "1,1", "2,0"}, updated)
+	assert.Equal(t, float64(43), computedOf(data)["0,1"])
+	assert.Equal(t, float64(86), computedOf(data)["1,1"])
+	assert.Equal(t, 1, calls)
+}
+
+func Test_Graph_Recalculate_Cycles(t *testing.T) {
+	data := cellData(map[string]string{"0,0": "1", "1,0": "=A1+1", "2,0": "=A2*2"})
+	g := BuildGraph(data)
+	g.RecalculateAll(data)
+	assert.Equal(t, float64(4), computedOf(data)["2,0"])
+
+	data["0,0"].(map[string]any)["value"] = "=A3"
+	g.Recalculate(data, []string{"0,0"})
+	for _, id := range []string{"0,0", "1,0", "2,0"} {
+		assert.Equal(t, ErrCircular, computedOf(data)[id], id)
+	}
+
+	data["0,0"].(map[string]any)["value"] = "3"
+	g.Recalculate(data, []string{"0,0"})
+	assert.Equal(t, float64(3), computedOf(data)["0,0"])
+	assert.Equal(t, float64(4), computedOf(data)["1,0"])
+	assert.Equal(t, float64(8), computedOf(data)["2,0"])
+}
+
+func Test_Recalculate_LargeRangesAreClamped(t *testing.T) {
+	values := map[string]string{"0,0": "5"}
+	for i := 1; i <= 10; i++ {
+		values["0,"+strconv.Itoa(i)] = "=SUM(A1:A1000000)"
+	}
+	values["1,11"] = "=ROWS(A1:A1000000)+COLUMNS(A1:C1)"
+	data := cellData(values)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	Recalculate(data)
+	runtime.ReadMemStats(&after)
+
+	assert.Equal(t, float64(5), computedOf(data)["0,10"])
+	assert.Equal(t, float64(1000003), computedOf(data)["1,11"])
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(16<<20))
+}
+
+func Test_Recalculate_DeepChain(t *testing.T) {
+	const depth = 200000
+	data := make(map[string]any, depth)
+	for i := 0; i < depth-1; i++ {
+		data[strconv.Itoa(i)+",0"] = map[string]any{"value": "=A" + strconv.Itoa(i+2) + "+1"}
+	}
+	data[strconv.Itoa(depth-1)+",0"] = map[string]any{"value": "0"}
+
+	Recalculate(data)
+	assert.Equal(t, float64(depth-1), computedOf(data)["0,0"])
+}
+
+type evalCase struct {
+	src  string
+	want string
+}
+
+// fixtureSheet is the grid the per-area function tests evaluate against:
+//
+//	   A    B          C      D
+//	1  10   apple      TRUE   2024-01-15
+//	2  20   banana     FALSE  2024-03-01
+//	3  30   cherry     3
+//	4  40              -2.5
+//	5  50   Apple pie
+func fixtureSheet() gridContext {
+	return gridContext{
+		{0, 0}: "10", {1, 0}: "20", {2, 0}: "30", {3, 0}: "40", {4, 0}: "50",
+		{0, 1}: "apple", {1, 1}: "banana", {2, 1}: "cherry", {4, 1}: "Apple pie",
+		{0, 2}: "TRUE", {1, 2}: "FALSE", {2, 2}: "3", {3, 2}: "-2.5",
+		{0, 3}: "2024-01-15", {1, 3}: "2024-03-01",
+	}
+}
+
+func runEvalCases(t *testing.T, cases []evalCase) {
+	t.Helper()
+	ctx := fixtureSheet()
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, evalString(t, tc.src, ctx), tc.src)
+	}
+}
@@ -0,0 +1,225 @@
+package formula
+
+import (
+	"regexp"
+	"strings"
+)
+
+// function receives already-evaluated arguments; ranges arrive as KindArray.
+type function func(args []Value) Value
+
+// lazyFunction evaluates its own arguments, so untaken branches (IF, IFERROR)
+// never surface their errors.
+type lazyFunction func(ev *evaluator, args []node) Value
+
+var (
+	functions     map[string]function
+	lazyFunctions map[string]lazyFunction
+)
+
+func init() {
+	functions = map[string]function{}
+	lazyFunctions = map[string]lazyFunction{}
+	registerMathFunctions()
+	registerStatFunctions()
+	registerLogicalFunctions()
+	registerTextFunctions()
+	registerDateFunctions()
+	registerLookupFunctions()
+}
+
+// IsSupported reports whether name is a known function.
+func IsSupported(name string) bool {
+	name = strings.ToUpper(name)
+	_, eager := functions[name]
+	_, lazy := lazyFunctions[name]
+	return eager || lazy
+}
+
+func argCount(args []Value, min, max int) bool {
+	return len(args) >= min && (max < 0 || len(args) <= max)
+}
+
+// scalarArg collapses a range argument to its top-left value.
+func scalarArg(v Value) Value {
+	if v.Kind == KindArray {
+		if first, ok := v.first(); ok {
+			return first
+		}
+		return emptyValue
+	}
+	return v
+}
+
+func numberArg(v Value) (float64, *Value) {
+	return scalarArg(v).ToNumber()
+}
+
+func stringArg(v Value) (string, *Value) {
+	v = scalarArg(v)
+	if v.IsError() {
+		return "", &v
+	}
+	return v.String(), nil
+}
+
+func intArg(v Value) (int, *Value) {
+	f, errv := numberArg(v)
+	if errv != nil {
+		return 0, errv
+	}
+	return int(f), nil
+}
+
+// collectNumbers gathers numeric inputs the way SUM does: numbers inside
+// ranges are used and text/booleans there are skipped, while direct scalar
+// arguments are coerced (and fail with #VALUE! when they are not numeric).
+func collectNumbers(args []Value) ([]float64, *Value) {
+	out := make([]float64, 0, len(args))
+	for _, a := range args {
+		if a.Kind == KindArray {
+			for _, v := range a.flatten() {
+				switch v.Kind {
+				case KindNumber:
+					out = append(out, v.Num)
+				case KindError:
+					errv := v
+					return nil, &errv
+				}
+			}
+			continue
+		}
+		switch a.Kind {
+		case KindEmpty:
+			continue
+		case KindError:
+			errv := a
+			return nil, &errv
+		}
+		f, errv := a.ToNumber()
+		if errv != nil {
+			return nil, errv
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// flattenArgs returns every scalar across all arguments.
+func flattenArgs(args []Value) []Value {
+	out := make([]Value, 0, len(args))
+	for _, a := range args {
+		out = append(out, a.flatten()...)
+	}
+	return out
+}
+
+// criteria implements the matching rules of COUNTIF/SUMIF and friends.
+type criteria struct {
+	op      string
+	value   Value
+	pattern *regexp.Regexp
+}
+
+func parseCriteria(v Value) criteria {
+	v = scalarArg(v)
+	if v.Kind != KindString {
+		return criteria{op: "=", value: v}
+	}
+	s := v.Str
+	op := "="
+	for _, candidate := range []string{">=", "<=", "<>", "!=", ">", "<", "="} {
+		if strings.HasPrefix(s, candidate) {
+			op = candidate
+			s = s[len(candidate):]
+			break
+		}
+	}
+	if op == "!=" {
+		op = "<>"
+	}
+	c := criteria{op: op, value: LiteralValue(s)}
+	if c.value.Kind == KindString && (op == "=" || op == "<>") && strings.ContainsAny(s, "*?") {
+		c.pattern = wildcardPattern(s)
+	}
+	return c
+}
+
+func wildcardPattern(s string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '~':
+			if i+1 < len(s) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(s[i])))
+			}
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+func (c criteria) match(v Value) bool {
+	if v.IsError() {
+		return false
+	}
+	if c.value.Kind == KindEmpty {
+		empty := v.Kind == KindEmpty || (v.Kind == KindString && v.Str == "")
+		if c.op == "<>" {
+			return !empty
+		}
+		if c.op == "=" {
+			return empty
+		}
+		return false
+	}
+	if c.pattern != nil {
+		matched := v.Kind != KindEmpty && c.pattern.MatchString(v.String())
+		if c.op == "<>" {
+			return !matched
+		}
+		return matched
+	}
+
+	candidate := v
+	if c.value.Kind == KindNumber && v.Kind == KindString {
+		if f, ok := parseNumber(v.Str); ok {
+			candidate = Number(f)
+		}
+	}
+	if candidate.Kind == KindEmpty {
+		if c.op == "<>" {
+			return true
+		}
+		return false
+	}
+	if typeRank(candidate) != typeRank(c.value) {
+		return c.op == "<>"
+	}
+	cmp := compareValues(candidate, c.value)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "<>":
+		return cmp != 0
+	}
+	return cmp == 0
+}
@@ -0,0 +1,431 @@
+package formula
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Dates are exchanged as ISO strings (the frontend's DATE() output), and
+// numbers are read as spreadsheet serials counted from 1899-12-30.
+const (
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = "2006-01-02 15:04:05"
+	timeLayout     = "15:04:05"
+)
+
+var serialEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+var dateLayouts = []string{
+	dateLayout,
+	dateTimeLayout,
+	"2006-01-02 15:04",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006/01/02",
+	"2006/1/2",
+	"01/02/2006",
+	"1/2/2006",
+	"02.01.2006",
+	"2.1.2006",
+	"Jan 2, 2006",
+	"2 Jan 2006",
+	"January 2, 2006",
+	timeLayout,
+	"15:04",
+}
+
+// now is swapped out by tests.
+var now = time.Now
+
+func registerDateFunctions() {
+	functions["TODAY"] = func(args []Value) Value {
+		if len(args) != 0 {
+			return Error(ErrValue)
+		}
+		return String(now().Format(dateLayout))
+	}
+	functions["NOW"] = func(args []Value) Value {
+		if len(args) != 0 {
+			return Error(ErrValue)
+		}
+		return String(now().Format(dateTimeLayout))
+	}
+	functions["DATE"] = fnDate
+	functions["TIME"] = fnTime
+	functions["YEAR"] = datePart(func(t time.Time) int { return t.Year() })
+	functions["MONTH"] = datePart(func(t time.Time) int { return int(t.Month()) })
+	functions["DAY"] = datePart(func(t time.Time) int { return t.Day() })
+	functions["HOUR"] = datePart(func(t time.Time) int { return t.Hour() })
+	functions["MINUTE"] = datePart(func(t time.Time) int { return t.Minute() })
+	functions["SECOND"] = datePart(func(t time.Time) int { return t.Second() })
+	functions["DAYS"] = fnDays
+	functions["EDATE"] = fnEDate
+	functions["EOMONTH"] = fnEOMonth
+	functions["WEEKDAY"] = fnWeekday
+	functions["WEEKNUM"] = fnWeekNum
+	functions["DATEDIF"] = fnDateDif
+	functions["NETWORKDAYS"] = fnNetworkDays
+}
+
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			if layout == timeLayout || layout == "15:04" {
+				t = serialEpoch.Add(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second)
+			}
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func dateToSerial(t time.Time) float64 {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return t.Sub(serialEpoch).Hours() / 24
+}
+
+func serialToDate(f float64) time.Time {
+	days := math.Floor(f)
+	secs := math.Round((f - days) * 86400)
+	return serialEpoch.AddDate(0, 0, int(days)).Add(time.Duration(secs) * time.Second)
+}
+
+// dateArg reads a date from a serial number or a date-like string.
+func dateArg(v Value) (time.Time, *Value) {
+	v = scalarArg(v)
+	switch v.Kind {
+	case KindNumber:
+		return serialToDate(v.Num), nil
+	case KindString:
+		if t, ok := parseDate(v.Str); ok {
+			return t, nil
+		}
+		if f, ok := parseNumber(v.Str); ok {
+			return serialToDate(f), nil
+		}
+	case KindError:
+		return time.Time{}, &v
+	}
+	e := Error(ErrValue)
+	return time.Time{}, &e
+}
+
+func formatDateValue(t time.Time) Value {
+	return String(t.Format(dateLayout))
+}
+
+func fnDate(args []Value) Value {
+	if !argCount(args, 3, 3) {
+		return Error(ErrValue)
+	}
+	parts := make([]int, 3)
+	for i := range parts {
+		n, errv := intArg(args[i])
+		if errv != nil {
+			return *errv
+		}
+		parts[i] = n
+	}
+	year := parts[0]
+	if year >= 0 && year < 1900 {
+		year += 1900
+	}
+	// time.Date normalises overflowing months/days like spreadsheets do.
+	return formatDateValue(time.Date(year, time.Month(parts[1]), parts[2], 0, 0, 0, 0, time.UTC))
+}
+
+func fnTime(args []Value) Value {
+	if !argCount(args, 3, 3) {
+		return Error(ErrValue)
+	}
+	parts := make([]int, 3)
+	for i := range parts {
+		n, errv := intArg(args[i])
+		if errv != nil {
+			return *errv
+		}
+		parts[i] = n
+	}
+	t := time.Date(2000, 1, 1, parts[0], parts[1], parts[2], 0, time.UTC)
+	return String(t.Format(timeLayout))
+}
+
+func datePart(fn func(time.Time) int) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 1) {
+			return Error(ErrValue)
+		}
+		t, errv := dateArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		return Number(float64(fn(t)))
+	}
+}
+
+func truncateDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func daysBetween(start, end time.Time) int {
+	return int(math.Round(truncateDay(end).Sub(truncateDay(start)).Hours() / 24))
+}
+
+func twoDates(args []Value) (time.Time, time.Time, *Value) {
+	a, errv := dateArg(args[0])
+	if errv != nil {
+		return time.Time{}, time.Time{}, errv
+	}
+	b, errv := dateArg(args[1])
+	if errv != nil {
+		return time.Time{}, time.Time{}, errv
+	}
+	return a, b, nil
+}
+
+func fnDays(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	end, start, errv := twoDates(args)
+	if errv != nil {
+		return *errv
+	}
+	return Number(float64(daysBetween(start, end)))
+}
+
+// addMonths clamps the day to the target month's length (Jan 31 + 1 month = Feb 28/29).
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, months, 0)
+	last := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+func fnEDate(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	t, errv := dateArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	months, errv := intArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	return formatDateValue(addMonths(t, months))
+}
+
+func fnEOMonth(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	t, errv := dateArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	months, errv := intArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, months+1, 0)
+	return formatDateValue(first.AddDate(0, 0, -1))
+}
+
+func fnWeekday(args []Value) Value {
+	if !argCount(args, 1, 2) {
+		return Error(ErrValue)
+	}
+	t, errv := dateArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	kind := 1
+	if len(args) == 2 {
+		if kind, errv = intArg(args[1]); errv != nil {
+			return *errv
+		}
+	}
+	wd := int(t.Weekday()) // Sunday = 0
+	switch kind {
+	case 1:
+		return Number(float64(wd + 1))
+	case 2:
+		return Number(float64((wd+6)%7 + 1))
+	case 3:
+		return Number(float64((wd + 6) % 7))
+	}
+	return Error(ErrNum)
+}
+
+func fnWeekNum(args []Value) Value {
+	if !argCount(args, 1, 2) {
+		return Error(ErrValue)
+	}
+	t, errv := dateArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	kind := 1
+	if len(args) == 2 {
+		if kind, errv = intArg(args[1]); errv != nil {
+			return *errv
+		}
+	}
+	jan1 := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	offset := int(jan1.Weekday()) // weeks start on Sunday
+	if kind == 2 {
+		offset = (offset + 6) % 7 // weeks start on Monday
+	}
+	return Number(float64((t.YearDay()-1+offset)/7 + 1))
+}
+
+func fnDateDif(args []Value) Value {
+	if !argCount(args, 3, 3) {
+		return Error(ErrValue)
+	}
+	start, end, errv := twoDates(args)
+	if errv != nil {
+		return *errv
+	}
+	unit, errv := stringArg(args[2])
+	if errv != nil {
+		return *errv
+	}
+	if end.Before(start) {
+		return Error(ErrNum)
+	}
+	months := (end.Year()-start.Year())*12 + int(end.Month()) - int(start.Month())
+	if end.Day() < start.Day() {
+		months--
+	}
+	switch strings.ToUpper(strings.TrimSpace(unit)) {
+	case "Y":
+		return Number(float64(months / 12))
+	case "M":
+		return Number(float64(months))
+	case "D":
+		return Number(float64(daysBetween(start, end)))
+	case "MD":
+		return Number(float64(daysBetween(addMonths(start, months), end)))
+	case "YM":
+		return Number(float64(months % 12))
+	case "YD":
+		anniversary := addMonths(start, (months/12)*12)
+		return Number(float64(daysBetween(anniversary, end)))
+	}
+	return Error(ErrNum)
+}
+
+func fnNetworkDays(args []Value) Value {
+	if len(args) < 2 {
+		return Error(ErrValue)
+	}
+	start, end, errv := twoDates(args)
+	if errv != nil {
+		return *errv
+	}
+	holidays := map[string]struct{}{}
+	for _, v := range flattenArgs(args[2:]) {
+		if v.Kind == KindEmpty {
+			continue
+		}
+		h, errv := dateArg(v)
+		if errv != nil {
+			return *errv
+		}
+		holidays[h.Format(dateLayout)] = struct{}{}
+	}
+	direction := 1
+	if end.Before(start) {
+		start, end = end, start
+		direction = -1
+	}
+	count := 0
+	for d := truncateDay(start); !d.After(truncateDay(end)); d = d.AddDate(0, 0, 1) {
+		if wd := d.Weekday(); wd == time.Saturday || wd == time.Sunday {
+			continue
+		}
+		if _, ok := holidays[d.Format(dateLayout)]; ok {
+			continue
+		}
+		count++
+	}
+	return Number(float64(direction * count))
+}
+
+func isDateFormat(format string) bool {
+	lower := strings.ToLower(format)
+	return strings.ContainsAny(lower, "ydh") || strings.Contains(lower, "ss") ||
+		(strings.Contains(lower, "m") && !strings.ContainsAny(lower, "0#"))
+}
+
+// formatDate renders t using spreadsheet date codes (yyyy, mm, dd, hh, ss...).
+func formatDate(t time.Time, format string) string {
+	replacements := []struct{ code, layout string }{
+		{"yyyy", "2006"}, {"yy", "06"},
+		{"mmmm", "January"}, {"mmm", "Jan"},
+		{"dddd", "Monday"}, {"ddd", "Mon"},
+		{"dd", "02"}, {"d", "2"},
+		{"hh", "15"}, {"h", "15"},
+		{"ss", "05"},
+	}
+	lower := strings.ToLower(format)
+	var sb strings.Builder
+	afterHour := false
+	for i := 0; i < len(lower); {
+		matched := false
+		if strings.HasPrefix(lower[i:], "mm") || lower[i] == 'm' {
+			// "m"/"mm" means minutes right after an hour code, months otherwise.
+			n := 1
+			if strings.HasPrefix(lower[i:], "mmmm") {
+				n = 4
+			} else if strings.HasPrefix(lower[i:], "mmm") {
+				n = 3
+			} else if strings.HasPrefix(lower[i:], "mm") {
+				n = 2
+			}
+			switch {
+			case afterHour && n <= 2:
+				sb.WriteString(fmt.Sprintf("%02d", t.Minute()))
+			case n == 4:
+				sb.WriteString(t.Format("January"))
+			case n == 3:
+				sb.WriteString(t.Format("Jan"))
+			case n == 2:
+				sb.WriteString(t.Format("01"))
+			default:
+				sb.WriteString(t.Format("1"))
+			}
+			i += n
+			continue
+		}
+		for _, r := range replacements {
+			if strings.HasPrefix(lower[i:], r.code) {
+				sb.WriteString(t.Format(r.layout))
+				afterHour = r.code == "hh" || r.code == "h"
+				i += len(r.code)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			if lower[i] != ':' && lower[i] != ' ' {
+				afterHour = false
+			}
+			sb.WriteByte(format[i])
+			i++
+		}
+	}
+	return sb.String()
+}
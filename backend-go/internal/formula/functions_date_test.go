@@ -0,0 +1,46 @@
+package formula
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_DateFunctions(t *testing.T) {
+	prev := now
+	now = func() time.Time { return time.Date(2024, 5, 17, 9, 30, 15, 0, time.UTC) }
+	defer func() { now = prev }()
+
+	runEvalCases(t, []evalCase{
+		{"=TODAY()", "2024-05-17"},
+		{"=NOW()", "2024-05-17 09:30:15"},
+		{"=TODAY(1)", ErrValue},
+		{"=DATE(2024,2,30)", "2024-03-01"},
+		{"=DATE(24,1,1)", "1924-01-01"},
+		{"=DATE(\"x\",1,1)", ErrValue},
+		{"=TIME(12,30,0)", "12:30:00"},
+		{"=HOUR(TIME(18,5,0))", "18"},
+		{"=YEAR(D1)", "2024"},
+		{"=MONTH(D2)", "3"},
+		{"=DAY(D1)", "15"},
+		{"=DAY(45306)", "15"},
+		{"=YEAR(\"not a date\")", ErrValue},
+		{"=HOUR(NOW())", "9"},
+		{"=MINUTE(NOW())", "30"},
+		{"=SECOND(NOW())", "15"},
+		{"=DAYS(D2,D1)", "46"},
+		{"=EDATE(D1,1)", "2024-02-15"},
+		{"=EDATE(\"2024-01-31\",1)", "2024-02-29"},
+		{"=EOMONTH(D1,1)", "2024-02-29"},
+		{"=EOMONTH(D1,-1)", "2023-12-31"},
+		{"=WEEKDAY(D1)", "2"},
+		{"=WEEKDAY(D1,2)", "1"},
+		{"=WEEKDAY(D1,9)", ErrNum},
+		{"=WEEKNUM(D1)", "3"},
+		{"=DATEDIF(D1,D2,\"d\")", "46"},
+		{"=DATEDIF(D1,D2,\"m\")", "1"},
+		{"=DATEDIF(\"2020-06-01\",D1,\"y\")", "3"},
+		{"=DATEDIF(D2,D1,\"d\")", ErrNum},
+		{"=DATEDIF(D1,D2,\"q\")", ErrNum},
+		{"=NETWORKDAYS(D1,\"2024-01-21\")", "5"},
+	})
+}
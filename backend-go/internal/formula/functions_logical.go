@@ -0,0 +1,187 @@
+package formula
+
+import "math"
+
+func registerLogicalFunctions() {
+	lazyFunctions["IF"] = fnIf
+	lazyFunctions["IFERROR"] = fnIfError
+	lazyFunctions["IFNA"] = fnIfNA
+	lazyFunctions["IFS"] = fnIfs
+	lazyFunctions["SWITCH"] = fnSwitch
+	lazyFunctions["CHOOSE"] = fnChoose
+
+	functions["AND"] = logicalFold(func(acc, v bool) bool { return acc && v }, true)
+	functions["OR"] = logicalFold(func(acc, v bool) bool { return acc || v }, false)
+	functions["XOR"] = logicalFold(func(acc, v bool) bool { return acc != v }, false)
+	functions["NOT"] = fnNot
+	functions["TRUE"] = func(args []Value) Value { return Bool(true) }
+	functions["FALSE"] = func(args []Value) Value { return Bool(false) }
+	functions["NA"] = func(args []Value) Value { return Error(ErrNA) }
+
+	functions["ISBLANK"] = isKind(func(v Value) bool { return v.Kind == KindEmpty })
+	functions["ISNUMBER"] = isKind(func(v Value) bool { return v.Kind == KindNumber })
+	functions["ISTEXT"] = isKind(func(v Value) bool { return v.Kind == KindString })
+	functions["ISLOGICAL"] = isKind(func(v Value) bool { return v.Kind == KindBool })
+	functions["ISERROR"] = isKind(func(v Value) bool { return v.Kind == KindError })
+	functions["ISNA"] = isKind(func(v Value) bool { return v.Kind == KindError && v.Str == ErrNA })
+	functions["ISEVEN"] = parity(0)
+	functions["ISODD"] = parity(1)
+}
+
+func fnIf(ev *evaluator, args []node) Value {
+	if len(args) < 2 || len(args) > 3 {
+		return Error(ErrValue)
+	}
+	cond, errv := ev.scalar(ev.eval(args[0])).ToBool()
+	if errv != nil {
+		return *errv
+	}
+	if cond {
+		return ev.eval(args[1])
+	}
+	if len(args) == 3 {
+		return ev.eval(args[2])
+	}
+	return Bool(false)
+}
+
+func fnIfError(ev *evaluator, args []node) Value {
+	if len(args) != 2 {
+		return Error(ErrValue)
+	}
+	v := ev.scalar(ev.eval(args[0]))
+	if v.IsError() {
+		return ev.eval(args[1])
+	}
+	return v
+}
+
+func fnIfNA(ev *evaluator, args []node) Value {
+	if len(args) != 2 {
+		return Error(ErrValue)
+	}
+	v := ev.scalar(ev.eval(args[0]))
+	if v.IsError() && v.Str == ErrNA {
+		return ev.eval(args[1])
+	}
+	return v
+}
+
+func fnIfs(ev *evaluator, args []node) Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return Error(ErrValue)
+	}
+	for i := 0; i < len(args); i += 2 {
+		cond, errv := ev.scalar(ev.eval(args[i])).ToBool()
+		if errv != nil {
+			return *errv
+		}
+		if cond {
+			return ev.eval(args[i+1])
+		}
+	}
+	return Error(ErrNA)
+}
+
+func fnSwitch(ev *evaluator, args []node) Value {
+	if len(args) < 3 {
+		return Error(ErrValue)
+	}
+	target := ev.scalar(ev.eval(args[0]))
+	if target.IsError() {
+		return target
+	}
+	i := 1
+	for ; i+1 < len(args); i += 2 {
+		candidate := ev.scalar(ev.eval(args[i]))
+		if candidate.IsError() {
+			return candidate
+		}
+		if compareValues(target, candidate) == 0 && typeRank(target) == typeRank(candidate) {
+			return ev.eval(args[i+1])
+		}
+	}
+	if i < len(args) {
+		return ev.eval(args[i])
+	}
+	return Error(ErrNA)
+}
+
+func fnChoose(ev *evaluator, args []node) Value {
+	if len(args) < 2 {
+		return Error(ErrValue)
+	}
+	idx, errv := ev.scalar(ev.eval(args[0])).ToNumber()
+	if errv != nil {
+		return *errv
+	}
+	i := int(math.Floor(idx))
+	if i < 1 || i >= len(args) {
+		return Error(ErrValue)
+	}
+	return ev.eval(args[i])
+}
+
+func logicalFold(op func(acc, v bool) bool, initial bool) function {
+	return func(args []Value) Value {
+		if len(args) == 0 {
+			return Error(ErrValue)
+		}
+		acc, seen := initial, false
+		for _, a := range args {
+			for _, v := range a.flatten() {
+				if v.IsError() {
+					return v
+				}
+				// Text and blanks inside ranges are ignored.
+				if a.Kind == KindArray && (v.Kind == KindString || v.Kind == KindEmpty) {
+					continue
+				}
+				b, errv := v.ToBool()
+				if errv != nil {
+					return *errv
+				}
+				acc = op(acc, b)
+				seen = true
+			}
+		}
+		if !seen {
+			return Error(ErrValue)
+		}
+		return Bool(acc)
+	}
+}
+
+func fnNot(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	b, errv := scalarArg(args[0]).ToBool()
+	if errv != nil {
+		return *errv
+	}
+	return Bool(!b)
+}
+
+func isKind(pred func(Value) bool) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 1) {
+			return Error(ErrValue)
+		}
+		return Bool(pred(scalarArg(args[0])))
+	}
+}
+
+func parity(want int) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 1) {
+			return Error(ErrValue)
+		}
+		f, errv := numberArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		n := int64(math.Trunc(math.Abs(f)))
+		return Bool(int(n%2) == want)
+	}
+}
@@ -0,0 +1,45 @@
+package formula
+
+import "testing"
+
+func Test_LogicalFunctions(t *testing.T) {
+	runEvalCases(t, []evalCase{
+		{"=IF(A1>5,\"big\",\"small\")", "big"},
+		{"=IF(A1>50,\"big\")", "FALSE"},
+		{"=IF(\"x\",1,2)", ErrValue},
+		{"=IF(TRUE,1,1/0)", "1"},
+		{"=IFERROR(1/0,\"oops\")", "oops"},
+		{"=IFERROR(5,0)", "5"},
+		{"=IFNA(NA(),\"none\")", "none"},
+		{"=IFNA(1/0,\"none\")", ErrDiv0},
+		{"=IFS(A1>30,\"a\",A1>5,\"b\")", "b"},
+		{"=IFS(A1>30,\"a\")", ErrNA},
+		{"=SWITCH(A2,10,\"ten\",20,\"twenty\",\"other\")", "twenty"},
+		{"=SWITCH(A3,10,\"ten\",\"other\")", "other"},
+		{"=SWITCH(A3,10,\"ten\")", ErrNA},
+		{"=CHOOSE(2,\"a\",\"b\",\"c\")", "b"},
+		{"=CHOOSE(4,\"a\",\"b\",\"c\")", ErrValue},
+		{"=AND(TRUE,A1>5)", "TRUE"},
+		{"=AND(C1:C2)", "FALSE"},
+		{"=AND(B1:B2)", ErrValue},
+		{"=OR(FALSE,A1>50)", "FALSE"},
+		{"=OR(C1:C2)", "TRUE"},
+		{"=XOR(TRUE,TRUE,TRUE)", "TRUE"},
+		{"=NOT(A1>5)", "FALSE"},
+		{"=TRUE()", "TRUE"},
+		{"=FALSE()", "FALSE"},
+		{"=NA()", ErrNA},
+		{"=ISBLANK(B4)", "TRUE"},
+		{"=ISBLANK(B1)", "FALSE"},
+		{"=ISNUMBER(A1)", "TRUE"},
+		{"=ISNUMBER(B1)", "FALSE"},
+		{"=ISTEXT(B1)", "TRUE"},
+		{"=ISLOGICAL(C1)", "TRUE"},
+		{"=ISERROR(1/0)", "TRUE"},
+		{"=ISNA(NA())", "TRUE"},
+		{"=ISNA(1/0)", "FALSE"},
+		{"=ISEVEN(A1)", "TRUE"},
+		{"=ISODD(3.9)", "TRUE"},
+		{"=ISEVEN(B1)", ErrValue},
+	})
+}
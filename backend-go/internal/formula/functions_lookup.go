@@ -0,0 +1,260 @@
+package formula
+
+func registerLookupFunctions() {
+	functions["VLOOKUP"] = fnVLookup
+	functions["HLOOKUP"] = fnHLookup
+	functions["LOOKUP"] = fnLookup
+	functions["INDEX"] = fnIndex
+	functions["MATCH"] = fnMatch
+	lazyFunctions["ROWS"] = refDimension(func(r Range) int { return r.EndRow - r.StartRow + 1 }, func(t [][]Value) int {
+		return len(t)
+	})
+	lazyFunctions["COLUMNS"] = refDimension(func(r Range) int { return r.EndCol - r.StartCol + 1 }, func(t [][]Value) int {
+		if len(t) == 0 {
+			return 0
+		}
+		return len(t[0])
+	})
+	lazyFunctions["ROW"] = refPosition(func(r Range) int { return r.StartRow })
+	lazyFunctions["COLUMN"] = refPosition(func(r Range) int { return r.StartCol })
+}
+
+func asTable(v Value) [][]Value {
+	if v.Kind == KindArray {
+		return v.Array
+	}
+	return [][]Value{{v}}
+}
+
+func lookupEqual(a, b Value) bool {
+	if a.Kind == KindEmpty || b.Kind == KindEmpty {
+		return a.Kind == b.Kind
+	}
+	return typeRank(a) == typeRank(b) && compareValues(a, b) == 0
+}
+
+// findInVector locates needle in vec. Exact matching (the frontend's behaviour)
+// is used unless approximate is set, in which case vec is assumed ascending
+// and the last value <= needle wins.
+func findInVector(needle Value, vec []Value, approximate bool) int {
+	if !approximate {
+		c := parseCriteria(needle)
+		for i, v := range vec {
+			if c.pattern != nil {
+				if c.match(v) {
+					return i
+				}
+				continue
+			}
+			if lookupEqual(needle, v) {
+				return i
+			}
+		}
+		return -1
+	}
+	found := -1
+	for i, v := range vec {
+		if v.Kind == KindEmpty || typeRank(v) != typeRank(needle) {
+			continue
+		}
+		if compareValues(v, needle) > 0 {
+			break
+		}
+		found = i
+	}
+	return found
+}
+
+func optionalBool(args []Value, idx int, def bool) (bool, *Value) {
+	if len(args) <= idx || args[idx].Kind == KindEmpty {
+		return def, nil
+	}
+	return scalarArg(args[idx]).ToBool()
+}
+
+func fnVLookup(args []Value) Value {
+	if !argCount(args, 3, 4) {
+		return Error(ErrValue)
+	}
+	needle := scalarArg(args[0])
+	if needle.IsError() {
+		return needle
+	}
+	table := asTable(args[1])
+	col, errv := intArg(args[2])
+	if errv != nil {
+		return *errv
+	}
+	approximate, errv := optionalBool(args, 3, false)
+	if errv != nil {
+		return *errv
+	}
+	if len(table) == 0 {
+		return Error(ErrNA)
+	}
+	if col < 1 || col > len(table[0]) {
+		return Error(ErrRef)
+	}
+	first := make([]Value, len(table))
+	for i, row := range table {
+		first[i] = row[0]
+	}
+	idx := findInVector(needle, first, approximate)
+	if idx < 0 {
+		return Error(ErrNA)
+	}
+	return table[idx][col-1]
+}
+
+func fnHLookup(args []Value) Value {
+	if !argCount(args, 3, 4) {
+		return Error(ErrValue)
+	}
+	needle := scalarArg(args[0])
+	if needle.IsError() {
+		return needle
+	}
+	table := asTable(args[1])
+	row, errv := intArg(args[2])
+	if errv != nil {
+		return *errv
+	}
+	approximate, errv := optionalBool(args, 3, false)
+	if errv != nil {
+		return *errv
+	}
+	if len(table) == 0 {
+		return Error(ErrNA)
+	}
+	if row < 1 || row > len(table) {
+		return Error(ErrRef)
+	}
+	idx := findInVector(needle, table[0], approximate)
+	if idx < 0 {
+		return Error(ErrNA)
+	}
+	return table[row-1][idx]
+}
+
+func fnLookup(args []Value) Value {
+	if !argCount(args, 2, 3) {
+		return Error(ErrValue)
+	}
+	needle := scalarArg(args[0])
+	if needle.IsError() {
+		return needle
+	}
+	lookup := args[1].flatten()
+	result := lookup
+	if len(args) == 3 {
+		result = args[2].flatten()
+	}
+	idx := findInVector(needle, lookup, false)
+	if idx < 0 || idx >= len(result) {
+		return Error(ErrNA)
+	}
+	return result[idx]
+}
+
+func fnIndex(args []Value) Value {
+	if !argCount(args, 2, 3) {
+		return Error(ErrValue)
+	}
+	table := asTable(args[0])
+	row, errv := intArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	col := 1
+	if len(args) == 3 {
+		if col, errv = intArg(args[2]); errv != nil {
+			return *errv
+		}
+	} else if len(table) == 1 {
+		// A single-row range indexes by column.
+		row, col = 1, row
+	}
+	if row < 1 || row > len(table) || col < 1 || col > len(table[row-1]) {
+		return Error(ErrRef)
+	}
+	return table[row-1][col-1]
+}
+
+func fnMatch(args []Value) Value {
+	if !argCount(args, 2, 3) {
+		return Error(ErrValue)
+	}
+	needle := scalarArg(args[0])
+	if needle.IsError() {
+		return needle
+	}
+	matchType := 0
+	if len(args) == 3 {
+		var errv *Value
+		if matchType, errv = intArg(args[2]); errv != nil {
+			return *errv
+		}
+	}
+	vec := args[1].flatten()
+	var idx int
+	switch {
+	case matchType == 0:
+		idx = findInVector(needle, vec, false)
+	case matchType > 0:
+		idx = findInVector(needle, vec, true)
+	default:
+		// Descending order: the smallest value >= needle.
+		idx = -1
+		for i, v := range vec {
+			if v.Kind == KindEmpty || typeRank(v) != typeRank(needle) {
+				continue
+			}
+			if compareValues(v, needle) < 0 {
+				break
+			}
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return Error(ErrNA)
+	}
+	return Number(float64(idx + 1))
+}
+
+// refPosition implements ROW/COLUMN, which need the reference itself rather than its value.
+func refPosition(pick func(Range) int) lazyFunction {
+	return func(ev *evaluator, args []node) Value {
+		if len(args) != 1 {
+			return Error(ErrValue)
+		}
+		switch t := args[0].(type) {
+		case refNode:
+			return Number(float64(pick(Range{StartRow: t.ref.Row, StartCol: t.ref.Col}) + 1))
+		case rangeNode:
+			return Number(float64(pick(t.rng) + 1))
+		}
+		return Error(ErrValue)
+	}
+}
+
+// refDimension implements ROWS/COLUMNS. A reference is measured from its
+// address, so large ranges report their full size even though evaluation
+// clamps them to the used part of the sheet.
+func refDimension(fromRange func(Range) int, fromTable func([][]Value) int) lazyFunction {
+	return func(ev *evaluator, args []node) Value {
+		if len(args) != 1 {
+			return Error(ErrValue)
+		}
+		switch t := args[0].(type) {
+		case refNode:
+			return Number(1)
+		case rangeNode:
+			return Number(float64(fromRange(t.rng)))
+		}
+		v := ev.eval(args[0])
+		if v.IsError() {
+			return v
+		}
+		return Number(float64(fromTable(asTable(v))))
+	}
+}
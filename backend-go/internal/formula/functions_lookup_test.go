@@ -0,0 +1,35 @@
+package formula
+
+import "testing"
+
+func Test_LookupFunctions(t *testing.T) {
+	runEvalCases(t, []evalCase{
+		{"=VLOOKUP(20,A1:B5,2,FALSE)", "banana"},
+		{"=VLOOKUP(20,A1:B5,2)", "banana"},
+		{"=VLOOKUP(25,A1:B5,2)", ErrNA},
+		{"=VLOOKUP(25,A1:B5,2,TRUE)", "banana"},
+		{"=VLOOKUP(5,A1:B5,2,TRUE)", ErrNA},
+		{"=VLOOKUP(20,A1:B5,3)", ErrRef},
+		{"=VLOOKUP(20,A1:B5,0)", ErrRef},
+		{"=HLOOKUP(\"banana\",B2:C3,2)", "cherry"},
+		{"=HLOOKUP(\"kiwi\",B2:C3,2)", ErrNA},
+		{"=LOOKUP(30,A1:A5,B1:B5)", "cherry"},
+		{"=LOOKUP(31,A1:A5,B1:B5)", ErrNA},
+		{"=INDEX(A1:B5,2,2)", "banana"},
+		{"=INDEX(B1:B5,3)", "cherry"},
+		{"=INDEX(A1:D1,4)", "2024-01-15"},
+		{"=INDEX(A1:B5,6,1)", ErrRef},
+		{"=MATCH(\"cherry\",B1:B5)", "3"},
+		{"=MATCH(\"CHERRY\",B1:B5,0)", "3"},
+		{"=MATCH(\"app*\",B1:B5,0)", "1"},
+		{"=MATCH(35,A1:A5,1)", "3"},
+		{"=MATCH(5,A1:A5,1)", ErrNA},
+		{"=MATCH(\"kiwi\",B1:B5,0)", ErrNA},
+		{"=ROWS(A1:B5)", "5"},
+		{"=COLUMNS(A1:D1)", "4"},
+		{"=ROWS(A1)", "1"},
+		{"=ROW(C3)", "3"},
+		{"=COLUMN(C3:D4)", "3"},
+		{"=ROW(1)", ErrValue},
+	})
+}
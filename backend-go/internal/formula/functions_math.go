@@ -0,0 +1,521 @@
+package formula
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+func registerMathFunctions() {
+	functions["SUM"] = fnSum
+	functions["PRODUCT"] = fnProduct
+	functions["SUMSQ"] = fnSumSq
+	functions["ABS"] = unaryMath(math.Abs)
+	functions["SQRT"] = fnSqrt
+	functions["EXP"] = unaryMath(math.Exp)
+	functions["LN"] = fnLn
+	functions["LOG10"] = fnLog10
+	functions["LOG"] = fnLog
+	functions["INT"] = unaryMath(math.Floor)
+	functions["SIGN"] = unaryMath(sign)
+	functions["SIN"] = unaryMath(math.Sin)
+	functions["COS"] = unaryMath(math.Cos)
+	functions["TAN"] = unaryMath(math.Tan)
+	functions["ASIN"] = unaryMath(math.Asin)
+	functions["ACOS"] = unaryMath(math.Acos)
+	functions["ATAN"] = unaryMath(math.Atan)
+	functions["RADIANS"] = unaryMath(func(f float64) float64 { return f * math.Pi / 180 })
+	functions["DEGREES"] = unaryMath(func(f float64) float64 { return f * 180 / math.Pi })
+	functions["EVEN"] = unaryMath(roundToParity(0))
+	functions["ODD"] = unaryMath(roundToParity(1))
+	functions["FACT"] = fnFact
+	functions["PI"] = func(args []Value) Value {
+		if len(args) != 0 {
+			return Error(ErrValue)
+		}
+		return Number(math.Pi)
+	}
+	functions["RAND"] = func(args []Value) Value {
+		if len(args) != 0 {
+			return Error(ErrValue)
+		}
+		return Number(rand.Float64())
+	}
+	functions["RANDBETWEEN"] = fnRandBetween
+	functions["ROUND"] = roundWith(func(f float64) float64 { return math.Round(f) })
+	functions["ROUNDUP"] = roundWith(func(f float64) float64 {
+		if f < 0 {
+			return math.Floor(f)
+		}
+		return math.Ceil(f)
+	})
+	functions["ROUNDDOWN"] = roundWith(math.Trunc)
+	functions["TRUNC"] = fnTrunc
+	functions["CEILING"] = multipleWith(math.Ceil)
+	functions["FLOOR"] = multipleWith(math.Floor)
+	functions["MROUND"] = fnMRound
+	functions["POWER"] = binaryMath(func(x, y float64) Value { return numberResult(math.Pow(x, y)) })
+	functions["MOD"] = binaryMath(func(x, y float64) Value {
+		if y == 0 {
+			return Error(ErrDiv0)
+		}
+		// Result takes the sign of the divisor, as in spreadsheets.
+		return Number(x - y*math.Floor(x/y))
+	})
+	functions["QUOTIENT"] = binaryMath(func(x, y float64) Value {
+		if y == 0 {
+			return Error(ErrDiv0)
+		}
+		return Number(math.Trunc(x / y))
+	})
+	functions["GCD"] = fnGCD
+	functions["LCM"] = fnLCM
+	functions["SUMPRODUCT"] = fnSumProduct
+	functions["SUMIF"] = fnSumIf
+	functions["SUMIFS"] = fnSumIfs
+}
+
+func unaryMath(fn func(float64) float64) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 1) {
+			return Error(ErrValue)
+		}
+		f, errv := numberArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		return numberResult(fn(f))
+	}
+}
+
+func binaryMath(fn func(x, y float64) Value) function {
+	return func(args []Value) Value {
+		if !argCount(args, 2, 2) {
+			return Error(ErrValue)
+		}
+		x, errv := numberArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		y, errv := numberArg(args[1])
+		if errv != nil {
+			return *errv
+		}
+		return fn(x, y)
+	}
+}
+
+func sign(f float64) float64 {
+	switch {
+	case f > 0:
+		return 1
+	case f < 0:
+		return -1
+	}
+	return 0
+}
+
+// roundToParity rounds away from zero to the next even (0) or odd (1) integer.
+func roundToParity(parity int) func(float64) float64 {
+	return func(f float64) float64 {
+		s := 1.0
+		if f < 0 {
+			s = -1
+		}
+		n := math.Ceil(math.Abs(f))
+		if int(n)%2 != parity {
+			n++
+		}
+		if parity == 1 && n == 0 {
+			n = 1
+		}
+		return s * n
+	}
+}
+
+func fnSum(args []Value) Value {
+	nums, errv := collectNumbers(args)
+	if errv != nil {
+		return *errv
+	}
+	total := 0.0
+	for _, n := range nums {
+		total += n
+	}
+	return Number(total)
+}
+
+func fnProduct(args []Value) Value {
+	nums, errv := collectNumbers(args)
+	if errv != nil {
+		return *errv
+	}
+	if len(nums) == 0 {
+		return Number(0)
+	}
+	total := 1.0
+	for _, n := range nums {
+		total *= n
+	}
+	return numberResult(total)
+}
+
+func fnSumSq(args []Value) Value {
+	nums, errv := collectNumbers(args)
+	if errv != nil {
+		return *errv
+	}
+	total := 0.0
+	for _, n := range nums {
+		total += n * n
+	}
+	return numberResult(total)
+}
+
+func fnSqrt(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	f, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	if f < 0 {
+		return Error(ErrNum)
+	}
+	return Number(math.Sqrt(f))
+}
+
+func fnLn(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	f, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	if f <= 0 {
+		return Error(ErrNum)
+	}
+	return Number(math.Log(f))
+}
+
+func fnLog10(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	f, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	if f <= 0 {
+		return Error(ErrNum)
+	}
+	return Number(math.Log10(f))
+}
+
+func fnLog(args []Value) Value {
+	if !argCount(args, 1, 2) {
+		return Error(ErrValue)
+	}
+	f, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	base := 10.0
+	if len(args) == 2 {
+		if base, errv = numberArg(args[1]); errv != nil {
+			return *errv
+		}
+	}
+	if f <= 0 || base <= 0 || base == 1 {
+		return Error(ErrNum)
+	}
+	return Number(math.Log(f) / math.Log(base))
+}
+
+func fnFact(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	f, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	if f < 0 || f > 170 {
+		return Error(ErrNum)
+	}
+	result := 1.0
+	for i := 2.0; i <= math.Floor(f); i++ {
+		result *= i
+	}
+	return Number(result)
+}
+
+func fnRandBetween(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	lo, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	hi, errv := numberArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	lo, hi = math.Ceil(lo), math.Floor(hi)
+	if hi < lo {
+		return Error(ErrNum)
+	}
+	return Number(lo + float64(rand.Int63n(int64(hi-lo)+1)))
+}
+
+func roundWith(fn func(float64) float64) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 2) {
+			return Error(ErrValue)
+		}
+		f, errv := numberArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		digits := 0
+		if len(args) == 2 {
+			if digits, errv = intArg(args[1]); errv != nil {
+				return *errv
+			}
+		}
+		return numberResult(roundDigits(f, digits, fn))
+	}
+}
+
+func roundDigits(f float64, digits int, fn func(float64) float64) float64 {
+	scale := math.Pow(10, float64(digits))
+	// Trim to 15 significant digits first so 2.675*100 rounds like spreadsheets do.
+	scaled, _ := strconv.ParseFloat(strconv.FormatFloat(f*scale, 'g', 15, 64), 64)
+	return fn(scaled) / scale
+}
+
+func fnTrunc(args []Value) Value {
+	if !argCount(args, 1, 2) {
+		return Error(ErrValue)
+	}
+	f, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	digits := 0
+	if len(args) == 2 {
+		if digits, errv = intArg(args[1]); errv != nil {
+			return *errv
+		}
+	}
+	scale := math.Pow(10, float64(digits))
+	return Number(math.Trunc(f*scale) / scale)
+}
+
+// multipleWith implements CEILING/FLOOR with an optional significance (default 1).
+func multipleWith(fn func(float64) float64) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 2) {
+			return Error(ErrValue)
+		}
+		f, errv := numberArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		significance := 1.0
+		if len(args) == 2 {
+			if significance, errv = numberArg(args[1]); errv != nil {
+				return *errv
+			}
+		}
+		if significance == 0 {
+			return Number(0)
+		}
+		significance = math.Abs(significance)
+		return Number(fn(f/significance) * significance)
+	}
+}
+
+func fnMRound(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	f, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	multiple, errv := numberArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	if multiple == 0 {
+		return Number(0)
+	}
+	if sign(f) != sign(multiple) && f != 0 {
+		return Error(ErrNum)
+	}
+	return Number(math.Round(f/multiple) * multiple)
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func integerArgs(args []Value) ([]int64, *Value) {
+	nums, errv := collectNumbers(args)
+	if errv != nil {
+		return nil, errv
+	}
+	out := make([]int64, 0, len(nums))
+	for _, n := range nums {
+		if n < 0 {
+			e := Error(ErrNum)
+			return nil, &e
+		}
+		out = append(out, int64(n))
+	}
+	return out, nil
+}
+
+func fnGCD(args []Value) Value {
+	ints, errv := integerArgs(args)
+	if errv != nil {
+		return *errv
+	}
+	var result int64
+	for _, n := range ints {
+		result = gcd(result, n)
+	}
+	return Number(float64(result))
+}
+
+func fnLCM(args []Value) Value {
+	ints, errv := integerArgs(args)
+	if errv != nil {
+		return *errv
+	}
+	if len(ints) == 0 {
+		return Number(0)
+	}
+	result := int64(1)
+	for _, n := range ints {
+		if n == 0 {
+			return Number(0)
+		}
+		result = result / gcd(result, n) * n
+	}
+	return Number(float64(result))
+}
+
+func fnSumProduct(args []Value) Value {
+	if len(args) == 0 {
+		return Error(ErrValue)
+	}
+	var size int
+	lists := make([][]Value, len(args))
+	for i, a := range args {
+		lists[i] = a.flatten()
+		if i == 0 {
+			size = len(lists[i])
+		} else if len(lists[i]) != size {
+			return Error(ErrValue)
+		}
+	}
+	total := 0.0
+	for j := 0; j < size; j++ {
+		product := 1.0
+		for i := range lists {
+			v := lists[i][j]
+			if v.IsError() {
+				return v
+			}
+			if v.Kind != KindNumber {
+				product = 0
+				continue
+			}
+			product *= v.Num
+		}
+		total += product
+	}
+	return Number(total)
+}
+
+func fnSumIf(args []Value) Value {
+	if !argCount(args, 2, 3) {
+		return Error(ErrValue)
+	}
+	cells := args[0].flatten()
+	sumCells := cells
+	if len(args) == 3 {
+		sumCells = args[2].flatten()
+	}
+	c := parseCriteria(args[1])
+	total := 0.0
+	for i, v := range cells {
+		if i >= len(sumCells) || !c.match(v) {
+			continue
+		}
+		if sumCells[i].Kind == KindNumber {
+			total += sumCells[i].Num
+		}
+	}
+	return Number(total)
+}
+
+// matchAllCriteria returns, for the *IFS family, which positions satisfy
+// every (range, criteria) pair starting at args[offset].
+func matchAllCriteria(args []Value, offset int, size int) ([]bool, *Value) {
+	if (len(args)-offset)%2 != 0 || len(args)-offset < 2 {
+		e := Error(ErrValue)
+		return nil, &e
+	}
+	ok := make([]bool, size)
+	for i := range ok {
+		ok[i] = true
+	}
+	for i := offset; i < len(args); i += 2 {
+		cells := args[i].flatten()
+		if len(cells) != size {
+			e := Error(ErrValue)
+			return nil, &e
+		}
+		c := parseCriteria(args[i+1])
+		for j, v := range cells {
+			if ok[j] && !c.match(v) {
+				ok[j] = false
+			}
+		}
+	}
+	return ok, nil
+}
+
+func fnSumIfs(args []Value) Value {
+	if len(args) < 3 {
+		return Error(ErrValue)
+	}
+	sumCells := args[0].flatten()
+	ok, errv := matchAllCriteria(args, 1, len(sumCells))
+	if errv != nil {
+		return *errv
+	}
+	total := 0.0
+	for i, v := range sumCells {
+		if ok[i] && v.Kind == KindNumber {
+			total += v.Num
+		}
+	}
+	return Number(total)
+}
+
+func sortedCopy(nums []float64) []float64 {
+	out := append([]float64(nil), nums...)
+	sort.Float64s(out)
+	return out
+}
@@ -0,0 +1,70 @@
+package formula
+
+import "testing"
+
+func Test_MathFunctions(t *testing.T) {
+	runEvalCases(t, []evalCase{
+		{"=SUM(A1:A5)", "150"},
+		{"=SUM(A1:A2,5,TRUE)", "36"},
+		{"=SUM(B1:B3)", "0"},
+		{"=SUM(\"x\")", ErrValue},
+		{"=SUM(A1,1/0)", ErrDiv0},
+		{"=PRODUCT(A1:A3)", "6000"},
+		{"=SUMSQ(3,4)", "25"},
+		{"=ABS(-3.5)", "3.5"},
+		{"=SQRT(16)", "4"},
+		{"=SQRT(-1)", ErrNum},
+		{"=EXP(0)", "1"},
+		{"=LN(1)", "0"},
+		{"=LN(0)", ErrNum},
+		{"=LOG10(1000)", "3"},
+		{"=LOG(8,2)", "3"},
+		{"=LOG(100)", "2"},
+		{"=INT(-2.5)", "-3"},
+		{"=SIGN(-4)", "-1"},
+		{"=SIN(0)+COS(0)", "1"},
+		{"=ROUND(DEGREES(PI()),6)", "180"},
+		{"=ROUND(RADIANS(180),5)", "3.14159"},
+		{"=EVEN(3)", "4"},
+		{"=ODD(4)", "5"},
+		{"=FACT(5)", "120"},
+		{"=FACT(-1)", ErrNum},
+		{"=ROUND(1234.567,-2)", "1200"},
+		{"=ROUNDUP(1.21,1)", "1.3"},
+		{"=ROUNDUP(5,0)", "5"},
+		{"=ROUNDDOWN(-1.29,1)", "-1.2"},
+		{"=TRUNC(8.97)", "8"},
+		{"=CEILING(4.2,1)", "5"},
+		{"=FLOOR(4.8,2)", "4"},
+		{"=MROUND(10,3)", "9"},
+		{"=POWER(2,10)", "1024"},
+		{"=MOD(10,3)", "1"},
+		{"=MOD(-3,2)", "1"},
+		{"=MOD(1,0)", ErrDiv0},
+		{"=QUOTIENT(7,2)", "3"},
+		{"=QUOTIENT(1,0)", ErrDiv0},
+		{"=GCD(12,18)", "6"},
+		{"=LCM(4,6)", "12"},
+		{"=SUMPRODUCT(A1:A2,A3:A4)", "1100"},
+		{"=SUMPRODUCT(A1:A2,A1:A3)", ErrValue},
+		{"=SUMIF(A1:A5,\">25\")", "120"},
+		{"=SUMIF(B1:B5,\"apple*\",A1:A5)", "60"},
+		{"=SUMIFS(A1:A5,A1:A5,\">=20\",A1:A5,\"<50\")", "90"},
+		{"=SUMIFS(A1:A5,A1:A2,\">0\")", ErrValue},
+	})
+}
+
+func Test_RandFunctions(t *testing.T) {
+	ctx := fixtureSheet()
+	for i := 0; i < 20; i++ {
+		expr, _ := Parse("=RANDBETWEEN(1,3)")
+		v := expr.Eval(ctx)
+		if v.Kind != KindNumber || v.Num < 1 || v.Num > 3 {
+			t.Fatalf("RANDBETWEEN(1,3) = %v", v)
+		}
+		expr, _ = Parse("=RAND()")
+		if v := expr.Eval(ctx); v.Kind != KindNumber || v.Num < 0 || v.Num >= 1 {
+			t.Fatalf("RAND() = %v", v)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package formula
+
+import (
+	"math"
+)
+
+func registerStatFunctions() {
+	functions["AVERAGE"] = fnAverage
+	functions["MIN"] = extremum(func(a, b float64) bool { return a < b })
+	functions["MAX"] = extremum(func(a, b float64) bool { return a > b })
+	functions["COUNT"] = fnCount
+	functions["COUNTA"] = fnCountA
+	functions["COUNTBLANK"] = fnCountBlank
+	functions["COUNTIF"] = fnCountIf
+	functions["COUNTIFS"] = fnCountIfs
+	functions["AVERAGEIF"] = fnAverageIf
+	functions["AVERAGEIFS"] = fnAverageIfs
+	functions["MEDIAN"] = fnMedian
+	functions["MODE"] = fnMode
+	functions["STDEV"] = variance(true, true)
+	functions["STDEV.S"] = variance(true, true)
+	functions["STDEVP"] = variance(true, false)
+	functions["STDEV.P"] = variance(true, false)
+	functions["VAR"] = variance(false, true)
+	functions["VAR.S"] = variance(false, true)
+	functions["VARP"] = variance(false, false)
+	functions["VAR.P"] = variance(false, false)
+	functions["LARGE"] = nth(true)
+	functions["SMALL"] = nth(false)
+	functions["PERCENTILE"] = fnPercentile
+	functions["RANK"] = fnRank
+}
+
+func fnAverage(args []Value) Value {
+	nums, errv := collectNumbers(args)
+	if errv != nil {
+		return *errv
+	}
+	if len(nums) == 0 {
+		return Error(ErrDiv0)
+	}
+	total := 0.0
+	for _, n := range nums {
+		total += n
+	}
+	return Number(total / float64(len(nums)))
+}
+
+func extremum(better func(a, b float64) bool) function {
+	return func(args []Value) Value {
+		nums, errv := collectNumbers(args)
+		if errv != nil {
+			return *errv
+		}
+		if len(nums) == 0 {
+			return Number(0)
+		}
+		best := nums[0]
+		for _, n := range nums[1:] {
+			if better(n, best) {
+				best = n
+			}
+		}
+		return Number(best)
+	}
+}
+
+func fnCount(args []Value) Value {
+	count := 0
+	for _, a := range args {
+		if a.Kind == KindArray {
+			for _, v := range a.flatten() {
+				if v.Kind == KindNumber {
+					count++
+				}
+			}
+			continue
+		}
+		if _, errv := a.ToNumber(); errv == nil && a.Kind != KindEmpty {
+			count++
+		}
+	}
+	return Number(float64(count))
+}
+
+func fnCountA(args []Value) Value {
+	count := 0
+	for _, v := range flattenArgs(args) {
+		if v.Kind != KindEmpty {
+			count++
+		}
+	}
+	return Number(float64(count))
+}
+
+func fnCountBlank(args []Value) Value {
+	count := 0
+	for _, v := range flattenArgs(args) {
+		if v.Kind == KindEmpty || (v.Kind == KindString && v.Str == "") {
+			count++
+		}
+	}
+	return Number(float64(count))
+}
+
+func fnCountIf(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	c := parseCriteria(args[1])
+	count := 0
+	for _, v := range args[0].flatten() {
+		if c.match(v) {
+			count++
+		}
+	}
+	return Number(float64(count))
+}
+
+func fnCountIfs(args []Value) Value {
+	if len(args) < 2 {
+		return Error(ErrValue)
+	}
+	ok, errv := matchAllCriteria(args, 0, len(args[0].flatten()))
+	if errv != nil {
+		return *errv
+	}
+	count := 0
+	for _, matched := range ok {
+		if matched {
+			count++
+		}
+	}
+	return Number(float64(count))
+}
+
+func fnAverageIf(args []Value) Value {
+	if !argCount(args, 2, 3) {
+		return Error(ErrValue)
+	}
+	cells := args[0].flatten()
+	avgCells := cells
+	if len(args) == 3 {
+		avgCells = args[2].flatten()
+	}
+	c := parseCriteria(args[1])
+	total, n := 0.0, 0
+	for i, v := range cells {
+		if i >= len(avgCells) || !c.match(v) || avgCells[i].Kind != KindNumber {
+			continue
+		}
+		total += avgCells[i].Num
+		n++
+	}
+	if n == 0 {
+		return Error(ErrDiv0)
+	}
+	return Number(total / float64(n))
+}
+
+func fnAverageIfs(args []Value) Value {
+	if len(args) < 3 {
+		return Error(ErrValue)
+	}
+	avgCells := args[0].flatten()
+	ok, errv := matchAllCriteria(args, 1, len(avgCells))
+	if errv != nil {
+		return *errv
+	}
+	total, n := 0.0, 0
+	for i, v := range avgCells {
+		if ok[i] && v.Kind == KindNumber {
+			total += v.Num
+			n++
+		}
+	}
+	if n == 0 {
+		return Error(ErrDiv0)
+	}
+	return Number(total / float64(n))
+}
+
+func fnMedian(args []Value) Value {
+	nums, errv := collectNumbers(args)
+	if errv != nil {
+		return *errv
+	}
+	if len(nums) == 0 {
+		return Error(ErrNum)
+	}
+	sorted := sortedCopy(nums)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return Number(sorted[mid])
+	}
+	return Number((sorted[mid-1] + sorted[mid]) / 2)
+}
+
+func fnMode(args []Value) Value {
+	nums, errv := collectNumbers(args)
+	if errv != nil {
+		return *errv
+	}
+	freq := make(map[float64]int, len(nums))
+	best, bestCount := 0.0, 1
+	for _, n := range nums {
+		freq[n]++
+		// Ties go to the value that reached the count first.
+		if freq[n] > bestCount {
+			best, bestCount = n, freq[n]
+		}
+	}
+	if bestCount < 2 {
+		return Error(ErrNA)
+	}
+	return Number(best)
+}
+
+func variance(stdev, sample bool) function {
+	return func(args []Value) Value {
+		nums, errv := collectNumbers(args)
+		if errv != nil {
+			return *errv
+		}
+		n := float64(len(nums))
+		if n == 0 || (sample && n < 2) {
+			return Error(ErrDiv0)
+		}
+		mean := 0.0
+		for _, x := range nums {
+			mean += x
+		}
+		mean /= n
+		sum := 0.0
+		for _, x := range nums {
+			sum += (x - mean) * (x - mean)
+		}
+		denom := n
+		if sample {
+			denom = n - 1
+		}
+		v := sum / denom
+		if stdev {
+			return Number(math.Sqrt(v))
+		}
+		return Number(v)
+	}
+}
+
+func nth(largest bool) function {
+	return func(args []Value) Value {
+		if !argCount(args, 2, 2) {
+			return Error(ErrValue)
+		}
+		nums, errv := collectNumbers(args[:1])
+		if errv != nil {
+			return *errv
+		}
+		k, errv := intArg(args[1])
+		if errv != nil {
+			return *errv
+		}
+		if k < 1 || k > len(nums) {
+			return Error(ErrNum)
+		}
+		sorted := sortedCopy(nums)
+		if largest {
+			return Number(sorted[len(sorted)-k])
+		}
+		return Number(sorted[k-1])
+	}
+}
+
+func fnPercentile(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	nums, errv := collectNumbers(args[:1])
+	if errv != nil {
+		return *errv
+	}
+	k, errv := numberArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	if len(nums) == 0 || k < 0 || k > 1 {
+		return Error(ErrNum)
+	}
+	sorted := sortedCopy(nums)
+	pos := float64(len(sorted)-1) * k
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return Number(sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo)))
+}
+
+func fnRank(args []Value) Value {
+	if !argCount(args, 2, 3) {
+		return Error(ErrValue)
+	}
+	x, errv := numberArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	nums, errv := collectNumbers(args[1:2])
+	if errv != nil {
+		return *errv
+	}
+	ascending := false
+	if len(args) == 3 {
+		order, errv := numberArg(args[2])
+		if errv != nil {
+			return *errv
+		}
+		ascending = order != 0
+	}
+	rank, found := 1, false
+	for _, n := range nums {
+		if n == x {
+			found = true
+		}
+		if (ascending && n < x) || (!ascending && n > x) {
+			rank++
+		}
+	}
+	if !found {
+		return Error(ErrNA)
+	}
+	return Number(float64(rank))
+}
@@ -0,0 +1,45 @@
+package formula
+
+import "testing"
+
+func Test_StatFunctions(t *testing.T) {
+	runEvalCases(t, []evalCase{
+		{"=AVERAGE(A1:A5)", "30"},
+		{"=AVERAGE(B1:B3)", ErrDiv0},
+		{"=MIN(A1:A5,5)", "5"},
+		{"=MAX(A1:A5)", "50"},
+		{"=MAX(B1:B2)", "0"},
+		{"=COUNT(A1:C5)", "7"},
+		{"=COUNTA(B1:B5)", "4"},
+		{"=COUNTBLANK(B1:B5)", "1"},
+		{"=COUNTIF(B1:B5,\"a*\")", "2"},
+		{"=COUNTIF(A1:A5,\"<>20\")", "4"},
+		{"=COUNTIF(A1:A5,30)", "1"},
+		{"=COUNTIF(B1:B5,\"\")", "1"},
+		{"=COUNTIFS(A1:A5,\">10\",B1:B5,\"<>\")", "3"},
+		{"=AVERAGEIF(A1:A5,\">20\")", "40"},
+		{"=AVERAGEIF(A1:A5,\">100\")", ErrDiv0},
+		{"=AVERAGEIFS(A1:A5,B1:B5,\"*an*\")", "20"},
+		{"=MEDIAN(A1:A4)", "25"},
+		{"=MODE(1,2,2,3)", "2"},
+		{"=MODE(1,2,3)", ErrNA},
+		{"=ROUND(STDEV(A1:A5),4)", "15.8114"},
+		{"=ROUND(STDEV.S(A1:A5),4)", "15.8114"},
+		{"=ROUND(STDEVP(A1:A5),4)", "14.1421"},
+		{"=ROUND(STDEV.P(A1:A5),4)", "14.1421"},
+		{"=VAR(A1:A5)", "250"},
+		{"=VAR.S(A1:A5)", "250"},
+		{"=VARP(A1:A5)", "200"},
+		{"=VAR.P(A1:A5)", "200"},
+		{"=STDEV(1)", ErrDiv0},
+		{"=LARGE(A1:A5,2)", "40"},
+		{"=SMALL(A1:A5,1)", "10"},
+		{"=LARGE(A1:A5,6)", ErrNum},
+		{"=PERCENTILE(A1:A5,0.5)", "30"},
+		{"=PERCENTILE(A1:A5,0.25)", "20"},
+		{"=PERCENTILE(A1:A5,2)", ErrNum},
+		{"=RANK(40,A1:A5)", "2"},
+		{"=RANK(40,A1:A5,1)", "4"},
+		{"=RANK(45,A1:A5)", ErrNA},
+	})
+}
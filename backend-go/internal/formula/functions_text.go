@@ -0,0 +1,460 @@
+package formula
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+func registerTextFunctions() {
+	functions["LEN"] = textToNumber(func(s string) float64 { return float64(len([]rune(s))) })
+	functions["UPPER"] = textMap(strings.ToUpper)
+	functions["LOWER"] = textMap(strings.ToLower)
+	functions["PROPER"] = textMap(properCase)
+	functions["TRIM"] = textMap(func(s string) string { return strings.Join(strings.Fields(s), " ") })
+	functions["CLEAN"] = textMap(func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r < 32 {
+				return -1
+			}
+			return r
+		}, s)
+	})
+	functions["LEFT"] = fnLeft
+	functions["RIGHT"] = fnRight
+	functions["MID"] = fnMid
+	functions["FIND"] = finder(false)
+	functions["SEARCH"] = finder(true)
+	functions["SUBSTITUTE"] = fnSubstitute
+	functions["REPLACE"] = fnReplace
+	functions["CONCATENATE"] = fnConcat
+	functions["CONCAT"] = fnConcat
+	functions["TEXTJOIN"] = fnTextJoin
+	functions["REPT"] = fnRept
+	functions["EXACT"] = fnExact
+	functions["VALUE"] = fnValue
+	functions["TEXT"] = fnText
+	functions["CHAR"] = fnChar
+	functions["CODE"] = fnCode
+}
+
+func textMap(fn func(string) string) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 1) {
+			return Error(ErrValue)
+		}
+		s, errv := stringArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		return String(fn(s))
+	}
+}
+
+func textToNumber(fn func(string) float64) function {
+	return func(args []Value) Value {
+		if !argCount(args, 1, 1) {
+			return Error(ErrValue)
+		}
+		s, errv := stringArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		return Number(fn(s))
+	}
+}
+
+func properCase(s string) string {
+	runes := []rune(strings.ToLower(s))
+	start := true
+	for i, r := range runes {
+		if unicode.IsLetter(r) {
+			if start {
+				runes[i] = unicode.ToUpper(r)
+			}
+			start = false
+		} else {
+			start = r != '\'' && r != '’'
+		}
+	}
+	return string(runes)
+}
+
+// textAndCount reads the (text, [count=1]) arguments of LEFT/RIGHT.
+func textAndCount(args []Value) (string, int, *Value) {
+	if !argCount(args, 1, 2) {
+		e := Error(ErrValue)
+		return "", 0, &e
+	}
+	s, errv := stringArg(args[0])
+	if errv != nil {
+		return "", 0, errv
+	}
+	n := 1
+	if len(args) == 2 {
+		if n, errv = intArg(args[1]); errv != nil {
+			return "", 0, errv
+		}
+	}
+	if n < 0 {
+		e := Error(ErrValue)
+		return "", 0, &e
+	}
+	return s, n, nil
+}
+
+func fnLeft(args []Value) Value {
+	s, n, errv := textAndCount(args)
+	if errv != nil {
+		return *errv
+	}
+	runes := []rune(s)
+	if n > len(runes) {
+		n = len(runes)
+	}
+	return String(string(runes[:n]))
+}
+
+func fnRight(args []Value) Value {
+	s, n, errv := textAndCount(args)
+	if errv != nil {
+		return *errv
+	}
+	runes := []rune(s)
+	if n > len(runes) {
+		n = len(runes)
+	}
+	return String(string(runes[len(runes)-n:]))
+}
+
+func fnMid(args []Value) Value {
+	if !argCount(args, 3, 3) {
+		return Error(ErrValue)
+	}
+	s, errv := stringArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	start, errv := intArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	n, errv := intArg(args[2])
+	if errv != nil {
+		return *errv
+	}
+	if start < 1 || n < 0 {
+		return Error(ErrValue)
+	}
+	runes := []rune(s)
+	if start > len(runes) {
+		return String("")
+	}
+	end := start - 1 + n
+	if end > len(runes) {
+		end = len(runes)
+	}
+	return String(string(runes[start-1 : end]))
+}
+
+func finder(caseInsensitive bool) function {
+	return func(args []Value) Value {
+		if !argCount(args, 2, 3) {
+			return Error(ErrValue)
+		}
+		needle, errv := stringArg(args[0])
+		if errv != nil {
+			return *errv
+		}
+		haystack, errv := stringArg(args[1])
+		if errv != nil {
+			return *errv
+		}
+		start := 1
+		if len(args) == 3 {
+			if start, errv = intArg(args[2]); errv != nil {
+				return *errv
+			}
+		}
+		if caseInsensitive {
+			needle = strings.ToLower(needle)
+			haystack = strings.ToLower(haystack)
+		}
+		hay := []rune(haystack)
+		if start < 1 || start > len(hay)+1 {
+			return Error(ErrValue)
+		}
+		idx := strings.Index(string(hay[start-1:]), needle)
+		if idx < 0 {
+			return Error(ErrValue)
+		}
+		return Number(float64(start + len([]rune(string(hay[start-1:])[:idx]))))
+	}
+}
+
+func fnSubstitute(args []Value) Value {
+	if !argCount(args, 3, 4) {
+		return Error(ErrValue)
+	}
+	strs := make([]string, 3)
+	for i := 0; i < 3; i++ {
+		s, errv := stringArg(args[i])
+		if errv != nil {
+			return *errv
+		}
+		strs[i] = s
+	}
+	text, old, repl := strs[0], strs[1], strs[2]
+	if old == "" {
+		return String(text)
+	}
+	if len(args) == 3 {
+		return String(strings.ReplaceAll(text, old, repl))
+	}
+	nth, errv := intArg(args[3])
+	if errv != nil {
+		return *errv
+	}
+	if nth < 1 {
+		return Error(ErrValue)
+	}
+	offset := 0
+	for i := 1; ; i++ {
+		idx := strings.Index(text[offset:], old)
+		if idx < 0 {
+			return String(text)
+		}
+		if i == nth {
+			pos := offset + idx
+			return String(text[:pos] + repl + text[pos+len(old):])
+		}
+		offset += idx + len(old)
+	}
+}
+
+func fnReplace(args []Value) Value {
+	if !argCount(args, 4, 4) {
+		return Error(ErrValue)
+	}
+	s, errv := stringArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	start, errv := intArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	n, errv := intArg(args[2])
+	if errv != nil {
+		return *errv
+	}
+	repl, errv := stringArg(args[3])
+	if errv != nil {
+		return *errv
+	}
+	if start < 1 || n < 0 {
+		return Error(ErrValue)
+	}
+	runes := []rune(s)
+	from := start - 1
+	if from > len(runes) {
+		from = len(runes)
+	}
+	to := from + n
+	if to > len(runes) {
+		to = len(runes)
+	}
+	return String(string(runes[:from]) + repl + string(runes[to:]))
+}
+
+func fnConcat(args []Value) Value {
+	var sb strings.Builder
+	for _, v := range flattenArgs(args) {
+		if v.IsError() {
+			return v
+		}
+		sb.WriteString(v.String())
+	}
+	return String(sb.String())
+}
+
+func fnTextJoin(args []Value) Value {
+	if len(args) < 3 {
+		return Error(ErrValue)
+	}
+	delim, errv := stringArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	ignoreEmpty, errv := scalarArg(args[1]).ToBool()
+	if errv != nil {
+		return *errv
+	}
+	parts := make([]string, 0, len(args))
+	for _, v := range flattenArgs(args[2:]) {
+		if v.IsError() {
+			return v
+		}
+		s := v.String()
+		if ignoreEmpty && s == "" {
+			continue
+		}
+		parts = append(parts, s)
+	}
+	return String(strings.Join(parts, delim))
+}
+
+func fnRept(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	s, errv := stringArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	n, errv := intArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	if n < 0 || len(s)*n > 32767 {
+		return Error(ErrValue)
+	}
+	return String(strings.Repeat(s, n))
+}
+
+func fnExact(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	a, errv := stringArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	b, errv := stringArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	return Bool(a == b)
+}
+
+func fnValue(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	v := scalarArg(args[0])
+	if v.Kind == KindString {
+		s := strings.TrimSpace(v.Str)
+		if strings.HasSuffix(s, "%") {
+			if f, ok := parseNumber(strings.TrimSuffix(s, "%")); ok {
+				return Number(f / 100)
+			}
+		}
+		cleaned := strings.NewReplacer(",", "", " ", "", "$", "").Replace(s)
+		if f, ok := parseNumber(cleaned); ok {
+			return Number(f)
+		}
+	}
+	f, errv := v.ToNumber()
+	if errv != nil {
+		return *errv
+	}
+	return Number(f)
+}
+
+func fnText(args []Value) Value {
+	if !argCount(args, 2, 2) {
+		return Error(ErrValue)
+	}
+	format, errv := stringArg(args[1])
+	if errv != nil {
+		return *errv
+	}
+	v := scalarArg(args[0])
+	if v.IsError() {
+		return v
+	}
+	if isDateFormat(format) {
+		t, errv := dateArg(v)
+		if errv != nil {
+			return *errv
+		}
+		return String(formatDate(t, format))
+	}
+	f, errv := v.ToNumber()
+	if errv != nil {
+		return *errv
+	}
+	return String(formatNumberPattern(f, format))
+}
+
+// formatNumberPattern supports the common 0/#/,/%/. number format codes.
+func formatNumberPattern(f float64, format string) string {
+	prefix, suffix := "", ""
+	core := format
+	if i := strings.IndexAny(core, "0#"); i > 0 {
+		prefix = core[:i]
+		core = core[i:]
+	}
+	if i := strings.LastIndexAny(core, "0#"); i >= 0 && i < len(core)-1 {
+		suffix = core[i+1:]
+		core = core[:i+1]
+	}
+	if strings.Contains(suffix, "%") {
+		f *= 100
+	}
+	decimals := 0
+	if i := strings.Index(core, "."); i >= 0 {
+		decimals = len(strings.Trim(core[i+1:], ",")) // trailing scaling commas are ignored
+	}
+	grouped := strings.Contains(core, ",")
+
+	neg := f < 0
+	s := strconv.FormatFloat(math.Abs(roundDigits(f, decimals, math.Round)), 'f', decimals, 64)
+	if grouped {
+		intPart, frac := s, ""
+		if i := strings.Index(s, "."); i >= 0 {
+			intPart, frac = s[:i], s[i:]
+		}
+		var sb strings.Builder
+		for i, r := range intPart {
+			if i > 0 && (len(intPart)-i)%3 == 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteRune(r)
+		}
+		s = sb.String() + frac
+	}
+	if neg && strings.Trim(s, "0.,") != "" {
+		s = "-" + s
+	}
+	return prefix + s + suffix
+}
+
+func fnChar(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	n, errv := intArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	if n < 1 || n > 0x10FFFF {
+		return Error(ErrValue)
+	}
+	return String(string(rune(n)))
+}
+
+func fnCode(args []Value) Value {
+	if !argCount(args, 1, 1) {
+		return Error(ErrValue)
+	}
+	s, errv := stringArg(args[0])
+	if errv != nil {
+		return *errv
+	}
+	if s == "" {
+		return Error(ErrValue)
+	}
+	return Number(float64([]rune(s)[0]))
+}
@@ -0,0 +1,52 @@
+package formula
+
+import "testing"
+
+func Test_TextFunctions(t *testing.T) {
+	runEvalCases(t, []evalCase{
+		{"=LEN(B2)", "6"},
+		{"=LEN(\"привет\")", "6"},
+		{"=UPPER(B1)", "APPLE"},
+		{"=LOWER(\"MiXeD\")", "mixed"},
+		{"=PROPER(\"hello wORLD o'neil\")", "Hello World O'neil"},
+		{"=TRIM(\"  a   b  \")", "a b"},
+		{"=CLEAN(\"a\"&CHAR(9)&\"b\")", "ab"},
+		{"=LEFT(B2,3)", "ban"},
+		{"=LEFT(B2)", "b"},
+		{"=LEFT(B2,-1)", ErrValue},
+		{"=RIGHT(B2,2)", "na"},
+		{"=RIGHT(B2,100)", "banana"},
+		{"=MID(B2,2,3)", "ana"},
+		{"=MID(B2,10,3)", ""},
+		{"=MID(B2,0,3)", ErrValue},
+		{"=FIND(\"an\",B2)", "2"},
+		{"=FIND(\"an\",B2,3)", "4"},
+		{"=FIND(\"AN\",B2)", ErrValue},
+		{"=SEARCH(\"AN\",B2)", "2"},
+		{"=SUBSTITUTE(B2,\"a\",\"o\")", "bonono"},
+		{"=SUBSTITUTE(B2,\"a\",\"o\",2)", "banona"},
+		{"=SUBSTITUTE(B2,\"a\",\"o\",0)", ErrValue},
+		{"=REPLACE(B1,1,1,\"A\")", "Apple"},
+		{"=CONCATENATE(B1,\"-\",A1)", "apple-10"},
+		{"=CONCAT(A1:A3)", "102030"},
+		{"=CONCAT(A1,1/0)", ErrDiv0},
+		{"=TEXTJOIN(\",\",TRUE,B1:B5)", "apple,banana,cherry,Apple pie"},
+		{"=TEXTJOIN(\",\",FALSE,B3:B4)", "cherry,"},
+		{"=REPT(\"ab\",3)", "ababab"},
+		{"=REPT(\"ab\",-1)", ErrValue},
+		{"=EXACT(B1,\"Apple\")", "FALSE"},
+		{"=EXACT(B1,\"apple\")", "TRUE"},
+		{"=VALUE(\"1,234.5\")", "1234.5"},
+		{"=VALUE(\"15%\")", "0.15"},
+		{"=VALUE(\"abc\")", ErrValue},
+		{"=TEXT(1234.567,\"#,##0.00\")", "1,234.57"},
+		{"=TEXT(0.256,\"0.0%\")", "25.6%"},
+		{"=TEXT(-5,\"$0\")", "$-5"},
+		{"=TEXT(D1,\"dd/mm/yyyy\")", "15/01/2024"},
+		{"=TEXT(\"abc\",\"0\")", ErrValue},
+		{"=CHAR(65)", "A"},
+		{"=CHAR(0)", ErrValue},
+		{"=CODE(\"A\")", "65"},
+		{"=CODE(\"\")", ErrValue},
+	})
+}
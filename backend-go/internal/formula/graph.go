@@ -0,0 +1,272 @@
+package formula
+
+import "fmt"
+
+// wideRangeCols is the column span above which a range is not indexed per
+// column but checked on every lookup instead.
+const wideRangeCols = 64
+
+type graphNode struct {
+	raw      string
+	expr     *Expr
+	parseErr bool
+	refs     []Range
+	volatile bool
+}
+
+type rangeDep struct {
+	rng       Range
+	dependent cellKey
+}
+
+// Graph records which cells every formula of a sheet reads, so that an edit
+// only re-evaluates the formulas that transitively depend on it.
+type Graph struct {
+	nodes    map[cellKey]*graphNode
+	cellDeps map[cellKey]map[cellKey]struct{} // single-cell precedent -> dependents
+	colDeps  map[int][]rangeDep               // multi-cell ranges, by every column they span
+	wideDeps []rangeDep
+}
+
+// BuildGraph parses every formula in a state.data map.
+func BuildGraph(data map[string]any) *Graph {
+	g := &Graph{
+		nodes:    map[cellKey]*graphNode{},
+		cellDeps: map[cellKey]map[cellKey]struct{}{},
+		colDeps:  map[int][]rangeDep{},
+	}
+	for id, cellAny := range data {
+		cell, ok := cellAny.(map[string]any)
+		if !ok {
+			continue
+		}
+		if row, col, ok := ParseCellID(id); ok {
+			g.set(cellKey{row, col}, CellRawValue(cell))
+		}
+	}
+	return g
+}
+
+func (g *Graph) node(k cellKey) *graphNode {
+	if g == nil {
+		return nil
+	}
+	return g.nodes[k]
+}
+
+// set records raw as the content of k, replacing its previous precedents.
+func (g *Graph) set(k cellKey, raw string) {
+	if n := g.nodes[k]; n != nil {
+		if n.raw == raw {
+			return
+		}
+		g.remove(k)
+	}
+	if !IsFormula(raw) {
+		return
+	}
+	n := &graphNode{raw: raw}
+	if expr, err := Parse(raw); err != nil {
+		n.parseErr = true
+	} else {
+		n.expr = expr
+		n.refs = expr.References()
+		n.volatile = expr.Volatile()
+	}
+	g.nodes[k] = n
+	for _, r := range n.refs {
+		switch {
+		case r.StartRow == r.EndRow && r.StartCol == r.EndCol:
+			p := cellKey{r.StartRow, r.StartCol}
+			if g.cellDeps[p] == nil {
+				g.cellDeps[p] = map[cellKey]struct{}{}
+			}
+			g.cellDeps[p][k] = struct{}{}
+		case r.EndCol-r.StartCol >= wideRangeCols:
+			g.wideDeps = append(g.wideDeps, rangeDep{r, k})
+		default:
+			for col := r.StartCol; col <= r.EndCol; col++ {
+				g.colDeps[col] = append(g.colDeps[col], rangeDep{r, k})
+			}
+		}
+	}
+}
+
+func (g *Graph) remove(k cellKey) {
+	n := g.nodes[k]
+	if n == nil {
+		return
+	}
+	delete(g.nodes, k)
+	for _, r := range n.refs {
+		switch {
+		case r.StartRow == r.EndRow && r.StartCol == r.EndCol:
+			p := cellKey{r.StartRow, r.StartCol}
+			delete(g.cellDeps[p], k)
+			if len(g.cellDeps[p]) == 0 {
+				delete(g.cellDeps, p)
+			}
+		case r.EndCol-r.StartCol >= wideRangeCols:
+			g.wideDeps = withoutDependent(g.wideDeps, k)
+		default:
+			for col := r.StartCol; col <= r.EndCol; col++ {
+				if deps := withoutDependent(g.colDeps[col], k); len(deps) > 0 {
+					g.colDeps[col] = deps
+				} else {
+					delete(g.colDeps, col)
+				}
+			}
+		}
+	}
+}
+
+func withoutDependent(deps []rangeDep, k cellKey) []rangeDep {
+	out := deps[:0]
+	for _, d := range deps {
+		if d.dependent != k {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// forEachDependent calls fn for every formula that reads k directly.
+func (g *Graph) forEachDependent(k cellKey, fn func(cellKey)) {
+	for d := range g.cellDeps[k] {
+		fn(d)
+	}
+	for _, d := range g.colDeps[k.col] {
+		if d.rng.Contains(k.row, k.col) {
+			fn(d.dependent)
+		}
+	}
+	for _, d := range g.wideDeps {
+		if d.rng.Contains(k.row, k.col) {
+			fn(d.dependent)
+		}
+	}
+}
+
+// affected returns the given cells, every volatile formula and all of their
+// transitive dependents.
+func (g *Graph) affected(keys []cellKey) map[cellKey]struct{} {
+	queue := append([]cellKey(nil), keys...)
+	for k, n := range g.nodes {
+		if n.volatile {
+			queue = append(queue, k)
+		}
+	}
+	seen := make(map[cellKey]struct{}, len(queue))
+	for len(queue) > 0 {
+		k := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		g.forEachDependent(k, func(d cellKey) {
+			if _, ok := seen[d]; !ok {
+				queue = append(queue, d)
+			}
+		})
+	}
+	return seen
+}
+
+// Dependents returns the "row,col" IDs of every formula that transitively
+// depends on one of the given cells.
+func (g *Graph) Dependents(ids ...string) []string {
+	keys := make([]cellKey, 0, len(ids))
+	for _, id := range ids {
+		if row, col, ok := ParseCellID(id); ok {
+			keys = append(keys, cellKey{row, col})
+		}
+	}
+	set := g.affected(keys)
+	for _, k := range keys {
+		delete(set, k)
+	}
+	out := make([]string, 0, len(set))
+	for _, k := range sortedKeys(set) {
+		if _, ok := g.nodes[k]; ok {
+			out = append(out, fmt.Sprintf("%d,%d", k.row, k.col))
+		}
+	}
+	return out
+}
+
+// References returns the ranges read by the formulas at the given IDs;
+// cells without a formula read none.
+func (g *Graph) References(ids ...string) []Range {
+	var out []Range
+	for _, id := range ids {
+		if row, col, ok := ParseCellID(id); ok {
+			if n := g.nodes[cellKey{row, col}]; n != nil {
+				out = append(out, n.refs...)
+			}
+		}
+	}
+	return out
+}
+
+// Update brings the graph up to date with the edited cells in data; a
+// changed ID missing from data is an emptied cell.
+func (g *Graph) Update(data map[string]any, changed []string) {
+	for _, id := range changed {
+		row, col, ok := ParseCellID(id)
+		if !ok {
+			continue
+		}
+		raw := ""
+		if cell, ok := data[id].(map[string]any); ok {
+			raw = CellRawValue(cell)
+		}
+		g.set(cellKey{row, col}, raw)
+	}
+}
+
+// Recalculate brings the graph up to date with the edited cells in data and
+// re-evaluates only those cells and their transitive dependents. Every other
+// formula keeps its stored computed value. It returns the IDs of the cells
+// whose computed field was rewritten.
+func (g *Graph) Recalculate(data map[string]any, changed []string) []string {
+	return g.RecalculatePart(data, changed, nil)
+}
+
+// RecalculatePart is Recalculate for a data map that holds only part of a
+// sheet: the changed cells, their dependents and every cell those read.
+// bounds returns the used rows and columns of the whole sheet, which large
+// ranges are clamped to; it is only called when such a range is read.
+func (g *Graph) RecalculatePart(data map[string]any, changed []string, bounds func() (rows, cols int)) []string {
+	g.Update(data, changed)
+	keys := make([]cellKey, 0, len(changed))
+	for _, id := range changed {
+		if row, col, ok := ParseCellID(id); ok {
+			keys = append(keys, cellKey{row, col})
+		}
+	}
+
+	dirty := g.affected(keys)
+	s := newSheet(data, g, dirty)
+	s.bounds = bounds
+	for _, k := range sortedKeys(dirty) {
+		if c, ok := s.cells[k]; ok && c.isFormula() && c.state == statePending {
+			s.evaluate(k)
+		}
+	}
+
+	// Formulas without a stored result are evaluated on demand as well.
+	written := make(map[cellKey]struct{}, len(dirty))
+	for k, c := range s.cells {
+		_, isDirty := dirty[k]
+		if isDirty || (!c.cached && c.state == stateDone) {
+			s.store(data, k)
+			written[k] = struct{}{}
+		}
+	}
+	updated := make([]string, 0, len(written))
+	for _, k := range sortedKeys(written) {
+		updated = append(updated, s.cells[k].id)
+	}
+	return updated
+}
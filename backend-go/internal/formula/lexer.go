@@ -0,0 +1,143 @@
+package formula
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent // function names, booleans and cell references
+	tokError // error literals such as #N/A
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+	tokColon
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // byte offset in the source
+	end  int
+}
+
+var errorLiterals = []string{ErrDiv0, ErrValue, ErrRef, ErrName, ErrNA, ErrNum, ErrCircular}
+
+// tokenize splits a formula body (without the leading '=') into tokens.
+func tokenize(src string) ([]token, error) {
+	tokens := make([]token, 0, len(src)/2+1)
+	i := 0
+	for i < len(src) {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch >= '0' && ch <= '9' || ch == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				j := i + 1
+				if j < len(src) && (src[j] == '+' || src[j] == '-') {
+					j++
+				}
+				if j < len(src) && isDigit(src[j]) {
+					i = j
+					for i < len(src) && isDigit(src[i]) {
+						i++
+					}
+				}
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[start:i], pos: start, end: i})
+		case ch == '"':
+			start := i
+			i++
+			var sb strings.Builder
+			closed := false
+			for i < len(src) {
+				if src[i] == '"' {
+					if i+1 < len(src) && src[i+1] == '"' {
+						sb.WriteByte('"')
+						i += 2
+						continue
+					}
+					i++
+					closed = true
+					break
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: start, end: i})
+		case ch == '#':
+			start := i
+			matched := ""
+			for _, lit := range errorLiterals {
+				if strings.HasPrefix(strings.ToUpper(src[i:]), lit) {
+					matched = lit
+					break
+				}
+			}
+			if matched == "" {
+				return nil, fmt.Errorf("unknown error literal at %d", start)
+			}
+			i += len(matched)
+			tokens = append(tokens, token{kind: tokError, text: matched, pos: start, end: i})
+		case isIdentStart(ch):
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[start:i], pos: start, end: i})
+		case ch == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i, end: i + 1})
+			i++
+		case ch == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i, end: i + 1})
+			i++
+		case ch == ',' || ch == ';':
+			tokens = append(tokens, token{kind: tokComma, text: ",", pos: i, end: i + 1})
+			i++
+		case ch == ':':
+			tokens = append(tokens, token{kind: tokColon, text: ":", pos: i, end: i + 1})
+			i++
+		case ch == '<' || ch == '>':
+			start := i
+			i++
+			if i < len(src) && (src[i] == '=' || (ch == '<' && src[i] == '>')) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokOp, text: src[start:i], pos: start, end: i})
+		case ch == '!' && i+1 < len(src) && src[i+1] == '=':
+			tokens = append(tokens, token{kind: tokOp, text: "<>", pos: i, end: i + 2})
+			i += 2
+		case strings.IndexByte("+-*/^&=%", ch) >= 0:
+			tokens = append(tokens, token{kind: tokOp, text: string(ch), pos: i, end: i + 1})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", ch, i)
+		}
+	}
+	tokens = append(tokens, token{kind: tokEOF, pos: len(src), end: len(src)})
+	return tokens, nil
+}
+
+func isDigit(ch byte) bool { return ch >= '0' && ch <= '9' }
+
+func isLetter(ch byte) bool { return (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') }
+
+func isIdentStart(ch byte) bool { return isLetter(ch) || ch == '$' || ch == '_' }
+
+func isIdentPart(ch byte) bool {
+	return isLetter(ch) || isDigit(ch) || ch == '$' || ch == '_' || ch == '.'
+}
@@ -0,0 +1,506 @@
+package formula
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxRow is the last addressable 0-based row; whole-column references
+// such as A:A span rows 0..MaxRow.
+const MaxRow = 1048575
+
+// CellRef addresses a single cell (0-based row/col).
+type CellRef struct {
+	Row    int
+	Col    int
+	AbsRow bool
+	AbsCol bool
+}
+
+// Range is an inclusive rectangular block of cells (0-based).
+type Range struct {
+	StartRow int
+	StartCol int
+	EndRow   int
+	EndCol   int
+}
+
+// Contains reports whether the cell at row/col lies inside r.
+func (r Range) Contains(row, col int) bool {
+	return row >= r.StartRow && row <= r.EndRow && col >= r.StartCol && col <= r.EndCol
+}
+
+// A1 writes r as "B2:B200", or "B2" for a single cell.
+func (r Range) A1() string {
+	start := ColumnLabel(r.StartCol) + strconv.Itoa(r.StartRow+1)
+	if r.StartRow == r.EndRow && r.StartCol == r.EndCol {
+		return start
+	}
+	return start + ":" + ColumnLabel(r.EndCol) + strconv.Itoa(r.EndRow+1)
+}
+
+// Expr is a parsed formula.
+type Expr struct {
+	root node
+}
+
+type node interface{}
+
+type numberNode struct{ val float64 }
+type stringNode struct{ val string }
+type boolNode struct{ val bool }
+type errorNode struct{ code string }
+type refNode struct{ ref CellRef }
+type rangeNode struct{ rng Range }
+type nameNode struct{ name string }
+type unaryNode struct {
+	op string
+	x  node
+}
+type postfixNode struct {
+	op string
+	x  node
+}
+type binaryNode struct {
+	op   string
+	l, r node
+}
+type callNode struct {
+	name string
+	args []node
+}
+
+// IsFormula reports whether raw cell input is a formula.
+func IsFormula(raw string) bool {
+	return len(raw) > 1 && raw[0] == '='
+}
+
+// Parse parses a formula. A leading '=' is optional.
+func Parse(src string) (*Expr, error) {
+	src = strings.TrimPrefix(src, "=")
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", p.peek().text, p.peek().pos)
+	}
+	return &Expr{root: root}, nil
+}
+
+// References returns every cell and range the expression reads.
+func (e *Expr) References() []Range {
+	var out []Range
+	walkNodes(e.root, func(n node) {
+		switch t := n.(type) {
+		case refNode:
+			out = append(out, Range{StartRow: t.ref.Row, StartCol: t.ref.Col, EndRow: t.ref.Row, EndCol: t.ref.Col})
+		case rangeNode:
+			out = append(out, t.rng)
+		}
+	})
+	return out
+}
+
+// volatileFunctions change value without any input changing.
+var volatileFunctions = map[string]bool{"RAND": true, "RANDBETWEEN": true, "TODAY": true, "NOW": true}
+
+// Volatile reports whether the expression calls a function such as NOW or
+// RAND whose result must be refreshed on every recalculation.
+func (e *Expr) Volatile() bool {
+	volatile := false
+	walkNodes(e.root, func(n node) {
+		if c, ok := n.(callNode); ok && volatileFunctions[c.name] {
+			volatile = true
+		}
+	})
+	return volatile
+}
+
+func walkNodes(n node, visit func(node)) {
+	visit(n)
+	switch t := n.(type) {
+	case unaryNode:
+		walkNodes(t.x, visit)
+	case postfixNode:
+		walkNodes(t.x, visit)
+	case binaryNode:
+		walkNodes(t.l, visit)
+		walkNodes(t.r, visit)
+	case callNode:
+		for _, a := range t.args {
+			walkNodes(a, visit)
+		}
+	}
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) peekOp(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseExpr() (node, error) { return p.parseComparison() }
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOp("=", "<>", "<", ">", "<=", ">=")
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, l: left, r: right}
+	}
+}
+
+func (p *parser) parseConcat() (node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("&"); !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "&", l: left, r: right}
+	}
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOp("+", "-")
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, l: left, r: right}
+	}
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	left, err := p.parsePower()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOp("*", "/")
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parsePower()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, l: left, r: right}
+	}
+}
+
+func (p *parser) parsePower() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("^"); !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "^", l: left, r: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if op, ok := p.peekOp("+", "-"); ok {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op: op, x: x}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("%"); !ok {
+			return x, nil
+		}
+		p.next()
+		x = postfixNode{op: "%", x: x}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return numberNode{val: f}, nil
+	case tokString:
+		return stringNode{val: t.text}, nil
+	case tokError:
+		return errorNode{code: t.text}, nil
+	case tokLParen:
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return inner, nil
+	case tokIdent:
+		return p.parseIdent(t)
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of formula")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *parser) parseIdent(t token) (node, error) {
+	if p.peek().kind == tokLParen {
+		p.next()
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		return callNode{name: strings.ToUpper(t.text), args: args}, nil
+	}
+
+	if p.peek().kind == tokColon {
+		return p.parseRange(t)
+	}
+
+	if ref, ok := parseCellRef(t.text); ok {
+		return refNode{ref: ref}, nil
+	}
+
+	switch strings.ToUpper(t.text) {
+	case "TRUE":
+		return boolNode{val: true}, nil
+	case "FALSE":
+		return boolNode{val: false}, nil
+	}
+	return nameNode{name: t.text}, nil
+}
+
+func (p *parser) parseRange(start token) (node, error) {
+	p.next() // ':'
+	end := p.next()
+	if end.kind != tokIdent {
+		return nil, fmt.Errorf("invalid range near %d", start.pos)
+	}
+
+	if a, ok := parseCellRef(start.text); ok {
+		b, ok := parseCellRef(end.text)
+		if !ok {
+			return nil, fmt.Errorf("invalid range %s:%s", start.text, end.text)
+		}
+		return rangeNode{rng: normalizeRange(a.Row, a.Col, b.Row, b.Col)}, nil
+	}
+
+	// Whole-column reference such as A:C.
+	c1, ok1 := parseColumnRef(start.text)
+	c2, ok2 := parseColumnRef(end.text)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("invalid range %s:%s", start.text, end.text)
+	}
+	return rangeNode{rng: normalizeRange(0, c1, MaxRow, c2)}, nil
+}
+
+func (p *parser) parseArgs() ([]node, error) {
+	var args []node
+	if p.peek().kind == tokRParen {
+		p.next()
+		return args, nil
+	}
+	for {
+		// Empty argument, e.g. IF(A1,,1).
+		if k := p.peek().kind; k == tokComma || k == tokRParen {
+			args = append(args, nil)
+		} else {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		switch t := p.next(); t.kind {
+		case tokComma:
+			continue
+		case tokRParen:
+			return args, nil
+		default:
+			return nil, fmt.Errorf("expected ',' or ')' at %d", t.pos)
+		}
+	}
+}
+
+func normalizeRange(r1, c1, r2, c2 int) Range {
+	if r1 > r2 {
+		r1, r2 = r2, r1
+	}
+	if c1 > c2 {
+		c1, c2 = c2, c1
+	}
+	return Range{StartRow: r1, StartCol: c1, EndRow: r2, EndCol: c2}
+}
+
+// ParseRange parses a cell ("B2") or range ("B2:B200") reference outside a
+// formula; '$' anchors are accepted and dropped.
+func ParseRange(s string) (Range, bool) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(s), ":")
+	a, ok := parseCellRef(from)
+	if !ok {
+		return Range{}, false
+	}
+	b := a
+	if isRange {
+		if b, ok = parseCellRef(to); !ok {
+			return Range{}, false
+		}
+	}
+	return normalizeRange(a.Row, a.Col, b.Row, b.Col), true
+}
+
+// parseCellRef parses A1-style references, with optional '$' anchors.
+func parseCellRef(s string) (CellRef, bool) {
+	var ref CellRef
+	i := 0
+	if i < len(s) && s[i] == '$' {
+		ref.AbsCol = true
+		i++
+	}
+	colStart := i
+	for i < len(s) && isLetter(s[i]) {
+		i++
+	}
+	if i == colStart || i-colStart > 3 {
+		return CellRef{}, false
+	}
+	col, ok := columnIndex(s[colStart:i])
+	if !ok {
+		return CellRef{}, false
+	}
+	if i < len(s) && s[i] == '$' {
+		ref.AbsRow = true
+		i++
+	}
+	rowStart := i
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if i == rowStart || i != len(s) {
+		return CellRef{}, false
+	}
+	row, err := strconv.Atoi(s[rowStart:])
+	if err != nil || row <= 0 || row-1 > MaxRow {
+		return CellRef{}, false
+	}
+	ref.Row = row - 1
+	ref.Col = col
+	return ref, true
+}
+
+func parseColumnRef(s string) (int, bool) {
+	s = strings.TrimPrefix(s, "$")
+	if s == "" || len(s) > 3 {
+		return 0, false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isLetter(s[i]) {
+			return 0, false
+		}
+	}
+	return columnIndex(s)
+}
+
+func columnIndex(s string) (int, bool) {
+	col := 0
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'a' && ch <= 'z' {
+			ch = ch - 'a' + 'A'
+		}
+		if ch < 'A' || ch > 'Z' {
+			return 0, false
+		}
+		col = col*26 + int(ch-'A'+1)
+	}
+	return col - 1, col > 0
+}
+
+// ColumnLabel converts a 0-based column index into its letter label (0 -> A).
+func ColumnLabel(col int) string {
+	if col < 0 {
+		return ""
+	}
+	label := ""
+	for col >= 0 {
+		label = string(rune('A'+col%26)) + label
+		col = col/26 - 1
+	}
+	return label
+}
@@ -0,0 +1,344 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type cellKey struct{ row, col int }
+
+const (
+	statePending = iota
+	stateVisiting
+	stateDone
+)
+
+type sheetCell struct {
+	id       string
+	raw      string
+	expr     *Expr
+	parseErr bool
+	state    int
+	value    Value
+	cached   bool // value was taken from the stored computed field
+}
+
+func (c *sheetCell) isFormula() bool { return c.expr != nil || c.parseErr }
+
+// sheet evaluates formulas over a state.data map ("row,col" -> cell object).
+type sheet struct {
+	cells    map[cellKey]*sheetCell
+	formulas []cellKey
+	rows     int
+	cols     int
+	circular map[cellKey]struct{}
+	inRange  map[Range][]cellKey // formula cells per referenced range
+	// bounds, when set, reports the used area of a sheet that data only
+	// holds part of.
+	bounds func() (rows, cols int)
+}
+
+// ParseCellID splits a "row,col" state key into its 0-based coordinates.
+func ParseCellID(id string) (row, col int, ok bool) {
+	parts := strings.Split(id, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	r, errR := strconv.Atoi(parts[0])
+	c, errC := strconv.Atoi(parts[1])
+	if errR != nil || errC != nil || r < 0 || c < 0 {
+		return 0, 0, false
+	}
+	return r, c, true
+}
+
+// CellRawValue returns the raw input stored in a state cell object.
+func CellRawValue(cell map[string]any) string {
+	if cell == nil {
+		return ""
+	}
+	switch v := cell["value"].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// newSheet indexes data for evaluation. Parsed formulas are reused from g
+// when it is non-nil. When dirty is non-nil, formula cells outside it keep
+// their stored computed value instead of being evaluated again.
+func newSheet(data map[string]any, g *Graph, dirty map[cellKey]struct{}) *sheet {
+	s := &sheet{
+		cells:    make(map[cellKey]*sheetCell, len(data)),
+		circular: map[cellKey]struct{}{},
+		inRange:  map[Range][]cellKey{},
+	}
+	for id, cellAny := range data {
+		cell, ok := cellAny.(map[string]any)
+		if !ok {
+			continue
+		}
+		row, col, ok := ParseCellID(id)
+		if !ok {
+			continue
+		}
+		key := cellKey{row, col}
+		sc := &sheetCell{id: id, raw: CellRawValue(cell)}
+		if IsFormula(sc.raw) {
+			if n := g.node(key); n != nil && n.raw == sc.raw {
+				sc.expr, sc.parseErr = n.expr, n.parseErr
+			} else if expr, err := Parse(sc.raw); err != nil {
+				sc.parseErr = true
+			} else {
+				sc.expr = expr
+			}
+			if dirty != nil {
+				if _, isDirty := dirty[key]; !isDirty {
+					if v, ok := cachedValue(cell["computed"]); ok {
+						sc.value, sc.state, sc.cached = v, stateDone, true
+					}
+				}
+			}
+		}
+		s.cells[key] = sc
+		if sc.isFormula() {
+			s.formulas = append(s.formulas, key)
+		}
+		if row+1 > s.rows {
+			s.rows = row + 1
+		}
+		if col+1 > s.cols {
+			s.cols = col + 1
+		}
+	}
+	return s
+}
+
+func (s *sheet) Bounds() (int, int) {
+	if s.bounds != nil {
+		rows, cols := s.bounds()
+		s.rows, s.cols = max(s.rows, rows), max(s.cols, cols)
+		s.bounds = nil
+	}
+	return s.rows, s.cols
+}
+
+func (s *sheet) Value(row, col int) Value {
+	key := cellKey{row, col}
+	c, ok := s.cells[key]
+	if !ok {
+		return emptyValue
+	}
+	switch {
+	case !c.isFormula():
+		return LiteralValue(c.raw)
+	case c.state == statePending:
+		s.evaluate(key)
+	case c.state == stateVisiting:
+		return Error(ErrCircular)
+	}
+	return c.value
+}
+
+// evaluate computes the formula at start after every formula it reads.
+// Precedents are walked with an explicit stack rather than by recursion so
+// that long reference chains cannot overflow the goroutine stack.
+func (s *sheet) evaluate(start cellKey) {
+	type frame struct {
+		key  cellKey
+		deps []cellKey
+		next int
+	}
+	s.cells[start].state = stateVisiting
+	stack := []frame{{key: start, deps: s.precedents(start)}}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next < len(top.deps) {
+			dep := top.deps[top.next]
+			top.next++
+			switch c := s.cells[dep]; c.state {
+			case stateVisiting:
+				// Every cell on the stack from dep upwards takes part in the cycle.
+				for i := len(stack) - 1; i >= 0; i-- {
+					s.circular[stack[i].key] = struct{}{}
+					if stack[i].key == dep {
+						break
+					}
+				}
+			case statePending:
+				c.state = stateVisiting
+				stack = append(stack, frame{key: dep, deps: s.precedents(dep)})
+			}
+			continue
+		}
+
+		c := s.cells[top.key]
+		_, circular := s.circular[top.key]
+		switch {
+		case c.parseErr:
+			c.value = Error(ErrParse)
+		case circular:
+			c.value = Error(ErrCircular)
+		default:
+			c.value = c.expr.Eval(s)
+		}
+		c.state = stateDone
+		stack = stack[:len(stack)-1]
+	}
+}
+
+// precedents returns the formula cells read by the formula at k.
+func (s *sheet) precedents(k cellKey) []cellKey {
+	c := s.cells[k]
+	if c.expr == nil {
+		return nil
+	}
+	var out []cellKey
+	for _, r := range c.expr.References() {
+		out = append(out, s.formulasIn(r)...)
+	}
+	return out
+}
+
+func (s *sheet) formulasIn(r Range) []cellKey {
+	r.EndRow = min(r.EndRow, s.rows-1)
+	r.EndCol = min(r.EndCol, s.cols-1)
+	if r.EndRow < r.StartRow || r.EndCol < r.StartCol {
+		return nil
+	}
+	if r.StartRow == r.EndRow && r.StartCol == r.EndCol {
+		k := cellKey{r.StartRow, r.StartCol}
+		if c, ok := s.cells[k]; ok && c.isFormula() {
+			return []cellKey{k}
+		}
+		return nil
+	}
+	if keys, ok := s.inRange[r]; ok {
+		return keys
+	}
+	var keys []cellKey
+	if (r.EndRow-r.StartRow+1)*(r.EndCol-r.StartCol+1) <= len(s.formulas) {
+		for row := r.StartRow; row <= r.EndRow; row++ {
+			for col := r.StartCol; col <= r.EndCol; col++ {
+				k := cellKey{row, col}
+				if c, ok := s.cells[k]; ok && c.isFormula() {
+					keys = append(keys, k)
+				}
+			}
+		}
+	} else {
+		for _, k := range s.formulas {
+			if r.Contains(k.row, k.col) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	s.inRange[r] = keys
+	return keys
+}
+
+// ComputedValue converts an evaluation result into the JSON shape stored in
+// a cell's "computed" field (numbers stay numbers, everything else is text).
+func ComputedValue(v Value) any {
+	if v.Kind == KindNumber {
+		return v.Num
+	}
+	return v.String()
+}
+
+// literalComputed mirrors the frontend: numeric input is stored as a number,
+// anything else as the raw text.
+func literalComputed(raw string) any {
+	if f, ok := parseNumber(raw); ok {
+		return f
+	}
+	return raw
+}
+
+var errorCodes = map[string]bool{
+	ErrDiv0: true, ErrValue: true, ErrRef: true, ErrName: true,
+	ErrNA: true, ErrNum: true, ErrCircular: true, ErrParse: true,
+}
+
+// cachedValue turns a stored computed field back into a Value.
+func cachedValue(computed any) (Value, bool) {
+	switch v := computed.(type) {
+	case float64:
+		return Number(v), true
+	case bool:
+		return Bool(v), true
+	case string:
+		switch {
+		case errorCodes[v]:
+			return Error(v), true
+		case v == "TRUE":
+			return Bool(true), true
+		case v == "FALSE":
+			return Bool(false), true
+		}
+		return String(v), true
+	}
+	return Value{}, false
+}
+
+// sortedKeys returns keys in row-major order, so that cells are evaluated
+// and written in the same order on every run rather than in map order.
+func sortedKeys[T any](m map[cellKey]T) []cellKey {
+	keys := make([]cellKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].row != keys[j].row {
+			return keys[i].row < keys[j].row
+		}
+		return keys[i].col < keys[j].col
+	})
+	return keys
+}
+
+// store writes the computed field of the cell at k back into data.
+func (s *sheet) store(data map[string]any, k cellKey) {
+	c := s.cells[k]
+	cell := data[c.id].(map[string]any)
+	if !c.isFormula() {
+		cell["computed"] = literalComputed(c.raw)
+		return
+	}
+	v := c.value
+	if _, ok := s.circular[k]; ok {
+		v = Error(ErrCircular)
+	}
+	cell["computed"] = ComputedValue(v)
+}
+
+// Recalculate evaluates every cell in data and stores the result in each
+// cell's "computed" field. Cells that take part in a reference cycle get
+// #CIRCULAR!, unparsable formulas get #ERROR.
+func Recalculate(data map[string]any) {
+	recalculateAll(data, nil)
+}
+
+// RecalculateAll is Recalculate reusing the formulas already parsed into g.
+// Stored computed values are ignored.
+func (g *Graph) RecalculateAll(data map[string]any) {
+	recalculateAll(data, g)
+}
+
+func recalculateAll(data map[string]any, g *Graph) {
+	s := newSheet(data, g, nil)
+	keys := sortedKeys(s.cells)
+	for _, k := range keys {
+		if c := s.cells[k]; c.isFormula() && c.state == statePending {
+			s.evaluate(k)
+		}
+	}
+	for _, k := range keys {
+		s.store(data, k)
+	}
+}
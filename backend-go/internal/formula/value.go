@@ -0,0 +1,209 @@
+package formula
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kind identifies the type held by a Value.
+type Kind int
+
+const (
+	KindEmpty Kind = iota
+	KindNumber
+	KindString
+	KindBool
+	KindError
+	KindArray
+)
+
+// Spreadsheet error codes. They match the strings the frontend renders.
+const (
+	ErrDiv0     = "#DIV/0!"
+	ErrValue    = "#VALUE!"
+	ErrRef      = "#REF!"
+	ErrName     = "#NAME?"
+	ErrNA       = "#N/A"
+	ErrNum      = "#NUM!"
+	ErrCircular = "#CIRCULAR!"
+	ErrParse    = "#ERROR"
+)
+
+// Value is the result of evaluating an expression or reading a cell.
+type Value struct {
+	Kind  Kind
+	Num   float64
+	Str   string // string payload, or the error code for KindError
+	Bool  bool
+	Array [][]Value // rows of values for KindArray (ranges)
+}
+
+var emptyValue = Value{Kind: KindEmpty}
+
+func Number(f float64) Value { return Value{Kind: KindNumber, Num: f} }
+func String(s string) Value  { return Value{Kind: KindString, Str: s} }
+func Bool(b bool) Value      { return Value{Kind: KindBool, Bool: b} }
+func Error(code string) Value {
+	return Value{Kind: KindError, Str: code}
+}
+
+// IsError reports whether v carries a spreadsheet error.
+func (v Value) IsError() bool { return v.Kind == KindError }
+
+// LiteralValue converts a raw (non-formula) cell input into a typed value.
+func LiteralValue(raw string) Value {
+	if raw == "" {
+		return emptyValue
+	}
+	if f, ok := parseNumber(raw); ok {
+		return Number(f)
+	}
+	switch strings.ToUpper(strings.TrimSpace(raw)) {
+	case "TRUE":
+		return Bool(true)
+	case "FALSE":
+		return Bool(false)
+	}
+	return String(raw)
+}
+
+// parseNumber accepts plain decimal numbers only (no hex, inf or nan forms
+// that strconv would otherwise allow).
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= '0' && ch <= '9') || ch == '.' || ch == '-' || ch == '+' || ch == 'e' || ch == 'E' {
+			continue
+		}
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// ToNumber coerces v to a number the way arithmetic operators do.
+func (v Value) ToNumber() (float64, *Value) {
+	switch v.Kind {
+	case KindEmpty:
+		return 0, nil
+	case KindNumber:
+		return v.Num, nil
+	case KindBool:
+		if v.Bool {
+			return 1, nil
+		}
+		return 0, nil
+	case KindString:
+		if f, ok := parseNumber(v.Str); ok {
+			return f, nil
+		}
+		if t, ok := parseDate(v.Str); ok {
+			return dateToSerial(t), nil
+		}
+		e := Error(ErrValue)
+		return 0, &e
+	case KindError:
+		return 0, &v
+	case KindArray:
+		if first, ok := v.first(); ok {
+			return first.ToNumber()
+		}
+		e := Error(ErrValue)
+		return 0, &e
+	}
+	e := Error(ErrValue)
+	return 0, &e
+}
+
+// ToBool coerces v to a boolean for logical functions.
+func (v Value) ToBool() (bool, *Value) {
+	switch v.Kind {
+	case KindEmpty:
+		return false, nil
+	case KindBool:
+		return v.Bool, nil
+	case KindNumber:
+		return v.Num != 0, nil
+	case KindString:
+		switch strings.ToUpper(strings.TrimSpace(v.Str)) {
+		case "TRUE":
+			return true, nil
+		case "FALSE", "":
+			return false, nil
+		}
+		if f, ok := parseNumber(v.Str); ok {
+			return f != 0, nil
+		}
+		e := Error(ErrValue)
+		return false, &e
+	case KindError:
+		return false, &v
+	case KindArray:
+		if first, ok := v.first(); ok {
+			return first.ToBool()
+		}
+	}
+	e := Error(ErrValue)
+	return false, &e
+}
+
+// String renders v the way it is shown in a cell.
+func (v Value) String() string {
+	switch v.Kind {
+	case KindEmpty:
+		return ""
+	case KindNumber:
+		return FormatNumber(v.Num)
+	case KindString, KindError:
+		return v.Str
+	case KindBool:
+		if v.Bool {
+			return "TRUE"
+		}
+		return "FALSE"
+	case KindArray:
+		if first, ok := v.first(); ok {
+			return first.String()
+		}
+	}
+	return ""
+}
+
+// FormatNumber renders a float without trailing zeros or exponent for common magnitudes.
+func FormatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	abs := math.Abs(f)
+	if abs >= 1e21 || (abs != 0 && abs < 1e-7) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (v Value) first() (Value, bool) {
+	if len(v.Array) == 0 || len(v.Array[0]) == 0 {
+		return Value{}, false
+	}
+	return v.Array[0][0], true
+}
+
+// flatten returns the scalar values of v in row-major order.
+func (v Value) flatten() []Value {
+	if v.Kind != KindArray {
+		return []Value{v}
+	}
+	out := make([]Value, 0, len(v.Array))
+	for _, row := range v.Array {
+		out = append(out, row...)
+	}
+	return out
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type createBranchInput struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type mergeBranchInput struct {
+	// Resolutions maps conflicting cell IDs ("row,col") to "main" or "branch".
+	Resolutions map[string]string `json:"resolutions"`
+	DryRun      bool              `json:"dry_run"`
+}
+
+// loadBranch resolves :branch of an accessible file and writes 404 when it does not exist.
+func (h *FileHandler) loadBranch(c *gin.Context, fileID uint) (*models.SheetFileBranch, bool) {
+	branch, err := h.Service.GetBranch(fileID, c.Param("branch"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "branch not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load branch"})
+		return nil, false
+	}
+	return branch, true
+}
+
+// ListBranches returns the branches of a file without their states.
+func (h *FileHandler) ListBranches(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+
+	branches, err := h.Service.ListBranches(file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list branches"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":  file.ID,
+		"branches": branches,
+	})
+}
+
+// CreateBranch starts a branch from the file's current state.
+func (h *FileHandler) CreateBranch(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+
+	var input createBranchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	branch, err := h.Service.CreateBranch(file.ID, input.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidBranchName):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid branch name (use letters, digits, '.', '_' or '-', max 64)"})
+		case errors.Is(err, services.ErrBranchExists):
+			c.JSON(http.StatusConflict, gin.H{"error": "branch already exists"})
+		case errors.Is(err, services.ErrBranchLimit):
+			c.JSON(http.StatusConflict, gin.H{"error": "branch limit reached"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create branch"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, branch)
+}
+
+// GetBranch returns a branch including its base and current state.
+func (h *FileHandler) GetBranch(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+	branch, ok := h.loadBranch(c, file.ID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, branch)
+}
+
+// DeleteBranch removes a branch without touching the file.
+func (h *FileHandler) DeleteBranch(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+
+	if err := h.Service.DeleteBranch(file.ID, c.Param("branch")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "branch not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete branch"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "branch deleted"})
+}
+
+// GetBranchCells reads a range of a branch, with the same query as GetCells.
+func (h *FileHandler) GetBranchCells(c *gin.Context) {
+	file, role, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+	branch, ok := h.loadBranch(c, file.ID)
+	if !ok {
+		return
+	}
+	q, ok := parseCellsQuery(c, branch.State)
+	if !ok {
+		return
+	}
+
+	writeCells(c, q, file.ID, branch.State, gin.H{"access_role": role, "branch": branch.Name})
+}
+
+// PatchBranchCells edits cells on a branch, with the same body as PatchCells.
+// Main and its realtime subscribers are not affected.
+func (h *FileHandler) PatchBranchCells(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+	branch, ok := h.loadBranch(c, file.ID)
+	if !ok {
+		return
+	}
+	edits, ok := parsePatchEdits(c, h.StateLimits, branch.State)
+	if !ok {
+		return
+	}
+
+	branch, updated, err := h.Service.PatchBranchCells(file.ID, branch.Name, edits)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "branch not found"})
+			return
+		}
+		if errors.Is(err, services.ErrSheetNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+			return
+		}
+		if errors.Is(err, services.ErrInvalidState) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to patch cells"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      file.ID,
+		"branch":  branch.Name,
+		"updated": updated,
+	})
+}
+
+// MergeBranch merges a branch into the file. Unresolved conflicts are
+// returned with 409 and nothing is written; the client resends the request
+// with a resolution per conflicting cell. dry_run previews the merge.
+func (h *FileHandler) MergeBranch(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+
+	var input mergeBranchInput
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	for id, resolution := range input.Resolutions {
+		if resolution != services.ResolveMain && resolution != services.ResolveBranch {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "resolution for " + id + " must be main or branch"})
+			return
+		}
+	}
+
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
+		return
+	}
+
+	previous := file.State
+	merged, result, err := h.Service.MergeBranch(file.ID, c.Param("branch"), input.Resolutions, input.DryRun, ifMatch...)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "branch not found"})
+		case errors.Is(err, services.ErrRevisionMismatch):
+			respondRevisionMismatch(c)
+		case errors.Is(err, services.ErrInvalidState):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid state"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to merge branch"})
+		}
+		return
+	}
+
+	if len(result.Conflicts) > 0 && !input.DryRun {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":     "merge conflicts",
+			"file_id":   file.ID,
+			"branch":    c.Param("branch"),
+			"conflicts": result.Conflicts,
+			"applied":   result.Applied,
+		})
+		return
+	}
+
+	if result.Merged {
+		if diffs, err := services.DiffStates(previous, merged.State); err == nil && len(diffs) > 0 {
+			edits := make([]services.CellEdit, 0, len(diffs))
+			for _, d := range diffs {
+				edits = append(edits, services.CellEdit{Sheet: d.Sheet, Row: d.Row, Col: d.Col, Value: d.After})
+			}
+			go notifyRealtimeBatchEdits(merged.ID, firstSheetEdits(merged.State, edits))
+		}
+	}
+
+	c.Header("ETag", fileETag(merged.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":      file.ID,
+		"branch":       c.Param("branch"),
+		"merged":       result.Merged,
+		"revision":     merged.Revision,
+		"dry_run":      input.DryRun,
+		"applied":      result.Applied,
+		"applied_meta": result.AppliedMeta,
+		"resolved":     result.Resolved,
+		"conflicts":    result.Conflicts,
+	})
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHandler_Branches(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	service := &services.SpreadsheetService{DB: db}
+	handler := NewFileHandler(service)
+
+	file, err := service.SaveFile(1, "Pipeline", json.RawMessage(`{"data": {"0,0": {"value": "a"}}, "rowCount": 10}`))
+	assert.NoError(t, err)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/cells", handler.GetCells)
+	router.GET("/files/:id/branches", handler.ListBranches)
+	router.POST("/files/:id/branches", handler.CreateBranch)
+	router.DELETE("/files/:id/branches/:branch", handler.DeleteBranch)
+	router.GET("/files/:id/branches/:branch/cells", handler.GetBranchCells)
+	router.PATCH("/files/:id/branches/:branch/cells", handler.PatchBranchCells)
+	router.POST("/files/:id/branches/:branch/merge", handler.MergeBranch)
+
+	viewer := fileTestRouter(2)
+	viewer.POST("/files/:id/branches", handler.CreateBranch)
+	assert.Equal(t, http.StatusForbidden, doJSON(viewer, "POST", "/files/1/branches", map[string]string{"name": "x"}).Code)
+
+	assert.Equal(t, http.StatusBadRequest, doJSON(router, "POST", "/files/1/branches", map[string]string{"name": "no spaces"}).Code)
+	assert.Equal(t, http.StatusCreated, doJSON(router, "POST", "/files/1/branches", map[string]string{"name": "bot"}).Code)
+	assert.Equal(t, http.StatusConflict, doJSON(router, "POST", "/files/1/branches", map[string]string{"name": "bot"}).Code)
+
+	w := doJSON(router, "PATCH", "/files/1/branches/bot/cells", map[string]any{
+		"edits": []map[string]any{{"cell": "A1", "value": "b"}, {"cell": "B2", "value": "new"}},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(router, "PATCH", "/files/1/branches/missing/cells", map[string]any{
+		"edits": []map[string]any{{"cell": "A1", "value": "b"}},
+	}).Code)
+
+	w = doJSON(router, "GET", "/files/1/branches/bot/cells?range=A1:B2", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var grid struct {
+		Values [][]string `json:"values"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grid))
+	assert.Equal(t, [][]string{{"b", ""}, {"", "new"}}, grid.Values)
+
+	w = doJSON(router, "GET", "/files/1/cells?range=A1:A1", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grid))
+	assert.Equal(t, [][]string{{"a"}}, grid.Values, "main is untouched")
+
+	_, _, err = service.PatchFileCells(file.ID, []services.CellEdit{{Row: 0, Col: 0, Value: "main"}})
+	assert.NoError(t, err)
+
+	w = doJSON(router, "POST", "/files/1/branches/bot/merge", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var conflict struct {
+		Conflicts []services.SheetMergeConflict `json:"conflicts"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+	assert.Equal(t, []services.SheetMergeConflict{{ID: "0,0", Row: 0, Col: 0, Base: "a", Main: "main", Branch: "b"}}, conflict.Conflicts)
+
+	assert.Equal(t, http.StatusBadRequest, doJSON(router, "POST", "/files/1/branches/bot/merge", map[string]any{
+		"resolutions": map[string]string{"0,0": "theirs"},
+	}).Code)
+	w = doJSON(router, "POST", "/files/1/branches/bot/merge", map[string]any{
+		"resolutions": map[string]string{"0,0": "branch"}, "dry_run": true,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"merged":false`)
+
+	w = doJSON(router, "POST", "/files/1/branches/bot/merge", map[string]any{
+		"resolutions": map[string]string{"0,0": "branch"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(router, "GET", "/files/1/cells?range=A1:B2", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grid))
+	assert.Equal(t, [][]string{{"b", ""}, {"", "new"}}, grid.Values)
+
+	assert.Equal(t, http.StatusOK, doJSON(router, "DELETE", "/files/1/branches/bot", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(router, "POST", "/files/1/branches/bot/merge", nil).Code)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"converter-backend/internal/formula"
+	"converter-backend/internal/logger"
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	odsContentType  = "application/vnd.oasis.opendocument.spreadsheet"
+	maxExportCells  = 5_000_000
+	utf8BOM         = "\ufeff"
+)
+
+// Export downloads a file. ?format=xlsx (the default) writes an Excel
+// workbook with every sheet, styles, merged cells and frozen panes;
+// ?format=ods writes the same as an OpenDocument spreadsheet, without panes.
+// ?format=csv|tsv streams one sheet as text, see exportDelimited.
+func (h *FileHandler) Export(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+
+	switch format := strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", "xlsx"))); format {
+	case "xlsx":
+		exportXLSX(c, file)
+	case "ods":
+		exportODS(c, file)
+	case "csv", "tsv":
+		exportDelimited(c, file, format)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported export format: " + format})
+	}
+}
+
+func exportXLSX(c *gin.Context, file *models.SheetFile) {
+	f, err := services.ExportXLSX(file.State)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidState) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid state"})
+			return
+		}
+		logger.Error(fmt.Sprintf("Failed to export file %d: %v", file.ID, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to export file"})
+		return
+	}
+	defer f.Close()
+
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to export file %d: %v", file.ID, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to export file"})
+		return
+	}
+
+	c.Header("Content-Disposition", attachmentDisposition(file.Name, ".xlsx"))
+	c.Header("ETag", fileETag(file.Revision))
+	c.Data(http.StatusOK, xlsxContentType, buf.Bytes())
+}
+
+func exportODS(c *gin.Context, file *models.SheetFile) {
+	var buf bytes.Buffer
+	if err := services.ExportODS(file.State, &buf); err != nil {
+		if errors.Is(err, services.ErrInvalidState) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid state"})
+			return
+		}
+		logger.Error(fmt.Sprintf("Failed to export file %d: %v", file.ID, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to export file"})
+		return
+	}
+
+	c.Header("Content-Disposition", attachmentDisposition(file.Name, ".ods"))
+	c.Header("ETag", fileETag(file.Revision))
+	c.Data(http.StatusOK, odsContentType, buf.Bytes())
+}
+
+// attachmentDisposition names a download after the file; non-ASCII names are
+// encoded as RFC 2231 by mime.
+func attachmentDisposition(name, ext string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\"`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		name = "export"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name + ext})
+}
+
+// exportDelimited streams a sheet as CSV or TSV. Query options:
+//
+//	range=Sheet2!A1:D20  cells to export, or a named range (default: the used
+//	                     range of ?sheet=)
+//	delimiter=;          comma, semicolon, tab, pipe or any single character
+//	value=raw            raw inputs instead of computed values
+//	header=false         skip the first row of the range
+//	bom=true             prefix a UTF-8 BOM so Excel detects the encoding
+func exportDelimited(c *gin.Context, file *models.SheetFile, format string) {
+	delimiter := ','
+	if format == "tsv" {
+		delimiter = '\t'
+	}
+	if d := c.Query("delimiter"); d != "" {
+		var ok bool
+		if delimiter, ok = services.ParseDelimiter(d); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delimiter"})
+			return
+		}
+	}
+
+	valueMode := strings.ToLower(strings.TrimSpace(c.DefaultQuery("value", "computed")))
+	if valueMode != "raw" && valueMode != "computed" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value must be raw or computed"})
+		return
+	}
+	includeHeader := c.DefaultQuery("header", "true") != "false"
+	withBOM := c.Query("bom") == "true"
+
+	sheetName := c.Query("sheet")
+	rangeStr := strings.TrimSpace(c.Query("range"))
+	var minRow, maxRow, minCol, maxCol int
+	if rangeStr != "" {
+		var ok bool
+		if rangeStr, ok = resolveRangeName(c, file.State, rangeStr); !ok {
+			return
+		}
+		minRow, maxRow, minCol, maxCol, ok = a1RangeToBounds(rangeStr)
+		if !ok || minRow < 0 || minCol < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range"})
+			return
+		}
+		if sheet, _ := splitSheetRef(rangeStr); sheet != "" {
+			sheetName = sheet
+		}
+	}
+
+	state, err := services.DecodeState(file.State)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode file state"})
+		return
+	}
+	sheet, _, storedName, err := services.LookupSheet(state, sheetName)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		return
+	}
+	data := sheet.Data
+
+	if rangeStr == "" {
+		var ok bool
+		if minRow, maxRow, minCol, maxCol, ok = usedRange(data); !ok {
+			minRow, maxRow, minCol, maxCol = 0, -1, 0, -1
+		}
+	}
+	if (maxRow-minRow+1)*(maxCol-minCol+1) > maxExportCells {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("range too large (max %d cells)", maxExportCells)})
+		return
+	}
+	if !includeHeader {
+		minRow++
+	}
+
+	getValue := func(cell models.CellData) string {
+		if valueMode == "computed" {
+			if v := services.ComputedText(cell); v != "" {
+				return v
+			}
+		}
+		return cell.Value
+	}
+
+	contentType, ext := "text/csv; charset=utf-8", ".csv"
+	if format == "tsv" {
+		contentType, ext = "text/tab-separated-values; charset=utf-8", ".tsv"
+	}
+	name := file.Name
+	if !services.IsFirstSheet(file.State, storedName) {
+		name += " - " + storedName
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", attachmentDisposition(name, ext))
+	c.Header("ETag", fileETag(file.Revision))
+	c.Status(http.StatusOK)
+
+	if withBOM {
+		_, _ = c.Writer.WriteString(utf8BOM)
+	}
+	writer := csv.NewWriter(c.Writer)
+	writer.Comma = delimiter
+	record := make([]string, max(maxCol-minCol+1, 0))
+	for r := minRow; r <= maxRow; r++ {
+		for col := minCol; col <= maxCol; col++ {
+			record[col-minCol] = getValue(data[fmt.Sprintf("%d,%d", r, col)])
+		}
+		if err := writer.Write(record); err != nil {
+			logger.Error(fmt.Sprintf("Error writing CSV row: %v", err))
+			return
+		}
+	}
+	writer.Flush()
+}
+
+// usedRange returns the bounds of the non-empty cells of data.
+func usedRange(data map[string]models.CellData) (minRow, maxRow, minCol, maxCol int, ok bool) {
+	for id, cell := range data {
+		if cell.Value == "" {
+			continue
+		}
+		row, col, valid := formula.ParseCellID(id)
+		if !valid {
+			continue
+		}
+		if !ok {
+			minRow, maxRow, minCol, maxCol, ok = row, row, col, col, true
+			continue
+		}
+		minRow, maxRow = minInt(minRow, row), maxInt(maxRow, row)
+		minCol, maxCol = minInt(minCol, col), maxInt(maxCol, col)
+	}
+	return minRow, maxRow, minCol, maxCol, ok
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xuri/excelize/v2"
+)
+
+func Test_FileHandler_ExportXLSX(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	file := models.SheetFile{UserID: 1, Name: "Q1 hisobot", Revision: 3, State: json.RawMessage(`{
+		"data": {"0,0": {"value": "Total", "style": {"bold": true}}, "0,1": {"value": "=2+3", "computed": 5}},
+		"mergedCells": [{"startRow": 1, "startCol": 0, "endRow": 1, "endCol": 1}]
+	}`)}
+	assert.NoError(t, db.Create(&file).Error)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	viewer := fileTestRouter(2)
+	viewer.GET("/files/:id/export", handler.Export)
+	w := doJSON(viewer, "GET", "/files/1/export?format=xlsx", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, xlsxContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="Q1 hisobot.xlsx"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, `"3"`, w.Header().Get("ETag"))
+
+	f, err := excelize.OpenReader(bytes.NewReader(w.Body.Bytes()))
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, []string{"Sheet1"}, f.GetSheetList())
+	value, _ := f.GetCellValue("Sheet1", "A1")
+	assert.Equal(t, "Total", value)
+	formula, _ := f.GetCellFormula("Sheet1", "B1")
+	assert.Equal(t, "2+3", formula)
+	merges, _ := f.GetMergeCells("Sheet1")
+	assert.Len(t, merges, 1)
+
+	w = doJSON(viewer, "GET", "/files/1/export?format=pdf", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	stranger := fileTestRouter(3)
+	stranger.GET("/files/:id/export", handler.Export)
+	w = doJSON(stranger, "GET", "/files/1/export", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_FileHandler_ExportCSV(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	file := models.SheetFile{UserID: 1, Name: "Sales", Revision: 1, State: json.RawMessage(`{
+		"data": {
+			"1,1": {"value": "item"}, "1,2": {"value": "qty"},
+			"2,1": {"value": "apple, red"}, "2,2": {"value": "=1+2", "computed": 3},
+			"3,1": {"value": "pear"}
+		},
+		"sheets": [{"name": "Q2", "data": {"0,0": {"value": "x"}, "0,1": {"value": "y"}}}]
+	}`)}
+	assert.NoError(t, db.Create(&file).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/export", handler.Export)
+
+	w := doJSON(router, "GET", "/files/1/export?format=csv", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=Sales.csv`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "item,qty\n\"apple, red\",3\npear,\n", w.Body.String(), "used range B2:C4, computed values")
+
+	w = doJSON(router, "GET", "/files/1/export?format=csv&value=raw&header=false&delimiter=semicolon&bom=true", nil)
+	assert.Equal(t, utf8BOM+"apple, red;=1+2\npear;\n", w.Body.String())
+
+	w = doJSON(router, "GET", "/files/1/export?format=tsv&range=A1:B2", nil)
+	assert.Equal(t, "text/tab-separated-values; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "\t\n\titem\n", w.Body.String())
+
+	w = doJSON(router, "GET", "/files/1/export?format=csv&range=Q2!A1:B1", nil)
+	assert.Equal(t, "x,y\n", w.Body.String())
+	assert.Equal(t, `attachment; filename="Sales - Q2.csv"`, w.Header().Get("Content-Disposition"))
+
+	w = doJSON(router, "GET", "/files/1/export?format=csv&sheet=missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doJSON(router, "GET", "/files/1/export?format=csv&delimiter=ab", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(router, "GET", "/files/1/export?format=csv&range=A1:XFD1048576", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Numbers are written in full, not as 1e+06.
+	amounts := models.SheetFile{UserID: 1, Name: "Amounts", Revision: 1, State: json.RawMessage(`{
+		"data": {"0,0": {"value": "1000000", "computed": 1000000}, "0,1": {"value": "=A1*1000", "computed": 1000000000}}
+	}`)}
+	assert.NoError(t, db.Create(&amounts).Error)
+	w = doJSON(router, "GET", "/files/"+jsonNumber(amounts.ID)+"/export?format=csv", nil)
+	assert.Equal(t, "1000000,1000000000\n", w.Body.String())
+}
+
+func Test_FileHandler_ExportODS(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	file := models.SheetFile{UserID: 1, Name: "Q1 hisobot", Revision: 2, State: json.RawMessage(`{
+		"data": {"0,0": {"value": "Total", "style": {"bold": true}}, "0,1": {"value": "=2+3", "computed": 5}},
+		"mergedCells": [{"startRow": 1, "startCol": 0, "endRow": 1, "endCol": 1}]
+	}`)}
+	assert.NoError(t, db.Create(&file).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/export", handler.Export)
+	w := doJSON(router, "GET", "/files/1/export?format=ods", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, odsContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="Q1 hisobot.ods"`, w.Header().Get("Content-Disposition"))
+	assert.True(t, bytes.HasPrefix(w.Body.Bytes(), []byte("PK")))
+
+	// The download imports back as a new file.
+	w = doUpload(t, handler, "Q1 hisobot.ods", "", w.Body.Bytes())
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var last models.SheetFile
+	assert.NoError(t, db.Last(&last).Error)
+	imported, err := handler.Service.GetFile(1, last.ID)
+	assert.NoError(t, err)
+	var state struct {
+		Data        map[string]map[string]any `json:"data"`
+		MergedCells []map[string]int          `json:"mergedCells"`
+	}
+	assert.NoError(t, json.Unmarshal(imported.State, &state))
+	assert.Equal(t, map[string]any{"bold": true}, state.Data["0,0"]["style"])
+	assert.Equal(t, "=2+3", state.Data["0,1"]["value"])
+	assert.Equal(t, 5.0, state.Data["0,1"]["computed"])
+	assert.Equal(t, []map[string]int{{"startRow": 1, "startCol": 0, "endRow": 1, "endCol": 1}}, state.MergedCells)
+}
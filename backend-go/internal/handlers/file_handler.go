@@ -5,6 +5,7 @@ import (
 	"converter-backend/internal/services"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,6 +16,15 @@ import (
 
 type FileHandler struct {
 	Service *services.SpreadsheetService
+	// MaxUploadSizeMB limits imported files; 0 means defaultMaxUploadSizeMB.
+	MaxUploadSizeMB int64
+	// Jobs runs background imports; nil disables the /jobs endpoints.
+	Jobs *services.JobQueue
+	// MaxJobUploadSizeMB limits uploads to /jobs/import; 0 means
+	// MaxUploadSizeMB.
+	MaxJobUploadSizeMB int64
+	// StateLimits bounds saved states and patched values.
+	StateLimits services.StateLimits
 }
 
 func NewFileHandler(service *services.SpreadsheetService) *FileHandler {
@@ -48,12 +58,16 @@ func (h *FileHandler) Save(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "state is required"})
 		return
 	}
+	if err := services.ValidateState(input.State, h.StateLimits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	var file *models.SheetFile
 	accessRole := "owner"
 	if input.ID != nil {
 		// Update existing file state and name (requires owner/editor)
-		existing, role, err := h.Service.GetFileAccess(userID, *input.ID)
+		existing, role, err := h.Service.GetFileMeta(userID, *input.ID)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 			return
@@ -62,9 +76,19 @@ func (h *FileHandler) Save(c *gin.Context) {
 			c.JSON(http.StatusForbidden, gin.H{"error": "read-only access"})
 			return
 		}
-		existing.Name = input.Name
-		existing.State = input.State
-		if err := h.Service.DB.Save(existing).Error; err != nil {
+		ifMatch, ok := parseIfMatch(c)
+		if !ok {
+			return
+		}
+		if err := h.Service.UpdateFile(existing, input.Name, input.State, ifMatch...); err != nil {
+			if errors.Is(err, services.ErrInvalidState) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid state"})
+				return
+			}
+			if errors.Is(err, services.ErrRevisionMismatch) {
+				respondRevisionMismatch(c)
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update file"})
 			return
 		}
@@ -73,16 +97,22 @@ func (h *FileHandler) Save(c *gin.Context) {
 	} else {
 		saved, err := h.Service.SaveFile(userID, input.Name, input.State)
 		if err != nil {
+			if errors.Is(err, services.ErrInvalidState) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid state"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
 			return
 		}
 		file = saved
 	}
 
+	c.Header("ETag", fileETag(file.Revision))
 	c.JSON(http.StatusOK, gin.H{
 		"id":          file.ID,
 		"name":        file.Name,
 		"state":       file.State,
+		"revision":    file.Revision,
 		"access_role": accessRole,
 	})
 }
@@ -163,11 +193,13 @@ func (h *FileHandler) Get(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", fileETag(file.Revision))
 	c.JSON(http.StatusOK, gin.H{
 		"id":          file.ID,
 		"user_id":     file.UserID,
 		"name":        file.Name,
 		"state":       file.State,
+		"revision":    file.Revision,
 		"created_at":  file.CreatedAt,
 		"updated_at":  file.UpdatedAt,
 		"access_role": role,
@@ -190,7 +222,7 @@ func (h *FileHandler) Delete(c *gin.Context) {
 		return
 	}
 
-	_, role, err := h.Service.GetFileAccess(userID, uint(id64))
+	_, role, err := h.Service.GetFileMeta(userID, uint(id64))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
@@ -209,51 +241,77 @@ func (h *FileHandler) Delete(c *gin.Context) {
 }
 
 type patchCellEditInput struct {
-	Cell  string `json:"cell,omitempty"` // A1 notation, e.g. "B2"
-	Row   *int   `json:"row,omitempty"`  // 0-based
-	Col   *int   `json:"col,omitempty"`  // 0-based
-	Value string `json:"value"`          // raw cell input
+	Cell  string  `json:"cell,omitempty"`  // A1 notation, e.g. "B2" or "Sheet2!B2", or a one-cell name
+	Sheet string  `json:"sheet,omitempty"` // overrides the request's sheet
+	Row   *int    `json:"row,omitempty"`   // 0-based
+	Col   *int    `json:"col,omitempty"`   // 0-based
+	Value *string `json:"value"`           // raw cell input; omit to only change the style
+	// Style is merged into the cell's style (null removes a field), or
+	// replaces it when ReplaceStyle is set.
+	Style        map[string]any `json:"style,omitempty"`
+	ReplaceStyle bool           `json:"replaceStyle,omitempty"`
 }
 
 type patchCellsInput struct {
+	Sheet string               `json:"sheet,omitempty"` // "" is the first sheet
 	Edits []patchCellEditInput `json:"edits"`
 }
 
-func (h *FileHandler) PatchCells(c *gin.Context) {
-	userIDVal, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
-	}
-	userID := userIDVal.(uint)
-
-	idParam := c.Param("id")
-	id64, err := strconv.ParseUint(idParam, 10, 64)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-		return
-	}
-
+// parsePatchEdits binds a patchCellsInput body into service edits and
+// writes a 400 when there is nothing valid to apply or a value or style
+// is not allowed. Named ranges in "cell" are resolved against the state
+// names.
+func parsePatchEdits(c *gin.Context, limits services.StateLimits, names json.RawMessage) ([]services.CellEdit, bool) {
 	var input patchCellsInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		return nil, false
 	}
 	if len(input.Edits) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "edits is required"})
-		return
+		return nil, false
 	}
 	if len(input.Edits) > 1000 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "too many edits (max 1000)"})
-		return
+		return nil, false
 	}
 
 	edits := make([]services.CellEdit, 0, len(input.Edits))
-	for _, edit := range input.Edits {
+	for i, edit := range input.Edits {
+		if edit.Value != nil && !limits.ValueFits(*edit.Value) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("edit %d: value is longer than %d characters", i, limits.WithDefaults().MaxValueLength)})
+			return nil, false
+		}
+		if edit.Style != nil {
+			if err := services.ValidateCellStyle(edit.Style, !edit.ReplaceStyle); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("edit %d: %v", i, err)})
+				return nil, false
+			}
+		}
 		var row, col int
 		var ok bool
+		sheet := input.Sheet
+		if edit.Sheet != "" {
+			sheet = edit.Sheet
+		}
 		if edit.Cell != "" {
-			row, col, ok = a1ToRowCol(edit.Cell)
+			ref, named, err := services.ResolveName(names, edit.Cell)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("edit %d: %v", i, err)})
+				return nil, false
+			}
+			if !named {
+				ref = edit.Cell
+			}
+			prefix, cell := splitSheetRef(ref)
+			if prefix != "" {
+				sheet = prefix
+			}
+			row, col, ok = a1ToRowCol(cell)
+			if named && !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("edit %d: %s is a range, not a single cell", i, strings.TrimSpace(edit.Cell))})
+				return nil, false
+			}
 		} else if edit.Row != nil && edit.Col != nil {
 			row, col = *edit.Row, *edit.Col
 			ok = true
@@ -261,43 +319,179 @@ func (h *FileHandler) PatchCells(c *gin.Context) {
 		if !ok || row < 0 || col < 0 {
 			continue
 		}
-		edits = append(edits, services.CellEdit{Row: row, Col: col, Value: edit.Value})
+		cellEdit := services.CellEdit{
+			Sheet:      sheet,
+			Row:        row,
+			Col:        col,
+			Style:      edit.Style,
+			MergeStyle: !edit.ReplaceStyle,
+			StyleOnly:  edit.Value == nil && edit.Style != nil,
+		}
+		if edit.Value != nil {
+			cellEdit.Value = *edit.Value
+		}
+		edits = append(edits, cellEdit)
 	}
 
 	if len(edits) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "no valid edits"})
-		return
+		return nil, false
 	}
+	return edits, true
+}
 
-	fileID := uint(id64)
-	_, role, err := h.Service.GetFileAccess(userID, fileID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+func (h *FileHandler) PatchCells(c *gin.Context) {
+	meta, _, ok := h.loadFileMeta(c, true)
+	if !ok {
 		return
 	}
-	if role == "viewer" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "read-only access"})
+	edits, ok := parsePatchEdits(c, h.StateLimits, meta.State)
+	if !ok {
+		return
+	}
+	fileID := meta.ID
+
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
 		return
 	}
 
-	file, updated, err := h.Service.PatchFileCells(fileID, edits)
+	file, updated, err := h.Service.PatchFileCells(fileID, edits, ifMatch...)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 			return
 		}
+		if errors.Is(err, services.ErrRevisionMismatch) {
+			respondRevisionMismatch(c)
+			return
+		}
+		if errors.Is(err, services.ErrSheetNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+			return
+		}
+		if errors.Is(err, services.ErrInvalidState) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to patch cells"})
 		return
 	}
 
-	go notifyRealtimeBatchEdits(file.ID, edits)
+	go notifyRealtimeBatchEdits(file.ID, firstSheetEdits(file.State, edits))
 
+	c.Header("ETag", fileETag(file.Revision))
 	c.JSON(http.StatusOK, gin.H{
-		"id":      file.ID,
-		"updated": updated,
+		"id":       file.ID,
+		"updated":  updated,
+		"revision": file.Revision,
 	})
 }
 
+// loadFileAccess runs the preamble shared by the per-file endpoints: it
+// resolves the caller and the :id parameter, checks access and, when write
+// is set, rejects viewers. On failure the response has been written.
+func (h *FileHandler) loadFileAccess(c *gin.Context, write bool) (*models.SheetFile, string, bool) {
+	return h.loadFile(c, write, h.Service.GetFileAccess)
+}
+
+// loadFileMeta is loadFileAccess without the file's cells: State holds
+// only the layout, named ranges included.
+func (h *FileHandler) loadFileMeta(c *gin.Context, write bool) (*models.SheetFile, string, bool) {
+	return h.loadFile(c, write, h.Service.GetFileMeta)
+}
+
+func (h *FileHandler) loadFile(c *gin.Context, write bool, get func(userID, fileID uint) (*models.SheetFile, string, error)) (*models.SheetFile, string, bool) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, "", false
+	}
+	userID := userIDVal.(uint)
+
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, "", false
+	}
+
+	file, role, err := get(userID, uint(id64))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return nil, "", false
+	}
+	if write && role == "viewer" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "read-only access"})
+		return nil, "", false
+	}
+	return file, role, true
+}
+
+// firstSheetEdits keeps the edits on the first sheet, the one realtime
+// clients display. Merged styles are replaced with the style the cell
+// ended up with in state, so clients can apply it as is.
+func firstSheetEdits(state json.RawMessage, edits []services.CellEdit) []services.CellEdit {
+	var stored struct {
+		Data map[string]struct {
+			Style map[string]any `json:"style"`
+		} `json:"data"`
+	}
+	decoded := false
+	out := make([]services.CellEdit, 0, len(edits))
+	for _, edit := range edits {
+		if !services.IsFirstSheet(state, edit.Sheet) {
+			continue
+		}
+		if edit.Style != nil && edit.MergeStyle {
+			if !decoded {
+				_ = json.Unmarshal(state, &stored)
+				decoded = true
+			}
+			edit.Style = stored.Data[strconv.Itoa(edit.Row)+","+strconv.Itoa(edit.Col)].Style
+			if edit.Style == nil {
+				edit.Style = map[string]any{}
+			}
+			edit.MergeStyle = false
+		}
+		out = append(out, edit)
+	}
+	return out
+}
+
+// fileETag formats a file revision as a strong entity tag.
+func fileETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// parseIfMatch reads the revisions listed in an If-Match header. A missing
+// header or "*" yields none, which makes the write unconditional. A header
+// that names no revision can never match and is answered with 412 here.
+func parseIfMatch(c *gin.Context) ([]int64, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return nil, true
+	}
+
+	var revisions []int64
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		tag = strings.TrimPrefix(tag, "W/")
+		tag = strings.Trim(tag, `"`)
+		if rev, err := strconv.ParseInt(tag, 10, 64); err == nil {
+			revisions = append(revisions, rev)
+		}
+	}
+	if len(revisions) == 0 {
+		respondRevisionMismatch(c)
+		return nil, false
+	}
+	return revisions, true
+}
+
+func respondRevisionMismatch(c *gin.Context) {
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "file was modified; reload it and retry"})
+}
+
 func a1ToRowCol(cell string) (row int, col int, ok bool) {
 	cell = strings.TrimSpace(cell)
 	if cell == "" {
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fileTestRouter returns a router whose requests are authenticated as userID.
+func fileTestRouter(userID uint) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("user_id", userID)
+		c.Next()
+	})
+	return router
+}
+
+func doJSON(router *gin.Engine, method, path string, body any) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func Test_FileHandler_Save(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	file := models.SheetFile{UserID: 1, Name: "Budget", State: json.RawMessage(`{"data": {}}`)}
+	assert.NoError(t, db.Create(&file).Error)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	state := map[string]any{"data": map[string]any{
+		"0,0": map[string]any{"value": "4"},
+		"0,1": map[string]any{"value": "=A1*A1"},
+	}}
+
+	owner := fileTestRouter(1)
+	owner.POST("/files", handler.Save)
+	w := doJSON(owner, "POST", "/files", gin.H{"id": file.ID, "name": "Budget", "state": state})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		State struct {
+			Data map[string]map[string]any `json:"data"`
+		} `json:"state"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, float64(16), resp.State.Data["0,1"]["computed"])
+
+	w = doJSON(owner, "POST", "/files", gin.H{"id": file.ID, "name": "Budget", "state": "not a sheet"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	viewer := fileTestRouter(2)
+	viewer.POST("/files", handler.Save)
+	w = doJSON(viewer, "POST", "/files", gin.H{"id": file.ID, "name": "Budget", "state": state})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func Test_FileHandler_Save_ValidatesState(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+	handler.StateLimits = services.StateLimits{MaxCells: 3, MaxValueLength: 5}
+
+	router := fileTestRouter(1)
+	router.POST("/files", handler.Save)
+	router.PATCH("/files/:id/cells", handler.PatchCells)
+	save := func(state string) (int, string) {
+		w := doJSON(router, "POST", "/files", gin.H{"name": "Checked", "state": json.RawMessage(state)})
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		msg, _ := out["error"].(string)
+		return w.Code, msg
+	}
+
+	code, _ := save(`{
+		"data": {"0,0": {"value": "Olma", "computed": "Olma", "style": {"bold": true, "borders": {"top": true}}}},
+		"activeCell": {"row": 0, "col": 0}, "selection": null,
+		"columnWidths": {"0": 120}, "rowHeights": {}, "rowCount": 100,
+		"freezePosition": {"rows": 1, "cols": 0},
+		"mergedCells": [{"startRow": 1, "startCol": 0, "endRow": 1, "endCol": 2}],
+		"sheetName": "Asosiy", "sheets": [{"name": "Q2", "data": {"0,0": {"value": "1"}}}]
+	}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	for state, want := range map[string]string{
+		`{"data": {"0,0": {"value": 5}}}`:                                                                        "invalid state: data.0,0.value must be a string",
+		`{"data": {"0,0": {"value": "x", "style": {"bold": "yes"}}}}`:                                            "invalid state: data.0,0.style.bold must be a boolean",
+		`{"data": {"0,0": {"value": "x", "style": {"textAlign": "up"}}}}`:                                        "invalid state: data.0,0.style.textAlign must be one of [left center right]",
+		`{"data": {"A1": {"value": "x"}}}`:                                                                       `invalid state: data has a bad cell key "A1" (want "row,col")`,
+		`{"data": {"0,0": {"value": "toolong"}}}`:                                                                "invalid state: data.0,0.value is longer than 5 characters",
+		`{"data": {"0,0": {"value": "a"}, "0,1": {"value": "b"}, "0,2": {"value": "c"}, "0,3": {"value": "d"}}}`: "invalid state: more than 3 cells",
+		`{"data": {}, "rowCount": "100"}`:                                                                        "invalid state: rowCount must be an integer",
+		`{"data": {}, "theme": "dark"}`:                                                                          `invalid state: unknown field "theme"`,
+		`{"data": {}, "sheets": [{"data": {}}]}`:                                                                 "invalid state: sheets.0.name is required",
+		`{"data": {}, "sheets": [{"name": "sheet1", "data": {}}]}`:                                               `invalid state: sheets.0.name "sheet1" is used by another sheet`,
+		`{"data": {}, "mergedCells": [{"startRow": 2, "endRow": 1}]}`:                                            "invalid state: mergedCells.0 is not a range",
+		`[1, 2]`: "invalid state: value must be an object",
+	} {
+		code, msg := save(state)
+		assert.Equal(t, http.StatusBadRequest, code, state)
+		assert.Equal(t, want, msg, state)
+	}
+
+	w := doJSON(router, "PATCH", "/files/1/cells", gin.H{"edits": []gin.H{{"cell": "A1", "value": "fits"}, {"cell": "A2", "value": "too long"}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "edit 1: value is longer than 5 characters")
+
+	handler.Service.StateLimits = handler.StateLimits
+	w = doJSON(router, "PATCH", "/files/1/cells", gin.H{"edits": []gin.H{{"cell": "A2", "value": "a"}, {"cell": "A3", "value": "b"}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid state: more than 3 cells")
+}
+
+func Test_FileHandler_IfMatch(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	service := &services.SpreadsheetService{DB: db}
+	handler := NewFileHandler(service)
+
+	file, err := service.SaveFile(1, "Synced", json.RawMessage(`{"data": {"0,0": {"value": "1"}}}`))
+	assert.NoError(t, err)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id", handler.Get)
+	router.GET("/files/:id/cells", handler.GetCells)
+	router.POST("/files", handler.Save)
+	router.PATCH("/files/:id/cells", handler.PatchCells)
+
+	withIfMatch := func(method, path, ifMatch string, body any) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		_ = json.NewEncoder(&buf).Encode(body)
+		req, _ := http.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	patch := gin.H{"edits": []gin.H{{"cell": "A1", "value": "2"}}}
+
+	w := doJSON(router, "GET", "/files/1", nil)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	assert.Equal(t, `"1"`, doJSON(router, "GET", "/files/1/cells?range=A1:A1", nil).Header().Get("ETag"))
+
+	w = withIfMatch("PATCH", "/files/1/cells", `"1"`, patch)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	// A second writer still holding revision 1 is rejected.
+	w = withIfMatch("PATCH", "/files/1/cells", `"1"`, patch)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = withIfMatch("POST", "/files", `"1"`, gin.H{"id": file.ID, "name": "Synced", "state": gin.H{"data": gin.H{}}})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, http.StatusPreconditionFailed, withIfMatch("PATCH", "/files/1/cells", `"abc"`, patch).Code)
+
+	w = withIfMatch("POST", "/files", `"7", "2"`, gin.H{"id": file.ID, "name": "Synced", "state": gin.H{"data": gin.H{}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"3"`, w.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusOK, withIfMatch("PATCH", "/files/1/cells", "*", patch).Code)
+	assert.Equal(t, http.StatusOK, doJSON(router, "PATCH", "/files/1/cells", patch).Code, "no If-Match is unconditional")
+	assert.Equal(t, `"5"`, doJSON(router, "GET", "/files/1", nil).Header().Get("ETag"))
+
+	// Restores and merges rewrite the file too.
+	router.POST("/files/:id/versions/:version/restore", handler.RestoreVersion)
+	router.POST("/files/:id/branches", handler.CreateBranch)
+	router.POST("/files/:id/branches/:branch/merge", handler.MergeBranch)
+	assert.Equal(t, http.StatusPreconditionFailed, withIfMatch("POST", "/files/1/versions/1/restore", `"4"`, nil).Code)
+	w = withIfMatch("POST", "/files/1/versions/1/restore", `"5"`, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"6"`, w.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusCreated, doJSON(router, "POST", "/files/1/branches", gin.H{"name": "bot"}).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, withIfMatch("POST", "/files/1/branches/bot/merge", `"5"`, gin.H{}).Code)
+	w = withIfMatch("POST", "/files/1/branches/bot/merge", `"6"`, gin.H{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"7"`, w.Header().Get("ETag"))
+}
+
+func Test_FileHandler_PatchCells_Styles(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	service := &services.SpreadsheetService{DB: db}
+	handler := NewFileHandler(service)
+
+	file, err := service.SaveFile(1, "Styled", json.RawMessage(`{"data": {
+		"0,0": {"value": "Olma", "style": {"bold": true, "color": "#333"}},
+		"0,1": {"value": "3"}
+	}}`))
+	assert.NoError(t, err)
+
+	router := fileTestRouter(1)
+	router.PATCH("/files/:id/cells", handler.PatchCells)
+	path := "/files/" + jsonNumber(file.ID) + "/cells"
+	cell := func(id string) map[string]any {
+		f, err := service.GetFile(1, file.ID)
+		assert.NoError(t, err)
+		var decoded struct {
+			Data map[string]map[string]any `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(f.State, &decoded))
+		return decoded.Data[id]
+	}
+
+	w := doJSON(router, "PATCH", path, gin.H{"edits": []gin.H{
+		{"cell": "A1", "style": gin.H{"color": nil, "backgroundColor": "#fff3bf"}},
+		{"cell": "B1", "value": "4", "style": gin.H{"numberFormat": "currency", "currencyCode": "UZS"}},
+		{"cell": "C1", "style": gin.H{"bold": true}},
+	}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]any{"value": "Olma", "computed": "Olma", "style": map[string]any{"bold": true, "backgroundColor": "#fff3bf"}}, cell("0,0"))
+	assert.Equal(t, map[string]any{"numberFormat": "currency", "currencyCode": "UZS"}, cell("0,1")["style"])
+	assert.EqualValues(t, 4, cell("0,1")["computed"])
+	assert.Equal(t, "", cell("0,2")["value"], "styling an empty cell creates it")
+
+	w = doJSON(router, "PATCH", path, gin.H{"edits": []gin.H{{"cell": "A1", "style": gin.H{"italic": true}, "replaceStyle": true}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]any{"italic": true}, cell("0,0")["style"])
+	w = doJSON(router, "PATCH", path, gin.H{"edits": []gin.H{{"cell": "A1", "style": gin.H{}, "replaceStyle": true}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, cell("0,0")["style"])
+	assert.Equal(t, "Olma", cell("0,0")["value"])
+
+	w = doJSON(router, "PATCH", path, gin.H{"edits": []gin.H{{"cell": "A1", "value": "x"}, {"cell": "B1", "style": gin.H{"textAlign": "justify"}}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "edit 1")
+	assert.Equal(t, "Olma", cell("0,0")["value"])
+
+	// Realtime clients are sent the style each cell ended up with.
+	stored, err := service.GetFile(1, file.ID)
+	assert.NoError(t, err)
+	edits := firstSheetEdits(stored.State, []services.CellEdit{
+		{Row: 0, Col: 1, Style: map[string]any{"bold": true}, MergeStyle: true, StyleOnly: true},
+		{Row: 0, Col: 0, Style: map[string]any{"bold": nil}, MergeStyle: true, StyleOnly: true},
+		{Sheet: "Nope", Row: 0, Col: 0, Value: "x"},
+	})
+	assert.Equal(t, []services.CellEdit{
+		{Row: 0, Col: 1, Style: map[string]any{"numberFormat": "currency", "currencyCode": "UZS"}, StyleOnly: true},
+		{Row: 0, Col: 0, Style: map[string]any{}, StyleOnly: true},
+	}, edits)
+}
@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"unicode"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
 
 	"github.com/gin-gonic/gin"
 )
@@ -30,8 +32,15 @@ func maxInt(a, b int) int {
 	return b
 }
 
+// splitSheetRef is services.SplitSheetRef.
+func splitSheetRef(ref string) (sheet, rest string) {
+	return services.SplitSheetRef(ref)
+}
+
+// a1RangeToBounds parses "A1:D20" or a single cell into 0-based bounds.
+// A sheet prefix ("Sheet1!A1:D20") is accepted and ignored; see splitSheetRef.
 func a1RangeToBounds(rangeStr string) (minRow, maxRow, minCol, maxCol int, ok bool) {
-	trimmed := strings.TrimSpace(rangeStr)
+	_, trimmed := splitSheetRef(rangeStr)
 	if trimmed == "" {
 		return 0, 0, 0, 0, false
 	}
@@ -74,131 +83,151 @@ func colToLabel(col int) string {
 	return label
 }
 
-func stateCellRawValue(cellAny map[string]any) string {
-	if cellAny == nil {
-		return ""
+// cellsQuery holds the parsed query of the cell read endpoints.
+type cellsQuery struct {
+	sheet                          string // "" is the first sheet
+	rangeStr                       string
+	name                           string // the named range rangeStr was read from
+	minRow, maxRow, minCol, maxCol int
+	valueMode                      string // raw|computed
+	format                         string // grid|sparse
+}
+
+// parseCellsQuery reads ?range=&value=&format= and writes a 400 on failure.
+// The range may name a sheet (Sheet2!A1:D20) or be a named range of state.
+func parseCellsQuery(c *gin.Context, state json.RawMessage) (cellsQuery, bool) {
+	rangeStr := c.Query("range")
+	if strings.TrimSpace(rangeStr) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "range is required (e.g. A1:D20)"})
+		return cellsQuery{}, false
 	}
-	v, ok := cellAny["value"]
-	if !ok || v == nil {
-		return ""
+	resolved, ok := resolveRangeName(c, state, rangeStr)
+	if !ok {
+		return cellsQuery{}, false
 	}
-	switch t := v.(type) {
-	case string:
-		return t
-	default:
-		return fmt.Sprint(v)
+	var name string
+	if resolved != rangeStr {
+		name, rangeStr = strings.TrimSpace(rangeStr), resolved
 	}
-}
-
-func stateCellComputedValue(cellAny map[string]any) string {
-	if cellAny == nil {
-		return ""
+	minRow, maxRow, minCol, maxCol, ok := a1RangeToBounds(rangeStr)
+	if !ok || minRow < 0 || minCol < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range"})
+		return cellsQuery{}, false
 	}
-	v, ok := cellAny["computed"]
-	if !ok || v == nil {
-		return ""
+
+	rows := maxRow - minRow + 1
+	cols := maxCol - minCol + 1
+	if rows <= 0 || cols <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range"})
+		return cellsQuery{}, false
 	}
-	switch t := v.(type) {
-	case string:
-		return t
-	default:
-		return fmt.Sprint(v)
+	if rows*cols > maxCellsReadGrid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("range too large (max %d cells)", maxCellsReadGrid)})
+		return cellsQuery{}, false
 	}
-}
 
-func containsLetter(s string) bool {
-	for _, r := range s {
-		if unicode.IsLetter(r) {
-			return true
-		}
+	valueMode := strings.ToLower(strings.TrimSpace(c.Query("value")))
+	if valueMode == "" {
+		valueMode = "raw"
 	}
-	return false
+	format := strings.ToLower(strings.TrimSpace(c.Query("format")))
+	if format == "" {
+		format = "grid"
+	}
+
+	sheet, _ := splitSheetRef(rangeStr)
+	return cellsQuery{
+		sheet:     sheet,
+		rangeStr:  strings.TrimSpace(rangeStr),
+		name:      name,
+		minRow:    minRow,
+		maxRow:    maxRow,
+		minCol:    minCol,
+		maxCol:    maxCol,
+		valueMode: valueMode,
+		format:    format,
+	}, true
 }
 
-func isNumericLike(s string) bool {
-	trimmed := strings.TrimSpace(s)
-	if trimmed == "" {
-		return false
+// resolveRangeName reads ref as a named range when state defines one by
+// that name, so names work wherever an A1 range does; any other ref comes
+// back as it is. It writes a 400 for a name whose cells were deleted.
+func resolveRangeName(c *gin.Context, state json.RawMessage, ref string) (string, bool) {
+	resolved, found, err := services.ResolveName(state, ref)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", false
+	}
+	if !found {
+		return ref, true
 	}
-	_, err := strconv.ParseFloat(trimmed, 64)
-	return err == nil
+	return resolved, true
 }
 
-// GetCells returns sheet values in a specific A1 range.
+// GetCells returns sheet values in a specific A1 range or named range.
 // Example: GET /api/v1/files/:id/cells?range=A1:D20&format=grid
 func (h *FileHandler) GetCells(c *gin.Context) {
-	userIDVal, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	file, role, ok := h.loadFileMeta(c, false)
+	if !ok {
 		return
 	}
-	userID := userIDVal.(uint)
-
-	idParam := c.Param("id")
-	id64, err := strconv.ParseUint(idParam, 10, 64)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+	q, ok := parseCellsQuery(c, file.State)
+	if !ok {
 		return
 	}
-	fileID := uint(id64)
 
-	rangeStr := c.Query("range")
-	if strings.TrimSpace(rangeStr) == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "range is required (e.g. A1:D20)"})
-		return
-	}
-	minRow, maxRow, minCol, maxCol, ok := a1RangeToBounds(rangeStr)
-	if !ok || minRow < 0 || minCol < 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range"})
+	// Only the cells inside the range are read.
+	if err := h.Service.LoadFileRange(file, q.sheet, services.CellRange{
+		MinRow: q.minRow, MaxRow: q.maxRow, MinCol: q.minCol, MaxCol: q.maxCol,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read cells"})
 		return
 	}
 
-	rows := maxRow - minRow + 1
-	cols := maxCol - minCol + 1
-	if rows <= 0 || cols <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range"})
-		return
-	}
-	if rows*cols > maxCellsReadGrid {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("range too large (max %d cells)", maxCellsReadGrid)})
-		return
-	}
+	c.Header("ETag", fileETag(file.Revision))
+	writeCells(c, q, file.ID, file.State, gin.H{"access_role": role, "revision": file.Revision})
+}
 
-	file, role, err := h.Service.GetFileAccess(userID, fileID)
+// writeCells renders the cells of state inside q as a grid or sparse list.
+// extra is merged into the response body.
+func writeCells(c *gin.Context, q cellsQuery, fileID uint, stateRaw json.RawMessage, extra gin.H) {
+	state, err := services.DecodeState(stateRaw)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
-		return
-	}
-
-	var state map[string]any
-	if err := json.Unmarshal(file.State, &state); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode file state"})
 		return
 	}
-	dataAny, _ := state["data"].(map[string]any)
-	if dataAny == nil {
-		dataAny = map[string]any{}
+	sheet, _, sheetName, err := services.LookupSheet(state, q.sheet)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		return
 	}
 
-	valueMode := strings.ToLower(strings.TrimSpace(c.Query("value")))
-	if valueMode == "" {
-		valueMode = "raw"
-	}
-	getValue := func(cellAny map[string]any) string {
-		if valueMode == "computed" {
-			if v := stateCellComputedValue(cellAny); strings.TrimSpace(v) != "" {
+	getValue := func(cell models.CellData) string {
+		if q.valueMode == "computed" {
+			if v := services.ComputedText(cell); strings.TrimSpace(v) != "" {
 				return v
 			}
 		}
-		return stateCellRawValue(cellAny)
+		return cell.Value
 	}
 
-	format := strings.ToLower(strings.TrimSpace(c.Query("format")))
-	if format == "" {
-		format = "grid"
+	resp := gin.H{
+		"file_id":    fileID,
+		"sheet":      sheetName,
+		"range":      q.rangeStr,
+		"start":      gin.H{"row": q.minRow, "col": q.minCol},
+		"end":        gin.H{"row": q.maxRow, "col": q.maxCol},
+		"format":     q.format,
+		"value_mode": q.valueMode,
+	}
+	if q.name != "" {
+		resp["name"] = q.name
+	}
+	for k, v := range extra {
+		resp[k] = v
 	}
 
-	if format == "sparse" {
+	if q.format == "sparse" {
 		type sparseCell struct {
 			Row   int    `json:"row"`
 			Col   int    `json:"col"`
@@ -206,11 +235,10 @@ func (h *FileHandler) GetCells(c *gin.Context) {
 		}
 
 		out := make([]sparseCell, 0, 64)
-		for r := minRow; r <= maxRow; r++ {
-			for col := minCol; col <= maxCol; col++ {
+		for r := q.minRow; r <= q.maxRow; r++ {
+			for col := q.minCol; col <= q.maxCol; col++ {
 				cellID := fmt.Sprintf("%d,%d", r, col)
-				cellAny, _ := dataAny[cellID].(map[string]any)
-				val := strings.TrimSpace(getValue(cellAny))
+				val := strings.TrimSpace(getValue(sheet.Data[cellID]))
 				if val == "" {
 					continue
 				}
@@ -218,42 +246,28 @@ func (h *FileHandler) GetCells(c *gin.Context) {
 			}
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"file_id":     file.ID,
-			"range":       strings.TrimSpace(rangeStr),
-			"start":       gin.H{"row": minRow, "col": minCol},
-			"end":         gin.H{"row": maxRow, "col": maxCol},
-			"format":      "sparse",
-			"value_mode":  valueMode,
-			"cells":       out,
-			"access_role": role,
-		})
+		resp["cells"] = out
+		c.JSON(http.StatusOK, resp)
 		return
 	}
 
+	rows := q.maxRow - q.minRow + 1
+	cols := q.maxCol - q.minCol + 1
 	values := make([][]string, rows)
 	for r := 0; r < rows; r++ {
-		rowIdx := minRow + r
+		rowIdx := q.minRow + r
 		rowVals := make([]string, cols)
 		for col := 0; col < cols; col++ {
-			colIdx := minCol + col
+			colIdx := q.minCol + col
 			cellID := fmt.Sprintf("%d,%d", rowIdx, colIdx)
-			cellAny, _ := dataAny[cellID].(map[string]any)
-			rowVals[col] = getValue(cellAny)
+			rowVals[col] = getValue(sheet.Data[cellID])
 		}
 		values[r] = rowVals
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"file_id":     file.ID,
-		"range":       strings.TrimSpace(rangeStr),
-		"start":       gin.H{"row": minRow, "col": minCol},
-		"end":         gin.H{"row": maxRow, "col": maxCol},
-		"format":      "grid",
-		"value_mode":  valueMode,
-		"values":      values,
-		"access_role": role,
-	})
+	resp["format"] = "grid"
+	resp["values"] = values
+	c.JSON(http.StatusOK, resp)
 }
 
 // GetSchema returns a lightweight schema description: used range, guessed header row and column headers.
@@ -279,14 +293,15 @@ func (h *FileHandler) GetSchema(c *gin.Context) {
 		return
 	}
 
-	var state map[string]any
-	if err := json.Unmarshal(file.State, &state); err != nil {
+	state, err := services.DecodeState(file.State)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode file state"})
 		return
 	}
-	dataAny, _ := state["data"].(map[string]any)
-	if dataAny == nil {
-		dataAny = map[string]any{}
+	sheet, _, sheetName, err := services.LookupSheet(state, c.Query("sheet"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		return
 	}
 
 	minRow := int(^uint(0) >> 1)
@@ -295,12 +310,8 @@ func (h *FileHandler) GetSchema(c *gin.Context) {
 	maxCol := -1
 
 	// Compute used range based on non-empty raw values.
-	for key, cell := range dataAny {
-		cellAny, ok := cell.(map[string]any)
-		if !ok {
-			continue
-		}
-		if strings.TrimSpace(stateCellRawValue(cellAny)) == "" {
+	for key, cell := range sheet.Data {
+		if strings.TrimSpace(cell.Value) == "" {
 			continue
 		}
 
@@ -332,6 +343,7 @@ func (h *FileHandler) GetSchema(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"file_id":     file.ID,
 			"name":        file.Name,
+			"sheet":       sheetName,
 			"used_range":  nil,
 			"header_row":  nil,
 			"columns":     []any{},
@@ -345,29 +357,16 @@ func (h *FileHandler) GetSchema(c *gin.Context) {
 	}
 
 	// Guess header row by scanning first few rows from minRow.
-	headerRow := minRow
-	bestScore := -1.0
+	lead := make([][]string, 0, 5)
 	for r := minRow; r <= minRow+4 && r <= maxRow; r++ {
-		nonEmpty := 0
-		textLike := 0
+		row := make([]string, 0, maxCol-minCol+1)
 		for col := minCol; col <= maxCol; col++ {
 			cellID := fmt.Sprintf("%d,%d", r, col)
-			cellAny, _ := dataAny[cellID].(map[string]any)
-			v := strings.TrimSpace(stateCellRawValue(cellAny))
-			if v == "" {
-				continue
-			}
-			nonEmpty++
-			if containsLetter(v) && !isNumericLike(v) {
-				textLike++
-			}
-		}
-		score := float64(nonEmpty) + float64(textLike)*0.25
-		if score > bestScore {
-			bestScore = score
-			headerRow = r
+			row = append(row, sheet.Data[cellID].Value)
 		}
+		lead = append(lead, row)
 	}
+	headerRow := minRow + services.DetectHeaderRow(lead)
 
 	columns := make([]gin.H, 0, maxCol-minCol+1)
 	categoryCandidates := make([]gin.H, 0, 4)
@@ -375,8 +374,7 @@ func (h *FileHandler) GetSchema(c *gin.Context) {
 
 	for col := minCol; col <= maxCol; col++ {
 		cellID := fmt.Sprintf("%d,%d", headerRow, col)
-		cellAny, _ := dataAny[cellID].(map[string]any)
-		header := strings.TrimSpace(stateCellRawValue(cellAny))
+		header := strings.TrimSpace(sheet.Data[cellID].Value)
 		label := colToLabel(col)
 		columns = append(columns, gin.H{
 			"col":    col,
@@ -403,6 +401,7 @@ func (h *FileHandler) GetSchema(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"file_id": file.ID,
 		"name":    file.Name,
+		"sheet":   sheetName,
 		"used_range": gin.H{
 			"min_row": minRow,
 			"max_row": maxRow,
@@ -418,3 +417,35 @@ func (h *FileHandler) GetSchema(c *gin.Context) {
 		"access_role": role,
 	})
 }
+
+// ListSheets returns the sheets of a workbook in order.
+func (h *FileHandler) ListSheets(c *gin.Context) {
+	file, role, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+
+	state, err := services.DecodeState(file.State)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode file state"})
+		return
+	}
+
+	names := services.StateSheetNames(state)
+	sheets := make([]gin.H, 0, len(names))
+	for i, sheet := range services.StateSheets(state) {
+		sheets = append(sheets, gin.H{
+			"index":     i,
+			"name":      names[i],
+			"row_count": sheet.RowCount,
+			"cells":     len(sheet.Data),
+		})
+	}
+
+	c.Header("ETag", fileETag(file.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":     file.ID,
+		"sheets":      sheets,
+		"access_role": role,
+	})
+}
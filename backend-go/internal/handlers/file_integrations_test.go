@@ -21,7 +21,7 @@ func setupFileHandlerTestDB(t *testing.T) *gorm.DB {
 	if err != nil {
 		t.Fatalf("failed to connect database: %v", err)
 	}
-	if err := db.AutoMigrate(&models.User{}, &models.SheetFile{}, &models.SheetFileShare{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.SheetFile{}, &models.SheetFileShare{}, &models.SheetFileVersion{}, &models.SheetFileBranch{}, &models.Job{}, &models.SheetCell{}, &models.SheetStyle{}); err != nil {
 		t.Fatalf("failed to migrate: %v", err)
 	}
 	return db
@@ -44,6 +44,92 @@ func Test_a1RangeToBounds(t *testing.T) {
 
 	_, _, _, _, ok = a1RangeToBounds("not-a-range")
 	assert.False(t, ok)
+
+	minR, maxR, minC, maxC, ok = a1RangeToBounds("Sheet1!A1:D20")
+	assert.True(t, ok)
+	assert.Equal(t, []int{0, 19, 0, 3}, []int{minR, maxR, minC, maxC})
+}
+
+func Test_splitSheetRef(t *testing.T) {
+	cases := []struct{ ref, sheet, rest string }{
+		{"A1:B2", "", "A1:B2"},
+		{"Sheet2!A1:B2", "Sheet2", "A1:B2"},
+		{"'Q2 2024'!C3", "Q2 2024", "C3"},
+		{"'Bob''s'!A1", "Bob's", "A1"},
+		{" Data ! B2 ", "Data", "B2"},
+	}
+	for _, tc := range cases {
+		sheet, rest := splitSheetRef(tc.ref)
+		assert.Equal(t, tc.sheet, sheet, tc.ref)
+		assert.Equal(t, tc.rest, rest, tc.ref)
+	}
+}
+
+func Test_FileHandler_Sheets(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	service := &services.SpreadsheetService{DB: db}
+	handler := NewFileHandler(service)
+
+	_, err := service.SaveFile(1, "Book", json.RawMessage(`{
+		"sheetName": "Summary",
+		"data": {"0,0": {"value": "=A2"}, "1,0": {"value": "7"}},
+		"rowCount": 100,
+		"sheets": [{"name": "Q2 2024", "data": {"0,0": {"value": "2"}, "0,1": {"value": "=A1*10"}}, "rowCount": 50}]
+	}`))
+	assert.NoError(t, err)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/sheets", handler.ListSheets)
+	router.GET("/files/:id/cells", handler.GetCells)
+	router.GET("/files/:id/schema", handler.GetSchema)
+	router.PATCH("/files/:id/cells", handler.PatchCells)
+
+	w := doJSON(router, "GET", "/files/1/sheets", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Sheets []struct {
+			Name     string `json:"name"`
+			RowCount int    `json:"row_count"`
+		} `json:"sheets"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Sheets, 2)
+	assert.Equal(t, "Summary", list.Sheets[0].Name)
+	assert.Equal(t, "Q2 2024", list.Sheets[1].Name)
+	assert.Equal(t, 50, list.Sheets[1].RowCount)
+
+	var grid struct {
+		Sheet  string     `json:"sheet"`
+		Values [][]string `json:"values"`
+	}
+	w = doJSON(router, "GET", "/files/1/cells?range='q2 2024'!A1:B1&value=computed", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grid))
+	assert.Equal(t, "Q2 2024", grid.Sheet)
+	assert.Equal(t, [][]string{{"2", "20"}}, grid.Values)
+
+	w = doJSON(router, "GET", "/files/1/cells?range=A1:A1&value=computed", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grid))
+	assert.Equal(t, "Summary", grid.Sheet)
+	assert.Equal(t, [][]string{{"7"}}, grid.Values)
+
+	assert.Equal(t, http.StatusNotFound, doJSON(router, "GET", "/files/1/cells?range=Nope!A1", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(router, "GET", "/files/1/schema?sheet=Nope", nil).Code)
+
+	w = doJSON(router, "PATCH", "/files/1/cells", gin.H{"edits": []gin.H{
+		{"cell": "'Q2 2024'!A1", "value": "3"},
+		{"cell": "A2", "value": "8"},
+	}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(router, "GET", "/files/1/cells?range='Q2 2024'!B1&value=computed", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grid))
+	assert.Equal(t, [][]string{{"30"}}, grid.Values)
+	w = doJSON(router, "GET", "/files/1/cells?range=Summary!A1&value=computed", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &grid))
+	assert.Equal(t, [][]string{{"8"}}, grid.Values)
+
+	w = doJSON(router, "PATCH", "/files/1/cells", gin.H{"sheet": "Nope", "edits": []gin.H{{"cell": "A1", "value": "1"}}})
+	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
 func Test_FileHandler_GetCells_Grid(t *testing.T) {
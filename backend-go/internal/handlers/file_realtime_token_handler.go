@@ -25,7 +25,7 @@ func (h *FileHandler) FileRealtimeToken(c *gin.Context) {
 	}
 	fileID := uint(fileID64)
 
-	_, role, err := h.Service.GetFileAccess(userID, fileID)
+	_, role, err := h.Service.GetFileMeta(userID, fileID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"converter-backend/internal/logger"
 	"converter-backend/internal/services"
 	"converter-backend/internal/utils"
-	"encoding/csv"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -38,25 +40,66 @@ func (h *Handler) Convert(c *gin.Context) {
 		return
 	}
 
+	csvOpts, ok := csvOptionsFromRequest(c)
+	if !ok {
+		return
+	}
+	if _, err := services.ParseConvertTarget(c.DefaultPostForm("target", c.Query("target"))); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": unsupportedTargetMessage})
+		return
+	}
+
 	// Process
-	rows, err := h.Service.ProcessAndSave(file, fileHeader.Filename)
+	wb, err := h.Service.ProcessAndSave(file, fileHeader.Filename, csvOpts)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process file: " + err.Error()})
 		return
 	}
+	defer wb.Close()
+
+	WriteConversion(c, wb, fileHeader.Filename)
+}
+
+var unsupportedTargetMessage = "unsupported target (use " + strings.Join(services.ConvertTargets, ", ") + ")"
+
+// WriteConversion answers a /convert request with one sheet of wb: the one
+// named by the "sheet" field or query (a name, or a 0-based index; default
+// the first) in the "target" format (default csv). X-Sheet-Names lists all
+// sheets of the upload.
+func WriteConversion(c *gin.Context, wb *services.WorkbookReader, filename string) {
+	target, err := services.ParseConvertTarget(c.DefaultPostForm("target", c.Query("target")))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": unsupportedTargetMessage})
+		return
+	}
+	index, err := wb.SheetIndex(c.DefaultPostForm("sheet", c.Query("sheet")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		return
+	}
+
+	sheetNames := make([]string, 0, len(wb.Sheets))
+	for _, name := range wb.Sheets {
+		sheetNames = append(sheetNames, url.QueryEscape(name))
+	}
 
-	// Response
 	c.Header("Content-Description", "File Transfer")
 	c.Header("Content-Transfer-Encoding", "binary")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", fileHeader.Filename))
-	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", filename, target))
+	c.Header("Content-Type", services.ConvertContentType(target))
 	c.Header("X-Db-Saved", "true")
+	c.Header("X-Sheet-Names", strings.Join(sheetNames, ","))
 
-	writer := csv.NewWriter(c.Writer)
-	for _, row := range rows {
-		if err := writer.Write(row); err != nil {
-			return
+	// Rows are streamed; once written, an error can only cut the response
+	// short.
+	if err := wb.Convert(index, target, c.Writer); err != nil {
+		logger.Error(fmt.Sprintf("Failed to convert %s to %s: %v", filename, target, err))
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			c.Writer.Header().Del("Content-Type")
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to convert file"})
 		}
+		return
 	}
-	writer.Flush()
+	logger.Info(fmt.Sprintf("Successfully converted file: %s (sheet %q to %s)", filename, wb.Sheets[index], target))
 }
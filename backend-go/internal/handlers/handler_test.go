@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Handler_ConvertTargets(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&models.SpreadsheetData{}))
+	handler := NewHandler(&services.SpreadsheetService{DB: db})
+	router := fileTestRouter(1)
+	router.POST("/convert", handler.Convert)
+
+	convert := func(query string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "fruit.csv")
+		_, _ = part.Write([]byte("Mahsulot;Soni\nOlma;3\n"))
+		_ = mw.Close()
+		req, _ := http.NewRequest("POST", "/convert"+query, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := convert("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Mahsulot,Soni\nOlma,3\n", w.Body.String())
+
+	w = convert("?target=json&sheet=0")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment; filename=fruit.csv.json", w.Header().Get("Content-Disposition"))
+	assert.JSONEq(t, `[{"Mahsulot": "Olma", "Soni": "3"}]`, w.Body.String())
+
+	w = convert("?target=xlsx")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "PK", w.Body.String()[:2])
+
+	assert.Equal(t, http.StatusBadRequest, convert("?target=pdf").Code)
+	assert.Equal(t, http.StatusNotFound, convert("?sheet=Q2").Code)
+}
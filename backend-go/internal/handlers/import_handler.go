@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"converter-backend/internal/logger"
+	"converter-backend/internal/services"
+	"converter-backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaxUploadSizeMB = 10
+
+func (h *FileHandler) maxUploadBytes() int64 {
+	limit := h.MaxUploadSizeMB
+	if limit <= 0 {
+		limit = defaultMaxUploadSizeMB
+	}
+	return limit * 1024 * 1024
+}
+
+// receiveUpload stores the multipart "file" field, of at most limit bytes,
+// in a temp file. The caller removes the returned path.
+func (h *FileHandler) receiveUpload(c *gin.Context, limit int64) (path, filename string, ok bool) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large. Maximum size is %dMB", limit/1024/1024)})
+			return "", "", false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return "", "", false
+	}
+	defer file.Close()
+
+	if err := utils.ValidateFile(file); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file type. Only Excel (.xlsx, .xls), OpenDocument (.ods) and CSV files are allowed"})
+		return "", "", false
+	}
+
+	filename = filepath.Base(header.Filename)
+	tmpFile, err := os.CreateTemp("", "upload-*"+strings.ToLower(filepath.Ext(filename)))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to create temp file: %v", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process file"})
+		return "", "", false
+	}
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.ReadFrom(file); err != nil {
+		os.Remove(tmpFile.Name())
+		logger.Error(fmt.Sprintf("Failed to save temp file: %v", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process file"})
+		return "", "", false
+	}
+	return tmpFile.Name(), filename, true
+}
+
+// csvOptionsFromRequest reads the delimiter, quote and encoding options of
+// an upload from its form or query and writes a 400 when they are invalid.
+func csvOptionsFromRequest(c *gin.Context) (services.CSVOptions, bool) {
+	field := func(key string) string {
+		return c.DefaultPostForm(key, c.Query(key))
+	}
+	opts, err := services.ParseCSVOptions(field("delimiter"), field("quote"), field("encoding"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return opts, false
+	}
+	return opts, true
+}
+
+// Import creates a new file from an uploaded XLSX or CSV. The optional form
+// field "name" names the file; it defaults to the upload's base name. CSV
+// uploads accept the options of csvOptionsFromRequest.
+func (h *FileHandler) Import(c *gin.Context) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	path, filename, ok := h.receiveUpload(c, h.maxUploadBytes())
+	if !ok {
+		return
+	}
+	defer os.Remove(path)
+
+	csvOpts, ok := csvOptionsFromRequest(c)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		name = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	if name == "" {
+		name = "Imported"
+	}
+
+	file, err := h.Service.ImportFile(userID, name, path, filename, csvOpts)
+	if err != nil {
+		if errors.Is(err, services.ErrUnsupportedFormat) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported file format (use .xlsx, .xls, .ods or .csv)"})
+			return
+		}
+		if errors.Is(err, services.ErrUnreadableFile) {
+			logger.Error(fmt.Sprintf("Failed to import %s: %v", filename, err))
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "failed to parse file"})
+			return
+		}
+		if errors.Is(err, services.ErrInvalidState) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+		return
+	}
+
+	var names []string
+	if state, err := services.DecodeState(file.State); err == nil {
+		names = services.StateSheetNames(state)
+	}
+
+	c.Header("ETag", fileETag(file.Revision))
+	c.JSON(http.StatusCreated, gin.H{
+		"id":       file.ID,
+		"name":     file.Name,
+		"sheets":   names,
+		"revision": file.Revision,
+	})
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"converter-backend/internal/services"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func doUpload(t *testing.T, h *FileHandler, filename, name string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	router := fileTestRouter(1)
+	router.POST("/files/import", h.Import)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", filename)
+	assert.NoError(t, err)
+	_, _ = part.Write(content)
+	if name != "" {
+		assert.NoError(t, mw.WriteField("name", name))
+	}
+	assert.NoError(t, mw.Close())
+
+	req, _ := http.NewRequest("POST", "/files/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func Test_FileHandler_Import(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	w := doUpload(t, handler, "sales.csv", "", []byte("item,qty\napple,3\npear,=B2*2\n"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	var resp struct {
+		ID     uint     `json:"id"`
+		Name   string   `json:"name"`
+		Sheets []string `json:"sheets"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "sales", resp.Name)
+	assert.Equal(t, []string{"Sheet1"}, resp.Sheets)
+
+	file, err := handler.Service.GetFile(1, resp.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), file.UserID)
+	var state struct {
+		Data map[string]map[string]any `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(file.State, &state))
+	assert.Equal(t, "apple", state.Data["1,0"]["value"])
+	assert.Equal(t, 6.0, state.Data["2,1"]["computed"])
+
+	w = doUpload(t, handler, "sales.csv", "Q1 sales", []byte("a,b\n"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"Q1 sales"`)
+
+	// Semicolon-separated Windows-1251 export from accounting software.
+	w = doUpload(t, handler, "kassa.csv", "", []byte("\xD1\xF3\xEC\xEC\xE0;\xC4\xE0\xF2\xE0\n100,5;01.02.2024\n"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	state.Data = nil
+	file, err = handler.Service.GetFile(1, resp.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(file.State, &state))
+	assert.Equal(t, "Сумма", state.Data["0,0"]["value"])
+	assert.Equal(t, "100,5", state.Data["1,0"]["value"])
+
+	router := fileTestRouter(1)
+	router.POST("/files/import", handler.Import)
+	req, _ := http.NewRequest("POST", "/files/import?delimiter=nope", bytes.NewReader(nil))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doUpload(t, handler, "notes.md", "", []byte("plain text"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w = doUpload(t, handler, "broken.xlsx", "", []byte("PK\x03\x04 not really a workbook"))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	handler.MaxUploadSizeMB = 1
+	w = doUpload(t, handler, "big.csv", "", bytes.Repeat([]byte("a,b\n"), 300*1024))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
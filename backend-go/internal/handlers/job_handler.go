@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"converter-backend/internal/logger"
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *FileHandler) maxJobUploadBytes() int64 {
+	if h.MaxJobUploadSizeMB > 0 {
+		return h.MaxJobUploadSizeMB * 1024 * 1024
+	}
+	return h.maxUploadBytes()
+}
+
+// CreateImportJob queues an upload for import in the background and answers
+// 202 with the job at once; GET /jobs/:id reports its progress. The form
+// takes the fields of Import plus "output": "file" (default) imports into
+// a new file, "csv" converts the first sheet to a CSV download.
+func (h *FileHandler) CreateImportJob(c *gin.Context) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	if h.Jobs == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "background jobs are disabled"})
+		return
+	}
+
+	path, filename, ok := h.receiveUpload(c, h.maxJobUploadBytes())
+	if !ok {
+		return
+	}
+	// EnqueueImport moves the upload away; this only cleans up failures.
+	defer os.Remove(path)
+
+	csvOpts, ok := csvOptionsFromRequest(c)
+	if !ok {
+		return
+	}
+	output := strings.ToLower(strings.TrimSpace(c.PostForm("output")))
+	if output != "" && output != services.JobOutputFile && output != services.JobOutputCSV {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "output must be file or csv"})
+		return
+	}
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		name = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	if name == "" {
+		name = "Imported"
+	}
+
+	job, err := h.Jobs.EnqueueImport(userID, name, path, filename, output, csvOpts)
+	if err != nil {
+		if errors.Is(err, services.ErrUnsupportedFormat) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported file format (use .xlsx, .xls, .ods or .csv)"})
+			return
+		}
+		logger.Error(fmt.Sprintf("Failed to queue import of %s: %v", filename, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to queue job"})
+		return
+	}
+
+	c.Header("Location", jobURL(c, job.ID))
+	c.JSON(http.StatusAccepted, jobResponse(c, job))
+}
+
+// GetJob reports the status and progress of a job of the current user.
+// Finished jobs link to their result: the new file and its export, or the
+// CSV download.
+func (h *FileHandler) GetJob(c *gin.Context) {
+	job, ok := h.loadJob(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, jobResponse(c, job))
+}
+
+// DownloadJobResult streams the CSV of a finished csv job.
+func (h *FileHandler) DownloadJobResult(c *gin.Context) {
+	job, ok := h.loadJob(c)
+	if !ok {
+		return
+	}
+	if job.Output != services.JobOutputCSV || job.Status != services.JobSucceeded || job.ResultPath == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "job has no download", "status": job.Status})
+		return
+	}
+	if _, err := os.Stat(job.ResultPath); err != nil {
+		c.JSON(http.StatusGone, gin.H{"error": "job result is no longer available"})
+		return
+	}
+
+	name := strings.TrimSuffix(job.Filename, filepath.Ext(job.Filename)) + ".csv"
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.File(job.ResultPath)
+}
+
+func (h *FileHandler) loadJob(c *gin.Context) (*models.Job, bool) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+	userID := userIDVal.(uint)
+
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	job, err := h.Service.GetJob(userID, uint(id64))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return nil, false
+	}
+	return job, true
+}
+
+// apiPrefix is the part of the matched route before /jobs, so links point
+// at the API version the client called.
+func apiPrefix(c *gin.Context) string {
+	route := c.FullPath()
+	if i := strings.Index(route, "/jobs"); i >= 0 {
+		return route[:i]
+	}
+	return ""
+}
+
+func jobURL(c *gin.Context, id uint) string {
+	return fmt.Sprintf("%s/jobs/%d", apiPrefix(c), id)
+}
+
+func jobResponse(c *gin.Context, job *models.Job) gin.H {
+	res := gin.H{
+		"id":             job.ID,
+		"status":         job.Status,
+		"output":         job.Output,
+		"name":           job.Name,
+		"filename":       job.Filename,
+		"rows_processed": job.RowsProcessed,
+		"attempts":       job.Attempts,
+		"created_at":     job.CreatedAt,
+		"updated_at":     job.UpdatedAt,
+		"url":            jobURL(c, job.ID),
+	}
+	if job.StartedAt != nil {
+		res["started_at"] = job.StartedAt
+	}
+	if job.FinishedAt != nil {
+		res["finished_at"] = job.FinishedAt
+	}
+	if job.Error != "" {
+		res["error"] = job.Error
+	}
+	if job.Status == services.JobSucceeded {
+		if job.FileID != nil {
+			res["file_id"] = *job.FileID
+			res["file_url"] = fmt.Sprintf("%s/files/%d", apiPrefix(c), *job.FileID)
+			res["download_url"] = fmt.Sprintf("%s/files/%d/export", apiPrefix(c), *job.FileID)
+		} else if job.Output == services.JobOutputCSV {
+			res["download_url"] = jobURL(c, job.ID) + "/download"
+		}
+	}
+	return res
+}
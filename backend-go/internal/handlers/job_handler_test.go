@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"converter-backend/internal/services"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHandler_ImportJob(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	// The in-memory database exists per connection; workers must share it.
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	service := &services.SpreadsheetService{DB: db}
+	handler := NewFileHandler(service)
+	router := fileTestRouter(1)
+	router.POST("/api/v1/jobs/import", handler.CreateImportJob)
+	router.GET("/api/v1/jobs/:id", handler.GetJob)
+	router.GET("/api/v1/jobs/:id/download", handler.DownloadJobResult)
+
+	submit := func(filename, output string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", filename)
+		_, _ = part.Write([]byte("name,qty\nOlma,3\n"))
+		if output != "" {
+			_ = mw.WriteField("output", output)
+		}
+		_ = mw.Close()
+		req, _ := http.NewRequest("POST", "/api/v1/jobs/import", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := submit("fruit.csv", "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "no queue configured")
+
+	queue, err := services.NewJobQueue(service, t.TempDir(), 1)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		queue.Wait()
+	}()
+	queue.Start(ctx)
+	handler.Jobs = queue
+
+	await := func(url string) map[string]any {
+		var job map[string]any
+		assert.Eventually(t, func() bool {
+			w := doJSON(router, "GET", url, nil)
+			if w.Code != http.StatusOK {
+				return false
+			}
+			job = nil
+			_ = json.Unmarshal(w.Body.Bytes(), &job)
+			return job["status"] == services.JobSucceeded || job["status"] == services.JobFailed
+		}, 5*time.Second, 20*time.Millisecond)
+		return job
+	}
+
+	w = submit("fruit.csv", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	location := w.Header().Get("Location")
+	assert.Regexp(t, `^/api/v1/jobs/\d+$`, location)
+
+	job := await(location)
+	assert.Equal(t, services.JobSucceeded, job["status"])
+	assert.EqualValues(t, 2, job["rows_processed"])
+	fileID := job["file_id"]
+	assert.NotNil(t, fileID)
+	assert.Equal(t, "/api/v1/files/"+jsonNumber(fileID)+"/export", job["download_url"])
+
+	w = submit("fruit.csv", "csv")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	job = await(w.Header().Get("Location"))
+	assert.Equal(t, services.JobSucceeded, job["status"])
+	assert.Nil(t, job["file_id"])
+	download := job["download_url"].(string)
+	w = doJSON(router, "GET", download, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "name,qty\nOlma,3\n", w.Body.String())
+
+	w = doJSON(router, "GET", location+"/download", nil)
+	assert.Equal(t, http.StatusConflict, w.Code, "file jobs have no CSV")
+
+	assert.Equal(t, http.StatusBadRequest, submit("fruit.csv", "pdf").Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, submit("notes.docx", "").Code)
+
+	other := fileTestRouter(2)
+	other.GET("/api/v1/jobs/:id", handler.GetJob)
+	assert.Equal(t, http.StatusNotFound, doJSON(other, "GET", location, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, doJSON(router, "GET", "/api/v1/jobs/x", nil).Code)
+}
+
+func jsonNumber(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
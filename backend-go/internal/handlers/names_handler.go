@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type namedRangeInput struct {
+	Name string `json:"name"`
+	Ref  string `json:"ref"` // "Sheet1!B2:B200"; without a sheet, the first one
+}
+
+// ListNames returns the named ranges of a file: GET /files/:id/names.
+// Names can be used wherever an A1 range is accepted, and follow their
+// cells when rows or columns are inserted, deleted or moved.
+func (h *FileHandler) ListNames(c *gin.Context) {
+	file, _, ok := h.loadFileMeta(c, false)
+	if !ok {
+		return
+	}
+
+	names := services.StateNames(file.State)
+	if names == nil {
+		names = []models.NamedRange{}
+	}
+	c.Header("ETag", fileETag(file.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":  file.ID,
+		"names":    names,
+		"revision": file.Revision,
+	})
+}
+
+// GetName returns one named range: GET /files/:id/names/:name.
+func (h *FileHandler) GetName(c *gin.Context) {
+	file, _, ok := h.loadFileMeta(c, false)
+	if !ok {
+		return
+	}
+
+	for _, named := range services.StateNames(file.State) {
+		if strings.EqualFold(named.Name, c.Param("name")) {
+			c.Header("ETag", fileETag(file.Revision))
+			c.JSON(http.StatusOK, named)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "name not found"})
+}
+
+// CreateName defines a named range: POST /files/:id/names with
+// {"name": "Revenue", "ref": "Sheet1!B2:B200"}.
+func (h *FileHandler) CreateName(c *gin.Context) {
+	h.defineName(c, "")
+}
+
+// UpdateName points a named range at another range, or renames it:
+// PUT /files/:id/names/:name with {"ref": "Sheet1!B2:B300"}. A missing
+// "name" keeps the current one.
+func (h *FileHandler) UpdateName(c *gin.Context) {
+	h.defineName(c, c.Param("name"))
+}
+
+// defineName serves CreateName and, with the name to replace, UpdateName.
+func (h *FileHandler) defineName(c *gin.Context, replace string) {
+	file, _, ok := h.loadFileMeta(c, true)
+	if !ok {
+		return
+	}
+	var input namedRangeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Name == "" {
+		input.Name = replace
+	}
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
+		return
+	}
+
+	updated, named, err := h.Service.DefineName(file.ID, models.NamedRange{Name: input.Name, Ref: input.Ref}, replace, ifMatch...)
+	if err != nil {
+		respondNameError(c, err, "failed to save name")
+		return
+	}
+
+	status := http.StatusOK
+	if replace == "" {
+		status = http.StatusCreated
+	}
+	c.Header("ETag", fileETag(updated.Revision))
+	c.JSON(status, gin.H{
+		"name":     named.Name,
+		"ref":      named.Ref,
+		"revision": updated.Revision,
+	})
+}
+
+// DeleteName removes a named range: DELETE /files/:id/names/:name. Cells
+// are not touched.
+func (h *FileHandler) DeleteName(c *gin.Context) {
+	file, _, ok := h.loadFileMeta(c, true)
+	if !ok {
+		return
+	}
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
+		return
+	}
+
+	updated, err := h.Service.DeleteName(file.ID, c.Param("name"), ifMatch...)
+	if err != nil {
+		respondNameError(c, err, "failed to delete name")
+		return
+	}
+
+	c.Header("ETag", fileETag(updated.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "name deleted",
+		"revision": updated.Revision,
+	})
+}
+
+func respondNameError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+	case errors.Is(err, services.ErrRevisionMismatch):
+		respondRevisionMismatch(c)
+	case errors.Is(err, services.ErrNameNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "name not found"})
+	case errors.Is(err, services.ErrNameExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "name already exists"})
+	case errors.Is(err, services.ErrSheetNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+	case errors.Is(err, services.ErrInvalidName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
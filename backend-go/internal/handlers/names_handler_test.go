@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/xuri/excelize/v2"
+)
+
+func Test_FileHandler_Names(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	state := `{
+		"data": {
+			"0,0": {"value": "Oy"}, "0,1": {"value": "Tushum"},
+			"1,0": {"value": "Yan"}, "1,1": {"value": "100"},
+			"2,0": {"value": "Fev"}, "2,1": {"value": "150"},
+			"4,0": {"value": "Soliq"}, "4,1": {"value": "0.12"}
+		},
+		"sheets": [{"name": "Q 2", "data": {"0,0": {"value": "x"}}}]
+	}`
+	file := models.SheetFile{UserID: 1, Name: "Budget", State: json.RawMessage(state)}
+	assert.NoError(t, db.Create(&file).Error)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/names", handler.ListNames)
+	router.POST("/files/:id/names", handler.CreateName)
+	router.GET("/files/:id/names/:name", handler.GetName)
+	router.PUT("/files/:id/names/:name", handler.UpdateName)
+	router.DELETE("/files/:id/names/:name", handler.DeleteName)
+	router.GET("/files/:id/cells", handler.GetCells)
+	router.PATCH("/files/:id/cells", handler.PatchCells)
+	router.POST("/files/:id/structure", handler.ApplyStructure)
+	router.PATCH("/files/:id/ranges/:a1/style", handler.PatchRangeStyle)
+	router.GET("/files/:id/export", handler.Export)
+	router.POST("/files", handler.Save)
+	base := "/files/" + jsonNumber(file.ID)
+	decode := func(w interface{ Bytes() []byte }) map[string]any {
+		var out map[string]any
+		_ = json.Unmarshal(w.Bytes(), &out)
+		return out
+	}
+	grid := func(ref string) (int, map[string]any) {
+		w := doJSON(router, "GET", base+"/cells?range="+ref, nil)
+		return w.Code, decode(w.Body)
+	}
+
+	w := doJSON(router, "POST", base+"/names", gin.H{"name": "Revenue", "ref": "$B$2:B3"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, map[string]any{"name": "Revenue", "ref": "Sheet1!B2:B3", "revision": float64(2)}, decode(w.Body))
+	w = doJSON(router, "POST", base+"/names", gin.H{"name": "Tax", "ref": "Sheet1!B5"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = doJSON(router, "POST", base+"/names", gin.H{"name": "Other", "ref": "'q 2'!A1:A3"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "'Q 2'!A1:A3", decode(w.Body)["ref"])
+
+	for _, bad := range []struct {
+		body gin.H
+		code int
+	}{
+		{gin.H{"name": "revenue", "ref": "C1"}, http.StatusConflict},
+		{gin.H{"name": "B2", "ref": "C1"}, http.StatusBadRequest},
+		{gin.H{"name": "R1C1", "ref": "C1"}, http.StatusBadRequest},
+		{gin.H{"name": "2024", "ref": "C1"}, http.StatusBadRequest},
+		{gin.H{"name": "Costs", "ref": "C1:nowhere"}, http.StatusBadRequest},
+		{gin.H{"name": "Costs", "ref": "Nope!C1"}, http.StatusNotFound},
+	} {
+		w = doJSON(router, "POST", base+"/names", bad.body)
+		assert.Equal(t, bad.code, w.Code, bad.body)
+	}
+
+	w = doJSON(router, "GET", base+"/names", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"4"`, w.Header().Get("ETag"))
+	assert.Len(t, decode(w.Body)["names"], 3)
+	w = doJSON(router, "GET", base+"/names/REVENUE", nil)
+	assert.Equal(t, map[string]any{"name": "Revenue", "ref": "Sheet1!B2:B3"}, decode(w.Body))
+
+	// A name reads like the range it stands for.
+	code, body := grid("Revenue")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Revenue", body["name"])
+	assert.Equal(t, "Sheet1!B2:B3", body["range"])
+	assert.Equal(t, []any{[]any{"100"}, []any{"150"}}, body["values"])
+
+	// Inserting a column in front of the table moves the names with it.
+	w = doJSON(router, "POST", base+"/structure", gin.H{"op": "insert", "dimension": "columns", "index": 1})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(router, "GET", base+"/names/Revenue", nil)
+	assert.Equal(t, "Sheet1!C2:C3", decode(w.Body)["ref"])
+	_, body = grid("Revenue")
+	assert.Equal(t, []any{[]any{"100"}, []any{"150"}}, body["values"])
+	w = doJSON(router, "GET", base+"/names/Other", nil)
+	assert.Equal(t, "'Q 2'!A1:A3", decode(w.Body)["ref"], "names on other sheets stay")
+
+	// One-cell names are cells for PatchCells; ranges are not.
+	w = doJSON(router, "PATCH", base+"/cells", gin.H{"edits": []gin.H{{"cell": "tax", "value": "0.15"}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, body = grid("Tax")
+	assert.Equal(t, []any{[]any{"0.15"}}, body["values"])
+	w = doJSON(router, "PATCH", base+"/cells", gin.H{"edits": []gin.H{{"cell": "Revenue", "value": "1"}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doJSON(router, "PATCH", base+"/ranges/Revenue/style", gin.H{"style": gin.H{"bold": true}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	f, err := handler.Service.GetFile(1, file.ID)
+	assert.NoError(t, err)
+	var stored struct {
+		Data map[string]models.CellData `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(f.State, &stored))
+	assert.NotNil(t, stored.Data["2,2"].Style)
+	assert.Nil(t, stored.Data["0,2"].Style)
+
+	w = doJSON(router, "GET", base+"/export?format=csv&range=Revenue", nil)
+	assert.Equal(t, "100\n150\n", w.Body.String())
+	w = doJSON(router, "GET", base+"/export?format=xlsx", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	xlsx, err := excelize.OpenReader(bytes.NewReader(w.Body.Bytes()))
+	assert.NoError(t, err)
+	refs := map[string]string{}
+	for _, dn := range xlsx.GetDefinedName() {
+		refs[dn.Name] = dn.RefersTo
+	}
+	assert.Equal(t, "'Sheet1'!$C$2:$C$3", refs["Revenue"])
+	assert.Equal(t, "'Q 2'!$A$1:$A$3", refs["Other"])
+
+	// A client saving the editor state without names keeps them; one
+	// sending broken names is turned away.
+	w = doJSON(router, "POST", "/files", gin.H{"id": file.ID, "name": "Budget", "state": gin.H{"data": gin.H{}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(router, "GET", base+"/names", nil)
+	assert.Len(t, decode(w.Body)["names"], 3)
+	w = doJSON(router, "POST", "/files", gin.H{"id": file.ID, "name": "Budget", "state": gin.H{"data": gin.H{}, "names": []gin.H{{"name": "A1", "ref": "Sheet1!A1"}}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, decode(w.Body)["error"], "names.0.name")
+
+	w = doJSON(router, "PUT", base+"/names/Revenue", gin.H{"name": "Sales", "ref": "C2:C4"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Sheet1!C2:C4", decode(w.Body)["ref"])
+	w = doJSON(router, "PUT", base+"/names/Revenue", gin.H{"ref": "C2"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doJSON(router, "PUT", base+"/names/Sales", gin.H{"name": "Tax", "ref": "C2"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Deleting the rows of a name leaves it pointing at #REF!.
+	w = doJSON(router, "POST", base+"/structure", gin.H{"op": "delete", "dimension": "rows", "index": 5})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(router, "GET", base+"/names/Tax", nil)
+	assert.Equal(t, "Sheet1!#REF!", decode(w.Body)["ref"])
+	code, body = grid("Tax")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body["error"], "deleted")
+
+	w = doJSON(router, "DELETE", base+"/names/Sales", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	code, _ = grid("Sales")
+	assert.Equal(t, http.StatusBadRequest, code)
+	w = doJSON(router, "DELETE", base+"/names/Sales", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req, _ := http.NewRequest("DELETE", base+"/names/Other", nil)
+	req.Header.Set("If-Match", `"1"`)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	viewer := fileTestRouter(2)
+	viewer.GET("/files/:id/names", handler.ListNames)
+	viewer.POST("/files/:id/names", handler.CreateName)
+	w = doJSON(viewer, "GET", base+"/names", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(viewer, "POST", base+"/names", gin.H{"name": "Mine", "ref": "A1"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type rangeOpInput struct {
+	Op     string `json:"op"`
+	To     string `json:"to"`     // copy, move: top-left cell of the destination
+	Clear  string `json:"clear"`  // clear: "all" (default), "values" or "styles"
+	Column string `json:"column"` // sort: column letter inside the range
+	Desc   bool   `json:"desc"`
+	Header bool   `json:"header"`
+	// style: merged into the style of each cell, or replacing it.
+	Style        map[string]any `json:"style"`
+	ReplaceStyle bool           `json:"replaceStyle"`
+}
+
+// ApplyRangeOp runs an operation on a range of cells:
+// POST /files/:id/ranges/:a1/ops with {"op": "copy", "to": "F1"}.
+//
+// op is one of copy, move, fill_down, fill_right, clear, sort and style. The
+// range may name its sheet ("Q2!A1:C10") or be a named range; otherwise
+// ?sheet= or the first sheet is used. All edits of the operation are applied, recalculated and
+// versioned at once, and realtime clients get them as one batch.
+func (h *FileHandler) ApplyRangeOp(c *gin.Context) {
+	h.applyRangeOp(c, "")
+}
+
+// PatchRangeStyle styles every cell of a range:
+// PATCH /files/:id/ranges/:a1/style with {"style": {"bold": true}}.
+// The style is merged into each cell's style, null removing a field, or
+// replaces it with "replaceStyle": true.
+func (h *FileHandler) PatchRangeStyle(c *gin.Context) {
+	h.applyRangeOp(c, services.RangeStyle)
+}
+
+// applyRangeOp serves the range endpoints; a non-empty op overrides the
+// one in the body.
+func (h *FileHandler) applyRangeOp(c *gin.Context, forceOp string) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+
+	ref, ok := resolveRangeName(c, file.State, c.Param("a1"))
+	if !ok {
+		return
+	}
+	sheet, _ := splitSheetRef(ref)
+	if sheet == "" {
+		sheet = c.Query("sheet")
+	}
+	minRow, maxRow, minCol, maxCol, ok := a1RangeToBounds(ref)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range"})
+		return
+	}
+
+	var input rangeOpInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if forceOp != "" {
+		input.Op = forceOp
+	}
+	op := services.RangeOp{
+		Op:           input.Op,
+		Sheet:        sheet,
+		Range:        services.CellRange{MinRow: minRow, MaxRow: maxRow, MinCol: minCol, MaxCol: maxCol},
+		Clear:        input.Clear,
+		Desc:         input.Desc,
+		Header:       input.Header,
+		Style:        input.Style,
+		ReplaceStyle: input.ReplaceStyle,
+	}
+	switch input.Op {
+	case services.RangeCopy, services.RangeMove:
+		if op.ToRow, op.ToCol, ok = a1ToRowCol(input.To); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a cell such as F1"})
+			return
+		}
+	case services.RangeSort:
+		column := strings.TrimSpace(input.Column)
+		if _, op.SortCol, ok = a1ToRowCol(column + "1"); !ok || strings.ContainsAny(column, "0123456789") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "column must be a column letter such as B"})
+			return
+		}
+	}
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
+		return
+	}
+
+	updated, edits, err := h.Service.ApplyRangeOp(file.ID, op, ifMatch...)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		case errors.Is(err, services.ErrRevisionMismatch):
+			respondRevisionMismatch(c)
+		case errors.Is(err, services.ErrSheetNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		case errors.Is(err, services.ErrInvalidRangeOp), errors.Is(err, services.ErrInvalidState):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply range operation"})
+		}
+		return
+	}
+
+	if len(edits) > 0 {
+		go notifyRealtimeBatchEdits(updated.ID, firstSheetEdits(updated.State, edits))
+	}
+
+	c.Header("ETag", fileETag(updated.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"id":       updated.ID,
+		"updated":  len(edits),
+		"revision": updated.Revision,
+	})
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHandler_ApplyRangeOp(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	state := `{"data": {
+		"0,0": {"value": "Item"}, "0,1": {"value": "Qty"}, "0,2": {"value": "Total"},
+		"1,0": {"value": "Olma", "style": {"bold": true}}, "1,1": {"value": "3"}, "1,2": {"value": "=B2*2"},
+		"2,0": {"value": "Nok"}, "2,1": {"value": "1"}, "2,2": {"value": "=B3*2"},
+		"3,0": {"value": "Anor"}, "3,1": {"value": "2"},
+		"5,0": {"value": "1"}, "6,0": {"value": "1.5"},
+		"5,1": {"value": "2024-01-15"}, "6,1": {"value": "2024-02-15"},
+		"5,2": {"value": "=A6"},
+		"9,0": {"value": "=C2+C3"}
+	}}`
+	file := models.SheetFile{UserID: 1, Name: "Stock", State: json.RawMessage(state)}
+	assert.NoError(t, db.Create(&file).Error)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	router := fileTestRouter(1)
+	router.POST("/files/:id/ranges/:a1/ops", handler.ApplyRangeOp)
+	router.PATCH("/files/:id/ranges/:a1/style", handler.PatchRangeStyle)
+	run := func(a1 string, body gin.H) (int, map[string]any) {
+		w := doJSON(router, "POST", "/files/"+jsonNumber(file.ID)+"/ranges/"+url.PathEscape(a1)+"/ops", body)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	cells := func(ids ...string) map[string]any {
+		f, err := handler.Service.GetFile(1, file.ID)
+		assert.NoError(t, err)
+		var decoded struct {
+			Data map[string]map[string]any `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(f.State, &decoded))
+		out := map[string]any{}
+		for _, id := range ids {
+			if cell, ok := decoded.Data[id]; ok {
+				out[id] = cell
+			} else {
+				out[id] = nil
+			}
+		}
+		return out
+	}
+	valuesOf := func(ids ...string) []any {
+		var out []any
+		for _, id := range ids {
+			cell, _ := cells(id)[id].(map[string]any)
+			out = append(out, cell["value"])
+		}
+		return out
+	}
+
+	// Rows 2..3 of the table copied to E2: formulas follow, styles come along.
+	code, body := run("A2:C3", gin.H{"op": "copy", "to": "E2"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 6, body["updated"])
+	assert.Equal(t, []any{"Olma", "=F2*2", "=F3*2"}, valuesOf("1,4", "1,6", "2,6"))
+	assert.Equal(t, map[string]any{"bold": true}, cells("1,4")["1,4"].(map[string]any)["style"])
+	assert.EqualValues(t, 6, cells("1,6")["1,6"].(map[string]any)["computed"])
+
+	// Moving column C of the table keeps its formulas and repoints A10.
+	code, _ = run("C2:C3", gin.H{"op": "move", "to": "D2"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{"=B2*2", "=B3*2", "=D2+D3"}, valuesOf("1,3", "2,3", "9,0"))
+	assert.Nil(t, cells("1,2")["1,2"])
+
+	// Numbers and months continue as series; a formula repeats.
+	code, _ = run("A6:C9", gin.H{"op": "fill_down"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{"2", "2.5"}, valuesOf("7,0", "8,0"))
+	assert.Equal(t, []any{"2024-03-15", "2024-04-15"}, valuesOf("7,1", "8,1"))
+	assert.Equal(t, []any{"=A7", "=A8", "=A9"}, valuesOf("6,2", "7,2", "8,2"))
+
+	code, _ = run("A6:A7", gin.H{"op": "fill_right"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{"1", "1.5"}, valuesOf("5,0", "6,0"), "one cell wide ranges have nothing to fill")
+
+	// Sort the table by Qty, largest first, keeping the header.
+	code, _ = run("A1:B4", gin.H{"op": "sort", "column": "B", "desc": true, "header": true})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []any{"Item", "Olma", "Anor", "Nok"}, valuesOf("0,0", "1,0", "2,0", "3,0"))
+	assert.Equal(t, []any{"3", "2", "1"}, valuesOf("1,1", "2,1", "3,1"))
+	assert.Equal(t, map[string]any{"bold": true}, cells("1,0")["1,0"].(map[string]any)["style"])
+
+	code, _ = run("Sheet1!A2:A2", gin.H{"op": "clear", "clear": "styles"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"value": "Olma", "computed": "Olma"}, cells("1,0")["1,0"])
+	code, _ = run("E2:G3", gin.H{"op": "clear"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"1,4": nil, "2,6": nil}, cells("1,4", "2,6"))
+
+	// Highlight the header row and the empty cell after it, then take the
+	// bold off again.
+	w := doJSON(router, "PATCH", "/files/"+jsonNumber(file.ID)+"/ranges/A1:D1/style", gin.H{"style": gin.H{"bold": true, "backgroundColor": "#fff3bf"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	code, _ = run("A1:B1", gin.H{"op": "style", "style": gin.H{"bold": nil}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{
+		"0,0": map[string]any{"value": "Item", "computed": "Item", "style": map[string]any{"backgroundColor": "#fff3bf"}},
+		"0,1": map[string]any{"value": "Qty", "computed": "Qty", "style": map[string]any{"backgroundColor": "#fff3bf"}},
+		"0,3": map[string]any{"value": "", "style": map[string]any{"bold": true, "backgroundColor": "#fff3bf"}},
+	}, cells("0,0", "0,1", "0,3"))
+	w = doJSON(router, "PATCH", "/files/"+jsonNumber(file.ID)+"/ranges/A1:C1/style", gin.H{"style": gin.H{"wrapMode": "shrink"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	for a1, bad := range map[string]gin.H{
+		"A1:B2":   {"op": "rotate"},
+		"B1:C2":   {"op": "copy", "to": "nowhere"},
+		"A1:B3":   {"op": "sort", "column": "C"},
+		"A1:C3":   {"op": "clear", "clear": "formats"},
+		"A1:ZZ99": {"op": "copy", "to": "A1048570"},
+		"1:2":     {"op": "clear"},
+		"A1:A2":   {"op": "style"},
+		"A1:A3":   {"op": "style", "style": gin.H{"bold": nil}, "replaceStyle": true},
+	} {
+		code, _ = run(a1, bad)
+		assert.Equal(t, http.StatusBadRequest, code, a1)
+	}
+	code, _ = run("Nope!A1:B2", gin.H{"op": "clear"})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	viewer := fileTestRouter(2)
+	viewer.POST("/files/:id/ranges/:a1/ops", handler.ApplyRangeOp)
+	w = doJSON(viewer, "POST", "/files/"+jsonNumber(file.ID)+"/ranges/A1/ops", gin.H{"op": "clear"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
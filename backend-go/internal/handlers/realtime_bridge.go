@@ -14,10 +14,14 @@ import (
 	"converter-backend/internal/services"
 )
 
+// realtimeInternalCellEdit is one cell of a batch. Value is left out when
+// only the style changed; Style, when set, is the cell's whole style and
+// an empty one clears it.
 type realtimeInternalCellEdit struct {
-	Row   int    `json:"row"`
-	Col   int    `json:"col"`
-	Value string `json:"value"`
+	Row   int            `json:"row"`
+	Col   int            `json:"col"`
+	Value *string        `json:"value,omitempty"`
+	Style map[string]any `json:"style"`
 }
 
 type realtimeInternalBatchEditRequest struct {
@@ -25,6 +29,50 @@ type realtimeInternalBatchEditRequest struct {
 }
 
 func notifyRealtimeBatchEdits(sheetID uint, edits []services.CellEdit) {
+	payload := realtimeInternalBatchEditRequest{Edits: make([]realtimeInternalCellEdit, 0, len(edits))}
+	for _, edit := range edits {
+		if edit.Row < 0 || edit.Col < 0 {
+			continue
+		}
+		cell := realtimeInternalCellEdit{Row: edit.Row, Col: edit.Col, Style: edit.Style}
+		if !edit.StyleOnly {
+			cell.Value = &edit.Value
+		}
+		payload.Edits = append(payload.Edits, cell)
+	}
+
+	if len(payload.Edits) == 0 {
+		return
+	}
+
+	postRealtime(fmt.Sprintf("/spreadsheets/%d/batch_edit", sheetID), payload)
+}
+
+// realtimeInternalStructureRequest tells the realtime service that rows or
+// columns of the first sheet moved, so it can shift its cells and clients.
+type realtimeInternalStructureRequest struct {
+	Op        string `json:"op"`
+	Dimension string `json:"dimension"`
+	Index     int    `json:"index"`
+	Count     int    `json:"count"`
+	To        int    `json:"to"`
+	Revision  int64  `json:"revision"`
+}
+
+func notifyRealtimeStructure(sheetID uint, op services.StructureOp, revision int64) {
+	postRealtime(fmt.Sprintf("/spreadsheets/%d/structure", sheetID), realtimeInternalStructureRequest{
+		Op:        op.Op,
+		Dimension: op.Dimension,
+		Index:     op.Index,
+		Count:     op.Count,
+		To:        op.To,
+		Revision:  revision,
+	})
+}
+
+// postRealtime sends a payload to an internal endpoint of the realtime
+// service. It is a no-op unless REALTIME_INTERNAL_URL and a secret are set.
+func postRealtime(path string, payload any) {
 	baseURL := strings.TrimRight(os.Getenv("REALTIME_INTERNAL_URL"), "/")
 	if baseURL == "" {
 		return
@@ -38,28 +86,16 @@ func notifyRealtimeBatchEdits(sheetID uint, edits []services.CellEdit) {
 		return
 	}
 
-	payload := realtimeInternalBatchEditRequest{Edits: make([]realtimeInternalCellEdit, 0, len(edits))}
-	for _, edit := range edits {
-		if edit.Row < 0 || edit.Col < 0 {
-			continue
-		}
-		payload.Edits = append(payload.Edits, realtimeInternalCellEdit{Row: edit.Row, Col: edit.Col, Value: edit.Value})
-	}
-
-	if len(payload.Edits) == 0 {
-		return
-	}
-
 	body, err := json.Marshal(payload)
 	if err != nil {
-		logger.Warn("realtime bridge: failed to marshal edits:", err)
+		logger.Warn("realtime bridge: failed to marshal payload:", err)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	url := fmt.Sprintf("%s/spreadsheets/%d/batch_edit", baseURL, sheetID)
+	url := baseURL + path
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		logger.Warn("realtime bridge: failed to create request:", err)
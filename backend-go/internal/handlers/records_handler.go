@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRecordsLimit = 100
+	maxRecordsLimit     = 1000
+)
+
+// recordRowKey carries the 1-based sheet row of a record.
+const recordRowKey = "_row"
+
+// GetRecords reads a sheet as records keyed by its header row:
+// GET /files/:id/records?sheet=&fields=Name,Amount&limit=100&cursor=
+//
+// Values are typed (number, bool, date as YYYY-MM-DD, string; null when
+// empty) and every record carries its sheet row in "_row". Pages continue
+// after "next_cursor".
+func (h *FileHandler) GetRecords(c *gin.Context) {
+	file, role, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+
+	limit := defaultRecordsLimit
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, maxRecordsLimit)
+	}
+	cursor := 0
+	if raw := strings.TrimSpace(c.Query("cursor")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		cursor = n
+	}
+
+	state, err := services.DecodeState(file.State)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode file state"})
+		return
+	}
+	sheet, _, sheetName, err := services.LookupSheet(state, c.Query("sheet"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		return
+	}
+
+	resp := gin.H{
+		"file_id":     file.ID,
+		"sheet":       sheetName,
+		"revision":    file.Revision,
+		"access_role": role,
+	}
+	c.Header("ETag", fileETag(file.Revision))
+
+	table := services.NewSheetTable(sheet)
+	if table == nil {
+		resp["header_row"] = nil
+		resp["fields"] = []any{}
+		resp["records"] = []any{}
+		resp["next_cursor"] = nil
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	columns, ok := projectFields(c, table)
+	if !ok {
+		return
+	}
+
+	rows := table.RecordRows()
+	types := table.FieldTypes(rows)
+	fields := make([]gin.H, 0, len(columns))
+	for _, col := range columns {
+		i := col - table.MinCol
+		fields = append(fields, gin.H{"name": table.Fields[i], "col": colToLabel(col), "type": types[i]})
+	}
+
+	// The cursor is the 1-based row of the last record sent, so the page
+	// starts at the first 0-based row index >= cursor.
+	start := sort.SearchInts(rows, cursor)
+	end := min(start+limit, len(rows))
+	records := make([]gin.H, 0, end-start)
+	for _, row := range rows[start:end] {
+		record := gin.H{recordRowKey: row + 1}
+		for _, col := range columns {
+			record[table.Fields[col-table.MinCol]] = table.Value(row, col)
+		}
+		records = append(records, record)
+	}
+
+	resp["header_row"] = table.HeaderRow + 1
+	resp["fields"] = fields
+	resp["records"] = records
+	resp["total"] = len(rows)
+	resp["next_cursor"] = nil
+	if end < len(rows) {
+		resp["next_cursor"] = rows[end-1] + 1
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// projectFields resolves ?fields=A,B to columns; without it every field is
+// returned. It writes a 400 for unknown fields.
+func projectFields(c *gin.Context, table *services.SheetTable) ([]int, bool) {
+	raw := strings.TrimSpace(c.Query("fields"))
+	if raw == "" {
+		columns := make([]int, 0, len(table.Fields))
+		for col := table.MinCol; col <= table.MaxCol; col++ {
+			columns = append(columns, col)
+		}
+		return columns, true
+	}
+
+	var columns []int
+	for _, name := range strings.Split(raw, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		col, ok := table.Field(name)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown field: " + strings.TrimSpace(name), "fields": table.Fields})
+			return nil, false
+		}
+		columns = append(columns, col)
+	}
+	return columns, true
+}
+
+// maxRecordsWrite limits the records of one write request.
+const maxRecordsWrite = 1000
+
+type recordsInput struct {
+	Records []services.Record `json:"records"`
+}
+
+// parseRecordsInput reads {"records": [...]} and writes a 400 on failure.
+func parseRecordsInput(c *gin.Context) ([]services.Record, bool) {
+	var input recordsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if len(input.Records) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "records is required"})
+		return nil, false
+	}
+	if len(input.Records) > maxRecordsWrite {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("too many records (max %d)", maxRecordsWrite)})
+		return nil, false
+	}
+	return input.Records, true
+}
+
+// recordsKey reads the required ?key= field name.
+func recordsKey(c *gin.Context) (string, bool) {
+	key := strings.TrimSpace(c.Query("key"))
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "key is required (a header name, e.g. key=OrderID)"})
+		return "", false
+	}
+	return key, true
+}
+
+// AppendRecords adds records after the last used row of a sheet:
+// POST /files/:id/records?sheet= with {"records": [{"OrderID": 7, ...}]}.
+// The row is chosen under the file's lock, so concurrent appends never
+// overwrite each other. An empty sheet gets a header row from the first
+// record's keys.
+func (h *FileHandler) AppendRecords(c *gin.Context) {
+	records, ok := parseRecordsInput(c)
+	if !ok {
+		return
+	}
+	h.writeRecords(c, func(fileID uint, sheet string, ifMatch []int64) (*models.SheetFile, []services.CellEdit, []services.RecordResult, error) {
+		return h.Service.AppendRecords(fileID, sheet, records, ifMatch...)
+	})
+}
+
+// UpsertRecords updates the rows whose ?key= field matches each record and
+// appends the others: PUT /files/:id/records?key=OrderID.
+func (h *FileHandler) UpsertRecords(c *gin.Context) {
+	key, ok := recordsKey(c)
+	if !ok {
+		return
+	}
+	records, ok := parseRecordsInput(c)
+	if !ok {
+		return
+	}
+	h.writeRecords(c, func(fileID uint, sheet string, ifMatch []int64) (*models.SheetFile, []services.CellEdit, []services.RecordResult, error) {
+		return h.Service.UpsertRecords(fileID, sheet, key, records, ifMatch...)
+	})
+}
+
+// DeleteRecords clears the rows whose ?key= field equals one of the
+// ?value= parameters: DELETE /files/:id/records?key=OrderID&value=7&value=9.
+func (h *FileHandler) DeleteRecords(c *gin.Context) {
+	key, ok := recordsKey(c)
+	if !ok {
+		return
+	}
+	values := c.QueryArray("value")
+	if len(values) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value is required"})
+		return
+	}
+	h.writeRecords(c, func(fileID uint, sheet string, ifMatch []int64) (*models.SheetFile, []services.CellEdit, []services.RecordResult, error) {
+		return h.Service.DeleteRecords(fileID, sheet, key, values, ifMatch...)
+	})
+}
+
+type recordsWrite func(fileID uint, sheet string, ifMatch []int64) (*models.SheetFile, []services.CellEdit, []services.RecordResult, error)
+
+// writeRecords runs a record write with the checks and realtime
+// notification of PatchCells.
+func (h *FileHandler) writeRecords(c *gin.Context, write recordsWrite) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
+		return
+	}
+
+	updated, edits, results, err := write(file.ID, c.Query("sheet"), ifMatch)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		case errors.Is(err, services.ErrRevisionMismatch):
+			respondRevisionMismatch(c)
+		case errors.Is(err, services.ErrSheetNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		case errors.Is(err, services.ErrUnknownField), errors.Is(err, services.ErrInvalidRecord), errors.Is(err, services.ErrInvalidState):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to write records"})
+		}
+		return
+	}
+
+	if len(edits) > 0 {
+		go notifyRealtimeBatchEdits(updated.ID, firstSheetEdits(updated.State, edits))
+	}
+
+	c.Header("ETag", fileETag(updated.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"id":       updated.ID,
+		"records":  results,
+		"updated":  len(edits),
+		"revision": updated.Revision,
+	})
+}
+
+// QueryRecords filters and sorts the records of a sheet on the server:
+// GET /files/:id/query?sheet=&where=Amount>100&sort=-Date&limit=50&offset=0
+//
+// where takes field, operator (= != > >= < <= ~) and value; repeat it or
+// join conditions with ";" to require all of them. Numbers compare as
+// numbers, text ignores case, "~" matches a substring and an empty value
+// matches empty cells. sort lists fields, "-" for descending. Records keep
+// their sheet row in "_row", as in GetRecords.
+func (h *FileHandler) QueryRecords(c *gin.Context) {
+	file, role, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+
+	conds, err := services.ParseRecordConditions(c.QueryArray("where"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sorts := services.ParseRecordSort(c.Query("sort"))
+	limit := defaultRecordsLimit
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = min(n, maxRecordsLimit)
+	}
+	offset := 0
+	if raw := strings.TrimSpace(c.Query("offset")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
+		offset = n
+	}
+
+	state, err := services.DecodeState(file.State)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode file state"})
+		return
+	}
+	sheet, _, sheetName, err := services.LookupSheet(state, c.Query("sheet"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		return
+	}
+
+	resp := gin.H{
+		"file_id":     file.ID,
+		"sheet":       sheetName,
+		"revision":    file.Revision,
+		"access_role": role,
+		"offset":      offset,
+		"limit":       limit,
+	}
+	c.Header("ETag", fileETag(file.Revision))
+
+	table := services.NewSheetTable(sheet)
+	if table == nil {
+		if len(conds) > 0 || len(sorts) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sheet has no header row"})
+			return
+		}
+		resp["header_row"] = nil
+		resp["records"] = []any{}
+		resp["total"] = 0
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	columns, ok := projectFields(c, table)
+	if !ok {
+		return
+	}
+	rows, err := table.Query(conds, sorts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": table.Fields})
+		return
+	}
+
+	start := min(offset, len(rows))
+	end := min(start+limit, len(rows))
+	records := make([]gin.H, 0, end-start)
+	for _, row := range rows[start:end] {
+		record := gin.H{recordRowKey: row + 1}
+		for _, col := range columns {
+			record[table.Fields[col-table.MinCol]] = table.Value(row, col)
+		}
+		records = append(records, record)
+	}
+
+	resp["header_row"] = table.HeaderRow + 1
+	resp["records"] = records
+	resp["total"] = len(rows)
+	c.JSON(http.StatusOK, resp)
+}
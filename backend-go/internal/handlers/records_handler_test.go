@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHandler_GetRecords(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	state := `{"data": {
+		"0,0": {"value": "Buyurtmalar"},
+		"1,0": {"value": "Name"}, "1,1": {"value": "Amount"}, "1,2": {"value": "Paid"}, "1,3": {"value": "Date"},
+		"2,0": {"value": "Olma"}, "2,1": {"value": "12.5"}, "2,2": {"value": "TRUE"}, "2,3": {"value": "2024-03-01"},
+		"4,0": {"value": "Nok"}, "4,1": {"value": "=B3*2", "computed": 25}, "4,2": {"value": "false"},
+		"5,0": {"value": "Uzum"}, "5,1": {"value": "7"}
+	}}`
+	file := models.SheetFile{UserID: 1, Name: "Orders", State: json.RawMessage(state)}
+	assert.NoError(t, db.Create(&file).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/records", handler.GetRecords)
+	get := func(query string) (int, map[string]any) {
+		w := doJSON(router, "GET", "/files/"+jsonNumber(file.ID)+"/records"+query, nil)
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	code, body := get("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 2, body["header_row"])
+	assert.EqualValues(t, 3, body["total"])
+	assert.Nil(t, body["next_cursor"])
+	fields, _ := json.Marshal(body["fields"])
+	assert.JSONEq(t, `[
+		{"name": "Name", "col": "A", "type": "string"},
+		{"name": "Amount", "col": "B", "type": "number"},
+		{"name": "Paid", "col": "C", "type": "bool"},
+		{"name": "Date", "col": "D", "type": "date"}
+	]`, string(fields))
+	records, _ := json.Marshal(body["records"])
+	assert.JSONEq(t, `[
+		{"_row": 3, "Name": "Olma", "Amount": 12.5, "Paid": true, "Date": "2024-03-01"},
+		{"_row": 5, "Name": "Nok", "Amount": 25, "Paid": false, "Date": null},
+		{"_row": 6, "Name": "Uzum", "Amount": 7, "Paid": null, "Date": null}
+	]`, string(records))
+
+	code, body = get("?limit=2&fields=name,Amount")
+	assert.Equal(t, http.StatusOK, code)
+	records, _ = json.Marshal(body["records"])
+	assert.JSONEq(t, `[{"_row": 3, "Name": "Olma", "Amount": 12.5}, {"_row": 5, "Name": "Nok", "Amount": 25}]`, string(records))
+	assert.EqualValues(t, 5, body["next_cursor"])
+
+	code, body = get("?limit=2&cursor=5")
+	assert.Equal(t, http.StatusOK, code)
+	records, _ = json.Marshal(body["records"])
+	assert.JSONEq(t, `[{"_row": 6, "Name": "Uzum", "Amount": 7, "Paid": null, "Date": null}]`, string(records))
+	assert.Nil(t, body["next_cursor"])
+
+	code, _ = get("?fields=Missing")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("?limit=x")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("?sheet=Nope")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func Test_FileHandler_WriteRecords(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	state := `{"data": {
+		"0,0": {"value": "OrderID"}, "0,1": {"value": "Item"}, "0,2": {"value": "Qty"}, "0,3": {"value": "Total"},
+		"1,0": {"value": "7"}, "1,1": {"value": "Olma"}, "1,2": {"value": "3"}, "1,3": {"value": "=C2*2"},
+		"2,0": {"value": "8"}, "2,1": {"value": "Nok"}, "2,2": {"value": "1"}
+	}}`
+	file := models.SheetFile{UserID: 1, Name: "Orders", State: json.RawMessage(state)}
+	assert.NoError(t, db.Create(&file).Error)
+	empty := models.SheetFile{UserID: 1, Name: "New", State: json.RawMessage(`{"data": {}}`)}
+	assert.NoError(t, db.Create(&empty).Error)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/records", handler.GetRecords)
+	router.POST("/files/:id/records", handler.AppendRecords)
+	router.PUT("/files/:id/records", handler.UpsertRecords)
+	router.DELETE("/files/:id/records", handler.DeleteRecords)
+	base := "/files/" + jsonNumber(file.ID) + "/records"
+	records := func() string {
+		w := doJSON(router, "GET", base+"?fields=OrderID,Item,Qty,Total", nil)
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		out, _ := json.Marshal(body["records"])
+		return string(out)
+	}
+
+	w := doJSON(router, "POST", base, gin.H{"records": []gin.H{
+		{"OrderID": 9, "Item": "Uzum", "Qty": 2, "Total": "=C4*2"},
+		{"orderid": "10", "item": "Anor"},
+	}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"_row": 4, "action": "inserted"}, {"_row": 5, "action": "inserted"}]`, jsonField(w, "records"))
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+
+	w = doJSON(router, "PUT", base+"?key=OrderID", gin.H{"records": []gin.H{
+		{"OrderID": "8", "Qty": 6},
+		{"OrderID": 11, "Item": "Behi", "Qty": 1},
+		{"OrderID": 11, "Qty": 4},
+	}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[
+		{"_row": 3, "action": "updated"},
+		{"_row": 6, "action": "inserted"},
+		{"_row": 6, "action": "updated"}
+	]`, jsonField(w, "records"))
+
+	w = doJSON(router, "DELETE", base+"?key=OrderID&value=7&value=10", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"_row": 2, "action": "deleted"}, {"_row": 5, "action": "deleted"}]`, jsonField(w, "records"))
+
+	assert.JSONEq(t, `[
+		{"_row": 3, "OrderID": 8, "Item": "Nok", "Qty": 6, "Total": null},
+		{"_row": 4, "OrderID": 9, "Item": "Uzum", "Qty": 2, "Total": 4},
+		{"_row": 6, "OrderID": 11, "Item": "Behi", "Qty": 4, "Total": null}
+	]`, records())
+
+	w = doJSON(router, "POST", base, gin.H{"records": []gin.H{{"Colour": "red"}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(router, "POST", base, gin.H{"records": []gin.H{{"Item": gin.H{"nested": true}}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(router, "PUT", base+"?key=OrderID", gin.H{"records": []gin.H{{"Item": "no key"}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(router, "PUT", base, gin.H{"records": []gin.H{{"OrderID": 1}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "key is required")
+
+	w = doJSON(router, "POST", "/files/"+jsonNumber(empty.ID)+"/records", gin.H{"records": []gin.H{{"Sana": "2024-05-01", "Summa": 10}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	stored, err := handler.Service.GetFile(1, empty.ID)
+	assert.NoError(t, err)
+	assert.Contains(t, string(stored.State), `"0,0":{"computed":"Sana","value":"Sana"}`)
+	assert.Contains(t, string(stored.State), `"1,1":{"computed":10,"value":"10"}`)
+
+	viewer := fileTestRouter(2)
+	viewer.POST("/files/:id/records", handler.AppendRecords)
+	w = doJSON(viewer, "POST", base, gin.H{"records": []gin.H{{"OrderID": 1}}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func Test_FileHandler_QueryRecords(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	state := `{"data": {
+		"0,0": {"value": "Name"}, "0,1": {"value": "Amount"}, "0,2": {"value": "Date"},
+		"1,0": {"value": "Olma"}, "1,1": {"value": "120"}, "1,2": {"value": "2024-03-01"},
+		"2,0": {"value": "Nok"}, "2,1": {"value": "80"}, "2,2": {"value": "2024-05-10"},
+		"3,0": {"value": "olcha"}, "3,1": {"value": "=B2+B3", "computed": 200},
+		"4,0": {"value": "Uzum"}, "4,1": {"value": "101"}, "4,2": {"value": "2024-01-15"}
+	}}`
+	file := models.SheetFile{UserID: 1, Name: "Orders", State: json.RawMessage(state)}
+	assert.NoError(t, db.Create(&file).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/query", handler.QueryRecords)
+	query := func(params url.Values) (int, map[string]any) {
+		w := doJSON(router, "GET", "/files/"+jsonNumber(file.ID)+"/query?"+params.Encode(), nil)
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+	rows := func(body map[string]any) []int {
+		var out []int
+		records, _ := body["records"].([]any)
+		for _, record := range records {
+			out = append(out, int(record.(map[string]any)["_row"].(float64)))
+		}
+		return out
+	}
+
+	code, body := query(url.Values{"where": {"Amount>100"}, "sort": {"-Date"}, "limit": {"50"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 3, body["total"])
+	// Empty dates sort last even in descending order.
+	assert.Equal(t, []int{2, 5, 4}, rows(body))
+	first, _ := json.Marshal(body["records"].([]any)[0])
+	assert.JSONEq(t, `{"_row": 2, "Name": "Olma", "Amount": 120, "Date": "2024-03-01"}`, string(first))
+
+	code, body = query(url.Values{"where": {"name~ol", "Amount<=150"}, "fields": {"Name"}})
+	assert.Equal(t, http.StatusOK, code)
+	records, _ := json.Marshal(body["records"])
+	assert.JSONEq(t, `[{"_row": 2, "Name": "Olma"}]`, string(records))
+
+	code, body = query(url.Values{"where": {"Date="}, "sort": {"Amount"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{4}, rows(body))
+
+	code, body = query(url.Values{"sort": {"Amount"}, "limit": {"2"}, "offset": {"1"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 4, body["total"])
+	assert.Equal(t, []int{5, 2}, rows(body))
+
+	code, _ = query(url.Values{"where": {"Missing=1"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = query(url.Values{"where": {"Amount"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = query(url.Values{"sort": {"-Missing"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func jsonField(w *httptest.ResponseRecorder, key string) string {
+	var body map[string]json.RawMessage
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	return string(body[key])
+}
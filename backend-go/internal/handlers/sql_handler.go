@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSQLRows = 1000
+	maxSQLRows     = 10000
+	// sqlTimeout bounds loading the sheets and running one query.
+	sqlTimeout = 5 * time.Second
+)
+
+type sqlQueryInput struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
+// QuerySQL runs a read-only SQL query over saved sheets:
+// POST /sql with {"query": "SELECT Category, SUM(Amount) FROM sheet_12 GROUP BY Category"}.
+//
+// sheet_<id> is the first sheet of a file and sheet_<id>_<n> its n-th sheet;
+// columns are the header names plus "_row". The caller needs at least
+// viewer access to every file named. At most limit rows (default 1000, max
+// 10000) are returned, with "truncated" set when there were more.
+func (h *FileHandler) QuerySQL(c *gin.Context) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var input sqlQueryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+	limit := defaultSQLRows
+	if input.Limit > 0 {
+		limit = min(input.Limit, maxSQLRows)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), sqlTimeout)
+	defer cancel()
+	result, err := h.Service.QuerySQL(ctx, userID, input.Query, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		case errors.Is(err, services.ErrSheetNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrInvalidSQL):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrSQLTimeout):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("query exceeded the %s time budget", sqlTimeout)})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to run query"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
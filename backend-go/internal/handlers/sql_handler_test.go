@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHandler_QuerySQL(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	sales := models.SheetFile{UserID: 1, Name: "Sales", State: json.RawMessage(`{"data": {
+		"0,0": {"value": "Category"}, "0,1": {"value": "Amount"}, "0,2": {"value": "Paid"},
+		"1,0": {"value": "Meva"}, "1,1": {"value": "120"}, "1,2": {"value": "TRUE"},
+		"2,0": {"value": "Sabzavot"}, "2,1": {"value": "80"},
+		"3,0": {"value": "Meva"}, "3,1": {"value": "=B2/4", "computed": 30}
+	}, "sheets": [{"name": "Plan", "data": {
+		"0,0": {"value": "Category"}, "0,1": {"value": "Target"},
+		"1,0": {"value": "Meva"}, "1,1": {"value": "100"}
+	}}]}`)}
+	shared := models.SheetFile{UserID: 2, Name: "Rates", State: json.RawMessage(`{"data": {
+		"0,0": {"value": "Category"}, "0,1": {"value": "Rate"},
+		"1,0": {"value": "Meva"}, "1,1": {"value": "0.5"}
+	}}`)}
+	private := models.SheetFile{UserID: 2, Name: "Secret", State: json.RawMessage(`{"data": {"0,0": {"value": "x"}}}`)}
+	for _, file := range []*models.SheetFile{&sales, &shared, &private} {
+		assert.NoError(t, db.Create(file).Error)
+	}
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: shared.ID, UserID: 1, Role: "viewer"}).Error)
+
+	router := fileTestRouter(1)
+	router.POST("/sql", handler.QuerySQL)
+	run := func(query string, limit int) (int, map[string]any) {
+		w := doJSON(router, "POST", "/sql", gin.H{"query": query, "limit": limit})
+		var body map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+	rowsJSON := func(body map[string]any) string {
+		raw, _ := json.Marshal(body["rows"])
+		return string(raw)
+	}
+
+	table := "sheet_" + jsonNumber(sales.ID)
+	code, body := run("SELECT Category, SUM(Amount) AS total FROM "+table+" GROUP BY Category ORDER BY Category", 0)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, []any{"Category", "total"}, body["columns"])
+	assert.JSONEq(t, `[["Meva", 150], ["Sabzavot", 80]]`, rowsJSON(body))
+	assert.Equal(t, false, body["truncated"])
+
+	code, body = run("SELECT _row, paid FROM "+table+" WHERE Paid IS NULL", 0)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[[3, null], [4, null]]`, rowsJSON(body))
+
+	code, body = run("SELECT s.Category, p.Target, r.Rate FROM "+table+" s JOIN "+table+"_2 p USING (Category) JOIN sheet_"+jsonNumber(shared.ID)+" r USING (Category) LIMIT 1", 0)
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[["Meva", 100, 0.5]]`, rowsJSON(body))
+	tables, _ := json.Marshal(body["tables"])
+	assert.Contains(t, string(tables), `"sheet":"Plan"`)
+
+	code, body = run("SELECT Amount FROM "+table+" ORDER BY _row", 2)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[[120], [80]]`, rowsJSON(body))
+	assert.Equal(t, true, body["truncated"])
+
+	code, _ = run("SELECT * FROM sheet_"+jsonNumber(private.ID), 0)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = run("SELECT * FROM "+table+"_5", 0)
+	assert.Equal(t, http.StatusNotFound, code)
+	for _, query := range []string{
+		"DELETE FROM " + table,
+		"CREATE TABLE t (x)",
+		"ATTACH DATABASE 'x.db' AS x",
+		"PRAGMA table_info(" + table + ")",
+		"SELEC 1",
+		"",
+	} {
+		code, _ = run(query, 0)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type structureInput struct {
+	Op        string `json:"op"`
+	Dimension string `json:"dimension"`
+	Sheet     string `json:"sheet"`
+	Index     int    `json:"index"`
+	Count     int    `json:"count"`
+	To        int    `json:"to"`
+}
+
+// ApplyStructure inserts, deletes or moves rows or columns of a sheet:
+// POST /files/:id/structure with
+// {"op": "insert", "dimension": "rows", "index": 3, "count": 2}.
+//
+// index and to are 1-based (row 1, column 1 = A); count defaults to 1. A
+// move puts the block in front of the row or column that was at "to".
+// Cells, formulas, sizes, merged cells and frozen panes shift together, and
+// references to deleted cells become #REF!.
+func (h *FileHandler) ApplyStructure(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+	var input structureInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Index < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "index must be 1 or more"})
+		return
+	}
+	if input.Count == 0 {
+		input.Count = 1
+	}
+	op := services.StructureOp{
+		Op:        input.Op,
+		Dimension: input.Dimension,
+		Sheet:     input.Sheet,
+		Index:     input.Index - 1,
+		Count:     input.Count,
+	}
+	if input.Op == services.StructureMove {
+		if input.To < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be 1 or more"})
+			return
+		}
+		op.To = input.To - 1
+	}
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
+		return
+	}
+
+	updated, err := h.Service.ApplyStructure(file.ID, op, ifMatch...)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		case errors.Is(err, services.ErrRevisionMismatch):
+			respondRevisionMismatch(c)
+		case errors.Is(err, services.ErrSheetNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "sheet not found"})
+		case errors.Is(err, services.ErrInvalidStructure), errors.Is(err, services.ErrInvalidState):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change structure"})
+		}
+		return
+	}
+
+	if services.IsFirstSheet(updated.State, op.Sheet) {
+		go notifyRealtimeStructure(updated.ID, op, updated.Revision)
+	}
+
+	c.Header("ETag", fileETag(updated.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"id":       updated.ID,
+		"revision": updated.Revision,
+	})
+}
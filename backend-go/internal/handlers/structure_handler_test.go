@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHandler_ApplyStructure(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	handler := NewFileHandler(&services.SpreadsheetService{DB: db})
+
+	state := `{
+		"data": {
+			"0,0": {"value": "Item"}, "0,1": {"value": "Qty"},
+			"1,0": {"value": "Olma"}, "1,1": {"value": "3"},
+			"2,0": {"value": "Nok"}, "2,1": {"value": "4"},
+			"3,0": {"value": "Jami"}, "3,1": {"value": "=SUM(B2:B3)"},
+			"3,2": {"value": "=B3*2"}
+		},
+		"rowCount": 100,
+		"rowHeights": {"2": 30, "3": 40},
+		"columnWidths": {"1": 120},
+		"mergedCells": [{"startRow": 1, "startCol": 2, "endRow": 2, "endCol": 3}],
+		"freezePosition": {"rows": 1, "cols": 0},
+		"sheets": [{"name": "Q2", "data": {"0,0": {"value": "=A2"}}}]
+	}`
+	file := models.SheetFile{UserID: 1, Name: "Stock", State: json.RawMessage(state)}
+	assert.NoError(t, db.Create(&file).Error)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	router := fileTestRouter(1)
+	router.POST("/files/:id/structure", handler.ApplyStructure)
+	path := "/files/" + jsonNumber(file.ID) + "/structure"
+	stored := func() map[string]any {
+		f, err := handler.Service.GetFile(1, file.ID)
+		assert.NoError(t, err)
+		var decoded map[string]any
+		assert.NoError(t, json.Unmarshal(f.State, &decoded))
+		return decoded
+	}
+	cellsOf := func(sheet map[string]any) string {
+		out := map[string]string{}
+		for id, cell := range sheet["data"].(map[string]any) {
+			out[id] = cell.(map[string]any)["value"].(string)
+		}
+		raw, _ := json.Marshal(out)
+		return string(raw)
+	}
+
+	// Two rows in front of row 3.
+	w := doJSON(router, "POST", path, gin.H{"op": "insert", "dimension": "rows", "index": 3, "count": 2})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+	s := stored()
+	assert.JSONEq(t, `{
+		"0,0": "Item", "0,1": "Qty", "1,0": "Olma", "1,1": "3",
+		"4,0": "Nok", "4,1": "4", "5,0": "Jami", "5,1": "=SUM(B2:B5)", "5,2": "=B5*2"
+	}`, cellsOf(s))
+	assert.EqualValues(t, 7, s["data"].(map[string]any)["5,1"].(map[string]any)["computed"])
+	assert.EqualValues(t, 102, s["rowCount"])
+	heights, _ := json.Marshal(s["rowHeights"])
+	assert.JSONEq(t, `{"4": 30, "5": 40}`, string(heights))
+	merges, _ := json.Marshal(s["mergedCells"])
+	assert.JSONEq(t, `[{"startRow": 1, "startCol": 2, "endRow": 4, "endCol": 3}]`, string(merges))
+	// Other sheets do not see the first one.
+	assert.JSONEq(t, `{"0,0": "=A2"}`, cellsOf(s["sheets"].([]any)[0].(map[string]any)))
+
+	// Deleting row 2 and the first new row shrinks the range and the merge.
+	w = doJSON(router, "POST", path, gin.H{"op": "delete", "dimension": "rows", "index": 2, "count": 2})
+	assert.Equal(t, http.StatusOK, w.Code)
+	s = stored()
+	assert.JSONEq(t, `{
+		"0,0": "Item", "0,1": "Qty", "2,0": "Nok", "2,1": "4",
+		"3,0": "Jami", "3,1": "=SUM(B2:B3)", "3,2": "=B3*2"
+	}`, cellsOf(s))
+	merges, _ = json.Marshal(s["mergedCells"])
+	assert.JSONEq(t, `[{"startRow": 1, "startCol": 2, "endRow": 2, "endCol": 3}]`, string(merges))
+	freeze, _ := json.Marshal(s["freezePosition"])
+	assert.JSONEq(t, `{"rows": 1, "cols": 0}`, string(freeze))
+
+	// Column B moves behind column C.
+	w = doJSON(router, "POST", path, gin.H{"op": "move", "dimension": "columns", "index": 2, "to": 4})
+	assert.Equal(t, http.StatusOK, w.Code)
+	s = stored()
+	assert.JSONEq(t, `{
+		"0,0": "Item", "0,2": "Qty", "2,0": "Nok", "2,2": "4",
+		"3,0": "Jami", "3,2": "=SUM(C2:C3)", "3,1": "=C3*2"
+	}`, cellsOf(s))
+	widths, _ := json.Marshal(s["columnWidths"])
+	assert.JSONEq(t, `{"2": 120}`, string(widths))
+	// The merge over columns C:D came apart.
+	assert.Empty(t, s["mergedCells"])
+
+	w = doJSON(router, "POST", path, gin.H{"op": "delete", "dimension": "columns", "index": 3})
+	assert.Equal(t, http.StatusOK, w.Code)
+	s = stored()
+	assert.Equal(t, "=#REF!*2", s["data"].(map[string]any)["3,1"].(map[string]any)["value"])
+	assert.Equal(t, "#REF!", s["data"].(map[string]any)["3,1"].(map[string]any)["computed"])
+
+	var versions []models.SheetFileVersion
+	assert.NoError(t, db.Where("file_id = ? AND source = ?", file.ID, services.VersionSourceStructure).Find(&versions).Error)
+	assert.Len(t, versions, 4)
+
+	for _, body := range []gin.H{
+		{"op": "split", "dimension": "rows", "index": 1},
+		{"op": "insert", "dimension": "cells", "index": 1},
+		{"op": "insert", "dimension": "rows", "index": 0},
+		{"op": "move", "dimension": "rows", "index": 2, "count": 3, "to": 3},
+		{"op": "insert", "dimension": "columns", "index": 16384, "count": 2},
+	} {
+		w = doJSON(router, "POST", path, body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	w = doJSON(router, "POST", path, gin.H{"op": "insert", "dimension": "rows", "index": 1, "sheet": "Nope"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	viewer := fileTestRouter(2)
+	viewer.POST("/files/:id/structure", handler.ApplyStructure)
+	w = doJSON(viewer, "POST", path, gin.H{"op": "insert", "dimension": "rows", "index": 1})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"converter-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func parseVersionParam(raw string) (int, bool) {
+	v, err := strconv.Atoi(raw)
+	return v, err == nil && v > 0
+}
+
+// ListVersions returns the stored history of a file, newest first.
+func (h *FileHandler) ListVersions(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+
+	versions, err := h.Service.ListVersions(file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":  file.ID,
+		"versions": versions,
+	})
+}
+
+// GetVersion returns the full state of one version.
+func (h *FileHandler) GetVersion(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+	version, valid := parseVersionParam(c.Param("version"))
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+
+	v, err := h.Service.GetVersion(file.ID, version)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load version"})
+		return
+	}
+
+	c.JSON(http.StatusOK, v)
+}
+
+// DiffVersions compares the cell values of two versions:
+// ?from=3&to=5. "to" defaults to the file's current state.
+func (h *FileHandler) DiffVersions(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, false)
+	if !ok {
+		return
+	}
+
+	from, valid := parseVersionParam(c.Query("from"))
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a version number"})
+		return
+	}
+	fromVersion, err := h.Service.GetVersion(file.ID, from)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+		return
+	}
+
+	toState := file.State
+	toLabel := "current"
+	if raw := c.Query("to"); raw != "" && raw != "current" {
+		to, valid := parseVersionParam(raw)
+		if !valid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a version number or current"})
+			return
+		}
+		toVersion, err := h.Service.GetVersion(file.ID, to)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+			return
+		}
+		toState = toVersion.State
+		toLabel = raw
+	}
+
+	diffs, err := services.DiffStates(fromVersion.State, toState)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to diff versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id": file.ID,
+		"from":    from,
+		"to":      toLabel,
+		"changes": diffs,
+	})
+}
+
+// RestoreVersion makes a past version the current state of the file.
+func (h *FileHandler) RestoreVersion(c *gin.Context) {
+	file, _, ok := h.loadFileAccess(c, true)
+	if !ok {
+		return
+	}
+	version, valid := parseVersionParam(c.Param("version"))
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	ifMatch, ok := parseIfMatch(c)
+	if !ok {
+		return
+	}
+
+	previous := file.State
+	restored, err := h.Service.RestoreVersion(file.ID, version, ifMatch...)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+			return
+		}
+		if errors.Is(err, services.ErrRevisionMismatch) {
+			respondRevisionMismatch(c)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore version"})
+		return
+	}
+
+	if diffs, err := services.DiffStates(previous, restored.State); err == nil && len(diffs) > 0 {
+		edits := make([]services.CellEdit, 0, len(diffs))
+		for _, d := range diffs {
+			edits = append(edits, services.CellEdit{Sheet: d.Sheet, Row: d.Row, Col: d.Col, Value: d.After})
+		}
+		go notifyRealtimeBatchEdits(restored.ID, firstSheetEdits(restored.State, edits))
+	}
+
+	c.Header("ETag", fileETag(restored.Revision))
+	c.JSON(http.StatusOK, gin.H{
+		"id":            restored.ID,
+		"name":          restored.Name,
+		"state":         restored.State,
+		"restored_from": version,
+		"revision":      restored.Revision,
+	})
+}
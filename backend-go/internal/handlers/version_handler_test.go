@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"converter-backend/internal/models"
+	"converter-backend/internal/services"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileHandler_Versions(t *testing.T) {
+	db := setupFileHandlerTestDB(t)
+	service := &services.SpreadsheetService{DB: db}
+	handler := NewFileHandler(service)
+
+	file, err := service.SaveFile(1, "History", json.RawMessage(`{"data": {"0,0": {"value": "old"}}}`))
+	assert.NoError(t, err)
+	_, _, err = service.PatchFileCells(file.ID, []services.CellEdit{{Row: 0, Col: 0, Value: "new"}, {Row: 1, Col: 1, Value: "x"}})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Create(&models.SheetFileShare{FileID: file.ID, UserID: 2, Role: "viewer"}).Error)
+
+	router := fileTestRouter(1)
+	router.GET("/files/:id/versions", handler.ListVersions)
+	router.GET("/files/:id/versions/diff", handler.DiffVersions)
+	router.GET("/files/:id/versions/:version", handler.GetVersion)
+	router.POST("/files/:id/versions/:version/restore", handler.RestoreVersion)
+
+	w := doJSON(router, "GET", "/files/1/versions", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Versions []models.SheetFileVersion `json:"versions"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Versions, 2)
+
+	w = doJSON(router, "GET", "/files/1/versions/diff?from=1&to=2", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var diff struct {
+		Changes []services.CellValueDiff `json:"changes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &diff))
+	assert.Equal(t, []services.CellValueDiff{
+		{ID: "0,0", Row: 0, Col: 0, Before: "old", After: "new"},
+		{ID: "1,1", Row: 1, Col: 1, Before: "", After: "x"},
+	}, diff.Changes)
+
+	assert.Equal(t, http.StatusBadRequest, doJSON(router, "GET", "/files/1/versions/diff", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(router, "GET", "/files/1/versions/9", nil).Code)
+
+	viewer := fileTestRouter(2)
+	viewer.POST("/files/:id/versions/:version/restore", handler.RestoreVersion)
+	assert.Equal(t, http.StatusForbidden, doJSON(viewer, "POST", "/files/1/versions/1/restore", nil).Code)
+
+	w = doJSON(router, "POST", "/files/1/versions/1/restore", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(router, "GET", "/files/1/versions/diff?from=1", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &diff))
+	assert.Empty(t, diff.Changes)
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SheetFileBranch is a named copy of a file's state that can be edited on its
+// own and merged back. BaseState is the main state the branch last synced
+// with and serves as the common ancestor of a three-way merge.
+type SheetFileBranch struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	FileID    uint            `gorm:"not null;uniqueIndex:idx_sheet_file_branch" json:"file_id"`
+	Name      string          `gorm:"type:varchar(64);not null;uniqueIndex:idx_sheet_file_branch" json:"name"`
+	BaseState json.RawMessage `gorm:"type:jsonb;not null" json:"base_state,omitempty"`
+	State     json.RawMessage `gorm:"type:jsonb;not null" json:"state,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import "encoding/json"
+
+// SheetCell is one stored cell of a SheetFile. A file's State keeps its
+// layout (sizes, merges, sheet names) with empty "data" maps; the cells live
+// here so range reads and patches only touch the rows involved.
+type SheetCell struct {
+	FileID   uint            `gorm:"primaryKey;autoIncrement:false" json:"file_id"`
+	Sheet    int             `gorm:"primaryKey;autoIncrement:false" json:"sheet"` // 0 is the first sheet
+	Row      int             `gorm:"primaryKey;autoIncrement:false" json:"row"`
+	Col      int             `gorm:"primaryKey;autoIncrement:false" json:"col"`
+	Value    string          `gorm:"type:text;not null" json:"value"`
+	Computed json.RawMessage `gorm:"type:jsonb" json:"computed,omitempty"`
+	StyleID  *uint           `gorm:"index" json:"style_id,omitempty"`
+}
+
+// SheetStyle is a cell style shared by every cell that uses it, found by the
+// hash of its JSON.
+type SheetStyle struct {
+	ID    uint            `gorm:"primaryKey" json:"id"`
+	Hash  string          `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	Style json.RawMessage `gorm:"type:jsonb;not null" json:"style"`
+}
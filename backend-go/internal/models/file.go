@@ -11,6 +11,7 @@ type SheetFile struct {
 	UserID    uint            `gorm:"index;not null" json:"user_id"`
 	Name      string          `gorm:"not null" json:"name"`
 	State     json.RawMessage `gorm:"type:jsonb;not null" json:"state"`
+	Revision  int64           `gorm:"not null;default:1" json:"revision"` // +1 on every write; served as the ETag
 	CreatedAt time.Time       `json:"created_at"`
 	UpdatedAt time.Time       `json:"updated_at"`
 }
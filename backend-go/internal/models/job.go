@@ -0,0 +1,29 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Job is an upload processed in the background by the job queue. Queued and
+// running jobs are picked up again after a restart; the upload waits on
+// disk until the job finishes.
+type Job struct {
+	ID            uint            `gorm:"primaryKey" json:"id"`
+	UserID        uint            `gorm:"index;not null" json:"user_id"`
+	Status        string          `gorm:"type:varchar(16);not null;index" json:"status"` // queued|running|succeeded|failed
+	Output        string          `gorm:"type:varchar(16);not null" json:"output"`       // file|csv
+	Name          string          `gorm:"not null" json:"name"`
+	Filename      string          `gorm:"not null" json:"filename"`
+	Options       json.RawMessage `gorm:"type:jsonb" json:"-"`
+	UploadPath    string          `json:"-"`
+	ResultPath    string          `json:"-"`
+	RowsProcessed int64           `gorm:"not null;default:0" json:"rows_processed"`
+	Attempts      int             `gorm:"not null;default:0" json:"attempts"`
+	Error         string          `json:"error,omitempty"`
+	FileID        *uint           `json:"file_id,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"` // doubles as the heartbeat of running jobs
+	StartedAt     *time.Time      `json:"started_at,omitempty"`
+	FinishedAt    *time.Time      `json:"finished_at,omitempty"`
+}
@@ -0,0 +1,88 @@
+package models
+
+// SheetState mirrors the SheetState of the editor (shlyux/types.ts). It is
+// the first sheet of a workbook; further sheets are in Sheets and the first
+// one is named by SheetName. Names are the workbook's named ranges.
+type SheetState struct {
+	Sheet
+	ActiveCell *CellPosition   `json:"activeCell"`
+	Selection  *SelectionRange `json:"selection"`
+	SheetName  string          `json:"sheetName,omitempty"`
+	Sheets     []Sheet         `json:"sheets,omitempty"`
+	Names      []NamedRange    `json:"names,omitempty"`
+}
+
+// Sheet holds the fields every sheet of a workbook has. Cells are keyed by
+// "row,col", both 0-based; Name is only set on further sheets.
+type Sheet struct {
+	Name           string              `json:"name,omitempty"`
+	Data           map[string]CellData `json:"data"`
+	ColumnWidths   map[int]float64     `json:"columnWidths,omitempty"`
+	RowHeights     map[int]float64     `json:"rowHeights,omitempty"`
+	RowCount       int                 `json:"rowCount,omitempty"`
+	FreezePosition *FreezePosition     `json:"freezePosition,omitempty"`
+	MergedCells    []MergedCell        `json:"mergedCells,omitempty"`
+}
+
+// NamedRange names a range of the workbook: {"name": "Revenue", "ref":
+// "Sheet1!B2:B200"}. The ref becomes "Sheet1!#REF!" when its cells are
+// deleted.
+type NamedRange struct {
+	Name string `json:"name"`
+	Ref  string `json:"ref"`
+}
+
+type CellData struct {
+	Value    string     `json:"value"`              // raw input, e.g. "=SUM(A1:A5)" or "100"
+	Computed any        `json:"computed,omitempty"` // display value: string or number
+	Style    *CellStyle `json:"style,omitempty"`
+}
+
+type CellStyle struct {
+	Bold            *bool        `json:"bold,omitempty"`
+	Italic          *bool        `json:"italic,omitempty"`
+	Underline       *bool        `json:"underline,omitempty"`
+	TextAlign       string       `json:"textAlign,omitempty"` // left|center|right
+	Color           string       `json:"color,omitempty"`
+	BackgroundColor string       `json:"backgroundColor,omitempty"`
+	FontSize        *float64     `json:"fontSize,omitempty"`
+	FontFamily      string       `json:"fontFamily,omitempty"`
+	NumberFormat    string       `json:"numberFormat,omitempty"` // general|number|currency|percent
+	DecimalPlaces   *int         `json:"decimalPlaces,omitempty"`
+	CurrencyCode    string       `json:"currencyCode,omitempty"`
+	VerticalAlign   string       `json:"verticalAlign,omitempty"` // top|middle|bottom
+	WrapMode        string       `json:"wrapMode,omitempty"`      // overflow|wrap|clip
+	Borders         *CellBorders `json:"borders,omitempty"`
+	Rotation        *float64     `json:"rotation,omitempty"` // degrees
+}
+
+type CellBorders struct {
+	Top    *bool  `json:"top,omitempty"`
+	Right  *bool  `json:"right,omitempty"`
+	Bottom *bool  `json:"bottom,omitempty"`
+	Left   *bool  `json:"left,omitempty"`
+	Color  string `json:"color,omitempty"`
+	Style  string `json:"style,omitempty"` // solid|dashed|dotted
+}
+
+type CellPosition struct {
+	Row int `json:"row"`
+	Col int `json:"col"`
+}
+
+type SelectionRange struct {
+	Start CellPosition `json:"start"`
+	End   CellPosition `json:"end"`
+}
+
+type FreezePosition struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+type MergedCell struct {
+	StartRow int `json:"startRow"`
+	StartCol int `json:"startCol"`
+	EndRow   int `json:"endRow"`
+	EndCol   int `json:"endCol"`
+}
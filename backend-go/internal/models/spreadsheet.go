@@ -9,6 +9,7 @@ import (
 type SpreadsheetData struct {
 	ID        uint `gorm:"primaryKey"`
 	Filename  string
+	SheetName string
 	RowData   json.RawMessage `gorm:"type:jsonb"` // Store row as JSON for flexibility
 	CreatedAt time.Time
 }
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SheetFileVersion is a snapshot of a SheetFile's state. One is written on
+// every save, cell patch and restore; the oldest are pruned per file.
+// Version numbers count up per file and are never reused.
+//
+// A cell patch does not copy the file: its version is stored as "live",
+// holding the file's layout and reading its cells from sheet_cells, and the
+// live version before it becomes an "undo" holding only the layout and the
+// cells the patch changed. Storage is empty for a full snapshot.
+type SheetFileVersion struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	FileID    uint            `gorm:"not null;uniqueIndex:idx_sheet_file_version" json:"file_id"`
+	Version   int             `gorm:"not null;uniqueIndex:idx_sheet_file_version" json:"version"`
+	Source    string          `gorm:"type:varchar(16);not null" json:"source"` // save|patch|restore|merge
+	State     json.RawMessage `gorm:"type:jsonb;not null" json:"state,omitempty"`
+	Storage   string          `gorm:"type:varchar(8);not null;default:''" json:"-"` // ""|live|undo
+	CreatedAt time.Time       `json:"created_at"`
+}
@@ -0,0 +1,516 @@
+package services
+
+import (
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxBranchesPerFile matches the branch limit of the frontend.
+const MaxBranchesPerFile = 20
+
+// VersionSourceMerge marks a version written by merging a branch.
+const VersionSourceMerge = "merge"
+
+// Merge resolutions accepted per conflicting cell.
+const (
+	ResolveMain   = "main"
+	ResolveBranch = "branch"
+)
+
+var (
+	ErrInvalidBranchName = errors.New("invalid branch name")
+	ErrBranchExists      = errors.New("branch already exists")
+	ErrBranchLimit       = errors.New("branch limit reached")
+)
+
+var branchNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// SheetMergeConflict is a cell changed differently on main and on the branch
+// since the branch's base. Values are the raw cell inputs.
+type SheetMergeConflict struct {
+	Sheet  string `json:"sheet,omitempty"` // "" is the first sheet
+	ID     string `json:"id"`              // "row,col"
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	Base   string `json:"base"`
+	Main   string `json:"main"`
+	Branch string `json:"branch"`
+}
+
+// MergeResult reports the outcome of a three-way merge. Conflicts only lists
+// cells without a resolution; when it is non-empty nothing was written.
+type MergeResult struct {
+	Conflicts   []SheetMergeConflict `json:"conflicts"`
+	Applied     int                  `json:"applied"`
+	AppliedMeta int                  `json:"applied_meta"`
+	Resolved    int                  `json:"resolved"`
+	Merged      bool                 `json:"merged"`
+}
+
+// CreateBranch starts a branch from the file's current state.
+func (s *SpreadsheetService) CreateBranch(fileID uint, name string) (*models.SheetFileBranch, error) {
+	if !branchNamePattern.MatchString(name) {
+		return nil, ErrInvalidBranchName
+	}
+
+	var branch models.SheetFileBranch
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var file models.SheetFile
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", fileID).
+			First(&file).Error; err != nil {
+			return err
+		}
+		if err := loadCells(tx, &file, -1, nil); err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.SheetFileBranch{}).Where("file_id = ?", fileID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= MaxBranchesPerFile {
+			return ErrBranchLimit
+		}
+		var existing int64
+		if err := tx.Model(&models.SheetFileBranch{}).
+			Where("file_id = ? AND name = ?", fileID, name).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return ErrBranchExists
+		}
+
+		branch = models.SheetFileBranch{
+			FileID:    fileID,
+			Name:      name,
+			BaseState: file.State,
+			State:     file.State,
+		}
+		return tx.Create(&branch).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &branch, nil
+}
+
+// ListBranches returns a file's branches by name, without their states.
+func (s *SpreadsheetService) ListBranches(fileID uint) ([]models.SheetFileBranch, error) {
+	var branches []models.SheetFileBranch
+	err := s.DB.Select("id", "file_id", "name", "created_at", "updated_at").
+		Where("file_id = ?", fileID).
+		Order("name").
+		Find(&branches).Error
+	return branches, err
+}
+
+// GetBranch returns one branch including its base and current state.
+func (s *SpreadsheetService) GetBranch(fileID uint, name string) (*models.SheetFileBranch, error) {
+	var branch models.SheetFileBranch
+	if err := s.DB.Where("file_id = ? AND name = ?", fileID, name).First(&branch).Error; err != nil {
+		return nil, err
+	}
+	return &branch, nil
+}
+
+// DeleteBranch removes a branch. Main is not affected.
+func (s *SpreadsheetService) DeleteBranch(fileID uint, name string) error {
+	result := s.DB.Where("file_id = ? AND name = ?", fileID, name).Delete(&models.SheetFileBranch{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// PatchBranchCells applies cell edits to a branch and recalculates its formulas.
+func (s *SpreadsheetService) PatchBranchCells(fileID uint, name string, edits []CellEdit) (*models.SheetFileBranch, int, error) {
+	if len(edits) == 0 {
+		return nil, 0, fmt.Errorf("no edits provided")
+	}
+
+	var branch models.SheetFileBranch
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("file_id = ? AND name = ?", fileID, name).
+			First(&branch).Error; err != nil {
+			return err
+		}
+
+		state, err := DecodeState(branch.State)
+		if err != nil {
+			return fmt.Errorf("failed to decode branch state: %w", err)
+		}
+		changed, err := applyWorkbookEdits(state, edits)
+		if err != nil {
+			return err
+		}
+		sheets := StateSheets(state)
+		cells := 0
+		for index, sheet := range sheets {
+			if _, ok := changed[index]; ok {
+				data := formulaData(sheet.Data)
+				formula.Recalculate(data)
+				storeComputed(sheet, data)
+			}
+			cells += len(sheet.Data)
+		}
+		if err := s.StateLimits.checkCellCount(cells); err != nil {
+			return err
+		}
+
+		next, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode branch state: %w", err)
+		}
+		branch.State = next
+		return tx.Save(&branch).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &branch, len(edits), nil
+}
+
+// MergeBranch merges a branch into the file with a three-way merge against
+// the branch's base. resolutions maps conflicting cell IDs to ResolveMain or
+// ResolveBranch. While any conflict is unresolved, or when dryRun is set, the
+// result is returned without writing anything. On success the merge is
+// recorded as a version and the branch's base moves to its current state, so
+// later edits on either side merge cleanly again. ifMatch works as in
+// UpdateFile.
+func (s *SpreadsheetService) MergeBranch(fileID uint, name string, resolutions map[string]string, dryRun bool, ifMatch ...int64) (*models.SheetFile, *MergeResult, error) {
+	var (
+		file   models.SheetFile
+		result MergeResult
+	)
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", fileID).
+			First(&file).Error; err != nil {
+			return err
+		}
+		if !revisionMatches(file.Revision, ifMatch) {
+			return ErrRevisionMismatch
+		}
+		if err := loadCells(tx, &file, -1, nil); err != nil {
+			return err
+		}
+		var branch models.SheetFileBranch
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("file_id = ? AND name = ?", fileID, name).
+			First(&branch).Error; err != nil {
+			return err
+		}
+
+		merged, res, err := MergeStates(branch.BaseState, file.State, branch.State, resolutions)
+		if err != nil {
+			return err
+		}
+		result = res
+		if len(result.Conflicts) > 0 || dryRun {
+			return nil
+		}
+
+		recalculateWorkbook(merged)
+		next, err := json.Marshal(merged)
+		if err != nil {
+			return fmt.Errorf("failed to encode file state: %w", err)
+		}
+
+		file.State = next
+		file.Revision++
+		if err := saveFile(tx, &file); err != nil {
+			return err
+		}
+		if err := s.recordVersion(tx, &file, VersionSourceMerge); err != nil {
+			return err
+		}
+
+		branch.BaseState = branch.State
+		if err := tx.Save(&branch).Error; err != nil {
+			return err
+		}
+		result.Merged = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &file, &result, nil
+}
+
+// MergeStates merges branch into main using base as the common ancestor,
+// following the frontend's mergeSheetsThreeWay: a cell is taken from the
+// branch when only the branch changed it, kept when only main changed it,
+// and reported as a conflict when both changed it differently. Column
+// widths and row heights merge per key; freeze panes and merged cells merge
+// as a whole; rowCount is the largest of the three.
+//
+// Further sheets merge the same way, matched by name. A sheet added on the
+// branch is added to main; sheets are never deleted by a merge. Resolutions
+// for cells of further sheets are keyed "Sheet!row,col".
+func MergeStates(base, main, branch json.RawMessage, resolutions map[string]string) (map[string]any, MergeResult, error) {
+	result := MergeResult{Conflicts: []SheetMergeConflict{}}
+
+	var baseState, mainState, branchState map[string]any
+	for _, s := range []struct {
+		raw json.RawMessage
+		dst *map[string]any
+	}{{base, &baseState}, {main, &mainState}, {branch, &branchState}} {
+		if len(s.raw) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(s.raw, s.dst); err != nil {
+			return nil, result, fmt.Errorf("%w: %v", ErrInvalidState, err)
+		}
+	}
+	if mainState == nil {
+		mainState = map[string]any{}
+	}
+
+	merged := mergeSheetThreeWay(baseState, mainState, branchState, "", resolutions, &result)
+
+	mainSheets := extraSheets(mainState)
+	if len(mainSheets) == 0 && len(extraSheets(branchState)) == 0 {
+		return merged, result, nil
+	}
+	findByName := func(state map[string]any, name string) map[string]any {
+		for _, sheet := range extraSheets(state) {
+			if n, _ := sheet["name"].(string); strings.EqualFold(n, name) {
+				return sheet
+			}
+		}
+		return nil
+	}
+
+	sheets := make([]any, 0, len(mainSheets))
+	for _, mainSheet := range mainSheets {
+		name, _ := mainSheet["name"].(string)
+		branchSheet := findByName(branchState, name)
+		if branchSheet == nil {
+			sheets = append(sheets, mainSheet)
+			continue
+		}
+		sheets = append(sheets, mergeSheetThreeWay(findByName(baseState, name), mainSheet, branchSheet, name, resolutions, &result))
+	}
+	for _, branchSheet := range extraSheets(branchState) {
+		name, _ := branchSheet["name"].(string)
+		if findByName(mainState, name) == nil && findByName(baseState, name) == nil {
+			sheets = append(sheets, branchSheet)
+			result.AppliedMeta++
+		}
+	}
+	merged["sheets"] = sheets
+
+	return merged, result, nil
+}
+
+// mergeSheetThreeWay merges one sheet object (data plus layout fields) and
+// adds its counts and conflicts to result. sheet is "" for the first sheet.
+func mergeSheetThreeWay(baseSheet, mainSheet, branchSheet map[string]any, sheet string, resolutions map[string]string, result *MergeResult) map[string]any {
+	merged := make(map[string]any, len(mainSheet))
+	for k, v := range mainSheet {
+		merged[k] = v
+	}
+
+	baseData, _ := baseSheet["data"].(map[string]any)
+	mainData, _ := mainSheet["data"].(map[string]any)
+	branchData, _ := branchSheet["data"].(map[string]any)
+
+	mergedData := make(map[string]any, len(mainData))
+	for id, cell := range mainData {
+		mergedData[id] = cell
+	}
+
+	ids := make(map[string]struct{}, len(mainData))
+	for _, data := range []map[string]any{baseData, mainData, branchData} {
+		for id := range data {
+			ids[id] = struct{}{}
+		}
+	}
+
+	takeBranch := func(id string, br *mergeCellInput) {
+		if br == nil {
+			delete(mergedData, id)
+			return
+		}
+		cell := map[string]any{"value": br.value}
+		if br.style != nil {
+			cell["style"] = br.style
+		}
+		mergedData[id] = cell
+	}
+
+	conflicts := []SheetMergeConflict{}
+	for id := range ids {
+		b := normalizeMergeCell(baseData[id])
+		m := normalizeMergeCell(mainData[id])
+		br := normalizeMergeCell(branchData[id])
+
+		if m.equal(br) {
+			continue
+		}
+		if m.equal(b) && !br.equal(b) {
+			takeBranch(id, br)
+			result.Applied++
+			continue
+		}
+		if br.equal(b) && !m.equal(b) {
+			continue
+		}
+
+		key := id
+		if sheet != "" {
+			key = sheet + "!" + id
+		}
+		switch resolutions[key] {
+		case ResolveBranch:
+			takeBranch(id, br)
+			result.Applied++
+			result.Resolved++
+			continue
+		case ResolveMain:
+			result.Resolved++
+			continue
+		}
+
+		row, col, ok := formula.ParseCellID(id)
+		if !ok {
+			row, col = -1, -1
+		}
+		conflicts = append(conflicts, SheetMergeConflict{
+			Sheet:  sheet,
+			ID:     id,
+			Row:    row,
+			Col:    col,
+			Base:   b.raw(),
+			Main:   m.raw(),
+			Branch: br.raw(),
+		})
+	}
+	merged["data"] = mergedData
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Row != conflicts[j].Row {
+			return conflicts[i].Row < conflicts[j].Row
+		}
+		return conflicts[i].Col < conflicts[j].Col
+	})
+	result.Conflicts = append(result.Conflicts, conflicts...)
+
+	for _, key := range []string{"columnWidths", "rowHeights"} {
+		record, applied := mergeRecordThreeWay(baseSheet[key], mainSheet[key], branchSheet[key])
+		merged[key] = record
+		result.AppliedMeta += applied
+	}
+
+	for _, key := range []string{"freezePosition", "mergedCells"} {
+		if reflect.DeepEqual(mainSheet[key], baseSheet[key]) && !reflect.DeepEqual(branchSheet[key], baseSheet[key]) {
+			if v, ok := branchSheet[key]; ok {
+				merged[key] = v
+			} else {
+				delete(merged, key)
+			}
+			result.AppliedMeta++
+		}
+	}
+
+	rowCount := 0.0
+	for _, state := range []map[string]any{baseSheet, mainSheet, branchSheet} {
+		if n, ok := state["rowCount"].(float64); ok && n > rowCount {
+			rowCount = n
+		}
+	}
+	merged["rowCount"] = rowCount
+
+	return merged
+}
+
+// mergeCellInput is the user-editable part of a cell; computed values are
+// derived and ignored by the merge. nil means an empty cell.
+type mergeCellInput struct {
+	value string
+	style map[string]any
+}
+
+func normalizeMergeCell(cellAny any) *mergeCellInput {
+	cell, _ := cellAny.(map[string]any)
+	if cell == nil {
+		return nil
+	}
+	style, _ := cell["style"].(map[string]any)
+	if len(style) == 0 {
+		style = nil
+	}
+	value := formula.CellRawValue(cell)
+	if value == "" && style == nil {
+		return nil
+	}
+	return &mergeCellInput{value: value, style: style}
+}
+
+func (c *mergeCellInput) equal(other *mergeCellInput) bool {
+	if c == nil || other == nil {
+		return c == nil && other == nil
+	}
+	return c.value == other.value && reflect.DeepEqual(c.style, other.style)
+}
+
+func (c *mergeCellInput) raw() string {
+	if c == nil {
+		return ""
+	}
+	return c.value
+}
+
+// mergeRecordThreeWay merges a {key: number} record such as columnWidths.
+// Keys changed on both sides keep main's value.
+func mergeRecordThreeWay(baseAny, mainAny, branchAny any) (map[string]any, int) {
+	base, _ := baseAny.(map[string]any)
+	main, _ := mainAny.(map[string]any)
+	branch, _ := branchAny.(map[string]any)
+
+	merged := make(map[string]any, len(main))
+	for k, v := range main {
+		merged[k] = v
+	}
+
+	keys := make(map[string]struct{}, len(main))
+	for _, record := range []map[string]any{base, main, branch} {
+		for k := range record {
+			keys[k] = struct{}{}
+		}
+	}
+
+	applied := 0
+	for k := range keys {
+		b, m, br := base[k], main[k], branch[k]
+		if reflect.DeepEqual(br, m) {
+			continue
+		}
+		if reflect.DeepEqual(m, b) {
+			if v, ok := br.(float64); ok {
+				merged[k] = v
+			} else {
+				delete(merged, k)
+			}
+			applied++
+		}
+	}
+	return merged, applied
+}
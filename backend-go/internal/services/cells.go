@@ -0,0 +1,638 @@
+package services
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Cells of a file are stored as sheet_cells rows, and SheetFile.State only
+// keeps the layout with empty "data" maps. Files saved before keep their
+// cells inline until their next write; both forms read the same.
+
+// cellBatchSize is how many cells are inserted per statement.
+const cellBatchSize = 500
+
+// CellRange bounds a range read; rows and columns are 0-based and inclusive.
+type CellRange struct {
+	MinRow, MaxRow, MinCol, MaxCol int
+}
+
+type cellKey struct {
+	sheet, row, col int
+}
+
+var cellPrimaryKey = []clause.Column{{Name: "file_id"}, {Name: "sheet"}, {Name: "row"}, {Name: "col"}}
+
+// stateSheetList lists the sheets of a state by index; 0 is the state
+// itself.
+func stateSheetList(state map[string]any) []map[string]any {
+	return append([]map[string]any{state}, extraSheets(state)...)
+}
+
+// loadCells fills file.State with the file's stored cells, all of them or,
+// with sheet >= 0, those of one sheet inside r. A state that still holds
+// its cells is complete as it is.
+func loadCells(db *gorm.DB, file *models.SheetFile, sheet int, r *CellRange) error {
+	if hasInlineCells(file.State) {
+		return nil
+	}
+	query := db.Where("file_id = ?", file.ID)
+	if sheet >= 0 {
+		query = query.Where("sheet = ?", sheet)
+	}
+	if r != nil {
+		query = query.
+			Where("? BETWEEN ? AND ?", clause.Column{Name: "row"}, r.MinRow, r.MaxRow).
+			Where("? BETWEEN ? AND ?", clause.Column{Name: "col"}, r.MinCol, r.MaxCol)
+	}
+	var cells []models.SheetCell
+	if err := query.Find(&cells).Error; err != nil {
+		return err
+	}
+	if len(cells) == 0 {
+		return nil
+	}
+
+	styles, err := cellStyles(db, cells)
+	if err != nil {
+		return err
+	}
+
+	var state map[string]any
+	if err := json.Unmarshal(file.State, &state); err != nil || state == nil {
+		return fmt.Errorf("failed to decode file state: %w", err)
+	}
+	sheets := stateSheetList(state)
+	for _, cell := range cells {
+		if cell.Sheet < 0 || cell.Sheet >= len(sheets) {
+			continue
+		}
+		data, _ := sheets[cell.Sheet]["data"].(map[string]any)
+		if data == nil {
+			data = map[string]any{}
+			sheets[cell.Sheet]["data"] = data
+		}
+		entry := map[string]any{"value": cell.Value}
+		if len(cell.Computed) > 0 {
+			entry["computed"] = cell.Computed
+		}
+		if cell.StyleID != nil {
+			if style, ok := styles[*cell.StyleID]; ok {
+				entry["style"] = style
+			}
+		}
+		data[fmt.Sprintf("%d,%d", cell.Row, cell.Col)] = entry
+	}
+
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode file state: %w", err)
+	}
+	file.State = raw
+	return nil
+}
+
+// cellStyles returns the styles of stored cells by ID.
+func cellStyles(db *gorm.DB, cells []models.SheetCell) (map[uint]json.RawMessage, error) {
+	styleIDs := map[uint]bool{}
+	for _, cell := range cells {
+		if cell.StyleID != nil {
+			styleIDs[*cell.StyleID] = true
+		}
+	}
+	styles := make(map[uint]json.RawMessage, len(styleIDs))
+	if len(styleIDs) == 0 {
+		return styles, nil
+	}
+	ids := make([]uint, 0, len(styleIDs))
+	for id := range styleIDs {
+		ids = append(ids, id)
+	}
+	var rows []models.SheetStyle
+	if err := db.Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		styles[row.ID] = row.Style
+	}
+	return styles, nil
+}
+
+// cellLoader loads the cells of a patched file into its decoded state as a
+// patch needs them, so a patch reads the cells it edits and those its
+// formulas read rather than the whole file. Every loaded cell is kept in
+// before as stored; a cell is loaded once, so one a patch deleted is not
+// brought back. A file that still holds its cells inline is complete from
+// the start.
+type cellLoader struct {
+	tx     *gorm.DB
+	fileID uint
+	state  *models.SheetState
+	inline bool
+	before map[cellKey]models.CellData
+	whole  map[int]bool
+	// err is the first error of bounds, which cannot return it.
+	err error
+}
+
+func newCellLoader(tx *gorm.DB, fileID uint, state *models.SheetState, inline bool) *cellLoader {
+	l := &cellLoader{tx: tx, fileID: fileID, state: state, inline: inline, before: map[cellKey]models.CellData{}, whole: map[int]bool{}}
+	if inline {
+		for index, sheet := range StateSheets(state) {
+			for id, cell := range sheet.Data {
+				if row, col, ok := formula.ParseCellID(id); ok {
+					l.before[cellKey{index, row, col}] = cell
+				}
+			}
+		}
+	}
+	return l
+}
+
+// sheet loads every cell of a sheet.
+func (l *cellLoader) sheet(index int) error {
+	if l.inline || l.whole[index] {
+		return nil
+	}
+	if _, err := l.load(index, l.tx); err != nil {
+		return err
+	}
+	l.whole[index] = true
+	return nil
+}
+
+// sheetNamed loads every cell of the sheet with the given name, "" being
+// the first.
+func (l *cellLoader) sheetNamed(name string) error {
+	_, index, _, err := LookupSheet(l.state, name)
+	if err != nil {
+		return err
+	}
+	return l.sheet(index)
+}
+
+// cells loads the cells of a sheet inside r and returns the IDs of those
+// it had not loaded before.
+func (l *cellLoader) cells(index int, r CellRange) ([]string, error) {
+	if l.inline || l.whole[index] {
+		return nil, nil
+	}
+	return l.load(index, l.tx.
+		Where("? BETWEEN ? AND ?", clause.Column{Name: "row"}, r.MinRow, r.MaxRow).
+		Where("? BETWEEN ? AND ?", clause.Column{Name: "col"}, r.MinCol, r.MaxCol))
+}
+
+// keys loads the cells of a sheet with the given "row,col" IDs.
+func (l *cellLoader) keys(index int, ids []string) error {
+	if l.inline || l.whole[index] {
+		return nil
+	}
+	var pairs []any
+	for _, id := range ids {
+		row, col, ok := formula.ParseCellID(id)
+		if !ok {
+			continue
+		}
+		if _, loaded := l.before[cellKey{index, row, col}]; !loaded {
+			pairs = append(pairs, []any{row, col})
+		}
+	}
+	for start := 0; start < len(pairs); start += cellBatchSize {
+		batch := pairs[start:min(start+cellBatchSize, len(pairs))]
+		if _, err := l.load(index, l.tx.Where("(?, ?) IN ?", clause.Column{Name: "row"}, clause.Column{Name: "col"}, batch)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formulas loads every formula cell of a sheet.
+func (l *cellLoader) formulas(index int) error {
+	if l.inline || l.whole[index] {
+		return nil
+	}
+	_, err := l.load(index, l.tx.Where("value LIKE ?", "=%"))
+	return err
+}
+
+// bounds returns the used rows and columns of a stored sheet.
+func (l *cellLoader) bounds(index int) (rows, cols int) {
+	if l.inline || l.err != nil {
+		return 0, 0
+	}
+	var used struct{ UsedRows, UsedCols int }
+	l.err = l.tx.Model(&models.SheetCell{}).
+		Select("COALESCE(MAX(?) + 1, 0) AS used_rows, COALESCE(MAX(?) + 1, 0) AS used_cols", clause.Column{Name: "row"}, clause.Column{Name: "col"}).
+		Where("file_id = ? AND sheet = ?", l.fileID, index).
+		Scan(&used).Error
+	return used.UsedRows, used.UsedCols
+}
+
+// load adds the cells of a sheet that query finds.
+func (l *cellLoader) load(index int, query *gorm.DB) ([]string, error) {
+	sheets := StateSheets(l.state)
+	if index < 0 || index >= len(sheets) {
+		return nil, nil
+	}
+	var rows []models.SheetCell
+	if err := query.Where("file_id = ? AND sheet = ?", l.fileID, index).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	styles, err := cellStyles(l.tx, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	sheet := sheets[index]
+	if sheet.Data == nil {
+		sheet.Data = map[string]models.CellData{}
+	}
+	var added []string
+	for _, row := range rows {
+		key := cellKey{index, row.Row, row.Col}
+		if _, loaded := l.before[key]; loaded {
+			continue
+		}
+		cell := models.CellData{Value: row.Value}
+		if len(row.Computed) > 0 {
+			_ = json.Unmarshal(row.Computed, &cell.Computed)
+		}
+		if row.StyleID != nil {
+			if style, ok := styles[*row.StyleID]; ok {
+				_ = json.Unmarshal(style, &cell.Style)
+			}
+		}
+		id := fmt.Sprintf("%d,%d", row.Row, row.Col)
+		l.before[key] = cell
+		sheet.Data[id] = cell
+		added = append(added, id)
+	}
+	return added, nil
+}
+
+// changes compares the cells of the state with those loaded. It returns
+// the cells to write and to delete, and each of their stored values (nil
+// for a cell that was not stored) in row order.
+func (l *cellLoader) changes() (changed map[cellKey]models.CellData, removed []cellKey, old []undoCell) {
+	changed = map[cellKey]models.CellData{}
+	seen := map[cellKey]bool{}
+	for index, sheet := range StateSheets(l.state) {
+		for id, cell := range sheet.Data {
+			row, col, ok := formula.ParseCellID(id)
+			if !ok {
+				continue
+			}
+			key := cellKey{index, row, col}
+			seen[key] = true
+			prev, stored := l.before[key]
+			if stored && cellFingerprint(prev) == cellFingerprint(cell) {
+				continue
+			}
+			if _, _, ok := storedCell(l.fileID, key, cell); !ok && !stored {
+				continue
+			}
+			changed[key] = cell
+		}
+	}
+	for key := range l.before {
+		if !seen[key] {
+			removed = append(removed, key)
+		}
+	}
+
+	for key := range changed {
+		old = append(old, l.undoCell(key))
+	}
+	for _, key := range removed {
+		old = append(old, l.undoCell(key))
+	}
+	slices.SortFunc(old, func(a, b undoCell) int {
+		return cmp.Or(cmp.Compare(a.Sheet, b.Sheet), cmp.Compare(a.Row, b.Row), cmp.Compare(a.Col, b.Col))
+	})
+	return changed, removed, old
+}
+
+func (l *cellLoader) undoCell(key cellKey) undoCell {
+	u := undoCell{Sheet: key.sheet, Row: key.row, Col: key.col}
+	if prev, stored := l.before[key]; stored {
+		u.Cell = &prev
+	}
+	return u
+}
+
+// storedCell is the row of a cell, with its style until the style has an
+// ID. ok is false for a cell with nothing to store.
+func storedCell(fileID uint, key cellKey, cell models.CellData) (row models.SheetCell, style json.RawMessage, ok bool) {
+	row = models.SheetCell{FileID: fileID, Sheet: key.sheet, Row: key.row, Col: key.col, Value: cell.Value}
+	if cell.Computed != nil {
+		row.Computed, _ = json.Marshal(cell.Computed)
+	}
+	if cell.Style != nil && *cell.Style != (models.CellStyle{}) {
+		style, _ = json.Marshal(cell.Style)
+	}
+	return row, style, row.Value != "" || style != nil
+}
+
+// typedCell converts a cell of a state decoded into a map.
+func typedCell(cell map[string]any) models.CellData {
+	typed := models.CellData{Value: formula.CellRawValue(cell), Computed: cell["computed"]}
+	if style := cell["style"]; style != nil {
+		raw, _ := json.Marshal(style)
+		_ = json.Unmarshal(raw, &typed.Style)
+	}
+	return typed
+}
+
+// splitState takes the cells out of a state: it returns the state's layout
+// and its cells by key. Data keys that are not "row,col" stay in the layout.
+func splitState(raw json.RawMessage) (json.RawMessage, map[cellKey]models.CellData, error) {
+	var state map[string]any
+	if err := json.Unmarshal(raw, &state); err != nil || state == nil {
+		return raw, nil, nil
+	}
+	cells := map[cellKey]models.CellData{}
+	for index, sheet := range stateSheetList(state) {
+		data, ok := sheet["data"].(map[string]any)
+		if !ok {
+			continue
+		}
+		for id, cell := range data {
+			row, col, ok := formula.ParseCellID(id)
+			if !ok {
+				continue
+			}
+			if m, ok := cell.(map[string]any); ok {
+				cells[cellKey{index, row, col}] = typedCell(m)
+			}
+			delete(data, id)
+		}
+	}
+	layout, err := json.Marshal(state)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode file state: %w", err)
+	}
+	return layout, cells, nil
+}
+
+// hasInlineCells reports whether a stored state still holds its cells, as
+// files saved before sheet_cells do.
+func hasInlineCells(raw json.RawMessage) bool {
+	var probe struct {
+		Data   map[string]json.RawMessage `json:"data"`
+		Sheets []struct {
+			Data map[string]json.RawMessage `json:"data"`
+		} `json:"sheets"`
+	}
+	if json.Unmarshal(raw, &probe) != nil {
+		return false
+	}
+	maps := []map[string]json.RawMessage{probe.Data}
+	for _, sheet := range probe.Sheets {
+		maps = append(maps, sheet.Data)
+	}
+	for _, data := range maps {
+		for id := range data {
+			if _, _, ok := formula.ParseCellID(id); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// saveFile writes a file and replaces its stored cells with those of its
+// State. file.State still holds the whole state afterwards.
+func saveFile(tx *gorm.DB, file *models.SheetFile) error {
+	if err := freezeLiveVersion(tx, file.ID); err != nil {
+		return err
+	}
+	full := file.State
+	layout, cells, err := splitState(full)
+	if err != nil {
+		return err
+	}
+	file.State = layout
+	err = tx.Save(file).Error
+	file.State = full
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Where("file_id = ?", file.ID).Delete(&models.SheetCell{}).Error; err != nil {
+		return err
+	}
+	return upsertCells(tx, file.ID, cells)
+}
+
+// saveCellChanges writes a patched file: its layout, and the cells of the
+// given sheets that differ from before (a cellSnapshot taken before the
+// edits).
+func saveCellChanges(tx *gorm.DB, file *models.SheetFile, state map[string]any, before map[cellKey]string, sheets map[int]bool) error {
+	if err := freezeLiveVersion(tx, file.ID); err != nil {
+		return err
+	}
+	sheetList := stateSheetList(state)
+	changed := map[cellKey]models.CellData{}
+	var removed []cellKey
+	seen := map[cellKey]bool{}
+	for index := range sheets {
+		if index >= len(sheetList) {
+			continue
+		}
+		data, _ := sheetList[index]["data"].(map[string]any)
+		for id, cell := range data {
+			row, col, ok := formula.ParseCellID(id)
+			m, isMap := cell.(map[string]any)
+			if !ok || !isMap {
+				continue
+			}
+			key := cellKey{index, row, col}
+			seen[key] = true
+			if before[key] != cellFingerprint(m) {
+				changed[key] = typedCell(m)
+			}
+		}
+	}
+	for key := range before {
+		if !seen[key] {
+			removed = append(removed, key)
+		}
+	}
+
+	full := file.State
+	layout, _, err := splitState(full)
+	if err != nil {
+		return err
+	}
+	file.State = layout
+	err = tx.Save(file).Error
+	file.State = full
+	if err != nil {
+		return err
+	}
+	return writeCellChanges(tx, file.ID, changed, removed)
+}
+
+// stateLayout encodes a typed state without its cells.
+func stateLayout(state *models.SheetState) (json.RawMessage, error) {
+	layout := *state
+	layout.Data = map[string]models.CellData{}
+	layout.Sheets = make([]models.Sheet, len(state.Sheets))
+	for i, sheet := range state.Sheets {
+		sheet.Data = map[string]models.CellData{}
+		layout.Sheets[i] = sheet
+	}
+	raw, err := json.Marshal(layout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode file state: %w", err)
+	}
+	return raw, nil
+}
+
+// writeCellChanges stores the changed cells of a file and deletes the
+// removed ones; a changed cell with nothing to store is deleted as well.
+func writeCellChanges(tx *gorm.DB, fileID uint, changed map[cellKey]models.CellData, removed []cellKey) error {
+	for key := range changed {
+		if _, _, ok := storedCell(fileID, key, changed[key]); !ok {
+			delete(changed, key)
+			removed = append(removed, key)
+		}
+	}
+	for _, key := range removed {
+		if err := tx.Where(map[string]any{"file_id": fileID, "sheet": key.sheet, "row": key.row, "col": key.col}).
+			Delete(&models.SheetCell{}).Error; err != nil {
+			return err
+		}
+	}
+	return upsertCells(tx, fileID, changed)
+}
+
+// checkStoredCells fails with ErrInvalidState when a write left a file
+// with more cells than limits allow; the caller rolls the write back.
+func checkStoredCells(tx *gorm.DB, fileID uint, limits StateLimits) error {
+	var count int64
+	if err := tx.Model(&models.SheetCell{}).Where("file_id = ?", fileID).Count(&count).Error; err != nil {
+		return err
+	}
+	return limits.checkCellCount(int(count))
+}
+
+// cellSnapshot fingerprints the cells of the given sheets, so
+// saveCellChanges can tell which ones an edit changed.
+func cellSnapshot(state map[string]any, sheets map[int]bool) map[cellKey]string {
+	snapshot := map[cellKey]string{}
+	for index, sheet := range stateSheetList(state) {
+		if !sheets[index] {
+			continue
+		}
+		data, _ := sheet["data"].(map[string]any)
+		for id, cell := range data {
+			row, col, ok := formula.ParseCellID(id)
+			m, isMap := cell.(map[string]any)
+			if ok && isMap {
+				snapshot[cellKey{index, row, col}] = cellFingerprint(m)
+			}
+		}
+	}
+	return snapshot
+}
+
+func cellFingerprint(cell any) string {
+	raw, _ := json.Marshal(cell)
+	return string(raw)
+}
+
+// upsertCells inserts or replaces the given cells, skipping empty ones.
+func upsertCells(tx *gorm.DB, fileID uint, cells map[cellKey]models.CellData) error {
+	rows := make([]models.SheetCell, 0, len(cells))
+	styleOf := map[int]string{}
+	styles := map[string]json.RawMessage{}
+	for key, cell := range cells {
+		row, style, ok := storedCell(fileID, key, cell)
+		if !ok {
+			continue
+		}
+		if style != nil {
+			hash := styleHash(style)
+			styles[hash] = style
+			styleOf[len(rows)] = hash
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	ids, err := styleIDs(tx, styles)
+	if err != nil {
+		return err
+	}
+	for i, hash := range styleOf {
+		id := ids[hash]
+		rows[i].StyleID = &id
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   cellPrimaryKey,
+		DoUpdates: clause.AssignmentColumns([]string{"value", "computed", "style_id"}),
+	}).CreateInBatches(&rows, cellBatchSize).Error
+}
+
+func styleHash(style json.RawMessage) string {
+	sum := sha256.Sum256(style)
+	return hex.EncodeToString(sum[:])
+}
+
+// styleIDs returns the IDs of styles by hash, storing the new ones.
+func styleIDs(tx *gorm.DB, styles map[string]json.RawMessage) (map[string]uint, error) {
+	ids := make(map[string]uint, len(styles))
+	if len(styles) == 0 {
+		return ids, nil
+	}
+	hashes := make([]string, 0, len(styles))
+	for hash := range styles {
+		hashes = append(hashes, hash)
+	}
+	find := func(hashes []string) error {
+		var found []models.SheetStyle
+		if err := tx.Select("id", "hash").Where("hash IN ?", hashes).Find(&found).Error; err != nil {
+			return err
+		}
+		for _, style := range found {
+			ids[style.Hash] = style.ID
+		}
+		return nil
+	}
+	if err := find(hashes); err != nil {
+		return nil, err
+	}
+
+	var missing []models.SheetStyle
+	var missingHashes []string
+	for _, hash := range hashes {
+		if _, ok := ids[hash]; !ok {
+			missing = append(missing, models.SheetStyle{Hash: hash, Style: styles[hash]})
+			missingHashes = append(missingHashes, hash)
+		}
+	}
+	if len(missing) == 0 {
+		return ids, nil
+	}
+	// Another writer may store the same style meanwhile.
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&missing).Error; err != nil {
+		return nil, err
+	}
+	if err := find(missingHashes); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
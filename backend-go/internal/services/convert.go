@@ -0,0 +1,340 @@
+package services
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Conversion targets of /convert.
+const (
+	TargetCSV    = "csv"
+	TargetTSV    = "tsv"
+	TargetXLSX   = "xlsx"
+	TargetJSON   = "json"
+	TargetNDJSON = "ndjson"
+	TargetODS    = "ods"
+)
+
+// ErrUnsupportedTarget is returned for a conversion target not in ConvertTargets.
+var ErrUnsupportedTarget = errors.New("unsupported conversion target")
+
+// ConvertTargets lists the targets in the order the API documents them.
+var ConvertTargets = []string{TargetCSV, TargetTSV, TargetXLSX, TargetJSON, TargetNDJSON, TargetODS}
+
+var convertContentTypes = map[string]string{
+	TargetCSV:    "text/csv",
+	TargetTSV:    "text/tab-separated-values",
+	TargetXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	TargetJSON:   "application/json",
+	TargetNDJSON: "application/x-ndjson",
+	TargetODS:    odsMimeType,
+}
+
+// ParseConvertTarget normalizes a target name; "" is CSV.
+func ParseConvertTarget(target string) (string, error) {
+	target = strings.ToLower(strings.TrimSpace(target))
+	switch target {
+	case "":
+		return TargetCSV, nil
+	case "jsonl":
+		return TargetNDJSON, nil
+	}
+	if _, ok := convertContentTypes[target]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedTarget, target)
+	}
+	return target, nil
+}
+
+// ConvertContentType is the media type of a conversion target.
+func ConvertContentType(target string) string {
+	return convertContentTypes[target]
+}
+
+// SheetIndex resolves a sheet chosen by name (case-insensitive) or by
+// 0-based index; "" is the first sheet. Names win over indexes, so a sheet
+// called "2" is found by its name.
+func (w *WorkbookReader) SheetIndex(sheet string) (int, error) {
+	sheet = strings.TrimSpace(sheet)
+	if sheet == "" {
+		return 0, nil
+	}
+	for i, name := range w.Sheets {
+		if strings.EqualFold(name, sheet) {
+			return i, nil
+		}
+	}
+	if i, err := strconv.Atoi(sheet); err == nil && i >= 0 && i < len(w.Sheets) {
+		return i, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrSheetNotFound, sheet)
+}
+
+// Convert writes the sheet at index in the target format. CSV, TSV, JSON
+// and NDJSON stream row by row; XLSX and ODS carry the sheet's formulas,
+// styles and layout, so they read the sheet whole.
+func (w *WorkbookReader) Convert(index int, target string, out io.Writer) error {
+	if index < 0 || index >= len(w.Sheets) {
+		return fmt.Errorf("%w: #%d", ErrSheetNotFound, index)
+	}
+	switch target {
+	case TargetCSV, TargetTSV:
+		writer := csv.NewWriter(out)
+		if target == TargetTSV {
+			writer.Comma = '\t'
+		}
+		if err := w.EachRow(index, writer.Write); err != nil {
+			return err
+		}
+		writer.Flush()
+		return writer.Error()
+	case TargetJSON, TargetNDJSON:
+		return w.convertRecords(index, target == TargetNDJSON, out)
+	case TargetXLSX, TargetODS:
+		state, err := w.sheetState(index)
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if target == TargetODS {
+			return ExportODS(raw, out)
+		}
+		f, err := ExportXLSX(raw)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Write(out)
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedTarget, target)
+}
+
+// sheetState reads the sheet at index with formatting as a one-sheet state
+// and evaluates its formulas, whose results the exporters write.
+func (w *WorkbookReader) sheetState(index int) (map[string]any, error) {
+	state, err := readWorkbookState(w.path, w.filename, w.csvOpts, nil)
+	if err != nil {
+		return nil, err
+	}
+	sheet := state
+	if index > 0 {
+		sheets := extraSheets(state)
+		if index-1 >= len(sheets) {
+			return nil, fmt.Errorf("%w: #%d", ErrSheetNotFound, index)
+		}
+		sheet = sheets[index-1]
+	}
+
+	single := make(map[string]any, len(sheet))
+	for key, value := range sheet {
+		if key != "sheets" && key != "name" {
+			single[key] = value
+		}
+	}
+	single["sheetName"] = w.Sheets[index]
+	recalculateWorkbook(single)
+	return single, nil
+}
+
+// headerScanRows is how many rows from the first non-empty one may hold
+// the header, as in GET /files/:id/schema.
+const headerScanRows = 5
+
+// DetectHeaderRow guesses which of the leading rows of a table is its
+// header: the one with the most filled cells, text counting a little more
+// than numbers. rows should start at the first non-empty row; only the
+// first headerScanRows are considered.
+func DetectHeaderRow(rows [][]string) int {
+	header := 0
+	bestScore := -1.0
+	for r := 0; r < len(rows) && r < headerScanRows; r++ {
+		nonEmpty := 0
+		textLike := 0
+		for _, cell := range rows[r] {
+			v := strings.TrimSpace(cell)
+			if v == "" {
+				continue
+			}
+			nonEmpty++
+			if containsLetter(v) && !isNumericLike(v) {
+				textLike++
+			}
+		}
+		score := float64(nonEmpty) + float64(textLike)*0.25
+		if score > bestScore {
+			bestScore = score
+			header = r
+		}
+	}
+	return header
+}
+
+func containsLetter(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNumericLike(s string) bool {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(trimmed, 64)
+	return err == nil
+}
+
+func isBlankRow(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// convertRecords writes the rows below the detected header row as objects
+// keyed by header: a JSON array, or one object per line for NDJSON. Rows
+// above the header (titles) and blank rows are left out; cells without a
+// header are keyed by their column letter.
+func (w *WorkbookReader) convertRecords(index int, ndjson bool, out io.Writer) error {
+	bw := bufio.NewWriter(out)
+	enc := recordEncoder{w: bw, ndjson: ndjson}
+
+	var lead [][]string
+	var keys []string
+	emit := func(row []string) error {
+		if isBlankRow(row) {
+			return nil
+		}
+		return enc.write(keys, row)
+	}
+	startBody := func() error {
+		h := DetectHeaderRow(lead)
+		keys = recordKeys(lead[h], 0)
+		for _, row := range lead[h+1:] {
+			if err := emit(row); err != nil {
+				return err
+			}
+		}
+		lead = nil
+		return nil
+	}
+
+	err := w.EachRow(index, func(row []string) error {
+		if keys != nil {
+			return emit(row)
+		}
+		if len(lead) == 0 && isBlankRow(row) {
+			return nil
+		}
+		lead = append(lead, row)
+		if len(lead) < headerScanRows {
+			return nil
+		}
+		return startBody()
+	})
+	if err == nil && keys == nil && len(lead) > 0 {
+		err = startBody()
+	}
+	if err != nil {
+		return err
+	}
+	if err := enc.close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// recordKeys turns a header row starting at column firstCol into unique
+// object keys; blank headers are named by their column letter.
+func recordKeys(header []string, firstCol int) []string {
+	keys := make([]string, len(header))
+	seen := map[string]int{}
+	for i, cell := range header {
+		key := strings.TrimSpace(cell)
+		if key == "" {
+			key, _ = excelize.ColumnNumberToName(firstCol + i + 1)
+		}
+		if n := seen[key]; n > 0 {
+			seen[key] = n + 1
+			key = fmt.Sprintf("%s_%d", key, n+1)
+		}
+		seen[key]++
+		keys[i] = key
+	}
+	return keys
+}
+
+// recordEncoder writes objects with their keys in column order.
+type recordEncoder struct {
+	w      *bufio.Writer
+	ndjson bool
+	count  int
+}
+
+func (e *recordEncoder) write(keys []string, row []string) error {
+	switch {
+	case e.ndjson:
+	case e.count == 0:
+		e.w.WriteByte('[')
+	default:
+		e.w.WriteByte(',')
+	}
+	e.count++
+
+	e.w.WriteByte('{')
+	n := max(len(keys), len(row))
+	for i := 0; i < n; i++ {
+		var key, value string
+		if i < len(keys) {
+			key = keys[i]
+		} else {
+			key, _ = excelize.ColumnNumberToName(i + 1)
+		}
+		if i < len(row) {
+			value = row[i]
+		}
+		if i >= len(keys) && value == "" {
+			continue
+		}
+		if i > 0 {
+			e.w.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(value)
+		e.w.Write(k)
+		e.w.WriteByte(':')
+		e.w.Write(v)
+	}
+	e.w.WriteByte('}')
+	if e.ndjson {
+		e.w.WriteByte('\n')
+	}
+	return nil
+}
+
+func (e *recordEncoder) close() error {
+	if e.ndjson {
+		return nil
+	}
+	if e.count == 0 {
+		_, err := e.w.WriteString("[]")
+		return err
+	}
+	return e.w.WriteByte(']')
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+)
+
+// ErrInvalidCSVOptions is returned by ParseCSVOptions for unknown
+// delimiters, quotes or encodings.
+var ErrInvalidCSVOptions = errors.New("invalid csv options")
+
+// CSVOptions controls how delimited text is parsed. Zero values are
+// detected from the data.
+type CSVOptions struct {
+	Delimiter rune   // 0 sniffs , ; tab and |
+	Quote     rune   // 0 is '"'
+	Encoding  string // "" detects UTF-8/UTF-16 by BOM, else Windows-1251 or -1252
+}
+
+// csvSniffBytes is how much of a file is inspected to detect its encoding
+// and delimiter.
+const csvSniffBytes = 64 * 1024
+
+// ParseCSVOptions validates user-supplied options; empty strings mean
+// "detect". Delimiters may be given by name: comma, semicolon, tab, pipe.
+func ParseCSVOptions(delimiter, quote, charset string) (CSVOptions, error) {
+	var opts CSVOptions
+	var ok bool
+	if delimiter != "" {
+		if opts.Delimiter, ok = ParseDelimiter(delimiter); !ok {
+			return opts, fmt.Errorf("%w: delimiter %q", ErrInvalidCSVOptions, delimiter)
+		}
+	}
+	if quote != "" {
+		r, size := utf8.DecodeRuneInString(quote)
+		if size != len(quote) || r == utf8.RuneError || r == '\r' || r == '\n' || r == opts.Delimiter {
+			return opts, fmt.Errorf("%w: quote %q", ErrInvalidCSVOptions, quote)
+		}
+		opts.Quote = r
+	}
+	if charset = strings.TrimSpace(charset); charset != "" {
+		if _, err := lookupEncoding(charset); err != nil {
+			return opts, fmt.Errorf("%w: encoding %q", ErrInvalidCSVOptions, charset)
+		}
+		opts.Encoding = charset
+	}
+	return opts, nil
+}
+
+// ParseDelimiter reads a delimiter name or single character.
+func ParseDelimiter(s string) (rune, bool) {
+	switch strings.ToLower(s) {
+	case "comma":
+		return ',', true
+	case "semicolon":
+		return ';', true
+	case "tab", `\t`:
+		return '\t', true
+	case "pipe":
+		return '|', true
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, false
+	}
+	return r, true
+}
+
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case "utf-8", "utf8":
+		return encoding.Nop, nil
+	}
+	return htmlindex.Get(name)
+}
+
+// CSVReader reads records from delimited text of any supported encoding.
+type CSVReader struct {
+	r         *csv.Reader
+	quote     rune
+	Delimiter rune   // the delimiter in use, given or sniffed
+	Encoding  string // the encoding in use, given or detected
+}
+
+// NewCSVReader prepares r for reading: it strips a BOM, decodes the text to
+// UTF-8 and sniffs the delimiter, as opts allow.
+func NewCSVReader(r io.Reader, opts CSVOptions) (*CSVReader, error) {
+	raw := bufio.NewReaderSize(r, csvSniffBytes)
+	sample, err := raw.Peek(csvSniffBytes)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+
+	var enc encoding.Encoding
+	name := opts.Encoding
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		enc, name = unicode.UTF8BOM, "utf-8"
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		enc, name = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), "utf-16le"
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		enc, name = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), "utf-16be"
+	case name != "":
+		if enc, err = lookupEncoding(name); err != nil {
+			return nil, fmt.Errorf("%w: encoding %q", ErrInvalidCSVOptions, name)
+		}
+	default:
+		name = detectCharset(sample)
+		enc, _ = lookupEncoding(name)
+	}
+
+	var text io.Reader = raw
+	if enc != encoding.Nop {
+		text = transform.NewReader(raw, enc.NewDecoder())
+	}
+	decoded := bufio.NewReaderSize(text, csvSniffBytes)
+
+	quote := opts.Quote
+	if quote == 0 {
+		quote = '"'
+	}
+	delimiter := opts.Delimiter
+	if delimiter == 0 {
+		head, _ := decoded.Peek(csvSniffBytes)
+		delimiter = sniffDelimiter(head, quote)
+	}
+
+	// encoding/csv only knows '"'. Another quote character is swapped with
+	// it on the way in and back in Read.
+	var input io.Reader = decoded
+	if quote != '"' {
+		input = transform.NewReader(decoded, runes.Map(func(r rune) rune {
+			switch r {
+			case quote:
+				return '"'
+			case '"':
+				return quote
+			}
+			return r
+		}))
+	}
+
+	reader := csv.NewReader(input)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1 // allow variable columns per row
+	reader.LazyQuotes = true
+	return &CSVReader{r: reader, quote: quote, Delimiter: delimiter, Encoding: name}, nil
+}
+
+// Read returns the next record or io.EOF.
+func (c *CSVReader) Read() ([]string, error) {
+	record, err := c.r.Read()
+	if err != nil || c.quote == '"' {
+		return record, err
+	}
+	for i, field := range record {
+		record[i] = strings.Map(func(r rune) rune {
+			switch r {
+			case '"':
+				return c.quote
+			case c.quote:
+				return '"'
+			}
+			return r
+		}, field)
+	}
+	return record, nil
+}
+
+// detectCharset names the encoding of BOM-less text: UTF-8 when it decodes,
+// otherwise Windows-1251 for mostly-Cyrillic bytes and Windows-1252 else.
+func detectCharset(sample []byte) string {
+	// The sample may end inside a multi-byte sequence.
+	trimmed := sample
+	for i := 0; i < utf8.UTFMax && len(trimmed) > 0 && !utf8.Valid(trimmed); i++ {
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	if utf8.Valid(trimmed) {
+		return "utf-8"
+	}
+
+	// Cyrillic letters are 0xC0-0xFF in Windows-1251, so Russian or Uzbek
+	// text is dominated by them; Western text only has a few accents.
+	high, latin := 0, 0
+	for _, b := range sample {
+		switch {
+		case b >= 0xC0:
+			high++
+		case (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z'):
+			latin++
+		}
+	}
+	if high*3 >= high+latin {
+		return "windows-1251"
+	}
+	return "windows-1252"
+}
+
+// sniffDelimiter picks the candidate that splits the first lines of head
+// into the same, non-zero number of fields most consistently.
+func sniffDelimiter(head []byte, quote rune) rune {
+	lines := make([]map[rune]int, 0, 10)
+	counts := map[rune]int{}
+	inQuotes := false
+	for _, r := range string(head) {
+		switch {
+		case r == quote:
+			inQuotes = !inQuotes
+		case inQuotes:
+		case r == '\n':
+			lines = append(lines, counts)
+			counts = map[rune]int{}
+		case r == ',' || r == ';' || r == '\t' || r == '|':
+			counts[r]++
+		}
+		if len(lines) == cap(lines) {
+			break
+		}
+	}
+	if len(counts) > 0 && len(lines) < cap(lines) {
+		lines = append(lines, counts)
+	}
+
+	best, bestScore := ',', 0
+	for _, candidate := range []rune{',', ';', '\t', '|'} {
+		score := 0
+		for _, line := range lines {
+			if n := line[candidate]; n > 0 && n == lines[0][candidate] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,439 @@
+package services
+
+import (
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ExportXLSX writes a file state as an Excel workbook: every sheet with its
+// values, formulas (plus their last computed value), cell styles, merged
+// cells, column widths, row heights, frozen panes and named ranges. The
+// caller closes the returned file.
+func ExportXLSX(raw json.RawMessage) (*excelize.File, error) {
+	state, err := DecodeState(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	f := excelize.NewFile()
+	styles := xlsxStyleWriter{f: f, ids: map[string]int{}}
+	used := map[string]bool{}
+	var titles []string
+	sheets := StateSheets(state)
+	for i, name := range StateSheetNames(state) {
+		title := xlsxSheetTitle(name, i, used)
+		titles = append(titles, title)
+		if i == 0 {
+			err = f.SetSheetName("Sheet1", title)
+		} else {
+			_, err = f.NewSheet(title)
+		}
+		if err == nil {
+			err = writeXLSXSheet(f, title, sheets[i], &styles)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to write sheet %q: %w", name, err)
+		}
+	}
+
+	// Named ranges become workbook-level defined names. One Excel does not
+	// accept is left out rather than failing the export.
+	for _, named := range exportedNames(state) {
+		_ = f.SetDefinedName(&excelize.DefinedName{
+			Name:     named.name,
+			RefersTo: quoteSheetTitle(titles[named.sheet]) + "!" + absoluteA1(named.cells, ""),
+		})
+	}
+
+	// Formulas carry the editor's result as cached value; let Excel
+	// recalculate them with its own engine on open.
+	fullCalc := true
+	if err := f.SetCalcProps(&excelize.CalcPropsOptions{FullCalcOnLoad: &fullCalc}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// xlsxSheetTitle makes name a valid, unique worksheet title.
+func xlsxSheetTitle(name string, index int, used map[string]bool) string {
+	title := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, strings.Trim(strings.TrimSpace(name), "'"))
+	if runes := []rune(title); len(runes) > 31 {
+		title = string(runes[:31])
+	}
+	if title == "" {
+		title = fmt.Sprintf("Sheet%d", index+1)
+	}
+	base := title
+	for n := 2; used[strings.ToLower(title)]; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		runes := []rune(base)
+		title = string(runes[:min(len(runes), 31-len(suffix))]) + suffix
+	}
+	used[strings.ToLower(title)] = true
+	return title
+}
+
+// quoteSheetTitle quotes a sheet title for a reference, as both Excel and
+// OpenDocument do.
+func quoteSheetTitle(title string) string {
+	return "'" + strings.ReplaceAll(title, "'", "''") + "'"
+}
+
+// absoluteA1 writes a range with '$' anchors: "$B$2:$B$200". Each cell is
+// prefixed with cellPrefix, "." in OpenDocument.
+func absoluteA1(r formula.Range, cellPrefix string) string {
+	cell := func(row, col int) string {
+		return cellPrefix + "$" + formula.ColumnLabel(col) + "$" + strconv.Itoa(row+1)
+	}
+	if r.StartRow == r.EndRow && r.StartCol == r.EndCol {
+		return cell(r.StartRow, r.StartCol)
+	}
+	return cell(r.StartRow, r.StartCol) + ":" + cell(r.EndRow, r.EndCol)
+}
+
+var isoDatePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+func writeXLSXSheet(f *excelize.File, title string, sheet *models.Sheet, styles *xlsxStyleWriter) error {
+	ids := make([]string, 0, len(sheet.Data))
+	for id := range sheet.Data {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		row, col, ok := formula.ParseCellID(id)
+		if !ok {
+			continue
+		}
+		cell := sheet.Data[id]
+		axis, err := excelize.CoordinatesToCellName(col+1, row+1)
+		if err != nil {
+			continue
+		}
+
+		value := cell.Value
+		isDate := false
+		switch {
+		case strings.HasPrefix(value, "=") && len(value) > 1:
+			if cell.Computed != nil {
+				if err := f.SetCellValue(title, axis, cell.Computed); err != nil {
+					return err
+				}
+			}
+			if err := f.SetCellFormula(title, axis, value[1:]); err != nil {
+				return err
+			}
+		case isoDatePattern.MatchString(value):
+			t, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				err = f.SetCellStr(title, axis, value)
+			} else {
+				isDate = true
+				err = f.SetCellValue(title, axis, t)
+			}
+			if err != nil {
+				return err
+			}
+		case value != "":
+			var err error
+			switch v := formula.LiteralValue(value); v.Kind {
+			case formula.KindNumber:
+				err = f.SetCellFloat(title, axis, v.Num, -1, 64)
+			case formula.KindBool:
+				err = f.SetCellBool(title, axis, v.Bool)
+			default:
+				err = f.SetCellStr(title, axis, value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if !hasStyle(cell) && !isDate {
+			continue
+		}
+		styleID, err := styles.get(cell.Style, isDate)
+		if err != nil {
+			return err
+		}
+		if err := f.SetCellStyle(title, axis, axis, styleID); err != nil {
+			return err
+		}
+	}
+
+	// Pixel sizes are converted back the way the importer reads them.
+	for col, px := range sheet.ColumnWidths {
+		if col < 0 || px <= 0 {
+			continue
+		}
+		name, err := excelize.ColumnNumberToName(col + 1)
+		if err != nil {
+			continue
+		}
+		if err := f.SetColWidth(title, name, name, math.Max((px-5)/7, 0)); err != nil {
+			return err
+		}
+	}
+	for row, px := range sheet.RowHeights {
+		if row < 0 || px <= 0 {
+			continue
+		}
+		if err := f.SetRowHeight(title, row+1, math.Min(px*3/4, 409)); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range sheet.MergedCells {
+		if m.StartRow == m.EndRow && m.StartCol == m.EndCol {
+			continue
+		}
+		from, err1 := excelize.CoordinatesToCellName(m.StartCol+1, m.StartRow+1)
+		to, err2 := excelize.CoordinatesToCellName(m.EndCol+1, m.EndRow+1)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if err := f.MergeCell(title, from, to); err != nil {
+			return err
+		}
+	}
+
+	if freeze := sheet.FreezePosition; freeze != nil {
+		rows, cols := freeze.Rows, freeze.Cols
+		if rows > 0 || cols > 0 {
+			topLeft, err := excelize.CoordinatesToCellName(cols+1, rows+1)
+			if err != nil {
+				return err
+			}
+			pane := "bottomRight"
+			switch {
+			case cols == 0:
+				pane = "bottomLeft"
+			case rows == 0:
+				pane = "topRight"
+			}
+			if err := f.SetPanes(title, &excelize.Panes{
+				Freeze:      true,
+				XSplit:      cols,
+				YSplit:      rows,
+				TopLeftCell: topLeft,
+				ActivePane:  pane,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// xlsxStyleWriter registers each distinct CellStyle once.
+type xlsxStyleWriter struct {
+	f   *excelize.File
+	ids map[string]int
+}
+
+func (w *xlsxStyleWriter) get(style *models.CellStyle, isDate bool) (int, error) {
+	encoded, _ := json.Marshal(style)
+	key := fmt.Sprintf("%s|%t", encoded, isDate)
+	if id, ok := w.ids[key]; ok {
+		return id, nil
+	}
+	id, err := w.f.NewStyle(xlsxStyleFromCell(style, isDate))
+	if err != nil {
+		return 0, err
+	}
+	w.ids[key] = id
+	return id, nil
+}
+
+// xlsxStyleFromCell is the inverse of cellStyleFromXLSX.
+func xlsxStyleFromCell(style *models.CellStyle, isDate bool) *excelize.Style {
+	s := &excelize.Style{}
+	if style == nil {
+		style = &models.CellStyle{}
+	}
+
+	font := &excelize.Font{}
+	hasFont := false
+	if isSet(style.Bold) {
+		font.Bold, hasFont = true, true
+	}
+	if isSet(style.Italic) {
+		font.Italic, hasFont = true, true
+	}
+	if isSet(style.Underline) {
+		font.Underline, hasFont = "single", true
+	}
+	if color := cssColor(style.Color); color != "" {
+		font.Color, hasFont = color, true
+	}
+	if size := style.FontSize; size != nil && *size > 0 {
+		font.Size, hasFont = *size, true
+	}
+	if family := style.FontFamily; family != "" {
+		font.Family, hasFont = family, true
+	}
+	if hasFont {
+		s.Font = font
+	}
+
+	if color := cssColor(style.BackgroundColor); color != "" {
+		s.Fill = excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{color}}
+	}
+
+	align := &excelize.Alignment{}
+	hasAlign := false
+	switch h := style.TextAlign; h {
+	case "left", "center", "right":
+		align.Horizontal, hasAlign = h, true
+	}
+	switch v := style.VerticalAlign; v {
+	case "top", "bottom":
+		align.Vertical, hasAlign = v, true
+	case "middle":
+		align.Vertical, hasAlign = "center", true
+	}
+	if style.WrapMode == "wrap" {
+		align.WrapText, hasAlign = true, true
+	}
+	if rotation := style.Rotation; rotation != nil && *rotation != 0 {
+		r := int(math.Max(-90, math.Min(90, *rotation)))
+		if r < 0 {
+			r = 90 - r
+		}
+		align.TextRotation, hasAlign = r, true
+	}
+	if hasAlign {
+		s.Alignment = align
+	}
+
+	if borders := style.Borders; borders != nil {
+		color := cssColor(borders.Color)
+		if color == "" {
+			color = "000000"
+		}
+		line := 1
+		switch borders.Style {
+		case "dashed":
+			line = 3
+		case "dotted":
+			line = 4
+		}
+		for _, side := range borderSides(borders) {
+			s.Border = append(s.Border, excelize.Border{Type: side, Color: color, Style: line})
+		}
+	}
+
+	decimals := -1
+	if d := style.DecimalPlaces; d != nil && *d >= 0 {
+		decimals = min(*d, 10)
+	}
+	switch style.NumberFormat {
+	case "number":
+		format := "#,##0.###"
+		if decimals >= 0 {
+			format = "#,##0" + fractionFormat(decimals)
+		}
+		s.CustomNumFmt = &format
+	case "currency":
+		format := currencyFormat(style.CurrencyCode, decimals)
+		s.CustomNumFmt = &format
+	case "percent":
+		if decimals < 0 {
+			decimals = 2
+		}
+		format := "0" + fractionFormat(decimals) + "%"
+		s.CustomNumFmt = &format
+	default:
+		if isDate {
+			format := "yyyy-mm-dd"
+			s.CustomNumFmt = &format
+		} else if decimals >= 0 {
+			format := "0" + fractionFormat(decimals)
+			s.CustomNumFmt = &format
+		}
+	}
+	return s
+}
+
+// hasStyle reports whether a cell carries a non-empty style.
+func hasStyle(cell models.CellData) bool {
+	return cell.Style != nil && *cell.Style != (models.CellStyle{})
+}
+
+func isSet(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+// borderSides lists the sides a border is drawn on, in CSS order.
+func borderSides(borders *models.CellBorders) []string {
+	var sides []string
+	for _, side := range []struct {
+		name string
+		on   *bool
+	}{{"top", borders.Top}, {"right", borders.Right}, {"bottom", borders.Bottom}, {"left", borders.Left}} {
+		if isSet(side.on) {
+			sides = append(sides, side.name)
+		}
+	}
+	return sides
+}
+
+func fractionFormat(decimals int) string {
+	if decimals <= 0 {
+		return ""
+	}
+	return "." + strings.Repeat("0", decimals)
+}
+
+var currencySymbols = map[string]string{
+	"USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥", "CNY": "¥", "RUB": "₽", "INR": "₹", "KRW": "₩", "TRY": "₺",
+}
+
+// currencyFormat mirrors Intl currency formatting: two decimals unless the
+// style says otherwise.
+func currencyFormat(code string, decimals int) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		code = "USD"
+	}
+	if decimals < 0 {
+		decimals = 2
+	}
+	number := "#,##0" + fractionFormat(decimals)
+	if symbol, ok := currencySymbols[code]; ok {
+		return `"` + symbol + `"` + number
+	}
+	return `"` + code + ` "` + number
+}
+
+// cssColor converts "#RGB" or "#RRGGBB" to "RRGGBB"; other CSS colors are dropped.
+func cssColor(color string) string {
+	color = strings.TrimPrefix(strings.TrimSpace(color), "#")
+	if len(color) == 3 {
+		color = string([]byte{color[0], color[0], color[1], color[1], color[2], color[2]})
+	}
+	if len(color) != 6 {
+		return ""
+	}
+	if _, err := strconv.ParseUint(color, 16, 32); err != nil {
+		return ""
+	}
+	return strings.ToUpper(color)
+}
@@ -0,0 +1,469 @@
+package services
+
+import (
+	"archive/zip"
+	"converter-backend/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+var (
+	// ErrUnsupportedFormat is returned for file types the importer does not know.
+	ErrUnsupportedFormat = errors.New("unsupported file format")
+	// ErrUnreadableFile is returned when a file of a known type fails to parse.
+	ErrUnreadableFile = errors.New("file could not be read")
+)
+
+// ImportFile reads a spreadsheet from disk and saves it as a new file of
+// userID. Every worksheet is imported with its values, formulas, column
+// widths, row heights, merged cells and the cell styles the editor supports.
+func (s *SpreadsheetService) ImportFile(userID uint, name, path, filename string, csvOpts CSVOptions) (*models.SheetFile, error) {
+	return s.importFile(userID, name, path, filename, csvOpts, nil)
+}
+
+func (s *SpreadsheetService) importFile(userID uint, name, path, filename string, csvOpts CSVOptions, rows *rowCounter) (*models.SheetFile, error) {
+	state, err := readWorkbookState(path, filename, csvOpts, rows)
+	if err != nil {
+		if errors.Is(err, ErrUnsupportedFormat) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrUnreadableFile, err)
+	}
+	cells := 0
+	for _, sheet := range stateSheetList(state) {
+		data, _ := sheet["data"].(map[string]any)
+		cells += len(data)
+	}
+	if err := s.StateLimits.checkCellCount(cells); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode file state: %w", err)
+	}
+	return s.SaveFile(userID, name, raw)
+}
+
+// ReadWorkbookState reads a spreadsheet file into a workbook state.
+// CSV files carry values only; ODS and legacy XLS files have their own
+// readers. A .xls that is really XLSX inside is read as XLSX.
+func ReadWorkbookState(path, filename string, csvOpts CSVOptions) (map[string]any, error) {
+	return readWorkbookState(path, filename, csvOpts, nil)
+}
+
+// IsImportFormat reports whether ReadWorkbookState knows the extension of
+// filename.
+func IsImportFormat(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv", ".tsv", ".txt", ".ods", ".xls", ".xlsx", ".xlsm", ".xltx", ".xltm":
+		return true
+	}
+	return false
+}
+
+func readWorkbookState(path, filename string, csvOpts CSVOptions, rows *rowCounter) (map[string]any, error) {
+	if !IsImportFormat(filename) {
+		return nil, ErrUnsupportedFormat
+	}
+	if isDelimitedFile(filename) {
+		sheets, err := readWorkbook(path, filename, csvOpts, rows)
+		if err != nil {
+			return nil, err
+		}
+		return NewWorkbookState(sheets), nil
+	}
+	if isODSFile(filename) {
+		return readODSState(path, rows)
+	}
+	if strings.ToLower(filepath.Ext(filename)) == ".xls" && isOLEFile(path) {
+		return readXLSState(path, rows)
+	}
+
+	f, err := excelize.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	parts, err := xlsxSheetParts(&z.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	names := f.GetSheetList()
+	sheets := make([]map[string]any, 0, len(names))
+	styles := xlsxStyleCache{f: f, byID: map[int]map[string]any{}}
+	for _, name := range names {
+		sheet, err := readXLSXSheet(f, &z.Reader, parts[name], name, &styles, rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sheet %q: %w", name, err)
+		}
+		sheets = append(sheets, sheet)
+	}
+	return assembleWorkbook(names, sheets), nil
+}
+
+// readXLSXSheet reads a worksheet row by row: values from excelize's row
+// iterator, formulas, styles and layout from the worksheet part in step
+// with it.
+func readXLSXSheet(f *excelize.File, z *zip.Reader, part, name string, styles *xlsxStyleCache, counter *rowCounter) (map[string]any, error) {
+	rows, err := f.Rows(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stream, err := openXLSXSheet(z, part)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	data := map[string]any{}
+	heights := map[int]float64{}
+	var meta xlsxRow
+	more := true
+	maxCols, rowCount := 0, 0
+	for r := 1; rows.Next(); r++ {
+		values, err := rows.Columns(excelize.Options{RawCellValue: true})
+		if err != nil {
+			return nil, err
+		}
+		for more && meta.row < r {
+			if meta, more, err = stream.next(); err != nil {
+				return nil, err
+			}
+			if more && meta.hasHeight {
+				heights[meta.row] = meta.height
+			}
+		}
+		counter.add(1)
+		if len(values) > 0 {
+			rowCount = r
+		}
+		maxCols = max(maxCols, len(values))
+		for c, value := range values {
+			var cellMeta xlsxCellMeta
+			if meta.row == r {
+				cellMeta = meta.cells[c+1]
+			}
+			style := styles.get(cellMeta.styleID)
+
+			cell := map[string]any{}
+			switch {
+			case cellMeta.formula != "":
+				cell["value"] = "=" + cellMeta.formula
+			case value != "":
+				cell["value"] = styles.displayValue(cellMeta.styleID, value)
+			}
+			if len(style) > 0 {
+				cell["style"] = style
+			}
+			if len(cell) == 0 {
+				continue
+			}
+			if _, ok := cell["value"]; !ok {
+				cell["value"] = ""
+			}
+			data[fmt.Sprintf("%d,%d", r-1, c)] = cell
+		}
+	}
+	if err := rows.Error(); err != nil {
+		return nil, err
+	}
+	// The rest of the part holds the merged cells.
+	for more {
+		if meta, more, err = stream.next(); err != nil {
+			return nil, err
+		}
+		if more && meta.hasHeight {
+			heights[meta.row] = meta.height
+		}
+	}
+
+	// Unset columns and rows report the sheet default, which the editor
+	// applies on its own; only explicit sizes are kept.
+	columnWidths := map[string]any{}
+	defaultWidth := stream.colWidth(excelize.MaxColumns)
+	for c := 1; c <= maxCols; c++ {
+		if width := stream.colWidth(c); width != defaultWidth {
+			columnWidths[strconv.Itoa(c-1)] = int(math.Round(width*7 + 5))
+		}
+	}
+	rowHeights := map[string]any{}
+	defaultHeight, ok := heights[rowCount+1]
+	if !ok {
+		defaultHeight = stream.defaultRowHeight
+	}
+	for r, height := range heights {
+		if r <= rowCount && height != defaultHeight {
+			rowHeights[strconv.Itoa(r-1)] = int(math.Round(height * 4 / 3))
+		}
+	}
+
+	sheet := map[string]any{
+		"data":         data,
+		"columnWidths": columnWidths,
+		"rowHeights":   rowHeights,
+		"rowCount":     max(rowCount, editorRowCount),
+	}
+
+	if len(stream.merges) > 0 {
+		mergedCells := make([]any, 0, len(stream.merges))
+		for _, ref := range stream.merges {
+			start, end, found := strings.Cut(ref, ":")
+			if !found {
+				end = start
+			}
+			startCol, startRow, err1 := excelize.CellNameToCoordinates(start)
+			endCol, endRow, err2 := excelize.CellNameToCoordinates(end)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			mergedCells = append(mergedCells, map[string]any{
+				"startRow": startRow - 1,
+				"startCol": startCol - 1,
+				"endRow":   endRow - 1,
+				"endCol":   endCol - 1,
+			})
+		}
+		sheet["mergedCells"] = mergedCells
+	}
+
+	if stream.frozen && (stream.xSplit > 0 || stream.ySplit > 0) {
+		sheet["freezePosition"] = map[string]any{"rows": stream.ySplit, "cols": stream.xSplit}
+	}
+	return sheet, nil
+}
+
+// rowCounter reports the rows an importer has read to an optional progress
+// callback. A nil counter ignores them.
+type rowCounter struct {
+	rows     int64
+	progress func(rows int64)
+}
+
+func (c *rowCounter) add(n int) {
+	if c == nil {
+		return
+	}
+	c.rows += int64(n)
+	if c.progress != nil {
+		c.progress(c.rows)
+	}
+}
+
+// xlsxStyleCache maps workbook style IDs onto the editor's CellStyle.
+type xlsxStyleCache struct {
+	f    *excelize.File
+	byID map[int]map[string]any
+	raw  map[int]*excelize.Style
+}
+
+func (c *xlsxStyleCache) style(id int) *excelize.Style {
+	if c.raw == nil {
+		c.raw = map[int]*excelize.Style{}
+	}
+	if s, ok := c.raw[id]; ok {
+		return s
+	}
+	s, err := c.f.GetStyle(id)
+	if err != nil {
+		s = nil
+	}
+	c.raw[id] = s
+	return s
+}
+
+func (c *xlsxStyleCache) get(id int) map[string]any {
+	if style, ok := c.byID[id]; ok {
+		return style
+	}
+	style := cellStyleFromXLSX(c.style(id))
+	c.byID[id] = style
+	return style
+}
+
+// displayValue turns a raw cell value into editor input. Date formats
+// become ISO dates, like the editor's DATE function returns them.
+func (c *xlsxStyleCache) displayValue(id int, value string) string {
+	s := c.style(id)
+	if s == nil || !isDateNumFmt(s) {
+		return value
+	}
+	serial, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	if text, ok := excelDateText(serial, false); ok {
+		return text
+	}
+	return value
+}
+
+// excelDateText formats an Excel date serial as date, time or both.
+func excelDateText(serial float64, date1904 bool) (string, bool) {
+	t, err := excelize.ExcelDateToTime(serial, date1904)
+	if err != nil {
+		return "", false
+	}
+	if serial == math.Trunc(serial) {
+		return t.Format("2006-01-02"), true
+	}
+	if serial < 1 {
+		return t.Format("15:04:05"), true
+	}
+	return t.Format("2006-01-02 15:04:05"), true
+}
+
+func isDateNumFmt(s *excelize.Style) bool {
+	if (s.NumFmt >= 14 && s.NumFmt <= 22) || (s.NumFmt >= 45 && s.NumFmt <= 47) {
+		return true
+	}
+	if s.CustomNumFmt == nil {
+		return false
+	}
+	// Strip quoted literals and colors before looking for date parts.
+	format := strings.ToLower(*s.CustomNumFmt)
+	var b strings.Builder
+	inQuote, inBracket := false, false
+	for _, r := range format {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case r == '[':
+			inBracket = true
+		case r == ']':
+			inBracket = false
+		case !inBracket:
+			b.WriteRune(r)
+		}
+	}
+	return strings.ContainsAny(b.String(), "yd")
+}
+
+func cellStyleFromXLSX(s *excelize.Style) map[string]any {
+	style := map[string]any{}
+	if s == nil {
+		return style
+	}
+
+	if font := s.Font; font != nil {
+		if font.Bold {
+			style["bold"] = true
+		}
+		if font.Italic {
+			style["italic"] = true
+		}
+		if font.Underline != "" && font.Underline != "none" {
+			style["underline"] = true
+		}
+		if color := xlsxColor(font.Color); color != "" && color != "#000000" {
+			style["color"] = color
+		}
+		if font.Size > 0 && font.Size != 11 {
+			style["fontSize"] = font.Size
+		}
+		if font.Family != "" && font.Family != "Calibri" {
+			style["fontFamily"] = font.Family
+		}
+	}
+
+	if s.Fill.Type == "pattern" && s.Fill.Pattern == 1 && len(s.Fill.Color) > 0 {
+		if color := xlsxColor(s.Fill.Color[0]); color != "" {
+			style["backgroundColor"] = color
+		}
+	}
+
+	if a := s.Alignment; a != nil {
+		switch a.Horizontal {
+		case "left", "center", "right":
+			style["textAlign"] = a.Horizontal
+		}
+		switch a.Vertical {
+		case "top", "bottom":
+			style["verticalAlign"] = a.Vertical
+		case "center":
+			style["verticalAlign"] = "middle"
+		}
+		if a.WrapText {
+			style["wrapMode"] = "wrap"
+		}
+		switch {
+		case a.TextRotation > 0 && a.TextRotation <= 90:
+			style["rotation"] = a.TextRotation
+		case a.TextRotation > 90 && a.TextRotation <= 180:
+			style["rotation"] = 90 - a.TextRotation
+		}
+	}
+
+	switch s.NumFmt {
+	case 1, 3:
+		style["numberFormat"] = "number"
+		style["decimalPlaces"] = 0
+	case 2, 4:
+		style["numberFormat"] = "number"
+		style["decimalPlaces"] = 2
+	case 5, 6, 7, 8:
+		style["numberFormat"] = "currency"
+	case 9:
+		style["numberFormat"] = "percent"
+		style["decimalPlaces"] = 0
+	case 10:
+		style["numberFormat"] = "percent"
+		style["decimalPlaces"] = 2
+	}
+
+	if len(s.Border) > 0 {
+		borders := map[string]any{}
+		for _, b := range s.Border {
+			if b.Style == 0 {
+				continue
+			}
+			switch b.Type {
+			case "top", "right", "bottom", "left":
+				borders[b.Type] = true
+			default:
+				continue
+			}
+			if color := xlsxColor(b.Color); color != "" {
+				borders["color"] = color
+			}
+			switch b.Style {
+			case 3, 8, 9, 10, 11, 12:
+				borders["style"] = "dashed"
+			case 4, 7:
+				borders["style"] = "dotted"
+			default:
+				borders["style"] = "solid"
+			}
+		}
+		if len(borders) > 0 {
+			style["borders"] = borders
+		}
+	}
+	return style
+}
+
+// xlsxColor converts "FF3366" or ARGB "FFFF3366" to "#FF3366".
+func xlsxColor(color string) string {
+	color = strings.TrimPrefix(strings.ToUpper(color), "#")
+	if len(color) == 8 {
+		color = color[2:]
+	}
+	if len(color) != 6 {
+		return ""
+	}
+	return "#" + color
+}
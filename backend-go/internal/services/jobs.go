@@ -0,0 +1,370 @@
+package services
+
+import (
+	"context"
+	"converter-backend/internal/logger"
+	"converter-backend/internal/models"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Job statuses.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job outputs: a new SheetFile, or the first sheet as a CSV download.
+const (
+	JobOutputFile = "file"
+	JobOutputCSV  = "csv"
+)
+
+const (
+	// jobHeartbeat is how often a worker touches its running job.
+	jobHeartbeat = 15 * time.Second
+	// jobStaleAfter is when a running job without heartbeat is assumed
+	// lost with its process and queued again.
+	jobStaleAfter = 2 * time.Minute
+	// jobMaxAttempts stops a job that keeps taking its worker down.
+	jobMaxAttempts = 3
+	// jobProgressEvery limits progress writes to one per interval.
+	jobProgressEvery = time.Second
+)
+
+var errJobInterrupted = errors.New("job was interrupted too many times")
+
+// JobQueue runs import jobs on a pool of workers. Jobs are rows of the jobs
+// table: workers claim the oldest queued row with a conditional update, so
+// several server instances can share one queue, and jobs of a process that
+// died are queued again once their heartbeat goes stale.
+type JobQueue struct {
+	Service *SpreadsheetService
+	// Dir keeps uploads until their job finishes, and CSV results.
+	Dir     string
+	Workers int
+	// PollInterval is how often idle workers look for jobs queued by other
+	// instances; jobs of this instance wake them at once.
+	PollInterval time.Duration
+
+	wake chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewJobQueue prepares a queue storing its files in dir.
+func NewJobQueue(service *SpreadsheetService, dir string, workers int) (*JobQueue, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create job directory: %w", err)
+	}
+	return &JobQueue{
+		Service:      service,
+		Dir:          dir,
+		Workers:      max(workers, 1),
+		PollInterval: 5 * time.Second,
+		wake:         make(chan struct{}, 1),
+	}, nil
+}
+
+// EnqueueImport queues the upload at path (moved into the queue's
+// directory) for import into a new file called name, or for conversion to
+// CSV when output is JobOutputCSV.
+func (q *JobQueue) EnqueueImport(userID uint, name, path, filename, output string, csvOpts CSVOptions) (*models.Job, error) {
+	if !IsImportFormat(filename) {
+		return nil, ErrUnsupportedFormat
+	}
+	if output == "" {
+		output = JobOutputFile
+	}
+	if output != JobOutputFile && output != JobOutputCSV {
+		return nil, fmt.Errorf("unknown job output %q", output)
+	}
+
+	upload, err := os.CreateTemp(q.Dir, "upload-*"+strings.ToLower(filepath.Ext(filename)))
+	if err != nil {
+		return nil, err
+	}
+	upload.Close()
+	if err := moveFile(path, upload.Name()); err != nil {
+		os.Remove(upload.Name())
+		return nil, err
+	}
+
+	options, _ := json.Marshal(csvOpts)
+	job := models.Job{
+		UserID:     userID,
+		Status:     JobQueued,
+		Output:     output,
+		Name:       name,
+		Filename:   filename,
+		Options:    options,
+		UploadPath: upload.Name(),
+	}
+	if err := q.Service.DB.Create(&job).Error; err != nil {
+		os.Remove(upload.Name())
+		return nil, err
+	}
+	q.notify()
+	return &job, nil
+}
+
+// moveFile renames src to dst, copying when they are on different devices.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// GetJob returns a job of userID.
+func (s *SpreadsheetService) GetJob(userID, jobID uint) (*models.Job, error) {
+	var job models.Job
+	if err := s.DB.Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the workers until ctx is cancelled; a worker busy with a job
+// stops once the job is done.
+func (q *JobQueue) Start(ctx context.Context) {
+	q.requeueStale()
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+}
+
+// Wait blocks until the workers of a cancelled queue have stopped.
+func (q *JobQueue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *JobQueue) work(ctx context.Context) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			job, err := q.claim()
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to claim job: %v", err))
+				break
+			}
+			if job == nil {
+				break
+			}
+			q.run(job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+			q.requeueStale()
+		}
+	}
+}
+
+// claim marks the oldest queued job as running and returns it; nil means
+// the queue is empty.
+func (q *JobQueue) claim() (*models.Job, error) {
+	db := q.Service.DB
+	for {
+		var job models.Job
+		err := db.Where("status = ?", JobQueued).Order("id").First(&job).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		res := db.Model(&models.Job{}).
+			Where("id = ? AND status = ?", job.ID, JobQueued).
+			Updates(map[string]any{"status": JobRunning, "started_at": now, "attempts": gorm.Expr("attempts + 1")})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			job.Status, job.StartedAt, job.Attempts = JobRunning, &now, job.Attempts+1
+			return &job, nil
+		}
+		// Another worker got it first.
+	}
+}
+
+// requeueStale queues running jobs whose worker stopped sending heartbeats,
+// or fails them once they used up their attempts.
+func (q *JobQueue) requeueStale() {
+	db := q.Service.DB
+	cutoff := time.Now().Add(-jobStaleAfter)
+	if err := db.Model(&models.Job{}).
+		Where("status = ? AND updated_at < ? AND attempts < ?", JobRunning, cutoff, jobMaxAttempts).
+		Update("status", JobQueued).Error; err != nil {
+		logger.Error(fmt.Sprintf("Failed to requeue stale jobs: %v", err))
+	}
+
+	var dead []models.Job
+	db.Where("status = ? AND updated_at < ?", JobRunning, cutoff).Find(&dead)
+	for i := range dead {
+		q.finish(&dead[i], errJobInterrupted)
+	}
+}
+
+// run processes a claimed job and records its outcome. A job cut off by the
+// process exiting keeps status running and is queued again once its
+// heartbeat goes stale.
+func (q *JobQueue) run(job *models.Job) {
+	db := q.Service.DB
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(jobHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				db.Model(&models.Job{}).Where("id = ? AND status = ?", job.ID, JobRunning).Update("updated_at", time.Now())
+			}
+		}
+	}()
+
+	var lastWrite time.Time
+	rows := &rowCounter{progress: func(n int64) {
+		if now := time.Now(); now.Sub(lastWrite) >= jobProgressEvery {
+			lastWrite = now
+			db.Model(&models.Job{}).Where("id = ?", job.ID).Update("rows_processed", n)
+		}
+	}}
+
+	var csvOpts CSVOptions
+	_ = json.Unmarshal(job.Options, &csvOpts)
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("job panicked: %v", r)
+			}
+		}()
+		if job.Output == JobOutputCSV {
+			return q.convertToCSV(job, csvOpts, rows)
+		}
+		file, err := q.Service.importFile(job.UserID, job.Name, job.UploadPath, job.Filename, csvOpts, rows)
+		if err == nil {
+			job.FileID = &file.ID
+		}
+		return err
+	}()
+	job.RowsProcessed = rows.rows
+	q.finish(job, err)
+}
+
+// finish stores the outcome of a job and removes its upload.
+func (q *JobQueue) finish(job *models.Job, err error) {
+	now := time.Now()
+	updates := map[string]any{
+		"status":         JobSucceeded,
+		"finished_at":    now,
+		"rows_processed": job.RowsProcessed,
+		"file_id":        job.FileID,
+		"result_path":    job.ResultPath,
+		"error":          "",
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Job %d failed: %v", job.ID, err))
+		updates["status"] = JobFailed
+		updates["error"] = jobErrorMessage(err)
+	}
+	if dbErr := q.Service.DB.Model(&models.Job{}).Where("id = ?", job.ID).Updates(updates).Error; dbErr != nil {
+		logger.Error(fmt.Sprintf("Failed to store result of job %d: %v", job.ID, dbErr))
+		return
+	}
+	if job.UploadPath != "" {
+		os.Remove(job.UploadPath)
+	}
+}
+
+// jobErrorMessage is the error shown to the job's owner; details of
+// internal failures stay in the log.
+func jobErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrUnsupportedFormat):
+		return "unsupported file format"
+	case errors.Is(err, ErrUnreadableFile), errors.Is(err, errJobInterrupted):
+		return err.Error()
+	}
+	return "failed to process file"
+}
+
+// convertToCSV writes the first sheet of the upload to a CSV file next to
+// it, as /convert does.
+func (q *JobQueue) convertToCSV(job *models.Job, csvOpts CSVOptions, rows *rowCounter) error {
+	wb, err := OpenWorkbook(job.UploadPath, job.Filename, csvOpts)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreadableFile, err)
+	}
+	defer wb.Close()
+
+	result := filepath.Join(q.Dir, fmt.Sprintf("job-%d.csv", job.ID))
+	out, err := os.Create(result)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(out)
+	err = wb.EachRow(0, func(row []string) error {
+		rows.add(1)
+		return writer.Write(row)
+	})
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(result)
+		return fmt.Errorf("%w: %v", ErrUnreadableFile, err)
+	}
+	job.ResultPath = result
+	return nil
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// VersionSourceNames marks versions written by DefineName and DeleteName.
+const VersionSourceNames = "names"
+
+// maxNameLength is Excel's limit on a defined name.
+const maxNameLength = 255
+
+// deletedRef is what the range of a named range becomes when a structural
+// operation deletes all of its cells: "Sheet1!#REF!".
+const deletedRef = "#REF!"
+
+var (
+	// ErrInvalidName is returned for a name or ref that cannot be defined;
+	// its message is meant for the client.
+	ErrInvalidName  = errors.New("invalid name")
+	ErrNameExists   = errors.New("name already exists")
+	ErrNameNotFound = errors.New("name not found")
+)
+
+var (
+	namePattern = regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}_.]*$`)
+	// r1c1Pattern matches names Excel would read as R1C1 references.
+	r1c1Pattern = regexp.MustCompile(`(?i)^(r\d*c?\d*|c\d*)$`)
+)
+
+// checkName checks a name the way Excel does: a letter or '_' followed by
+// letters, digits, '_' and '.', and nothing that reads as a cell.
+func checkName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("name is required")
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return fmt.Errorf("name must be at most %d characters", maxNameLength)
+	case !namePattern.MatchString(name):
+		return fmt.Errorf("name %q must start with a letter or '_' and hold only letters, digits, '_' and '.'", name)
+	case r1c1Pattern.MatchString(name):
+		return fmt.Errorf("name %q reads as a cell reference", name)
+	}
+	if _, ok := formula.ParseRange(name); ok {
+		return fmt.Errorf("name %q reads as a cell reference", name)
+	}
+	return nil
+}
+
+// checkNameRef checks the ref of a stored name: a range on a named sheet,
+// or the sheet and #REF! once its cells are deleted. The sheet is not
+// looked up, as a client may delete it.
+func checkNameRef(ref string) error {
+	sheet, a1 := splitNameRef(ref)
+	if sheet == "" {
+		return fmt.Errorf("ref %q must name its sheet, e.g. Sheet1!B2:B200", ref)
+	}
+	if _, ok := formula.ParseRange(a1); !ok && a1 != deletedRef {
+		return fmt.Errorf("ref %q is not a range such as Sheet1!B2:B200", ref)
+	}
+	return nil
+}
+
+// splitNameRef is SplitSheetRef for the ref of a stored name, which may end
+// in #REF!.
+func splitNameRef(ref string) (sheet, a1 string) {
+	if sheet, ok := strings.CutSuffix(strings.TrimSpace(ref), "!"+deletedRef); ok {
+		sheet, _ = SplitSheetRef(sheet + "!")
+		return sheet, deletedRef
+	}
+	return SplitSheetRef(ref)
+}
+
+// StateNames returns the named ranges of a state.
+func StateNames(raw json.RawMessage) []models.NamedRange {
+	var decoded struct {
+		Names []models.NamedRange `json:"names"`
+	}
+	_ = json.Unmarshal(raw, &decoded)
+	return decoded.Names
+}
+
+// ResolveName returns the ref of ref when it is a name the state defines,
+// so it can be used wherever an A1 range is: "Revenue" gives
+// "Sheet1!B2:B200". found is false for anything else, including A1 ranges,
+// which are never read as names. A name whose cells were deleted is found
+// but fails with ErrInvalidName.
+func ResolveName(state json.RawMessage, ref string) (resolved string, found bool, err error) {
+	name := strings.TrimSpace(ref)
+	if checkName(name) != nil {
+		return "", false, nil
+	}
+	names := StateNames(state)
+	index := nameIndex(names, name)
+	if index < 0 {
+		return "", false, nil
+	}
+	resolved = names[index].Ref
+	if _, a1 := splitNameRef(resolved); a1 == deletedRef {
+		return "", true, fmt.Errorf("%w: the cells of %s were deleted", ErrInvalidName, name)
+	}
+	return resolved, true, nil
+}
+
+// nameIndex finds a name; names are matched case-insensitively, as in
+// Excel.
+func nameIndex(names []models.NamedRange, name string) int {
+	for i, n := range names {
+		if strings.EqualFold(n.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeNameRef resolves the sheet of a ref submitted by a client and
+// writes it as names are stored: "Sheet1!B2:B200", with the sheet name as
+// stored and no '$' anchors. A ref without a sheet is on the first sheet.
+func normalizeNameRef(state map[string]any, ref string) (string, error) {
+	sheet, a1 := SplitSheetRef(ref)
+	r, ok := formula.ParseRange(a1)
+	if !ok {
+		return "", fmt.Errorf("%w: ref %q is not a range such as Sheet1!B2:B200", ErrInvalidName, ref)
+	}
+	_, stored, err := FindSheet(state, sheet)
+	if err != nil {
+		return "", err
+	}
+	return SheetRef(stored, r.A1()), nil
+}
+
+// DefineName adds a named range, or replaces the one called replace; a
+// replacement may rename it. The ref may leave out the sheet to mean the
+// first one.
+func (s *SpreadsheetService) DefineName(fileID uint, named models.NamedRange, replace string, ifMatch ...int64) (*models.SheetFile, models.NamedRange, error) {
+	named.Name = strings.TrimSpace(named.Name)
+	if err := checkName(named.Name); err != nil {
+		return nil, named, fmt.Errorf("%w: %v", ErrInvalidName, err)
+	}
+	file, err := s.updateNames(fileID, ifMatch, func(state map[string]any, names []models.NamedRange) ([]models.NamedRange, error) {
+		ref, err := normalizeNameRef(state, named.Ref)
+		if err != nil {
+			return nil, err
+		}
+		named.Ref = ref
+
+		index := len(names)
+		if replace != "" {
+			if index = nameIndex(names, replace); index < 0 {
+				return nil, ErrNameNotFound
+			}
+		}
+		if other := nameIndex(names, named.Name); other >= 0 && other != index {
+			return nil, ErrNameExists
+		}
+		if index == len(names) {
+			return append(names, named), nil
+		}
+		names[index] = named
+		return names, nil
+	})
+	return file, named, err
+}
+
+// DeleteName removes a named range.
+func (s *SpreadsheetService) DeleteName(fileID uint, name string, ifMatch ...int64) (*models.SheetFile, error) {
+	return s.updateNames(fileID, ifMatch, func(_ map[string]any, names []models.NamedRange) ([]models.NamedRange, error) {
+		index := nameIndex(names, name)
+		if index < 0 {
+			return nil, ErrNameNotFound
+		}
+		return append(names[:index], names[index+1:]...), nil
+	})
+}
+
+// updateNames rewrites the names of a file in one locked transaction and
+// records the result as a version. Cells are not touched.
+func (s *SpreadsheetService) updateNames(fileID uint, ifMatch []int64, update func(state map[string]any, names []models.NamedRange) ([]models.NamedRange, error)) (*models.SheetFile, error) {
+	var file models.SheetFile
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", fileID).
+			First(&file).Error; err != nil {
+			return err
+		}
+		if !revisionMatches(file.Revision, ifMatch) {
+			return ErrRevisionMismatch
+		}
+		inline := hasInlineCells(file.State)
+		if err := loadCells(tx, &file, -1, nil); err != nil {
+			return err
+		}
+
+		var state map[string]any
+		if err := json.Unmarshal(file.State, &state); err != nil {
+			return fmt.Errorf("failed to decode file state: %w", err)
+		}
+		names, err := update(state, StateNames(file.State))
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			delete(state, "names")
+		} else {
+			state["names"] = names
+		}
+
+		next, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode file state: %w", err)
+		}
+		file.State = next
+		file.Revision++
+		if inline {
+			err = saveFile(tx, &file)
+		} else {
+			err = saveCellChanges(tx, &file, state, nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+		return s.recordVersion(tx, &file, VersionSourceNames)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// shiftNames moves the named ranges on the sheet at index along with a
+// structural operation, as shiftSheet does with formulas.
+func shiftNames(state map[string]any, index int, op StructureOp, mapIndex func(int) int) {
+	names := namesOf(state)
+	if len(names) == 0 {
+		return
+	}
+	refs := formula.RefMap{Col: mapIndex}
+	if op.Dimension == DimensionRows {
+		refs = formula.RefMap{Row: mapIndex}
+	}
+	for i, named := range names {
+		sheet, a1 := splitNameRef(named.Ref)
+		if at, err := sheetIndex(state, sheet); err != nil || at != index || a1 == deletedRef {
+			continue
+		}
+		if adjusted := formula.AdjustReferences("="+a1, refs); adjusted != "="+a1 {
+			names[i].Ref = SheetRef(sheet, strings.TrimPrefix(adjusted, "="))
+		}
+	}
+	state["names"] = names
+}
+
+// namesOf returns the named ranges of a decoded state.
+func namesOf(state map[string]any) []models.NamedRange {
+	raw, err := json.Marshal(map[string]any{"names": state["names"]})
+	if err != nil {
+		return nil
+	}
+	return StateNames(raw)
+}
+
+// exportedName is a named range resolved for the exporters.
+type exportedName struct {
+	name  string
+	sheet int // index of the sheet, 0 is the first
+	cells formula.Range
+}
+
+// exportedNames resolves the named ranges of a decoded state for the
+// exporters, leaving out those whose cells or sheet were deleted.
+func exportedNames(state *models.SheetState) []exportedName {
+	var out []exportedName
+	for _, named := range state.Names {
+		sheet, a1 := splitNameRef(named.Ref)
+		_, index, _, err := LookupSheet(state, sheet)
+		r, ok := formula.ParseRange(a1)
+		if err != nil || !ok {
+			continue
+		}
+		out = append(out, exportedName{name: named.Name, sheet: index, cells: r})
+	}
+	return out
+}
@@ -0,0 +1,647 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// OpenDocument spreadsheets are zip files whose content.xml holds every
+// table (sheet) row by row. Rows and cells may be repeated
+// (number-rows-repeated / number-columns-repeated); LibreOffice pads sheets
+// with huge repeated empty runs, so runs are never expanded blindly.
+
+const (
+	odsNSOffice = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	odsNSStyle  = "urn:oasis:names:tc:opendocument:xmlns:style:1.0"
+	odsNSTable  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	odsNSText   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+
+	odsMimeType = "application/vnd.oasis.opendocument.spreadsheet"
+
+	// Sheets are cut at these sizes, the limits of Excel.
+	odsMaxRows = 1 << 20
+	odsMaxCols = 1 << 14
+
+	// LibreOffice's default column width, 2.258cm.
+	odsDefaultColWidthPx = 85
+)
+
+// odsCell is a run of equal cells in a table row.
+type odsCell struct {
+	value     string // editor input; formulas start with "="
+	style     string
+	valueType string // office:value-type
+	currency  string
+	colSpan   int
+	rowSpan   int
+	repeat    int
+	covered   bool
+}
+
+func (c odsCell) hasContent() bool {
+	return c.value != "" || c.colSpan > 1 || c.rowSpan > 1
+}
+
+// odsStyle is an automatic style of content.xml.
+type odsStyle struct {
+	Name   string `xml:"name,attr"`
+	Family string `xml:"family,attr"`
+	Cell   struct {
+		Background    string `xml:"background-color,attr"`
+		Border        string `xml:"border,attr"`
+		BorderTop     string `xml:"border-top,attr"`
+		BorderRight   string `xml:"border-right,attr"`
+		BorderBottom  string `xml:"border-bottom,attr"`
+		BorderLeft    string `xml:"border-left,attr"`
+		VerticalAlign string `xml:"vertical-align,attr"`
+		WrapOption    string `xml:"wrap-option,attr"`
+		Rotation      string `xml:"rotation-angle,attr"`
+	} `xml:"table-cell-properties"`
+	Paragraph struct {
+		TextAlign string `xml:"text-align,attr"`
+	} `xml:"paragraph-properties"`
+	Text struct {
+		FontWeight string `xml:"font-weight,attr"`
+		FontStyle  string `xml:"font-style,attr"`
+		Underline  string `xml:"text-underline-style,attr"`
+		Color      string `xml:"color,attr"`
+		FontSize   string `xml:"font-size,attr"`
+		FontName   string `xml:"font-name,attr"`
+		FontFamily string `xml:"font-family,attr"`
+	} `xml:"text-properties"`
+	Column struct {
+		Width string `xml:"column-width,attr"`
+	} `xml:"table-column-properties"`
+	Row struct {
+		Height  string `xml:"row-height,attr"`
+		Optimal string `xml:"use-optimal-row-height,attr"`
+	} `xml:"table-row-properties"`
+}
+
+// odsHandler receives the parts of content.xml. table returns false to skip
+// a table; column and row get runs that repeat the given number of times.
+type odsHandler struct {
+	style  func(s odsStyle)
+	table  func(index int, name string) bool
+	column func(style string, repeat int)
+	row    func(style string, repeat int, cells []odsCell) error
+}
+
+// scanODSContent walks content.xml once, calling h as it goes.
+func scanODSContent(r io.Reader, h odsHandler) error {
+	d := xml.NewDecoder(r)
+	tableIndex := -1
+	var rowStyle string
+	var rowRepeat int
+	var cells []odsCell
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Space == odsNSStyle && t.Name.Local == "style":
+				var s odsStyle
+				if err := d.DecodeElement(&s, &t); err != nil {
+					return err
+				}
+				if h.style != nil {
+					h.style(s)
+				}
+			case t.Name.Space != odsNSTable:
+			case t.Name.Local == "table":
+				tableIndex++
+				if h.table != nil && !h.table(tableIndex, odsAttr(t, odsNSTable, "name")) {
+					if err := d.Skip(); err != nil {
+						return err
+					}
+				}
+			case t.Name.Local == "table-column":
+				if h.column != nil {
+					h.column(odsAttr(t, odsNSTable, "style-name"), odsRepeat(t, "number-columns-repeated"))
+				}
+			case t.Name.Local == "table-row":
+				rowStyle = odsAttr(t, odsNSTable, "style-name")
+				rowRepeat = odsRepeat(t, "number-rows-repeated")
+				cells = cells[:0]
+			case t.Name.Local == "table-cell" || t.Name.Local == "covered-table-cell":
+				cell, err := readODSCell(d, t)
+				if err != nil {
+					return err
+				}
+				cells = append(cells, cell)
+			}
+		case xml.EndElement:
+			if t.Name.Space == odsNSTable && t.Name.Local == "table-row" && h.row != nil {
+				if err := h.row(rowStyle, rowRepeat, cells); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func odsAttr(t xml.StartElement, space, local string) string {
+	for _, a := range t.Attr {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func odsRepeat(t xml.StartElement, attr string) int {
+	n, err := strconv.Atoi(odsAttr(t, odsNSTable, attr))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// readODSCell consumes a table cell up to its end element.
+func readODSCell(d *xml.Decoder, start xml.StartElement) (odsCell, error) {
+	cell := odsCell{
+		style:     odsAttr(start, odsNSTable, "style-name"),
+		valueType: odsAttr(start, odsNSOffice, "value-type"),
+		currency:  odsAttr(start, odsNSOffice, "currency"),
+		colSpan:   odsRepeat(start, "number-columns-spanned"),
+		rowSpan:   odsRepeat(start, "number-rows-spanned"),
+		repeat:    odsRepeat(start, "number-columns-repeated"),
+		covered:   start.Name.Local == "covered-table-cell",
+	}
+
+	var text strings.Builder
+	paragraphs, inParagraph := 0, 0
+	for done := false; !done; {
+		tok, err := d.Token()
+		if err != nil {
+			return cell, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Space == odsNSOffice && t.Name.Local == "annotation":
+				if err := d.Skip(); err != nil {
+					return cell, err
+				}
+			case t.Name.Space != odsNSText:
+			case t.Name.Local == "p":
+				if paragraphs > 0 {
+					text.WriteByte('\n')
+				}
+				paragraphs++
+				inParagraph++
+			case t.Name.Local == "s":
+				n, err := strconv.Atoi(odsAttr(t, odsNSText, "c"))
+				if err != nil || n < 1 {
+					n = 1
+				}
+				text.WriteString(strings.Repeat(" ", min(n, 1024)))
+			case t.Name.Local == "tab":
+				text.WriteByte('\t')
+			case t.Name.Local == "line-break":
+				text.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inParagraph > 0 {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case t.Name == start.Name:
+				done = true
+			case t.Name.Space == odsNSText && t.Name.Local == "p":
+				inParagraph--
+			}
+		}
+	}
+
+	if formula := odsAttr(start, odsNSTable, "formula"); formula != "" {
+		cell.value = "=" + odsFormulaToA1(formula)
+		return cell, nil
+	}
+	switch cell.valueType {
+	case "float", "percentage", "currency":
+		cell.value = odsAttr(start, odsNSOffice, "value")
+	case "date":
+		cell.value = odsDate(odsAttr(start, odsNSOffice, "date-value"))
+	case "boolean":
+		cell.value = strings.ToUpper(odsAttr(start, odsNSOffice, "boolean-value"))
+	default:
+		cell.value = text.String()
+	}
+	return cell, nil
+}
+
+// odsDate turns "2024-03-05T10:30:00" into the editor's date text.
+func odsDate(v string) string {
+	date, clock, ok := strings.Cut(v, "T")
+	if !ok || strings.Trim(clock, "0:.") == "" {
+		return date
+	}
+	if len(clock) > 8 {
+		clock = clock[:8]
+	}
+	return date + " " + clock
+}
+
+// odsFormulaToA1 converts OpenFormula ("of:=SUM([.A1:.B2];[$Sheet2.C3])")
+// to the editor's syntax ("SUM(A1:B2,Sheet2!C3)").
+func odsFormulaToA1(f string) string {
+	if prefix, rest, ok := strings.Cut(f, ":="); ok && !strings.ContainsAny(prefix, `"[(`) {
+		f = rest
+	} else {
+		f = strings.TrimPrefix(f, "=")
+	}
+
+	var b strings.Builder
+	inString := false
+	for i := 0; i < len(f); i++ {
+		ch := f[i]
+		switch {
+		case ch == '"':
+			inString = !inString
+			b.WriteByte(ch)
+		case inString:
+			b.WriteByte(ch)
+		case ch == '[':
+			end := strings.IndexByte(f[i:], ']')
+			if end < 0 {
+				b.WriteString(f[i:])
+				return b.String()
+			}
+			b.WriteString(odsRefToA1(f[i+1 : i+end]))
+			i += end
+		case ch == ';':
+			b.WriteByte(',')
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+func odsRefToA1(ref string) string {
+	parts := strings.Split(ref, ":")
+	sheet := ""
+	for i, part := range parts {
+		if dot := strings.LastIndex(part, "."); dot >= 0 {
+			if i == 0 {
+				sheet = strings.TrimPrefix(part[:dot], "$")
+			}
+			part = part[dot+1:]
+		}
+		parts[i] = part
+	}
+	out := strings.Join(parts, ":")
+	if sheet != "" {
+		out = sheet + "!" + out
+	}
+	return out
+}
+
+// odsLengthPx converts an ODF length ("2.258cm", "0.1665in", "12pt") to
+// pixels at 96 dpi.
+func odsLengthPx(v string) (float64, bool) {
+	units := map[string]float64{"cm": 96 / 2.54, "mm": 96 / 25.4, "in": 96, "pt": 96.0 / 72, "pc": 16, "px": 1}
+	for unit, factor := range units {
+		if num, ok := strings.CutSuffix(v, unit); ok {
+			f, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, false
+			}
+			return f * factor, true
+		}
+	}
+	return 0, false
+}
+
+// odsOpen opens content.xml of an ODS file.
+func odsOpen(path string) (*zip.ReadCloser, io.ReadCloser, error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range z.File {
+		if f.Name == "content.xml" {
+			r, err := f.Open()
+			if err != nil {
+				z.Close()
+				return nil, nil, err
+			}
+			return z, r, nil
+		}
+	}
+	z.Close()
+	return nil, nil, fmt.Errorf("content.xml not found")
+}
+
+// odsSheetNames lists the tables of an ODS file.
+func odsSheetNames(path string) ([]string, error) {
+	z, r, err := odsOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	defer r.Close()
+
+	var names []string
+	err = scanODSContent(r, odsHandler{table: func(_ int, name string) bool {
+		names = append(names, name)
+		return false
+	}})
+	return names, err
+}
+
+// odsEachRow streams the values of one table, like WorkbookReader.EachRow.
+func odsEachRow(path string, index int, fn func(row []string) error) error {
+	z, r, err := odsOpen(path)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	defer r.Close()
+
+	pendingEmpty, rows := 0, 0
+	return scanODSContent(r, odsHandler{
+		table: func(i int, _ string) bool { return i == index },
+		row: func(_ string, repeat int, cells []odsCell) error {
+			values := odsRowValues(cells)
+			if len(values) == 0 {
+				pendingEmpty += repeat
+				return nil
+			}
+			for ; pendingEmpty > 0 && rows < odsMaxRows; pendingEmpty-- {
+				if err := fn(nil); err != nil {
+					return err
+				}
+				rows++
+			}
+			pendingEmpty = 0
+			for ; repeat > 0 && rows < odsMaxRows; repeat-- {
+				if err := fn(values); err != nil {
+					return err
+				}
+				rows++
+			}
+			return nil
+		},
+	})
+}
+
+// odsRowValues expands the cell runs of a row up to its last value.
+func odsRowValues(cells []odsCell) []string {
+	last := -1
+	width := 0
+	for _, c := range cells {
+		width += c.repeat
+		if c.value != "" {
+			last = min(width, odsMaxCols) - 1
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	values := make([]string, 0, last+1)
+	for _, c := range cells {
+		for n := 0; n < c.repeat && len(values) <= last; n++ {
+			values = append(values, c.value)
+		}
+	}
+	return values
+}
+
+// readODSState reads an ODS file into a workbook state with the same parts
+// as the XLSX importer: values, formulas, styles, sizes and merged cells.
+func readODSState(path string, counter *rowCounter) (map[string]any, error) {
+	z, r, err := odsOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	defer r.Close()
+
+	styles := map[string]odsStyle{}
+	cellStyles := map[string]map[string]any{}
+	var names []string
+	var sheets []map[string]any
+	var data, widths, heights map[string]any
+	var merged []any
+	row, col, usedRows := 0, 0, 0
+
+	finish := func() {
+		if data == nil {
+			return
+		}
+		sheet := map[string]any{
+			"data":         data,
+			"columnWidths": widths,
+			"rowHeights":   heights,
+			"rowCount":     max(usedRows, editorRowCount),
+		}
+		if len(merged) > 0 {
+			sheet["mergedCells"] = merged
+		}
+		sheets = append(sheets, sheet)
+	}
+
+	err = scanODSContent(r, odsHandler{
+		style: func(s odsStyle) { styles[s.Name] = s },
+		table: func(_ int, name string) bool {
+			finish()
+			names = append(names, name)
+			data, widths, heights, merged = map[string]any{}, map[string]any{}, map[string]any{}, nil
+			row, col, usedRows = 0, 0, 0
+			return true
+		},
+		column: func(style string, repeat int) {
+			px, ok := odsLengthPx(styles[style].Column.Width)
+			if !ok || math.Abs(px-odsDefaultColWidthPx) <= 1 {
+				col += repeat
+				return
+			}
+			for ; repeat > 0 && col < odsMaxCols; repeat-- {
+				widths[strconv.Itoa(col)] = int(math.Round(px))
+				col++
+			}
+		},
+		row: func(style string, repeat int, cells []odsCell) error {
+			if s := styles[style]; s.Row.Optimal == "false" && repeat == 1 {
+				if px, ok := odsLengthPx(s.Row.Height); ok {
+					heights[strconv.Itoa(row)] = int(math.Round(px))
+				}
+			}
+			content := false
+			for _, c := range cells {
+				content = content || c.hasContent()
+			}
+			if !content {
+				row += repeat
+				return nil
+			}
+
+			for ; repeat > 0 && row < odsMaxRows; repeat-- {
+				counter.add(1)
+				c := 0
+				for _, cell := range cells {
+					// Styled empty runs only count once, not across the padding.
+					if !cell.hasContent() && (cell.style == "" || cell.repeat > 1) {
+						c += cell.repeat
+						continue
+					}
+					for n := 0; n < cell.repeat && c < odsMaxCols; n++ {
+						odsPutCell(data, row, c, cell, styles, cellStyles)
+						if cell.colSpan > 1 || cell.rowSpan > 1 {
+							merged = append(merged, map[string]any{
+								"startRow": row,
+								"startCol": c,
+								"endRow":   row + cell.rowSpan - 1,
+								"endCol":   c + cell.colSpan - 1,
+							})
+						}
+						c++
+					}
+				}
+				row++
+				usedRows = row
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	finish()
+	if len(sheets) == 0 {
+		return NewWorkbookState(nil), nil
+	}
+	return assembleWorkbook(names, sheets), nil
+}
+
+func odsPutCell(data map[string]any, row, col int, cell odsCell, styles map[string]odsStyle, cache map[string]map[string]any) {
+	if cell.covered {
+		return
+	}
+	key := cell.style + "|" + cell.valueType + "|" + cell.currency
+	style, ok := cache[key]
+	if !ok {
+		style = cellStyleFromODS(styles[cell.style])
+		switch cell.valueType {
+		case "percentage":
+			style["numberFormat"] = "percent"
+		case "currency":
+			style["numberFormat"] = "currency"
+			if cell.currency != "" {
+				style["currencyCode"] = cell.currency
+			}
+		}
+		cache[key] = style
+	}
+
+	out := map[string]any{"value": cell.value}
+	if len(style) > 0 {
+		out["style"] = style
+	}
+	if cell.value == "" && len(style) == 0 {
+		return
+	}
+	data[fmt.Sprintf("%d,%d", row, col)] = out
+}
+
+func cellStyleFromODS(s odsStyle) map[string]any {
+	style := map[string]any{}
+	if s.Text.FontWeight == "bold" || s.Text.FontWeight == "700" {
+		style["bold"] = true
+	}
+	if s.Text.FontStyle == "italic" || s.Text.FontStyle == "oblique" {
+		style["italic"] = true
+	}
+	if s.Text.Underline != "" && s.Text.Underline != "none" {
+		style["underline"] = true
+	}
+	if color := odsColor(s.Text.Color); color != "" && color != "#000000" {
+		style["color"] = color
+	}
+	if size, ok := strings.CutSuffix(s.Text.FontSize, "pt"); ok {
+		if f, err := strconv.ParseFloat(size, 64); err == nil && f > 0 && f != 10 {
+			style["fontSize"] = f
+		}
+	}
+	family := strings.Trim(s.Text.FontFamily, `'"`)
+	if family == "" {
+		family = s.Text.FontName
+	}
+	if family != "" && family != "Liberation Sans" {
+		style["fontFamily"] = family
+	}
+	if color := odsColor(s.Cell.Background); color != "" {
+		style["backgroundColor"] = color
+	}
+
+	switch s.Paragraph.TextAlign {
+	case "start", "left":
+		style["textAlign"] = "left"
+	case "center":
+		style["textAlign"] = "center"
+	case "end", "right":
+		style["textAlign"] = "right"
+	}
+	switch s.Cell.VerticalAlign {
+	case "top", "middle", "bottom":
+		style["verticalAlign"] = s.Cell.VerticalAlign
+	}
+	if s.Cell.WrapOption == "wrap" {
+		style["wrapMode"] = "wrap"
+	}
+	if deg, err := strconv.ParseFloat(strings.TrimSuffix(s.Cell.Rotation, "deg"), 64); err == nil && deg != 0 {
+		if deg > 180 {
+			deg -= 360
+		}
+		if deg >= -90 && deg <= 90 {
+			style["rotation"] = deg
+		}
+	}
+
+	borders := map[string]any{}
+	for side, spec := range map[string]string{"top": s.Cell.BorderTop, "right": s.Cell.BorderRight, "bottom": s.Cell.BorderBottom, "left": s.Cell.BorderLeft} {
+		if spec == "" {
+			spec = s.Cell.Border
+		}
+		if spec == "" || spec == "none" {
+			continue
+		}
+		borders[side] = true
+		for _, part := range strings.Fields(spec) {
+			switch {
+			case part == "dashed" || part == "dotted" || part == "solid":
+				borders["style"] = part
+			case strings.HasPrefix(part, "#"):
+				borders["color"] = odsColor(part)
+			}
+		}
+	}
+	if len(borders) > 0 {
+		style["borders"] = borders
+	}
+	return style
+}
+
+// odsColor normalizes "#ff0000" to "#FF0000"; "transparent" is dropped.
+func odsColor(v string) string {
+	if len(v) != 7 || v[0] != '#' {
+		return ""
+	}
+	return strings.ToUpper(v)
+}
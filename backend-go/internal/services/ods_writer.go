@@ -0,0 +1,493 @@
+package services
+
+import (
+	"archive/zip"
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExportODS writes a file state as an OpenDocument spreadsheet: every sheet
+// with its values, formulas, cell styles, merged cells, column widths, row
+// heights and named ranges.
+func ExportODS(raw json.RawMessage, w io.Writer) error {
+	state, err := DecodeState(raw)
+	if err != nil {
+		return err
+	}
+
+	styles := &odsStyleWriter{ids: map[string]string{}}
+	var body strings.Builder
+	used := map[string]bool{}
+	var titles []string
+	sheets := StateSheets(state)
+	for i, name := range StateSheetNames(state) {
+		titles = append(titles, xlsxSheetTitle(name, i, used))
+		writeODSTable(&body, titles[i], sheets[i], styles)
+	}
+	if names := exportedNames(state); len(names) > 0 {
+		body.WriteString(`<table:named-expressions>`)
+		for _, named := range names {
+			cells := absoluteA1(named.cells, ".")
+			start, _, _ := strings.Cut(cells, ":")
+			fmt.Fprintf(&body, `<table:named-range table:name="%s" table:base-cell-address="%s" table:cell-range-address="%s"/>`,
+				odsEscape(named.name), odsEscape("$"+quoteSheetTitle(titles[named.sheet])+start), odsEscape("$"+quoteSheetTitle(titles[named.sheet])+cells))
+		}
+		body.WriteString(`</table:named-expressions>`)
+	}
+
+	zw := zip.NewWriter(w)
+	// The mimetype entry must come first and be stored uncompressed.
+	mt, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mt, odsMimeType); err != nil {
+		return err
+	}
+
+	manifest, err := zw.Create("META-INF/manifest.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(manifest, xml.Header+
+		`<manifest:manifest xmlns:manifest="urn:oasis:names:tc:opendocument:xmlns:manifest:1.0" manifest:version="1.2">`+
+		`<manifest:file-entry manifest:full-path="/" manifest:version="1.2" manifest:media-type="`+odsMimeType+`"/>`+
+		`<manifest:file-entry manifest:full-path="content.xml" manifest:media-type="text/xml"/>`+
+		`</manifest:manifest>`); err != nil {
+		return err
+	}
+
+	content, err := zw.Create("content.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(content, xml.Header+
+		`<office:document-content`+
+		` xmlns:office="`+odsNSOffice+`"`+
+		` xmlns:style="`+odsNSStyle+`"`+
+		` xmlns:table="`+odsNSTable+`"`+
+		` xmlns:text="`+odsNSText+`"`+
+		` xmlns:fo="urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0"`+
+		` xmlns:number="urn:oasis:names:tc:opendocument:xmlns:datastyle:1.0"`+
+		` xmlns:of="urn:oasis:names:tc:opendocument:xmlns:of:1.2"`+
+		` office:version="1.2">`+
+		`<office:automatic-styles>`+styles.xml.String()+`</office:automatic-styles>`+
+		`<office:body><office:spreadsheet>`+body.String()+`</office:spreadsheet></office:body>`+
+		`</office:document-content>`); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// odsEscape escapes s for XML text and attribute values.
+func odsEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeODSTable(b *strings.Builder, title string, sheet *models.Sheet, styles *odsStyleWriter) {
+	maxRow, maxCol := -1, -1
+	for id := range sheet.Data {
+		if row, col, ok := formula.ParseCellID(id); ok {
+			maxRow, maxCol = max(maxRow, row), max(maxCol, col)
+		}
+	}
+
+	// Merged ranges: spans on the top-left cell, covered cells elsewhere.
+	spans := map[[2]int][2]int{}
+	covered := map[[2]int]bool{}
+	for _, m := range sheet.MergedCells {
+		sr, sc, er, ec := m.StartRow, m.StartCol, m.EndRow, m.EndCol
+		if sr < 0 || sc < 0 || er < sr || ec < sc || (sr == er && sc == ec) {
+			continue
+		}
+		spans[[2]int{sr, sc}] = [2]int{er - sr + 1, ec - sc + 1}
+		for r := sr; r <= er; r++ {
+			for c := sc; c <= ec; c++ {
+				if r != sr || c != sc {
+					covered[[2]int{r, c}] = true
+				}
+			}
+		}
+		maxRow, maxCol = max(maxRow, er), max(maxCol, ec)
+	}
+	for col := range sheet.ColumnWidths {
+		if col >= 0 && col < odsMaxCols {
+			maxCol = max(maxCol, col)
+		}
+	}
+
+	fmt.Fprintf(b, `<table:table table:name="%s">`, odsEscape(title))
+	// Columns without a width get LibreOffice's default, as the XLSX
+	// exporter leaves them to Excel's.
+	for col := 0; col <= max(maxCol, 0); col++ {
+		width := "2.258cm"
+		if px := sheet.ColumnWidths[col]; px > 0 {
+			width = fmt.Sprintf("%.4fin", px/96)
+		}
+		fmt.Fprintf(b, `<table:table-column table:style-name="%s"/>`, styles.column(width))
+	}
+
+	emptyRows := 0
+	flushEmpty := func() {
+		if emptyRows == 0 {
+			return
+		}
+		if emptyRows > 1 {
+			fmt.Fprintf(b, `<table:table-row table:number-rows-repeated="%d">`, emptyRows)
+		} else {
+			b.WriteString(`<table:table-row>`)
+		}
+		fmt.Fprintf(b, `<table:table-cell table:number-columns-repeated="%d"/></table:table-row>`, maxCol+1)
+		emptyRows = 0
+	}
+
+	for row := 0; row <= maxRow; row++ {
+		height := sheet.RowHeights[row]
+		var cells strings.Builder
+		emptyCells, content := 0, false
+		for col := 0; col <= maxCol; col++ {
+			key := [2]int{row, col}
+			cell := sheet.Data[fmt.Sprintf("%d,%d", row, col)]
+			_, spanned := spans[key]
+			if !covered[key] && !spanned && cell.Value == "" && !hasStyle(cell) {
+				emptyCells++
+				continue
+			}
+			writeODSEmptyCells(&cells, emptyCells)
+			emptyCells, content = 0, true
+			if covered[key] {
+				cells.WriteString(`<table:covered-table-cell/>`)
+				continue
+			}
+			writeODSCell(&cells, cell, spans[key], styles)
+		}
+		if !content && height <= 0 {
+			emptyRows++
+			continue
+		}
+		flushEmpty()
+		if height > 0 {
+			fmt.Fprintf(b, `<table:table-row table:style-name="%s">`, styles.row(height))
+		} else {
+			b.WriteString(`<table:table-row>`)
+		}
+		b.WriteString(cells.String())
+		writeODSEmptyCells(b, emptyCells)
+		b.WriteString(`</table:table-row>`)
+	}
+	flushEmpty()
+	if maxRow < 0 {
+		b.WriteString(`<table:table-row><table:table-cell/></table:table-row>`)
+	}
+	b.WriteString(`</table:table>`)
+}
+
+func writeODSEmptyCells(b *strings.Builder, n int) {
+	switch {
+	case n == 1:
+		b.WriteString(`<table:table-cell/>`)
+	case n > 1:
+		fmt.Fprintf(b, `<table:table-cell table:number-columns-repeated="%d"/>`, n)
+	}
+}
+
+func writeODSCell(b *strings.Builder, cell models.CellData, span [2]int, styles *odsStyleWriter) {
+	value := cell.Value
+	style := cell.Style
+	if style == nil {
+		style = &models.CellStyle{}
+	}
+	numberFormat := style.NumberFormat
+
+	var attrs strings.Builder
+	text := value
+	isDate := false
+
+	// Values are typed like the XLSX exporter types them; formulas take the
+	// type of their computed result.
+	typed := value
+	if strings.HasPrefix(value, "=") && len(value) > 1 {
+		fmt.Fprintf(&attrs, ` table:formula="%s"`, odsEscape(a1FormulaToODS(value)))
+		typed = ComputedText(cell)
+		text = typed
+	}
+	switch {
+	case typed == "":
+	case isoDatePattern.MatchString(typed):
+		isDate = true
+		fmt.Fprintf(&attrs, ` office:value-type="date" office:date-value="%s"`, typed)
+	default:
+		switch v := formula.LiteralValue(typed); v.Kind {
+		case formula.KindNumber:
+			num := strconv.FormatFloat(v.Num, 'g', -1, 64)
+			switch numberFormat {
+			case "percent":
+				fmt.Fprintf(&attrs, ` office:value-type="percentage" office:value="%s"`, num)
+			case "currency":
+				code := strings.ToUpper(strings.TrimSpace(style.CurrencyCode))
+				if code == "" {
+					code = "USD"
+				}
+				fmt.Fprintf(&attrs, ` office:value-type="currency" office:currency="%s" office:value="%s"`, odsEscape(code), num)
+			default:
+				fmt.Fprintf(&attrs, ` office:value-type="float" office:value="%s"`, num)
+			}
+		case formula.KindBool:
+			fmt.Fprintf(&attrs, ` office:value-type="boolean" office:boolean-value="%t"`, v.Bool)
+		default:
+			attrs.WriteString(` office:value-type="string"`)
+		}
+	}
+
+	if hasStyle(cell) || isDate {
+		fmt.Fprintf(&attrs, ` table:style-name="%s"`, styles.cell(style, isDate))
+	}
+	if span[0] > 1 || span[1] > 1 {
+		fmt.Fprintf(&attrs, ` table:number-rows-spanned="%d" table:number-columns-spanned="%d"`, span[0], span[1])
+	}
+
+	if text == "" {
+		fmt.Fprintf(b, `<table:table-cell%s/>`, attrs.String())
+		return
+	}
+	fmt.Fprintf(b, `<table:table-cell%s>`, attrs.String())
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(b, `<text:p>%s</text:p>`, odsEscape(line))
+	}
+	b.WriteString(`</table:table-cell>`)
+}
+
+// a1CellRefPattern matches A1 references and ranges with an optional
+// unquoted sheet prefix.
+var a1CellRefPattern = regexp.MustCompile(`(?:([A-Za-z_][A-Za-z0-9_.]*)!)?(\$?[A-Za-z]{1,3}\$?[0-9]+)(?::(\$?[A-Za-z]{1,3}\$?[0-9]+))?`)
+
+// a1FormulaToODS is the inverse of odsFormulaToA1.
+func a1FormulaToODS(value string) string {
+	f := strings.TrimPrefix(value, "=")
+	var b strings.Builder
+	b.WriteString("of:=")
+	start := 0
+	inString := false
+	for i := 0; i <= len(f); i++ {
+		if i < len(f) && f[i] != '"' {
+			continue
+		}
+		segment := f[start:i]
+		if inString {
+			b.WriteString(segment)
+		} else {
+			b.WriteString(odsConvertRefs(segment))
+		}
+		if i < len(f) {
+			b.WriteByte('"')
+		}
+		inString = !inString
+		start = i + 1
+	}
+	return b.String()
+}
+
+func odsConvertRefs(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range a1CellRefPattern.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[0], m[1]
+		// Skip function names like LOG10( and parts of longer identifiers.
+		if start > 0 && odsIdentByte(s[start-1]) || end < len(s) && (odsIdentByte(s[end]) || s[end] == '(') {
+			continue
+		}
+		b.WriteString(strings.ReplaceAll(s[last:start], ",", ";"))
+		b.WriteByte('[')
+		if m[2] >= 0 {
+			b.WriteString("$" + s[m[2]:m[3]])
+		}
+		b.WriteString("." + s[m[4]:m[5]])
+		if m[6] >= 0 {
+			b.WriteString(":." + s[m[6]:m[7]])
+		}
+		b.WriteByte(']')
+		last = end
+	}
+	b.WriteString(strings.ReplaceAll(s[last:], ",", ";"))
+	return b.String()
+}
+
+func odsIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// odsStyleWriter collects the automatic styles of content.xml, each
+// distinct one once.
+type odsStyleWriter struct {
+	xml strings.Builder
+	ids map[string]string
+	n   int
+}
+
+func (w *odsStyleWriter) add(key, prefix string, build func(name string) string) string {
+	if name, ok := w.ids[key]; ok {
+		return name
+	}
+	w.n++
+	name := fmt.Sprintf("%s%d", prefix, w.n)
+	w.ids[key] = name
+	w.xml.WriteString(build(name))
+	return name
+}
+
+func (w *odsStyleWriter) column(width string) string {
+	return w.add("co|"+width, "co", func(name string) string {
+		return fmt.Sprintf(`<style:style style:name="%s" style:family="table-column"><style:table-column-properties style:column-width="%s"/></style:style>`, name, width)
+	})
+}
+
+func (w *odsStyleWriter) row(px float64) string {
+	height := fmt.Sprintf("%.4fin", px/96)
+	return w.add("ro|"+height, "ro", func(name string) string {
+		return fmt.Sprintf(`<style:style style:name="%s" style:family="table-row"><style:table-row-properties style:row-height="%s" style:use-optimal-row-height="false"/></style:style>`, name, height)
+	})
+}
+
+// cell is the inverse of cellStyleFromODS, plus a data style for number
+// formats and dates.
+func (w *odsStyleWriter) cell(style *models.CellStyle, isDate bool) string {
+	encoded, _ := json.Marshal(style)
+	return w.add(fmt.Sprintf("ce|%s|%t", encoded, isDate), "ce", func(name string) string {
+		var cellProps, textProps strings.Builder
+		if color := cssColor(style.BackgroundColor); color != "" {
+			fmt.Fprintf(&cellProps, ` fo:background-color="#%s"`, strings.ToLower(color))
+		}
+		if borders := style.Borders; borders != nil {
+			color := cssColor(borders.Color)
+			if color == "" {
+				color = "000000"
+			}
+			line := "solid"
+			switch borders.Style {
+			case "dashed", "dotted":
+				line = borders.Style
+			}
+			for _, side := range borderSides(borders) {
+				fmt.Fprintf(&cellProps, ` fo:border-%s="0.75pt %s #%s"`, side, line, strings.ToLower(color))
+			}
+		}
+		switch v := style.VerticalAlign; v {
+		case "top", "middle", "bottom":
+			fmt.Fprintf(&cellProps, ` style:vertical-align="%s"`, v)
+		}
+		if style.WrapMode == "wrap" {
+			cellProps.WriteString(` fo:wrap-option="wrap"`)
+		}
+		if rotation := style.Rotation; rotation != nil && *rotation != 0 {
+			r := math.Max(-90, math.Min(90, *rotation))
+			if r < 0 {
+				r += 360
+			}
+			fmt.Fprintf(&cellProps, ` style:rotation-angle="%g"`, r)
+		}
+
+		if isSet(style.Bold) {
+			textProps.WriteString(` fo:font-weight="bold"`)
+		}
+		if isSet(style.Italic) {
+			textProps.WriteString(` fo:font-style="italic"`)
+		}
+		if isSet(style.Underline) {
+			textProps.WriteString(` style:text-underline-style="solid" style:text-underline-width="auto" style:text-underline-color="font-color"`)
+		}
+		if color := cssColor(style.Color); color != "" {
+			fmt.Fprintf(&textProps, ` fo:color="#%s"`, strings.ToLower(color))
+		}
+		if size := style.FontSize; size != nil && *size > 0 {
+			fmt.Fprintf(&textProps, ` fo:font-size="%gpt"`, *size)
+		}
+		if family := style.FontFamily; family != "" {
+			fmt.Fprintf(&textProps, ` fo:font-family="%s"`, odsEscape(family))
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, `<style:style style:name="%s" style:family="table-cell"`, name)
+		if dataStyle := w.dataStyle(style, isDate); dataStyle != "" {
+			fmt.Fprintf(&b, ` style:data-style-name="%s"`, dataStyle)
+		}
+		b.WriteString(`>`)
+		if cellProps.Len() > 0 {
+			fmt.Fprintf(&b, `<style:table-cell-properties%s/>`, cellProps.String())
+		}
+		switch h := style.TextAlign; h {
+		case "left", "center", "right":
+			align := map[string]string{"left": "start", "center": "center", "right": "end"}[h]
+			fmt.Fprintf(&b, `<style:paragraph-properties fo:text-align="%s"/>`, align)
+		}
+		if textProps.Len() > 0 {
+			fmt.Fprintf(&b, `<style:text-properties%s/>`, textProps.String())
+		}
+		b.WriteString(`</style:style>`)
+		return b.String()
+	})
+}
+
+// dataStyle registers the number style of a CellStyle, mirroring the
+// number formats of xlsxStyleFromCell.
+func (w *odsStyleWriter) dataStyle(style *models.CellStyle, isDate bool) string {
+	decimals := -1
+	if d := style.DecimalPlaces; d != nil && *d >= 0 {
+		decimals = min(*d, 10)
+	}
+	number := func(d int, grouping bool) string {
+		return fmt.Sprintf(`<number:number number:decimal-places="%d" number:min-decimal-places="%d" number:min-integer-digits="1" number:grouping="%t"/>`, d, d, grouping)
+	}
+
+	switch style.NumberFormat {
+	case "number":
+		if decimals < 0 {
+			decimals = 3
+		}
+		return w.add(fmt.Sprintf("N|number|%d", decimals), "N", func(name string) string {
+			return fmt.Sprintf(`<number:number-style style:name="%s">%s</number:number-style>`, name, number(decimals, true))
+		})
+	case "percent":
+		if decimals < 0 {
+			decimals = 2
+		}
+		return w.add(fmt.Sprintf("N|percent|%d", decimals), "N", func(name string) string {
+			return fmt.Sprintf(`<number:percentage-style style:name="%s">%s<number:text>%%</number:text></number:percentage-style>`, name, number(decimals, false))
+		})
+	case "currency":
+		if decimals < 0 {
+			decimals = 2
+		}
+		code := strings.ToUpper(strings.TrimSpace(style.CurrencyCode))
+		if code == "" {
+			code = "USD"
+		}
+		symbol, ok := currencySymbols[code]
+		if !ok {
+			symbol = code + " "
+		}
+		return w.add(fmt.Sprintf("N|currency|%s|%d", code, decimals), "N", func(name string) string {
+			return fmt.Sprintf(`<number:currency-style style:name="%s"><number:currency-symbol>%s</number:currency-symbol>%s</number:currency-style>`, name, odsEscape(symbol), number(decimals, true))
+		})
+	}
+	if isDate {
+		return w.add("N|date", "N", func(name string) string {
+			return fmt.Sprintf(`<number:date-style style:name="%s"><number:year number:style="long"/><number:text>-</number:text><number:month number:style="long"/><number:text>-</number:text><number:day number:style="long"/></number:date-style>`, name)
+		})
+	}
+	if decimals >= 0 {
+		return w.add(fmt.Sprintf("N|fixed|%d", decimals), "N", func(name string) string {
+			return fmt.Sprintf(`<number:number-style style:name="%s">%s</number:number-style>`, name, number(decimals, false))
+		})
+	}
+	return ""
+}
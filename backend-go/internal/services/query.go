@@ -0,0 +1,231 @@
+package services
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"converter-backend/internal/formula"
+)
+
+// ErrInvalidQuery is returned for a filter or sort that cannot be parsed.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Filter operators of RecordCondition; "~" matches a substring.
+var queryOperators = []string{"!=", ">=", "<=", "=", ">", "<", "~"}
+
+// RecordCondition compares a field with a value, e.g. Amount>100.
+type RecordCondition struct {
+	Field string
+	Op    string
+	Value any // typed like a cell; nil matches empty cells
+}
+
+// RecordSort orders records by a field.
+type RecordSort struct {
+	Field string
+	Desc  bool
+}
+
+// ParseRecordConditions parses filters such as "Amount>100" or
+// "Status=paid"; an expression may hold several joined by ";". All
+// conditions must hold.
+func ParseRecordConditions(exprs []string) ([]RecordCondition, error) {
+	var conds []RecordCondition
+	for _, expr := range exprs {
+		for _, part := range strings.Split(expr, ";") {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			cond, err := parseRecordCondition(part)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, cond)
+		}
+	}
+	return conds, nil
+}
+
+func parseRecordCondition(expr string) (RecordCondition, error) {
+	at := strings.IndexAny(expr, "!<>=~")
+	if at <= 0 {
+		return RecordCondition{}, fmt.Errorf("%w: %q needs a field, an operator (= != > >= < <= ~) and a value", ErrInvalidQuery, expr)
+	}
+	op := ""
+	for _, candidate := range queryOperators {
+		if strings.HasPrefix(expr[at:], candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return RecordCondition{}, fmt.Errorf("%w: unknown operator in %q", ErrInvalidQuery, expr)
+	}
+
+	field := strings.TrimSpace(expr[:at])
+	value := strings.TrimSpace(expr[at+len(op):])
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		// Quotes keep a value text: Code="007".
+		return RecordCondition{Field: field, Op: op, Value: value[1 : len(value)-1]}, nil
+	}
+	return RecordCondition{Field: field, Op: op, Value: literalJSON(value)}, nil
+}
+
+// ParseRecordSort parses "-Date,Name": fields in order, "-" for descending.
+func ParseRecordSort(expr string) []RecordSort {
+	var sorts []RecordSort
+	for _, part := range strings.Split(expr, ",") {
+		part = strings.TrimSpace(part)
+		desc := strings.HasPrefix(part, "-")
+		part = strings.TrimSpace(strings.TrimLeft(part, "+-"))
+		if part != "" {
+			sorts = append(sorts, RecordSort{Field: part, Desc: desc})
+		}
+	}
+	return sorts
+}
+
+// Query returns the rows of the records matching every condition, ordered
+// by sorts and then by row. Empty values sort last either way.
+func (t *SheetTable) Query(conds []RecordCondition, sorts []RecordSort) ([]int, error) {
+	condCols := make([]int, len(conds))
+	for i, cond := range conds {
+		col, ok := t.Field(cond.Field)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownField, cond.Field)
+		}
+		condCols[i] = col
+	}
+	sortCols := make([]int, len(sorts))
+	for i, sort := range sorts {
+		col, ok := t.Field(sort.Field)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownField, sort.Field)
+		}
+		sortCols[i] = col
+	}
+
+	var rows []int
+	for _, row := range t.RecordRows() {
+		match := true
+		for i, cond := range conds {
+			if !cond.matches(t.Value(row, condCols[i])) {
+				match = false
+				break
+			}
+		}
+		if match {
+			rows = append(rows, row)
+		}
+	}
+
+	if len(sorts) > 0 {
+		slices.SortStableFunc(rows, func(a, b int) int {
+			for i, sort := range sorts {
+				va, vb := t.Value(a, sortCols[i]), t.Value(b, sortCols[i])
+				if va == nil || vb == nil {
+					// Empty last, whatever the direction.
+					if c := cmp.Compare(boolRank(va == nil), boolRank(vb == nil)); c != 0 {
+						return c
+					}
+					continue
+				}
+				c := compareValues(va, vb)
+				if sort.Desc {
+					c = -c
+				}
+				if c != 0 {
+					return c
+				}
+			}
+			return 0
+		})
+	}
+	return rows, nil
+}
+
+func (cond RecordCondition) matches(v any) bool {
+	if cond.Value == nil {
+		switch cond.Op {
+		case "=":
+			return v == nil
+		case "!=":
+			return v != nil
+		}
+		return false
+	}
+	if v == nil {
+		return cond.Op == "!="
+	}
+
+	if cond.Op == "~" {
+		return strings.Contains(strings.ToLower(valueText(v)), strings.ToLower(valueText(cond.Value)))
+	}
+	c := compareValues(v, cond.Value)
+	switch cond.Op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+	return false
+}
+
+// compareValues orders typed values: numbers and booleans by value, text
+// (dates included, whose ISO form sorts by time) ignoring case. Values of
+// different types order as number < bool < text.
+func compareValues(a, b any) int {
+	if c := cmp.Compare(typeRank(a), typeRank(b)); c != 0 {
+		return c
+	}
+	switch ta := a.(type) {
+	case float64:
+		return cmp.Compare(ta, b.(float64))
+	case bool:
+		return cmp.Compare(boolRank(ta), boolRank(b.(bool)))
+	}
+	return strings.Compare(strings.ToLower(valueText(a)), strings.ToLower(valueText(b)))
+}
+
+func typeRank(v any) int {
+	switch v.(type) {
+	case float64:
+		return 0
+	case bool:
+		return 1
+	}
+	return 2
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func valueText(v any) string {
+	switch t := v.(type) {
+	case float64:
+		return formula.FormatNumber(t)
+	case bool:
+		if t {
+			return "TRUE"
+		}
+		return "FALSE"
+	case string:
+		return t
+	}
+	return fmt.Sprint(v)
+}
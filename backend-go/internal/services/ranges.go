@@ -0,0 +1,419 @@
+package services
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+)
+
+// Range operations of ApplyRangeOp.
+const (
+	RangeCopy      = "copy"
+	RangeMove      = "move"
+	RangeFillDown  = "fill_down"
+	RangeFillRight = "fill_right"
+	RangeClear     = "clear"
+	RangeSort      = "sort"
+	RangeStyle     = "style"
+)
+
+// What a RangeClear removes.
+const (
+	ClearAll    = "all"
+	ClearValues = "values"
+	ClearStyles = "styles"
+)
+
+// maxRangeOpCells bounds the area a range operation may cover.
+const maxRangeOpCells = 100000
+
+// ErrInvalidRangeOp is returned for a range operation that cannot be
+// applied; its message is meant for the client.
+var ErrInvalidRangeOp = errors.New("invalid range operation")
+
+// RangeOp is an operation on the cells of Range in Sheet.
+type RangeOp struct {
+	Op    string
+	Sheet string // "" is the first sheet
+	Range CellRange
+	// ToRow and ToCol are the top-left cell a copy or move goes to.
+	ToRow, ToCol int
+	// Clear is what a clear removes: ClearAll (the default), ClearValues
+	// or ClearStyles.
+	Clear string
+	// SortCol is the column a sort orders the rows by; Header keeps the
+	// first row of the range in place.
+	SortCol int
+	Desc    bool
+	Header  bool
+	// Style is merged into the style of every cell of the range by a
+	// style op, or replaces it when ReplaceStyle is set.
+	Style        map[string]any
+	ReplaceStyle bool
+}
+
+func (op RangeOp) validate() error {
+	r := op.Range
+	if r.MinRow < 0 || r.MinCol < 0 || r.MinRow > r.MaxRow || r.MinCol > r.MaxCol {
+		return fmt.Errorf("%w: bad range", ErrInvalidRangeOp)
+	}
+	if (r.MaxRow-r.MinRow+1)*(r.MaxCol-r.MinCol+1) > maxRangeOpCells {
+		return fmt.Errorf("%w: range covers more than %d cells", ErrInvalidRangeOp, maxRangeOpCells)
+	}
+
+	switch op.Op {
+	case RangeCopy, RangeMove:
+		if op.ToRow < 0 || op.ToCol < 0 ||
+			op.ToRow+r.MaxRow-r.MinRow > formula.MaxRow || op.ToCol+r.MaxCol-r.MinCol >= maxSheetColumns {
+			return fmt.Errorf("%w: destination is off the sheet", ErrInvalidRangeOp)
+		}
+	case RangeClear:
+		switch op.Clear {
+		case "", ClearAll, ClearValues, ClearStyles:
+		default:
+			return fmt.Errorf("%w: clear must be %q, %q or %q", ErrInvalidRangeOp, ClearAll, ClearValues, ClearStyles)
+		}
+	case RangeSort:
+		if op.SortCol < r.MinCol || op.SortCol > r.MaxCol {
+			return fmt.Errorf("%w: sort column is outside the range", ErrInvalidRangeOp)
+		}
+	case RangeStyle:
+		if op.Style == nil {
+			return fmt.Errorf("%w: style is required", ErrInvalidRangeOp)
+		}
+		if err := ValidateCellStyle(op.Style, !op.ReplaceStyle); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidRangeOp, err)
+		}
+	case RangeFillDown, RangeFillRight:
+	default:
+		return fmt.Errorf("%w: unknown op %q", ErrInvalidRangeOp, op.Op)
+	}
+	return nil
+}
+
+// ApplyRangeOp runs a range operation as one cell patch: the edits it
+// makes are applied, recalculated and versioned together, and returned.
+//
+// A copy writes the range at the destination, shifting the relative
+// references of its formulas. A move does the same without shifting, clears
+// the cells it left, and points formulas that read the moved cells at their
+// new place. A fill extends each column (or row) of the range from the
+// filled cells at its start into the rest: two or more numbers or dates
+// continue as a series, anything else repeats. A sort reorders the rows of
+// the range by one of its columns, empty values last. A style op sets the
+// style of every cell in the range, empty ones included.
+func (s *SpreadsheetService) ApplyRangeOp(fileID uint, op RangeOp, ifMatch ...int64) (*models.SheetFile, []CellEdit, error) {
+	if err := op.validate(); err != nil {
+		return nil, nil, err
+	}
+	var edits []CellEdit
+	file, err := s.patchFile(fileID, ifMatch, func(state *models.SheetState, cells *cellLoader) ([]CellEdit, error) {
+		sheet, index, _, err := LookupSheet(state, op.Sheet)
+		if err != nil {
+			return nil, err
+		}
+		if err := op.load(cells, index); err != nil {
+			return nil, err
+		}
+		edits = op.edits(sheet.Data)
+		return edits, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, edits, nil
+}
+
+// load loads the cells the operation reads: its range, the destination of
+// a copy or move, and the formulas a move may point elsewhere.
+func (op RangeOp) load(cells *cellLoader, index int) error {
+	if _, err := cells.cells(index, op.Range); err != nil {
+		return err
+	}
+	switch op.Op {
+	case RangeCopy, RangeMove:
+		r := op.Range
+		dst := CellRange{MinRow: op.ToRow, MaxRow: op.ToRow + r.MaxRow - r.MinRow, MinCol: op.ToCol, MaxCol: op.ToCol + r.MaxCol - r.MinCol}
+		if _, err := cells.cells(index, dst); err != nil {
+			return err
+		}
+	}
+	if op.Op == RangeMove {
+		return cells.formulas(index)
+	}
+	return nil
+}
+
+// edits plans the operation against the sheet's data as it is.
+func (op RangeOp) edits(data map[string]models.CellData) []CellEdit {
+	r := op.Range
+	at := func(row, col int) *models.CellData {
+		cell, ok := data[fmt.Sprintf("%d,%d", row, col)]
+		if !ok {
+			return nil
+		}
+		return &cell
+	}
+	var edits []CellEdit
+	add := func(row, col int, from *models.CellData, value string) {
+		edits = append(edits, CellEdit{Sheet: op.Sheet, Row: row, Col: col, Value: value, Style: cellStyle(from)})
+	}
+
+	switch op.Op {
+	case RangeCopy:
+		rows, cols := op.ToRow-r.MinRow, op.ToCol-r.MinCol
+		for row := r.MinRow; row <= r.MaxRow; row++ {
+			for col := r.MinCol; col <= r.MaxCol; col++ {
+				from := at(row, col)
+				if from == nil && at(row+rows, col+cols) == nil {
+					continue
+				}
+				add(row+rows, col+cols, from, formula.OffsetReferences(cellValue(from), rows, cols))
+			}
+		}
+
+	case RangeMove:
+		rows, cols := op.ToRow-r.MinRow, op.ToCol-r.MinCol
+		src := formula.Range{StartRow: r.MinRow, StartCol: r.MinCol, EndRow: r.MaxRow, EndCol: r.MaxCol}
+		dst := CellRange{MinRow: op.ToRow, MaxRow: op.ToRow + r.MaxRow - r.MinRow, MinCol: op.ToCol, MaxCol: op.ToCol + r.MaxCol - r.MinCol}
+
+		// Formulas elsewhere follow the cells they read.
+		var followers []CellEdit
+		for id, cell := range data {
+			row, col, ok := formula.ParseCellID(id)
+			if !ok || r.contains(row, col) || dst.contains(row, col) {
+				continue
+			}
+			raw := cell.Value
+			if moved := formula.MoveReferences(raw, src, rows, cols); moved != raw {
+				followers = append(followers, CellEdit{Sheet: op.Sheet, Row: row, Col: col, Value: moved})
+			}
+		}
+		slices.SortFunc(followers, func(a, b CellEdit) int {
+			return cmp.Or(cmp.Compare(a.Row, b.Row), cmp.Compare(a.Col, b.Col))
+		})
+		edits = append(edits, followers...)
+
+		for row := r.MinRow; row <= r.MaxRow; row++ {
+			for col := r.MinCol; col <= r.MaxCol; col++ {
+				if at(row, col) != nil && !dst.contains(row, col) {
+					add(row, col, nil, "")
+				}
+			}
+		}
+		for row := r.MinRow; row <= r.MaxRow; row++ {
+			for col := r.MinCol; col <= r.MaxCol; col++ {
+				from := at(row, col)
+				if from == nil && at(row+rows, col+cols) == nil {
+					continue
+				}
+				add(row+rows, col+cols, from, formula.MoveReferences(cellValue(from), src, rows, cols))
+			}
+		}
+
+	case RangeFillDown:
+		for col := r.MinCol; col <= r.MaxCol; col++ {
+			edits = append(edits, op.fill(at, r.MaxRow-r.MinRow+1, func(i int) (int, int) { return r.MinRow + i, col })...)
+		}
+
+	case RangeFillRight:
+		for row := r.MinRow; row <= r.MaxRow; row++ {
+			edits = append(edits, op.fill(at, r.MaxCol-r.MinCol+1, func(i int) (int, int) { return row, r.MinCol + i })...)
+		}
+
+	case RangeClear:
+		for row := r.MinRow; row <= r.MaxRow; row++ {
+			for col := r.MinCol; col <= r.MaxCol; col++ {
+				cell := at(row, col)
+				if cell == nil {
+					continue
+				}
+				switch op.Clear {
+				case ClearValues:
+					edits = append(edits, CellEdit{Sheet: op.Sheet, Row: row, Col: col})
+				case ClearStyles:
+					if cell.Style != nil {
+						edits = append(edits, CellEdit{Sheet: op.Sheet, Row: row, Col: col, Style: map[string]any{}, StyleOnly: true})
+					}
+				default:
+					add(row, col, nil, "")
+				}
+			}
+		}
+
+	case RangeStyle:
+		for row := r.MinRow; row <= r.MaxRow; row++ {
+			for col := r.MinCol; col <= r.MaxCol; col++ {
+				edits = append(edits, CellEdit{Sheet: op.Sheet, Row: row, Col: col, Style: op.Style, MergeStyle: !op.ReplaceStyle, StyleOnly: true})
+			}
+		}
+
+	case RangeSort:
+		first := r.MinRow
+		if op.Header {
+			first++
+		}
+		var order []int
+		for row := first; row <= r.MaxRow; row++ {
+			order = append(order, row)
+		}
+		slices.SortStableFunc(order, func(a, b int) int {
+			va, vb := TypedCellValue(cellOrEmpty(at(a, op.SortCol))), TypedCellValue(cellOrEmpty(at(b, op.SortCol)))
+			if va == nil || vb == nil {
+				return cmp.Compare(boolRank(va == nil), boolRank(vb == nil))
+			}
+			if op.Desc {
+				return compareValues(vb, va)
+			}
+			return compareValues(va, vb)
+		})
+		for i, from := range order {
+			to := first + i
+			if from == to {
+				continue
+			}
+			for col := r.MinCol; col <= r.MaxCol; col++ {
+				cell := at(from, col)
+				if cell == nil && at(to, col) == nil {
+					continue
+				}
+				add(to, col, cell, formula.OffsetReferences(cellValue(cell), to-from, 0))
+			}
+		}
+	}
+	return edits
+}
+
+// fill extends a line of n cells, position i of which is at pos(i), from
+// its leading filled cells into the rest.
+func (op RangeOp) fill(at func(row, col int) *models.CellData, n int, pos func(i int) (int, int)) []CellEdit {
+	var seeds []*models.CellData
+	for i := 0; i < n; i++ {
+		cell := at(pos(i))
+		if cellValue(cell) == "" {
+			break
+		}
+		seeds = append(seeds, cell)
+	}
+	if len(seeds) == 0 || len(seeds) == n {
+		return nil
+	}
+
+	series := fillSeries(seeds)
+	edits := make([]CellEdit, 0, n-len(seeds))
+	for i := len(seeds); i < n; i++ {
+		seed := i % len(seeds)
+		row, col := pos(i)
+		value := ""
+		if series != nil {
+			value = series(i)
+		} else {
+			seedRow, seedCol := pos(seed)
+			value = formula.OffsetReferences(seeds[seed].Value, row-seedRow, col-seedCol)
+		}
+		edits = append(edits, CellEdit{Sheet: op.Sheet, Row: row, Col: col, Value: value, Style: cellStyle(seeds[seed])})
+	}
+	return edits
+}
+
+// fillSeries returns the i-th value of the series that two or more seed
+// numbers or ISO dates start, or nil when the seeds are not one. Numbers
+// step by their average difference; dates by a whole number of months when
+// they share the day of the month, and otherwise by their common
+// difference in days.
+func fillSeries(seeds []*models.CellData) func(i int) string {
+	if len(seeds) < 2 {
+		return nil
+	}
+	raws := make([]string, len(seeds))
+	for i, seed := range seeds {
+		raws[i] = seed.Value
+		if formula.IsFormula(raws[i]) {
+			return nil
+		}
+	}
+
+	nums := make([]float64, len(raws))
+	numeric := true
+	for i, raw := range raws {
+		v := formula.LiteralValue(raw)
+		if v.Kind != formula.KindNumber {
+			numeric = false
+			break
+		}
+		nums[i] = v.Num
+	}
+	if numeric {
+		step := (nums[len(nums)-1] - nums[0]) / float64(len(nums)-1)
+		return func(i int) string {
+			// 15 significant digits, as Excel keeps, so 0.1 steps stay exact.
+			v, _ := strconv.ParseFloat(strconv.FormatFloat(nums[0]+step*float64(i), 'g', 15, 64), 64)
+			return formula.FormatNumber(v)
+		}
+	}
+
+	dates := make([]time.Time, len(raws))
+	for i, raw := range raws {
+		if !isoDatePattern.MatchString(raw) {
+			return nil
+		}
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return nil
+		}
+		dates[i] = t
+	}
+	months := monthsBetween(dates[0], dates[1])
+	days := int(math.Round(dates[1].Sub(dates[0]).Hours() / 24))
+	sameDay, monthly, daily := true, months != 0, days != 0
+	for i := 1; i < len(dates); i++ {
+		sameDay = sameDay && dates[i].Day() == dates[0].Day()
+		monthly = monthly && monthsBetween(dates[i-1], dates[i]) == months
+		daily = daily && int(math.Round(dates[i].Sub(dates[i-1]).Hours()/24)) == days
+	}
+	switch {
+	case sameDay && monthly:
+		return func(i int) string { return dates[0].AddDate(0, months*i, 0).Format("2006-01-02") }
+	case daily:
+		return func(i int) string { return dates[0].AddDate(0, 0, days*i).Format("2006-01-02") }
+	}
+	return nil
+}
+
+func monthsBetween(a, b time.Time) int {
+	return (b.Year()-a.Year())*12 + int(b.Month()) - int(a.Month())
+}
+
+// cellStyle is the style a cell carries, or an empty style.
+func cellStyle(cell *models.CellData) map[string]any {
+	if cell == nil {
+		return map[string]any{}
+	}
+	return styleMap(cell.Style)
+}
+
+// cellValue is the raw value of a cell; "" for none.
+func cellValue(cell *models.CellData) string {
+	if cell == nil {
+		return ""
+	}
+	return cell.Value
+}
+
+func cellOrEmpty(cell *models.CellData) models.CellData {
+	if cell == nil {
+		return models.CellData{}
+	}
+	return *cell
+}
+
+func (r CellRange) contains(row, col int) bool {
+	return row >= r.MinRow && row <= r.MaxRow && col >= r.MinCol && col <= r.MaxCol
+}
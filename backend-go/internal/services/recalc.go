@@ -0,0 +1,93 @@
+package services
+
+import (
+	"converter-backend/internal/formula"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrInvalidState is returned when a submitted sheet state cannot be decoded.
+var ErrInvalidState = errors.New("invalid state")
+
+// RecalculateState evaluates every formula in every sheet of a state and
+// returns the state with fresh computed values. Other state fields are
+// passed through.
+func RecalculateState(state json.RawMessage) (json.RawMessage, error) {
+	var decoded map[string]any
+	if err := json.Unmarshal(state, &decoded); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if decoded == nil {
+		return state, nil
+	}
+
+	recalculateWorkbook(decoded)
+
+	next, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode file state: %w", err)
+	}
+	return next, nil
+}
+
+// maxCachedGraphs bounds how many file dependency graphs stay in memory.
+const maxCachedGraphs = 128
+
+type graphEntry struct {
+	graphs   map[int]*formula.Graph // by sheet index
+	stamp    time.Time
+	lastUsed time.Time
+}
+
+// formulaGraphCache keeps the dependency graphs of the sheets of recently
+// patched files so a batch edit does not have to re-parse every formula. Entries are tagged
+// with the file's UpdatedAt; any write that bypasses the cache (a full Save,
+// another instance) changes it and the graph is rebuilt.
+type formulaGraphCache struct {
+	mu      sync.Mutex
+	entries map[uint]*graphEntry
+}
+
+// take removes and returns the cached graphs of a file if they still match
+// the stored state. The caller puts it back once its transaction commits, so
+// a rolled back edit never leaves a half-updated graph behind.
+func (c *formulaGraphCache) take(fileID uint, stamp time.Time) map[int]*formula.Graph {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[fileID]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, fileID)
+	if !sameStamp(entry.stamp, stamp) {
+		return nil
+	}
+	return entry.graphs
+}
+
+func (c *formulaGraphCache) put(fileID uint, stamp time.Time, graphs map[int]*formula.Graph) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[uint]*graphEntry{}
+	}
+	if _, ok := c.entries[fileID]; !ok && len(c.entries) >= maxCachedGraphs {
+		var oldestID uint
+		var oldest time.Time
+		for id, e := range c.entries {
+			if oldest.IsZero() || e.lastUsed.Before(oldest) {
+				oldestID, oldest = id, e.lastUsed
+			}
+		}
+		delete(c.entries, oldestID)
+	}
+	c.entries[fileID] = &graphEntry{graphs: graphs, stamp: stamp, lastUsed: time.Now()}
+}
+
+// sameStamp compares timestamps at the database's microsecond precision.
+func sameStamp(a, b time.Time) bool {
+	return a.Truncate(time.Microsecond).Equal(b.Truncate(time.Microsecond))
+}
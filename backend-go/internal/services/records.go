@@ -0,0 +1,519 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+)
+
+// Record field types, inferred from cell values.
+const (
+	FieldNumber = "number"
+	FieldBool   = "bool"
+	FieldDate   = "date"
+	FieldString = "string"
+)
+
+// SheetTable reads a sheet as a table of records: the header row, detected
+// as in GET /files/:id/schema, names the columns of the used range and every
+// non-blank row below it is a record.
+type SheetTable struct {
+	HeaderRow int
+	MinCol    int
+	MaxCol    int
+	// LastRow is the last row holding a value; HeaderRow when the table has
+	// no records yet.
+	LastRow int
+	// Fields[i] names column MinCol+i.
+	Fields []string
+
+	data map[string]models.CellData
+}
+
+// NewSheetTable builds the table of a sheet; nil means the sheet is empty.
+func NewSheetTable(sheet *models.Sheet) *SheetTable {
+	minRow, minCol, maxRow, maxCol := -1, -1, -1, -1
+	for id, cell := range sheet.Data {
+		row, col, ok := formula.ParseCellID(id)
+		if !ok || strings.TrimSpace(cell.Value) == "" {
+			continue
+		}
+		if minRow < 0 || row < minRow {
+			minRow = row
+		}
+		if minCol < 0 || col < minCol {
+			minCol = col
+		}
+		maxRow = max(maxRow, row)
+		maxCol = max(maxCol, col)
+	}
+	if maxRow < 0 {
+		return nil
+	}
+
+	t := &SheetTable{MinCol: minCol, MaxCol: maxCol, LastRow: maxRow, data: sheet.Data}
+	lead := make([][]string, 0, headerScanRows)
+	for r := minRow; r < minRow+headerScanRows && r <= maxRow; r++ {
+		lead = append(lead, t.rawRow(r))
+	}
+	t.HeaderRow = minRow + DetectHeaderRow(lead)
+	t.Fields = recordKeys(t.rawRow(t.HeaderRow), minCol)
+	return t
+}
+
+func (t *SheetTable) cell(row, col int) models.CellData {
+	return t.data[fmt.Sprintf("%d,%d", row, col)]
+}
+
+func (t *SheetTable) rawRow(row int) []string {
+	values := make([]string, 0, t.MaxCol-t.MinCol+1)
+	for col := t.MinCol; col <= t.MaxCol; col++ {
+		values = append(values, t.cell(row, col).Value)
+	}
+	return values
+}
+
+// Field finds a field by name, exactly or else ignoring case, and returns
+// its column.
+func (t *SheetTable) Field(name string) (int, bool) {
+	name = strings.TrimSpace(name)
+	for i, field := range t.Fields {
+		if field == name {
+			return t.MinCol + i, true
+		}
+	}
+	for i, field := range t.Fields {
+		if strings.EqualFold(field, name) {
+			return t.MinCol + i, true
+		}
+	}
+	return 0, false
+}
+
+// IsBlank reports whether a row has no value in the table's columns.
+func (t *SheetTable) IsBlank(row int) bool {
+	for col := t.MinCol; col <= t.MaxCol; col++ {
+		if strings.TrimSpace(t.cell(row, col).Value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordRows lists the rows of the records, in order.
+func (t *SheetTable) RecordRows() []int {
+	rows := make([]int, 0, t.LastRow-t.HeaderRow)
+	for row := t.HeaderRow + 1; row <= t.LastRow; row++ {
+		if !t.IsBlank(row) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// Value returns the typed value of a cell: formulas give their computed
+// result, numbers and booleans their JSON type, everything else (dates
+// included, as YYYY-MM-DD) text. Empty cells are nil.
+func (t *SheetTable) Value(row, col int) any {
+	return TypedCellValue(t.cell(row, col))
+}
+
+// Record returns a row as an object keyed by field.
+func (t *SheetTable) Record(row int) map[string]any {
+	record := make(map[string]any, len(t.Fields))
+	for i, field := range t.Fields {
+		record[field] = t.Value(row, t.MinCol+i)
+	}
+	return record
+}
+
+// FieldTypes infers the type of every field from its values in rows: the
+// type all non-empty values share, or string when they differ.
+func (t *SheetTable) FieldTypes(rows []int) []string {
+	types := make([]string, len(t.Fields))
+	for i := range t.Fields {
+		for _, row := range rows {
+			kind := ValueType(t.Value(row, t.MinCol+i))
+			if kind == "" {
+				continue
+			}
+			if types[i] == "" {
+				types[i] = kind
+			} else if types[i] != kind {
+				types[i] = FieldString
+				break
+			}
+		}
+		if types[i] == "" {
+			types[i] = FieldString
+		}
+	}
+	return types
+}
+
+// TypedCellValue is the JSON value of a state cell; see SheetTable.Value.
+func TypedCellValue(cell models.CellData) any {
+	if formula.IsFormula(cell.Value) {
+		switch computed := cell.Computed.(type) {
+		case nil:
+			return nil
+		case string:
+			return literalJSON(computed)
+		default:
+			return computed
+		}
+	}
+	return literalJSON(cell.Value)
+}
+
+// ComputedText is the computed value of a cell as the editor displays it;
+// "" when the cell has none.
+func ComputedText(cell models.CellData) string {
+	switch computed := cell.Computed.(type) {
+	case nil:
+		return ""
+	case string:
+		return computed
+	case float64:
+		// fmt.Sprint would write 1000000 as 1e+06.
+		return formula.FormatNumber(computed)
+	case bool:
+		if computed {
+			return "TRUE"
+		}
+		return "FALSE"
+	default:
+		return fmt.Sprint(computed)
+	}
+}
+
+func literalJSON(raw string) any {
+	v := formula.LiteralValue(raw)
+	switch v.Kind {
+	case formula.KindEmpty:
+		return nil
+	case formula.KindNumber:
+		return v.Num
+	case formula.KindBool:
+		return v.Bool
+	}
+	return raw
+}
+
+// ValueType names the type of a typed cell value; "" for nil.
+func ValueType(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return FieldNumber
+	case bool:
+		return FieldBool
+	case string:
+		if isoDatePattern.MatchString(t) {
+			return FieldDate
+		}
+	}
+	return FieldString
+}
+
+// Errors of the record write API; their messages are meant for the client.
+var (
+	ErrUnknownField  = errors.New("unknown field")
+	ErrInvalidRecord = errors.New("invalid record")
+)
+
+// Record is a JSON object written as a sheet row. Fields keeps the order of
+// its keys, which names the columns of a sheet that has no header yet.
+type Record struct {
+	Fields []string
+	Values map[string]any
+}
+
+// UnmarshalJSON decodes an object keeping the order of its keys.
+func (r *Record) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("%w: a record must be an object", ErrInvalidRecord)
+	}
+	r.Fields = nil
+	r.Values = map[string]any{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		if _, dup := r.Values[key]; !dup {
+			r.Fields = append(r.Fields, key)
+		}
+		r.Values[key] = value
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// recordCellValue renders a JSON value as the raw input of a cell.
+func recordCellValue(field string, v any) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return t.String(), nil
+		}
+		return formula.FormatNumber(f), nil
+	case float64:
+		return formula.FormatNumber(t), nil
+	case bool:
+		if t {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	}
+	return "", fmt.Errorf("%w: %s must be a string, number, boolean or null", ErrInvalidRecord, field)
+}
+
+// normalizeKey is the typed form a key is matched by, so 12, "12" and
+// "12.0" are the same key; nil for no key.
+func normalizeKey(v any) any {
+	switch t := v.(type) {
+	case string:
+		return literalJSON(strings.TrimSpace(t))
+	case json.Number:
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t.String()
+	case float64, bool:
+		return v
+	}
+	return nil
+}
+
+// RecordResult reports where a written record went.
+type RecordResult struct {
+	Row    int    `json:"_row"` // 1-based sheet row
+	Action string `json:"action"`
+}
+
+// Record write actions.
+const (
+	RecordInserted = "inserted"
+	RecordUpdated  = "updated"
+	RecordDeleted  = "deleted"
+)
+
+// recordWriter plans the cell edits of record writes on a locked state.
+type recordWriter struct {
+	sheet   string
+	table   *SheetTable
+	nextRow int
+	edits   []CellEdit
+	results []RecordResult
+}
+
+// newRecordWriter reads the table of a sheet. A sheet without values gets
+// its header from the first record, in row 1.
+func newRecordWriter(state *models.SheetState, sheet string, first *Record) (*recordWriter, error) {
+	found, _, _, err := LookupSheet(state, sheet)
+	if err != nil {
+		return nil, err
+	}
+	w := &recordWriter{sheet: sheet, table: NewSheetTable(found)}
+	if w.table != nil {
+		w.nextRow = w.table.LastRow + 1
+		return w, nil
+	}
+	if first == nil || len(first.Fields) == 0 {
+		return nil, fmt.Errorf("%w: the sheet has no header row", ErrUnknownField)
+	}
+	w.table = &SheetTable{MaxCol: len(first.Fields) - 1, Fields: first.Fields, data: map[string]models.CellData{}}
+	for col, field := range first.Fields {
+		w.edits = append(w.edits, CellEdit{Sheet: sheet, Row: 0, Col: col, Value: field})
+	}
+	w.nextRow = 1
+	return w, nil
+}
+
+// write plans the cells of record at row.
+func (w *recordWriter) write(row int, record Record) error {
+	for _, field := range record.Fields {
+		col, ok := w.table.Field(field)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownField, field)
+		}
+		value, err := recordCellValue(field, record.Values[field])
+		if err != nil {
+			return err
+		}
+		w.edits = append(w.edits, CellEdit{Sheet: w.sheet, Row: row, Col: col, Value: value})
+	}
+	return nil
+}
+
+func (w *recordWriter) insert(record Record) error {
+	row := w.nextRow
+	w.nextRow++
+	w.results = append(w.results, RecordResult{Row: row + 1, Action: RecordInserted})
+	return w.write(row, record)
+}
+
+// AppendRecords writes records below the last used row of a sheet. The row
+// is found under the file's lock, so concurrent appends never collide.
+func (s *SpreadsheetService) AppendRecords(fileID uint, sheet string, records []Record, ifMatch ...int64) (*models.SheetFile, []CellEdit, []RecordResult, error) {
+	var w *recordWriter
+	file, err := s.patchFile(fileID, ifMatch, func(state *models.SheetState, cells *cellLoader) ([]CellEdit, error) {
+		if err := cells.sheetNamed(sheet); err != nil {
+			return nil, err
+		}
+		var err error
+		if w, err = newRecordWriter(state, sheet, firstRecord(records)); err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if err := w.insert(record); err != nil {
+				return nil, err
+			}
+		}
+		return w.edits, nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return file, w.edits, w.results, nil
+}
+
+// UpsertRecords updates the row whose key field equals each record's key,
+// or appends the record when no row matches. Only the fields a record
+// carries are written.
+func (s *SpreadsheetService) UpsertRecords(fileID uint, sheet, key string, records []Record, ifMatch ...int64) (*models.SheetFile, []CellEdit, []RecordResult, error) {
+	var w *recordWriter
+	file, err := s.patchFile(fileID, ifMatch, func(state *models.SheetState, cells *cellLoader) ([]CellEdit, error) {
+		if err := cells.sheetNamed(sheet); err != nil {
+			return nil, err
+		}
+		var err error
+		if w, err = newRecordWriter(state, sheet, firstRecord(records)); err != nil {
+			return nil, err
+		}
+		keyCol, ok := w.table.Field(key)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownField, key)
+		}
+		// Rows by key; the first row wins when keys repeat.
+		byKey := map[any]int{}
+		for _, row := range w.table.RecordRows() {
+			if k := normalizeKey(w.table.Value(row, keyCol)); k != nil {
+				if _, seen := byKey[k]; !seen {
+					byKey[k] = row
+				}
+			}
+		}
+		for i, record := range records {
+			keyValue, _ := recordValue(record, key)
+			k := normalizeKey(keyValue)
+			if k == nil {
+				return nil, fmt.Errorf("%w: record %d has no %s", ErrInvalidRecord, i, key)
+			}
+			row, ok := byKey[k]
+			if !ok {
+				// Later records with the same key update this one.
+				byKey[k] = w.nextRow
+				if err := w.insert(record); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			w.results = append(w.results, RecordResult{Row: row + 1, Action: RecordUpdated})
+			if err := w.write(row, record); err != nil {
+				return nil, err
+			}
+		}
+		return w.edits, nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return file, w.edits, w.results, nil
+}
+
+// DeleteRecords clears the rows whose key field equals one of values. The
+// rows stay in place, empty, so row numbers and references elsewhere keep
+// pointing at the same data.
+func (s *SpreadsheetService) DeleteRecords(fileID uint, sheet, key string, values []string, ifMatch ...int64) (*models.SheetFile, []CellEdit, []RecordResult, error) {
+	var edits []CellEdit
+	var results []RecordResult
+	file, err := s.patchFile(fileID, ifMatch, func(state *models.SheetState, cells *cellLoader) ([]CellEdit, error) {
+		if err := cells.sheetNamed(sheet); err != nil {
+			return nil, err
+		}
+		found, _, _, err := LookupSheet(state, sheet)
+		if err != nil {
+			return nil, err
+		}
+		table := NewSheetTable(found)
+		if table == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownField, key)
+		}
+		keyCol, ok := table.Field(key)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownField, key)
+		}
+		wanted := map[any]bool{}
+		for _, v := range values {
+			if k := normalizeKey(v); k != nil {
+				wanted[k] = true
+			}
+		}
+		for _, row := range table.RecordRows() {
+			if k := normalizeKey(table.Value(row, keyCol)); k == nil || !wanted[k] {
+				continue
+			}
+			results = append(results, RecordResult{Row: row + 1, Action: RecordDeleted})
+			for col := table.MinCol; col <= table.MaxCol; col++ {
+				if table.cell(row, col).Value != "" {
+					edits = append(edits, CellEdit{Sheet: sheet, Row: row, Col: col, Value: ""})
+				}
+			}
+		}
+		return edits, nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return file, edits, results, nil
+}
+
+func firstRecord(records []Record) *Record {
+	if len(records) == 0 {
+		return nil
+	}
+	return &records[0]
+}
+
+// recordValue looks a field up by name, exactly or else ignoring case.
+func recordValue(record Record, field string) (any, bool) {
+	if v, ok := record.Values[field]; ok {
+		return v, true
+	}
+	for _, name := range record.Fields {
+		if strings.EqualFold(name, field) {
+			return record.Values[name], true
+		}
+	}
+	return nil, false
+}
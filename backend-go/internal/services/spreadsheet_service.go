@@ -1,21 +1,20 @@
 package services
 
 import (
+	"converter-backend/internal/formula"
 	"converter-backend/internal/models"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"mime/multipart"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/xuri/excelize/v2"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -23,12 +22,32 @@ import (
 
 type SpreadsheetService struct {
 	DB *gorm.DB
+	// MaxVersionsPerFile caps the stored history of each file
+	// (DefaultMaxVersionsPerFile when zero).
+	MaxVersionsPerFile int
+	// StateLimits bounds the files the service writes itself: patches,
+	// structure changes, branch edits and imports.
+	StateLimits StateLimits
+
+	graphs formulaGraphCache
 }
 
+// ErrRevisionMismatch is returned when an If-Match precondition does not
+// match the file's current revision.
+var ErrRevisionMismatch = errors.New("revision mismatch")
+
 type CellEdit struct {
+	Sheet string // "" is the first sheet
 	Row   int
 	Col   int
 	Value string
+	// Style, when not nil, replaces the cell's style; an empty map removes it.
+	Style map[string]any
+	// MergeStyle merges Style into the cell's style instead, where null
+	// removes a field (see ValidateCellStyle).
+	MergeStyle bool
+	// StyleOnly edits leave the value alone and only apply Style.
+	StyleOnly bool
 }
 
 type AccessibleFileMeta struct {
@@ -62,83 +81,143 @@ func NewSpreadsheetService(dsn string) *SpreadsheetService {
 		log.Fatalf("SpreadsheetService failed to connect to database after %d attempts: %v", maxAttempts, err)
 	}
 
-	db.AutoMigrate(&models.SpreadsheetData{}, &models.SheetFile{}, &models.SheetFileShare{})
+	db.AutoMigrate(&models.SpreadsheetData{}, &models.SheetFile{}, &models.SheetFileShare{}, &models.SheetFileVersion{}, &models.SheetFileBranch{}, &models.Job{}, &models.SheetCell{}, &models.SheetStyle{})
 	return &SpreadsheetService{DB: db}
 }
 
-func (s *SpreadsheetService) ProcessAndSave(file multipart.File, filename string) ([][]string, error) {
+// importBatchSize is how many rows ProcessAndSave inserts per statement.
+const importBatchSize = 500
+
+// ProcessAndSave stores every row of every sheet of an upload, streaming
+// them into the database in batches so no sheet is held in memory. The
+// returned workbook reads the upload again, e.g. to stream the first sheet
+// back; closing it removes the temp copy.
+func (s *SpreadsheetService) ProcessAndSave(file multipart.File, filename string, csvOpts CSVOptions) (*WorkbookReader, error) {
 	// Save temp file for excelize (it prefers file paths)
-	// In a real prod env, we might stream or use a better temp handling
-	tempFile, err := os.CreateTemp("", "upload-*.xlsx")
+	tempFile, err := os.CreateTemp("", "upload-*"+strings.ToLower(filepath.Ext(filename)))
 	if err != nil {
 		return nil, err
 	}
-	defer os.Remove(tempFile.Name())
+	cleanup := func() { os.Remove(tempFile.Name()) }
 
 	// Copy uploaded file to temp
 	// Reset file pointer first just in case
 	file.Seek(0, 0)
 	_, err = tempFile.ReadFrom(file)
+	tempFile.Close() // Close so excelize can open it
 	if err != nil {
+		cleanup()
 		return nil, err
 	}
-	tempFile.Close() // Close so excelize can open it
 
-	var rows [][]string
-	ext := strings.ToLower(filepath.Ext(filename))
-	if ext == ".csv" {
-		rows, err = readCSVRows(tempFile.Name())
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		f, err := excelize.OpenFile(tempFile.Name())
-		if err != nil {
-			return nil, err
-		}
-		defer f.Close()
-
-		sheetName := f.GetSheetName(0)
-		rows, err = f.GetRows(sheetName)
-		if err != nil {
-			return nil, err
-		}
+	wb, err := OpenWorkbook(tempFile.Name(), filename, csvOpts)
+	if err != nil {
+		cleanup()
+		return nil, err
 	}
+	wb.onClose = cleanup
 
-	records := make([]models.SpreadsheetData, 0, len(rows))
-	for _, row := range rows {
-		jsonData, err := json.Marshal(row)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal row: %w", err)
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		batch := make([]models.SpreadsheetData, 0, importBatchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := tx.Create(&batch).Error; err != nil {
+				return fmt.Errorf("failed to save rows: %w", err)
+			}
+			batch = batch[:0]
+			return nil
 		}
-		records = append(records, models.SpreadsheetData{
-			Filename: filename,
-			RowData:  jsonData,
-		})
-	}
 
-	if len(records) > 0 {
-		if err := s.DB.CreateInBatches(records, 500).Error; err != nil {
-			return nil, fmt.Errorf("failed to save rows: %w", err)
+		for i, name := range wb.Sheets {
+			err := wb.EachRow(i, func(row []string) error {
+				jsonData, err := json.Marshal(row)
+				if err != nil {
+					return fmt.Errorf("failed to marshal row: %w", err)
+				}
+				batch = append(batch, models.SpreadsheetData{
+					Filename:  filename,
+					SheetName: name,
+					RowData:   jsonData,
+				})
+				if len(batch) == importBatchSize {
+					return flush()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
 		}
+		return flush()
+	})
+	if err != nil {
+		wb.Close()
+		return nil, err
 	}
-
-	return rows, nil
+	return wb, nil
 }
 
-// SaveFile persists a sheet state for a user.
+// SaveFile persists a sheet state for a user as a new file with its first version.
 func (s *SpreadsheetService) SaveFile(userID uint, name string, state json.RawMessage) (*models.SheetFile, error) {
-	file := &models.SheetFile{
-		UserID: userID,
-		Name:   name,
-		State:  state,
+	state, err := RecalculateState(state)
+	if err != nil {
+		return nil, err
 	}
-	if err := s.DB.Save(file).Error; err != nil {
+	file := &models.SheetFile{
+		UserID:   userID,
+		Name:     name,
+		State:    state,
+		Revision: 1,
+	}
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveFile(tx, file); err != nil {
+			return err
+		}
+		return s.recordVersion(tx, file, VersionSourceSave)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return file, nil
 }
 
+// UpdateFile replaces the name and state of an existing file. The state is
+// recalculated before it is stored and recorded as a new version. When
+// ifMatch is given, the write fails with ErrRevisionMismatch unless the
+// stored revision is one of them.
+func (s *SpreadsheetService) UpdateFile(file *models.SheetFile, name string, state json.RawMessage, ifMatch ...int64) error {
+	state, err := RecalculateState(state)
+	if err != nil {
+		return err
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", file.ID).
+			First(file).Error; err != nil {
+			return err
+		}
+		if !revisionMatches(file.Revision, ifMatch) {
+			return ErrRevisionMismatch
+		}
+		if err := loadCells(tx, file, -1, nil); err != nil {
+			return err
+		}
+		state, err := keepSheets(file.State, state)
+		if err != nil {
+			return fmt.Errorf("failed to encode file state: %w", err)
+		}
+		file.Name = name
+		file.State = state
+		file.Revision++
+		if err := saveFile(tx, file); err != nil {
+			return err
+		}
+		return s.recordVersion(tx, file, VersionSourceSave)
+	})
+}
+
 // ListFiles returns user's files sorted by updated_at desc.
 func (s *SpreadsheetService) ListFiles(userID uint) ([]models.SheetFile, error) {
 	var files []models.SheetFile
@@ -148,6 +227,18 @@ func (s *SpreadsheetService) ListFiles(userID uint) ([]models.SheetFile, error)
 
 // GetFile fetches a file by id/user.
 func (s *SpreadsheetService) GetFile(userID, fileID uint) (*models.SheetFile, error) {
+	file, err := s.getFile(userID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadCells(s.DB, file, -1, nil); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// getFile fetches a file by id/user without its stored cells.
+func (s *SpreadsheetService) getFile(userID, fileID uint) (*models.SheetFile, error) {
 	var file models.SheetFile
 	err := s.DB.Where("id = ? AND user_id = ?", fileID, userID).First(&file).Error
 	if err != nil {
@@ -159,7 +250,48 @@ func (s *SpreadsheetService) GetFile(userID, fileID uint) (*models.SheetFile, er
 // GetFileAccess returns a file if the user is the owner or has an explicit share.
 // Role is one of: owner|editor|viewer.
 func (s *SpreadsheetService) GetFileAccess(userID, fileID uint) (*models.SheetFile, string, error) {
-	if file, err := s.GetFile(userID, fileID); err == nil {
+	file, role, err := s.GetFileMeta(userID, fileID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := loadCells(s.DB, file, -1, nil); err != nil {
+		return nil, "", err
+	}
+	return file, role, nil
+}
+
+// GetFileRange is GetFileAccess for range reads: State holds only the cells
+// of sheet ("" is the first) inside r, read without loading the others.
+func (s *SpreadsheetService) GetFileRange(userID, fileID uint, sheet string, r CellRange) (*models.SheetFile, string, error) {
+	file, role, err := s.GetFileMeta(userID, fileID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.LoadFileRange(file, sheet, r); err != nil {
+		return nil, "", err
+	}
+	return file, role, nil
+}
+
+// LoadFileRange fills the State of a file read by GetFileMeta with the
+// cells of sheet ("" is the first) inside r. An unknown sheet is left for
+// the caller to report.
+func (s *SpreadsheetService) LoadFileRange(file *models.SheetFile, sheet string, r CellRange) error {
+	layout, err := DecodeState(file.State)
+	if err != nil {
+		return fmt.Errorf("failed to decode file state: %w", err)
+	}
+	_, index, _, err := LookupSheet(layout, sheet)
+	if err != nil {
+		return nil
+	}
+	return loadCells(s.DB, file, index, &r)
+}
+
+// GetFileMeta is GetFileAccess without the file's stored cells, for callers
+// that only check access or need the revision and layout.
+func (s *SpreadsheetService) GetFileMeta(userID, fileID uint) (*models.SheetFile, string, error) {
+	if file, err := s.getFile(userID, fileID); err == nil {
 		return file, "owner", nil
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, "", err
@@ -262,7 +394,7 @@ func (s *SpreadsheetService) ListAccessibleFiles(userID uint) ([]AccessibleFileM
 func (s *SpreadsheetService) UpdateFileName(userID, fileID uint, name string) error {
 	return s.DB.Model(&models.SheetFile{}).
 		Where("id = ? AND user_id = ?", fileID, userID).
-		Updates(map[string]interface{}{"name": name, "updated_at": time.Now()}).Error
+		Updates(map[string]interface{}{"name": name, "revision": gorm.Expr("revision + 1"), "updated_at": time.Now()}).Error
 }
 
 // DeleteFile deletes a file by ID for a specific user
@@ -274,19 +406,45 @@ func (s *SpreadsheetService) DeleteFile(userID, fileID uint) error {
 	if result.RowsAffected == 0 {
 		return gorm.ErrRecordNotFound
 	}
-	return nil
+	if err := s.DB.Where("file_id = ?", fileID).Delete(&models.SheetFileBranch{}).Error; err != nil {
+		return err
+	}
+	if err := s.DB.Where("file_id = ?", fileID).Delete(&models.SheetCell{}).Error; err != nil {
+		return err
+	}
+	return s.DB.Where("file_id = ?", fileID).Delete(&models.SheetFileVersion{}).Error
 }
 
 // PatchFileCells applies a set of cell edits to an existing file state.
-// It updates only state.data[*].value (and clears computed) while preserving other state fields.
-func (s *SpreadsheetService) PatchFileCells(fileID uint, edits []CellEdit) (*models.SheetFile, int, error) {
+// It updates state.data[*].value and preserves other state fields. Only the edited cells and the
+// formulas that depend on them are re-evaluated, using the cached dependency graphs of the file's sheets.
+// ifMatch works as in UpdateFile.
+func (s *SpreadsheetService) PatchFileCells(fileID uint, edits []CellEdit, ifMatch ...int64) (*models.SheetFile, int, error) {
 	if len(edits) == 0 {
 		return nil, 0, fmt.Errorf("no edits provided")
 	}
+	file, err := s.patchFile(fileID, ifMatch, func(*models.SheetState, *cellLoader) ([]CellEdit, error) {
+		return edits, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, len(edits), nil
+}
 
+// patchFile locks a file and applies the edits plan derives from its
+// current state, so edits that depend on the state (such as appending after
+// the last row) cannot race with other writers. When plan returns no edits
+// the file is returned unchanged.
+//
+// The state plan sees holds the file's layout only; plan loads the cells it
+// reads through cells. The edited cells, the formulas that depend on them
+// and the cells those read are loaded after it, and only they are written
+// back. The returned file holds the loaded cells.
+func (s *SpreadsheetService) patchFile(fileID uint, ifMatch []int64, plan func(state *models.SheetState, cells *cellLoader) ([]CellEdit, error)) (*models.SheetFile, error) {
 	tx := s.DB.Begin()
 	if tx.Error != nil {
-		return nil, 0, tx.Error
+		return nil, tx.Error
 	}
 	defer func() {
 		if r := recover(); r != nil {
@@ -300,74 +458,260 @@ func (s *SpreadsheetService) PatchFileCells(fileID uint, edits []CellEdit) (*mod
 		Where("id = ?", fileID).
 		First(&file).Error; err != nil {
 		tx.Rollback()
-		return nil, 0, err
+		return nil, err
+	}
+	if !revisionMatches(file.Revision, ifMatch) {
+		tx.Rollback()
+		return nil, ErrRevisionMismatch
 	}
 
-	var state map[string]any
-	if err := json.Unmarshal(file.State, &state); err != nil {
+	state, err := DecodeState(file.State)
+	if err != nil {
 		tx.Rollback()
-		return nil, 0, fmt.Errorf("failed to decode file state: %w", err)
+		return nil, fmt.Errorf("failed to decode file state: %w", err)
 	}
+	inline := hasInlineCells(file.State)
+	cells := newCellLoader(tx, file.ID, state, inline)
 
-	dataAny, ok := state["data"].(map[string]any)
-	if !ok || dataAny == nil {
-		dataAny = map[string]any{}
+	edits, err := plan(state, cells)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if len(edits) == 0 {
+		tx.Rollback()
+		return &file, nil
 	}
 
-	maxRow := -1
+	// The first sheet is recalculated on every patch, other sheets when
+	// edited.
+	sheets := map[int]bool{0: true}
+	edited := map[int][]string{}
 	for _, edit := range edits {
-		if edit.Row < 0 || edit.Col < 0 {
-			continue
+		if _, index, _, err := LookupSheet(state, edit.Sheet); err == nil {
+			sheets[index] = true
+			edited[index] = append(edited[index], fmt.Sprintf("%d,%d", edit.Row, edit.Col))
 		}
+	}
+	for index, ids := range edited {
+		if err := cells.keys(index, ids); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
 
-		cellID := fmt.Sprintf("%d,%d", edit.Row, edit.Col)
+	changed, err := applyWorkbookEdits(state, edits)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
-		cellAny, _ := dataAny[cellID].(map[string]any)
-		if cellAny == nil {
-			cellAny = map[string]any{}
+	graphs := s.graphs.take(file.ID, file.UpdatedAt)
+	if graphs == nil {
+		graphs = map[int]*formula.Graph{}
+	}
+	sheetList := StateSheets(state)
+	for index := range sheets {
+		if err := recalculatePatch(cells, sheetList[index], index, graphs, changed[index]); err != nil {
+			tx.Rollback()
+			return nil, err
 		}
+	}
 
-		cellAny["value"] = edit.Value
-		delete(cellAny, "computed")
-		dataAny[cellID] = cellAny
+	layout, err := stateLayout(state)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	nextState, err := json.Marshal(state)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to encode file state: %w", err)
+	}
+	updates, removed, old := cells.changes()
 
-		if edit.Row > maxRow {
-			maxRow = edit.Row
+	file.Revision++
+	if inline {
+		// Moves the file's cells out of its state.
+		file.State = nextState
+		err = saveFile(tx, &file)
+	} else {
+		file.State = layout
+		if err = tx.Save(&file).Error; err == nil {
+			err = writeCellChanges(tx, file.ID, updates, removed)
 		}
 	}
+	if err == nil && grows(cells, updates) {
+		err = checkStoredCells(tx, file.ID, s.StateLimits)
+	}
+	if err == nil {
+		err = s.recordPatchVersion(tx, &file, layout, old)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	s.graphs.put(file.ID, file.UpdatedAt, graphs)
 
-	state["data"] = dataAny
+	file.State = nextState
+	return &file, nil
+}
 
-	if maxRow >= 0 {
-		switch current := state["rowCount"].(type) {
-		case float64:
-			if maxRow+1 > int(current) {
-				state["rowCount"] = maxRow + 1
+// recalculatePatch loads the formulas of a patched sheet that depend on
+// its changed cells, with every cell they read, and re-evaluates them.
+func recalculatePatch(cells *cellLoader, sheet *models.Sheet, index int, graphs map[int]*formula.Graph, changed []string) error {
+	graph := graphs[index]
+	if graph == nil {
+		if err := cells.formulas(index); err != nil {
+			return err
+		}
+		graph = formula.BuildGraph(formulaData(sheet.Data))
+		graphs[index] = graph
+		if cells.inline {
+			// The computed values of a file saved before sheet_cells may
+			// come from the frontend, so its formulas are refreshed once.
+			data := formulaData(sheet.Data)
+			graph.RecalculateAll(data)
+			storeComputed(sheet, data)
+			return nil
+		}
+	}
+	graph.Update(formulaData(sheet.Data), changed)
+
+	dependents := graph.Dependents(changed...)
+	if err := cells.keys(index, dependents); err != nil {
+		return err
+	}
+	// Formulas read the ranges they reference; formulas loaded that way
+	// without a computed value are evaluated as well, so their ranges are
+	// needed too.
+	read := map[formula.Range]bool{}
+	pending := append(append([]string(nil), changed...), dependents...)
+	for len(pending) > 0 {
+		refs := graph.References(pending...)
+		pending = nil
+		for _, r := range refs {
+			if read[r] {
+				continue
+			}
+			read[r] = true
+			added, err := cells.cells(index, CellRange{MinRow: r.StartRow, MaxRow: r.EndRow, MinCol: r.StartCol, MaxCol: r.EndCol})
+			if err != nil {
+				return err
 			}
-		case int:
-			if maxRow+1 > current {
-				state["rowCount"] = maxRow + 1
+			for _, id := range added {
+				if cell := sheet.Data[id]; formula.IsFormula(cell.Value) && cell.Computed == nil {
+					pending = append(pending, id)
+				}
 			}
 		}
 	}
 
-	nextState, err := json.Marshal(state)
-	if err != nil {
-		tx.Rollback()
-		return nil, 0, fmt.Errorf("failed to encode file state: %w", err)
+	data := formulaData(sheet.Data)
+	graph.RecalculatePart(data, changed, func() (int, int) { return cells.bounds(index) })
+	if cells.err != nil {
+		return cells.err
 	}
+	storeComputed(sheet, data)
+	return nil
+}
 
-	file.State = nextState
-	if err := tx.Save(&file).Error; err != nil {
-		tx.Rollback()
-		return nil, 0, err
+// grows reports whether writing updates adds cells to the file.
+func grows(cells *cellLoader, updates map[cellKey]models.CellData) bool {
+	for key, cell := range updates {
+		if _, stored := cells.before[key]; stored {
+			continue
+		}
+		if _, _, ok := storedCell(cells.fileID, key, cell); ok {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := tx.Commit().Error; err != nil {
-		return nil, 0, err
+// revisionMatches reports whether current satisfies an If-Match list; an
+// empty list is unconditional.
+func revisionMatches(current int64, ifMatch []int64) bool {
+	if len(ifMatch) == 0 {
+		return true
+	}
+	return slices.Contains(ifMatch, current)
+}
+
+// applyCellEdits writes edits into a sheet, grows its rowCount to fit them
+// and returns the IDs of the cells whose value was edited.
+func applyCellEdits(sheet *models.Sheet, edits []CellEdit) []string {
+	if sheet.Data == nil {
+		sheet.Data = map[string]models.CellData{}
+	}
+
+	maxRow := -1
+	changed := make([]string, 0, len(edits))
+	for _, edit := range edits {
+		if edit.Row < 0 || edit.Col < 0 {
+			continue
+		}
+
+		cellID := fmt.Sprintf("%d,%d", edit.Row, edit.Col)
+		cell, exists := sheet.Data[cellID]
+
+		if edit.Style != nil {
+			style := edit.Style
+			if edit.MergeStyle {
+				style = mergeStyle(styleMap(cell.Style), style)
+			}
+			cell.Style = typedStyle(style)
+		}
+		if edit.StyleOnly {
+			if exists || cell.Style != nil {
+				sheet.Data[cellID] = cell
+			}
+			continue
+		}
+		cell.Value = edit.Value
+		sheet.Data[cellID] = cell
+		changed = append(changed, cellID)
+
+		if edit.Row > maxRow {
+			maxRow = edit.Row
+		}
+	}
+
+	// A sheet without a row count keeps the editor's default.
+	if sheet.RowCount > 0 && maxRow+1 > sheet.RowCount {
+		sheet.RowCount = maxRow + 1
+	}
+	return changed
+}
+
+// formulaData is the cells of a sheet in the form the formula engine
+// reads: "row,col" -> {"value", "computed"}.
+func formulaData(cells map[string]models.CellData) map[string]any {
+	data := make(map[string]any, len(cells))
+	for id, cell := range cells {
+		entry := map[string]any{"value": cell.Value}
+		if cell.Computed != nil {
+			entry["computed"] = cell.Computed
+		}
+		data[id] = entry
 	}
+	return data
+}
 
-	return &file, len(edits), nil
+// storeComputed copies the computed values of data back into the sheet.
+func storeComputed(sheet *models.Sheet, data map[string]any) {
+	for id, entry := range data {
+		cell, ok := sheet.Data[id]
+		if !ok {
+			continue
+		}
+		cell.Computed = entry.(map[string]any)["computed"]
+		sheet.Data[id] = cell
+	}
 }
 
 // ListFilesWithPagination returns user's files with pagination
@@ -389,28 +733,3 @@ func (s *SpreadsheetService) ListFilesWithPagination(userID uint, offset, limit
 
 	return files, total, err
 }
-
-// readCSVRows loads a CSV file from disk into [][]string while preserving empty fields.
-func readCSVRows(path string) ([][]string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	reader := csv.NewReader(f)
-	reader.FieldsPerRecord = -1 // allow variable columns per row
-
-	var rows [][]string
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		rows = append(rows, record)
-	}
-	return rows, nil
-}
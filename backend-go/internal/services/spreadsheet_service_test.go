@@ -1,11 +1,27 @@
 package services
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"converter-backend/internal/formula"
 	"converter-backend/internal/models"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf16"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/xuri/excelize/v2"
+	textunicode "golang.org/x/text/encoding/unicode"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -15,7 +31,7 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	db.AutoMigrate(&models.SheetFile{}, &models.SpreadsheetData{})
+	db.AutoMigrate(&models.SheetFile{}, &models.SpreadsheetData{}, &models.SheetFileVersion{}, &models.SheetFileBranch{}, &models.Job{}, &models.SheetCell{}, &models.SheetStyle{})
 	return db
 }
 
@@ -95,3 +111,1442 @@ func Test_GetFile_WrongUser(t *testing.T) {
 
 	assert.NotNil(t, err)
 }
+
+func Test_PatchFileCells_RecalculatesFormulas(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	state := json.RawMessage(`{"data": {"0,0": {"value": "2"}, "1,0": {"value": "3"}, "2,0": {"value": "=SUM(A1:A2)"}}, "rowCount": 100}`)
+	file, err := service.SaveFile(1, "Formulas", state)
+	assert.Nil(t, err)
+
+	_, updated, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "10"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, updated)
+
+	saved, err := service.GetFile(1, file.ID)
+	assert.Nil(t, err)
+	var decoded struct {
+		Data map[string]struct {
+			Computed any `json:"computed"`
+		} `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(saved.State, &decoded))
+	assert.Equal(t, float64(13), decoded.Data["2,0"].Computed)
+}
+
+func computedCells(t *testing.T, state json.RawMessage) map[string]any {
+	t.Helper()
+	var decoded struct {
+		Data map[string]map[string]any `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(state, &decoded))
+	out := map[string]any{}
+	for id, cell := range decoded.Data {
+		out[id] = cell["computed"]
+	}
+	return out
+}
+
+func Test_PatchFileCells_IncrementalAndCycles(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	state := json.RawMessage(`{"data": {"0,0": {"value": "1"}, "0,1": {"value": "2"}, "0,2": {"value": "=SUM(A1:B1)"}, "1,0": {"value": "=C1*2"}}}`)
+	file, err := service.SaveFile(1, "Graph", state)
+	assert.Nil(t, err)
+
+	patched, _, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 1, Value: "5"}})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(12), computedCells(t, patched.State)["1,0"])
+
+	// A1 -> C1 -> A1 forms a cycle; breaking it clears the error.
+	patched, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "=C1"}})
+	assert.Nil(t, err)
+	cells := computedCells(t, patched.State)
+	assert.Equal(t, "#CIRCULAR!", cells["0,0"])
+	assert.Equal(t, "#CIRCULAR!", cells["0,2"])
+
+	patched, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "4"}})
+	assert.Nil(t, err)
+	cells = computedCells(t, patched.State)
+	assert.Equal(t, float64(9), cells["0,2"])
+	assert.Equal(t, float64(18), cells["1,0"])
+}
+
+func Test_PatchFileCells_RebuildsGraphAfterFullSave(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	file, err := service.SaveFile(1, "Graph", json.RawMessage(`{"data": {"0,0": {"value": "1"}, "1,0": {"value": "=A1+1"}}}`))
+	assert.Nil(t, err)
+	_, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "2"}})
+	assert.Nil(t, err)
+
+	// A full save replaces the formulas behind the cache's back.
+	var stored models.SheetFile
+	assert.Nil(t, db.First(&stored, file.ID).Error)
+	stored.State = json.RawMessage(`{"data": {"0,0": {"value": "2"}, "1,0": {"value": "=A1*10", "computed": 20}}}`)
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(t, db.Save(&stored).Error)
+	assert.Nil(t, service.graphs.take(file.ID, stored.UpdatedAt))
+
+	patched, _, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "3"}})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(30), computedCells(t, patched.State)["1,0"])
+}
+
+func Test_formulaGraphCache(t *testing.T) {
+	var cache formulaGraphCache
+	stamp := time.Now()
+	cache.put(1, stamp, map[int]*formula.Graph{0: formula.BuildGraph(nil)})
+
+	assert.Nil(t, cache.take(1, stamp.Add(time.Second)))
+	assert.Nil(t, cache.take(1, stamp), "a stale entry is dropped")
+
+	cache.put(1, stamp, map[int]*formula.Graph{0: formula.BuildGraph(nil)})
+	assert.NotNil(t, cache.take(1, stamp))
+	assert.Nil(t, cache.take(1, stamp), "take removes the entry")
+
+	for id := uint(0); id <= maxCachedGraphs; id++ {
+		cache.put(id, stamp, map[int]*formula.Graph{0: formula.BuildGraph(nil)})
+	}
+	assert.Len(t, cache.entries, maxCachedGraphs)
+}
+
+func Test_Versions_RecordRetainAndRestore(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db, MaxVersionsPerFile: 3}
+
+	file, err := service.SaveFile(1, "History", json.RawMessage(`{"data": {"0,0": {"value": "a"}}}`))
+	assert.Nil(t, err)
+	for _, v := range []string{"b", "c", "d"} {
+		_, _, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: v}})
+		assert.Nil(t, err)
+	}
+
+	versions, err := service.ListVersions(file.ID)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, 4, versions[0].Version)
+	assert.Equal(t, VersionSourcePatch, versions[0].Source)
+	assert.Equal(t, 2, versions[2].Version)
+	assert.Nil(t, versions[0].State)
+
+	_, err = service.GetVersion(file.ID, 1)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound, "pruned by retention")
+
+	restored, err := service.RestoreVersion(file.ID, 2)
+	assert.Nil(t, err)
+	current, err := service.GetVersion(file.ID, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, VersionSourceRestore, current.Source)
+
+	diffs, err := DiffStates(current.State, json.RawMessage(`{"data": {"0,0": {"value": "d"}, "2,1": {"value": "new"}}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []CellValueDiff{
+		{ID: "0,0", Row: 0, Col: 0, Before: "b", After: "d"},
+		{ID: "2,1", Row: 2, Col: 1, Before: "", After: "new"},
+	}, diffs)
+	assert.Equal(t, "b", computedCells(t, restored.State)["0,0"])
+}
+
+func Test_Versions_PatchDeltas(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db, MaxVersionsPerFile: 5}
+
+	file, err := service.SaveFile(1, "Deltas", json.RawMessage(`{"data": {"0,0": {"value": "1"}, "1,0": {"value": "=A1*2"}}}`))
+	assert.Nil(t, err)
+	for _, edits := range [][]CellEdit{{{Row: 0, Col: 0, Value: "2"}}, {{Row: 0, Col: 0, Value: "3"}}, {{Row: 0, Col: 1, Value: "x"}}} {
+		_, _, err := service.PatchFileCells(file.ID, edits)
+		assert.Nil(t, err)
+	}
+
+	// Only the latest patch reads the file; the others keep what they changed.
+	var rows []models.SheetFileVersion
+	assert.Nil(t, db.Where("file_id = ?", file.ID).Order("version").Find(&rows).Error)
+	assert.Equal(t, []string{"", versionStorageUndo, versionStorageUndo, versionStorageLive}, []string{rows[0].Storage, rows[1].Storage, rows[2].Storage, rows[3].Storage})
+	assert.NotContains(t, string(rows[3].State), `"0,0"`)
+	assert.NotContains(t, string(rows[2].State), `"1,0"`)
+
+	versionCells := func(version int) map[string]any {
+		v, err := service.GetVersion(file.ID, version)
+		assert.Nil(t, err)
+		return computedCells(t, v.State)
+	}
+	assert.Equal(t, map[string]any{"0,0": float64(1), "1,0": float64(2)}, versionCells(1))
+	assert.Equal(t, map[string]any{"0,0": float64(2), "1,0": float64(4)}, versionCells(2))
+	assert.Equal(t, map[string]any{"0,0": float64(3), "1,0": float64(6)}, versionCells(3))
+	assert.Equal(t, map[string]any{"0,0": float64(3), "1,0": float64(6), "0,1": "x"}, versionCells(4))
+
+	// A restore replaces the cells the live version reads, so it keeps a
+	// full copy first.
+	_, err = service.RestoreVersion(file.ID, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Where("file_id = ? AND version = 4", file.ID).First(&rows[3]).Error)
+	assert.Equal(t, "", rows[3].Storage)
+	assert.Equal(t, map[string]any{"0,0": float64(3), "1,0": float64(6), "0,1": "x"}, versionCells(4))
+	assert.Equal(t, map[string]any{"0,0": float64(3), "1,0": float64(6)}, versionCells(3))
+	loaded, err := service.GetFile(1, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"0,0": float64(2), "1,0": float64(4)}, computedCells(t, loaded.State))
+
+	// Pruning drops the oldest versions; the rest still replay.
+	for _, v := range []string{"5", "6"} {
+		_, _, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: v}})
+		assert.Nil(t, err)
+	}
+	_, err = service.GetVersion(file.ID, 2)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	assert.Equal(t, map[string]any{"0,0": float64(3), "1,0": float64(6)}, versionCells(3))
+	assert.Equal(t, map[string]any{"0,0": float64(5), "1,0": float64(10)}, versionCells(6))
+	assert.Equal(t, map[string]any{"0,0": float64(6), "1,0": float64(12)}, versionCells(7))
+}
+
+func Test_MergeStates(t *testing.T) {
+	base := json.RawMessage(`{"data": {"0,0": {"value": "a"}, "0,1": {"value": "b"}, "0,2": {"value": "c"}, "0,3": {"value": "d"}},
+		"columnWidths": {"0": 100, "1": 100}, "rowCount": 10}`)
+	main := json.RawMessage(`{"data": {"0,0": {"value": "a"}, "0,1": {"value": "main"}, "0,2": {"value": "main"}, "0,3": {"value": "d"}},
+		"columnWidths": {"0": 120, "1": 100}, "rowCount": 10}`)
+	branch := json.RawMessage(`{"data": {"0,0": {"value": "branch", "computed": "branch"}, "0,1": {"value": "b"}, "0,2": {"value": "branch"},
+		"5,5": {"value": "new", "style": {"bold": true}}}, "columnWidths": {"0": 100, "1": 80}, "rowCount": 30, "freezePosition": {"row": 1, "col": 0}}`)
+
+	merged, result, err := MergeStates(base, main, branch, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []SheetMergeConflict{{ID: "0,2", Row: 0, Col: 2, Base: "c", Main: "main", Branch: "branch"}}, result.Conflicts)
+	assert.Equal(t, 3, result.Applied, "0,0 changed, 0,3 deleted and 5,5 added on the branch")
+	assert.Equal(t, 2, result.AppliedMeta, "column 1 width and freezePosition")
+
+	data := merged["data"].(map[string]any)
+	assert.Equal(t, map[string]any{"value": "branch"}, data["0,0"], "computed values are not carried over")
+	assert.Equal(t, "main", data["0,1"].(map[string]any)["value"], "only main changed it")
+	assert.Equal(t, "main", data["0,2"].(map[string]any)["value"], "conflicts keep main")
+	assert.NotContains(t, data, "0,3")
+	assert.Equal(t, map[string]any{"value": "new", "style": map[string]any{"bold": true}}, data["5,5"])
+	assert.Equal(t, map[string]any{"0": 120.0, "1": 80.0}, merged["columnWidths"])
+	assert.Equal(t, 30.0, merged["rowCount"])
+	assert.Equal(t, map[string]any{"row": 1.0, "col": 0.0}, merged["freezePosition"])
+
+	merged, result, err = MergeStates(base, main, branch, map[string]string{"0,2": ResolveBranch})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Conflicts)
+	assert.Equal(t, 1, result.Resolved)
+	assert.Equal(t, "branch", merged["data"].(map[string]any)["0,2"].(map[string]any)["value"])
+
+	_, _, err = MergeStates(base, json.RawMessage(`{`), branch, nil)
+	assert.ErrorIs(t, err, ErrInvalidState)
+
+	base = json.RawMessage(`{"data": {}, "sheets": [{"name": "Q2", "data": {"0,0": {"value": "a"}}}]}`)
+	main = json.RawMessage(`{"data": {}, "sheets": [{"name": "Q2", "data": {"0,0": {"value": "main"}}}]}`)
+	branch = json.RawMessage(`{"data": {}, "sheets": [{"name": "q2", "data": {"0,0": {"value": "branch"}, "1,0": {"value": "b"}}},
+		{"name": "New", "data": {"0,0": {"value": "n"}}}]}`)
+	merged, result, err = MergeStates(base, main, branch, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []SheetMergeConflict{{Sheet: "Q2", ID: "0,0", Row: 0, Col: 0, Base: "a", Main: "main", Branch: "branch"}}, result.Conflicts)
+	assert.Equal(t, []string{"Sheet1", "Q2", "New"}, SheetNames(merged))
+
+	merged, result, err = MergeStates(base, main, branch, map[string]string{"Q2!0,0": ResolveBranch})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Conflicts)
+	q2, _, err := FindSheet(merged, "Q2")
+	assert.Nil(t, err)
+	assert.Len(t, q2["data"], 2)
+}
+
+func Test_Branches_PatchAndMerge(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	file, err := service.SaveFile(1, "Branched", json.RawMessage(`{"data": {"0,0": {"value": "1"}, "0,1": {"value": "=A1*2"}}}`))
+	assert.Nil(t, err)
+
+	_, err = service.CreateBranch(file.ID, "bad name")
+	assert.ErrorIs(t, err, ErrInvalidBranchName)
+	_, err = service.CreateBranch(file.ID, "proposal")
+	assert.Nil(t, err)
+	_, err = service.CreateBranch(file.ID, "proposal")
+	assert.ErrorIs(t, err, ErrBranchExists)
+
+	branch, _, err := service.PatchBranchCells(file.ID, "proposal", []CellEdit{{Row: 0, Col: 0, Value: "5"}, {Row: 1, Col: 0, Value: "x"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 10.0, computedCells(t, branch.State)["0,1"])
+	current, err := service.GetFile(1, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, computedCells(t, current.State)["0,1"], "main is untouched")
+
+	_, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 1, Col: 0, Value: "y"}})
+	assert.Nil(t, err)
+
+	_, result, err := service.MergeBranch(file.ID, "proposal", nil, false)
+	assert.Nil(t, err)
+	assert.False(t, result.Merged)
+	assert.Equal(t, []SheetMergeConflict{{ID: "1,0", Row: 1, Col: 0, Base: "", Main: "y", Branch: "x"}}, result.Conflicts)
+
+	merged, result, err := service.MergeBranch(file.ID, "proposal", map[string]string{"1,0": ResolveMain}, false)
+	assert.Nil(t, err)
+	assert.True(t, result.Merged)
+	cells := computedCells(t, merged.State)
+	assert.Equal(t, 10.0, cells["0,1"], "merged formulas are recalculated")
+	assert.Equal(t, "y", cells["1,0"])
+
+	versions, err := service.ListVersions(file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, VersionSourceMerge, versions[0].Source)
+
+	_, result, err = service.MergeBranch(file.ID, "proposal", nil, false)
+	assert.Nil(t, err)
+	assert.Empty(t, result.Conflicts, "the resolved conflict does not come back")
+	assert.Zero(t, result.Applied)
+
+	assert.Nil(t, service.DeleteBranch(file.ID, "proposal"))
+	assert.ErrorIs(t, service.DeleteBranch(file.ID, "proposal"), gorm.ErrRecordNotFound)
+}
+
+func Test_Revision_IfMatch(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	file, err := service.SaveFile(1, "Rev", json.RawMessage(`{"data": {}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), file.Revision)
+
+	patched, _, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "a"}}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), patched.Revision)
+
+	_, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "b"}}, 1)
+	assert.ErrorIs(t, err, ErrRevisionMismatch)
+	assert.ErrorIs(t, service.UpdateFile(file, "Rev", json.RawMessage(`{"data": {}}`), 1), ErrRevisionMismatch)
+
+	assert.Nil(t, service.UpdateFile(file, "Rev", json.RawMessage(`{"data": {}}`), 2))
+	assert.Equal(t, int64(3), file.Revision)
+
+	assert.Nil(t, service.UpdateFileName(1, file.ID, "Renamed"))
+	restored, err := service.RestoreVersion(file.ID, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), restored.Revision)
+}
+
+func Test_ReadWorkbook_AllSheets(t *testing.T) {
+	dir := t.TempDir()
+
+	f := excelize.NewFile()
+	assert.Nil(t, f.SetSheetRow("Sheet1", "A1", &[]any{"name", "qty"}))
+	_, err := f.NewSheet("Q2")
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetSheetRow("Q2", "A1", &[]any{"x", 5}))
+	xlsxPath := filepath.Join(dir, "book.xlsx")
+	assert.Nil(t, f.SaveAs(xlsxPath))
+
+	sheets, err := ReadWorkbook(xlsxPath, "book.xlsx", CSVOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []WorkbookSheet{
+		{Name: "Sheet1", Rows: [][]string{{"name", "qty"}}},
+		{Name: "Q2", Rows: [][]string{{"x", "5"}}},
+	}, sheets)
+
+	csvPath := filepath.Join(dir, "data.csv")
+	assert.Nil(t, os.WriteFile(csvPath, []byte("a,b\n1,\n"), 0o600))
+	sheets, err = ReadWorkbook(csvPath, "data.csv", CSVOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []WorkbookSheet{{Name: DefaultSheetName, Rows: [][]string{{"a", "b"}, {"1", ""}}}}, sheets)
+}
+
+func Test_Workbook_StateAndSave(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	state := NewWorkbookState([]WorkbookSheet{
+		{Name: "Data", Rows: [][]string{{"1", "2"}}},
+		{Name: "Calc", Rows: [][]string{{"4", "=A1*2"}}},
+	})
+	assert.Equal(t, []string{"Data", "Calc"}, SheetNames(state))
+	raw, err := json.Marshal(state)
+	assert.Nil(t, err)
+
+	file, err := service.SaveFile(1, "Book", raw)
+	assert.Nil(t, err)
+	var saved map[string]any
+	assert.Nil(t, json.Unmarshal(file.State, &saved))
+	calc, name, err := FindSheet(saved, "calc")
+	assert.Nil(t, err)
+	assert.Equal(t, "Calc", name)
+	assert.Equal(t, 8.0, calc["data"].(map[string]any)["0,1"].(map[string]any)["computed"], "every sheet is recalculated")
+
+	_, _, err = FindSheet(saved, "missing")
+	assert.ErrorIs(t, err, ErrSheetNotFound)
+
+	// A single-sheet client saving only the first grid keeps the other sheets.
+	assert.Nil(t, service.UpdateFile(file, "Book", json.RawMessage(`{"data": {"0,0": {"value": "9"}}}`)))
+	assert.Nil(t, json.Unmarshal(file.State, &saved))
+	assert.Equal(t, []string{"Data", "Calc"}, SheetNames(saved))
+
+	assert.Nil(t, service.UpdateFile(file, "Book", json.RawMessage(`{"data": {}, "sheets": []}`)))
+	assert.Nil(t, json.Unmarshal(file.State, &saved))
+	assert.Equal(t, []string{"Data"}, SheetNames(saved))
+}
+
+func Test_Workbook_PatchAndDiffSheets(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	raw, err := json.Marshal(NewWorkbookState([]WorkbookSheet{
+		{Name: "Data", Rows: [][]string{{"1"}}},
+		{Name: "Calc", Rows: [][]string{{"4", "=A1*2"}, {"=B1+1"}}},
+	}))
+	assert.Nil(t, err)
+	file, err := service.SaveFile(1, "Book", raw)
+	assert.Nil(t, err)
+
+	// The second patch goes through Calc's cached graph.
+	for i, value := range []string{"5", "6"} {
+		patched, _, err := service.PatchFileCells(file.ID, []CellEdit{{Sheet: "Calc", Row: 0, Col: 0, Value: value}})
+		assert.Nil(t, err)
+		var state map[string]any
+		assert.Nil(t, json.Unmarshal(patched.State, &state))
+		calc, _, err := FindSheet(state, "Calc")
+		assert.Nil(t, err)
+		data := calc["data"].(map[string]any)
+		assert.Equal(t, float64(10+2*i), data["0,1"].(map[string]any)["computed"])
+		assert.Equal(t, float64(11+2*i), data["1,0"].(map[string]any)["computed"])
+	}
+	assert.NotNil(t, service.graphs.entries[file.ID].graphs[1], "Calc keeps its graph")
+
+	diffs, err := DiffStates(raw, json.RawMessage(`{"sheetName": "Data", "data": {"0,0": {"value": "1"}},
+		"sheets": [{"name": "calc", "data": {"0,0": {"value": "6"}, "0,1": {"value": "=A1*2"}, "1,0": {"value": "=B1+1"}}},
+		{"name": "New", "data": {"2,2": {"value": "x"}}}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []CellValueDiff{
+		{Sheet: "calc", ID: "0,0", Row: 0, Col: 0, Before: "4", After: "6"},
+		{Sheet: "New", ID: "2,2", Row: 2, Col: 2, Before: "", After: "x"},
+	}, diffs)
+
+	diffs, err = DiffStates(raw, json.RawMessage(`{"data": {"0,0": {"value": "2"}}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []CellValueDiff{
+		{ID: "0,0", Row: 0, Col: 0, Before: "1", After: "2"},
+		{Sheet: "Calc", ID: "0,0", Row: 0, Col: 0, Before: "4", After: ""},
+		{Sheet: "Calc", ID: "0,1", Row: 0, Col: 1, Before: "=A1*2", After: ""},
+		{Sheet: "Calc", ID: "1,0", Row: 1, Col: 0, Before: "=B1+1", After: ""},
+	}, diffs)
+}
+
+func Test_ImportFile_XLSX(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	f := excelize.NewFile()
+	assert.Nil(t, f.SetSheetName("Sheet1", "Budget"))
+	assert.Nil(t, f.SetCellValue("Budget", "A1", "Item"))
+	assert.Nil(t, f.SetCellValue("Budget", "B1", 4))
+	assert.Nil(t, f.SetCellFormula("Budget", "C1", "B1*2"))
+	assert.Nil(t, f.SetCellValue("Budget", "A2", time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)))
+	assert.Nil(t, f.SetColWidth("Budget", "A", "A", 20))
+	assert.Nil(t, f.SetRowHeight("Budget", 2, 30))
+	assert.Nil(t, f.MergeCell("Budget", "A3", "C3"))
+	shared, sharedRef := excelize.STCellFormulaTypeShared, "D1:D2"
+	assert.Nil(t, f.SetCellFormula("Budget", "D1", "$B$1+B1", excelize.FormulaOpts{Type: &shared, Ref: &sharedRef}))
+	assert.Nil(t, f.SetPanes("Budget", &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}))
+	styleID, err := f.NewStyle(&excelize.Style{
+		Font:      &excelize.Font{Bold: true, Color: "FF0000", Size: 14},
+		Fill:      excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"FFFF00"}},
+		Alignment: &excelize.Alignment{Horizontal: "center", Vertical: "center", WrapText: true},
+		Border:    []excelize.Border{{Type: "bottom", Color: "0000FF", Style: 1}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetCellStyle("Budget", "A1", "A1", styleID))
+	dateStyle, err := f.NewStyle(&excelize.Style{NumFmt: 14})
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetCellStyle("Budget", "A2", "A2", dateStyle))
+	_, err = f.NewSheet("Notes")
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetCellValue("Notes", "B2", "hello"))
+
+	path := filepath.Join(t.TempDir(), "book.xlsx")
+	assert.Nil(t, f.SaveAs(path))
+	assert.Nil(t, f.Close())
+
+	file, err := service.ImportFile(7, "Budget", path, "book.xlsx", CSVOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint(7), file.UserID)
+	assert.Equal(t, int64(1), file.Revision)
+
+	var state struct {
+		SheetName string `json:"sheetName"`
+		Data      map[string]struct {
+			Value    string         `json:"value"`
+			Computed any            `json:"computed"`
+			Style    map[string]any `json:"style"`
+		} `json:"data"`
+		ColumnWidths   map[string]int   `json:"columnWidths"`
+		RowHeights     map[string]int   `json:"rowHeights"`
+		MergedCells    []map[string]int `json:"mergedCells"`
+		FreezePosition map[string]int   `json:"freezePosition"`
+		Sheets         []struct {
+			Name string                    `json:"name"`
+			Data map[string]map[string]any `json:"data"`
+		} `json:"sheets"`
+	}
+	assert.Nil(t, json.Unmarshal(file.State, &state))
+
+	assert.Equal(t, "Budget", state.SheetName)
+	assert.Equal(t, "Item", state.Data["0,0"].Value)
+	assert.Equal(t, "=B1*2", state.Data["0,2"].Value)
+	assert.Equal(t, 8.0, state.Data["0,2"].Computed)
+	assert.Equal(t, "2024-03-05", state.Data["1,0"].Value)
+	assert.Equal(t, "=$B$1+B1", state.Data["0,3"].Value)
+	assert.Equal(t, "=$B$1+B2", state.Data["1,3"].Value, "shared formulas are shifted per cell")
+	assert.Equal(t, map[string]int{"rows": 1, "cols": 0}, state.FreezePosition)
+
+	style := state.Data["0,0"].Style
+	assert.Equal(t, true, style["bold"])
+	assert.Equal(t, "#FF0000", style["color"])
+	assert.Equal(t, 14.0, style["fontSize"])
+	assert.Equal(t, "#FFFF00", style["backgroundColor"])
+	assert.Equal(t, "center", style["textAlign"])
+	assert.Equal(t, "middle", style["verticalAlign"])
+	assert.Equal(t, "wrap", style["wrapMode"])
+	assert.Equal(t, map[string]any{"bottom": true, "color": "#0000FF", "style": "solid"}, style["borders"])
+	assert.Nil(t, state.Data["0,1"].Style)
+
+	assert.Equal(t, map[string]int{"0": 145}, state.ColumnWidths)
+	assert.Equal(t, map[string]int{"1": 40}, state.RowHeights)
+	assert.Equal(t, []map[string]int{{"startRow": 2, "startCol": 0, "endRow": 2, "endCol": 2}}, state.MergedCells)
+
+	assert.Len(t, state.Sheets, 1)
+	assert.Equal(t, "Notes", state.Sheets[0].Name)
+	assert.Equal(t, "hello", state.Sheets[0].Data["1,1"]["value"])
+
+	_, err = service.ImportFile(7, "Doc", path, "book.docx", CSVOptions{})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	broken := filepath.Join(t.TempDir(), "broken.xlsx")
+	assert.Nil(t, os.WriteFile(broken, []byte("not a zip"), 0o600))
+	_, err = service.ImportFile(7, "Broken", broken, "broken.xlsx", CSVOptions{})
+	assert.ErrorIs(t, err, ErrUnreadableFile)
+}
+
+func Test_ExportXLSX_RoundTrip(t *testing.T) {
+	state := json.RawMessage(`{
+		"sheetName": "Budget",
+		"data": {
+			"0,0": {"value": "Item", "style": {"bold": true, "color": "#ff0000", "backgroundColor": "#FFFF00", "textAlign": "center", "verticalAlign": "middle", "wrapMode": "wrap", "borders": {"bottom": true, "color": "#0000FF", "style": "dashed"}}},
+			"0,1": {"value": "4", "style": {"numberFormat": "currency", "currencyCode": "EUR"}},
+			"0,2": {"value": "=B1*2", "computed": 8},
+			"1,0": {"value": "2024-03-05"},
+			"1,1": {"value": "0.25", "style": {"numberFormat": "percent", "decimalPlaces": 1, "rotation": -45}}
+		},
+		"columnWidths": {"0": 145},
+		"rowHeights": {"1": 40},
+		"mergedCells": [{"startRow": 2, "startCol": 0, "endRow": 2, "endCol": 2}],
+		"freezePosition": {"rows": 1, "cols": 0},
+		"sheets": [{"name": "Notes/Q1", "data": {"1,1": {"value": "hello"}}}]
+	}`)
+
+	f, err := ExportXLSX(state)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Budget", "Notes_Q1"}, f.GetSheetList())
+
+	formula, _ := f.GetCellFormula("Budget", "C1")
+	assert.Equal(t, "B1*2", formula)
+	cached, _ := f.GetCellValue("Budget", "C1", excelize.Options{RawCellValue: true})
+	assert.Equal(t, "8", cached)
+	b1, _ := f.GetCellValue("Budget", "B1")
+	assert.Equal(t, "€4.00", b1)
+	b2, _ := f.GetCellValue("Budget", "B2")
+	assert.Equal(t, "25.0%", b2)
+	styleID, _ := f.GetCellStyle("Budget", "B2")
+	style, _ := f.GetStyle(styleID)
+	assert.Equal(t, 135, style.Alignment.TextRotation)
+	panes, _ := f.GetPanes("Budget")
+	assert.True(t, panes.Freeze)
+	assert.Equal(t, 1, panes.YSplit)
+
+	path := filepath.Join(t.TempDir(), "export.xlsx")
+	assert.Nil(t, f.SaveAs(path))
+	assert.Nil(t, f.Close())
+
+	imported, err := ReadWorkbookState(path, "export.xlsx", CSVOptions{})
+	assert.Nil(t, err)
+	raw, _ := json.Marshal(imported)
+	var back struct {
+		Data           map[string]map[string]any `json:"data"`
+		ColumnWidths   map[string]int            `json:"columnWidths"`
+		RowHeights     map[string]int            `json:"rowHeights"`
+		MergedCells    []map[string]int          `json:"mergedCells"`
+		FreezePosition map[string]int            `json:"freezePosition"`
+	}
+	assert.Nil(t, json.Unmarshal(raw, &back))
+
+	assert.Equal(t, "=B1*2", back.Data["0,2"]["value"])
+	assert.Equal(t, "2024-03-05", back.Data["1,0"]["value"])
+	assert.Equal(t, map[string]any{
+		"bold": true, "color": "#FF0000", "backgroundColor": "#FFFF00", "textAlign": "center",
+		"verticalAlign": "middle", "wrapMode": "wrap",
+		"borders": map[string]any{"bottom": true, "color": "#0000FF", "style": "dashed"},
+	}, back.Data["0,0"]["style"])
+	assert.Equal(t, -45.0, back.Data["1,1"]["style"].(map[string]any)["rotation"])
+	assert.Equal(t, map[string]int{"0": 145}, back.ColumnWidths)
+	assert.Equal(t, map[string]int{"1": 40}, back.RowHeights)
+	assert.Equal(t, []map[string]int{{"startRow": 2, "startCol": 0, "endRow": 2, "endCol": 2}}, back.MergedCells)
+	assert.Equal(t, map[string]int{"rows": 1, "cols": 0}, back.FreezePosition)
+
+	_, err = ExportXLSX(json.RawMessage(`[1]`))
+	assert.ErrorIs(t, err, ErrInvalidState)
+}
+
+func Test_NewCSVReader(t *testing.T) {
+	utf16, _ := textunicode.UTF16(textunicode.LittleEndian, textunicode.UseBOM).NewEncoder().String("a\tb\nc\td\n")
+	tests := []struct {
+		name      string
+		input     string
+		opts      CSVOptions
+		want      [][]string
+		delimiter rune
+		encoding  string
+	}{
+		{"comma", "a,b\n1,2\n", CSVOptions{}, [][]string{{"a", "b"}, {"1", "2"}}, ',', "utf-8"},
+		{"semicolon sniffed", "name;price\n\"x,y\";1,5\nz;2\n", CSVOptions{}, [][]string{{"name", "price"}, {"x,y", "1,5"}, {"z", "2"}}, ';', "utf-8"},
+		{"tab sniffed", "a\tb\tc\n1\t2\t3\n", CSVOptions{}, [][]string{{"a", "b", "c"}, {"1", "2", "3"}}, '\t', "utf-8"},
+		{"utf-8 bom stripped", "\xEF\xBB\xBFid,name\n", CSVOptions{}, [][]string{{"id", "name"}}, ',', "utf-8"},
+		{"utf-16 bom", utf16, CSVOptions{}, [][]string{{"a", "b"}, {"c", "d"}}, '\t', "utf-16le"},
+		{"windows-1251 detected", "\xCF\xF0\xE8\xE2\xE5\xF2;\xCC\xE8\xF0\n", CSVOptions{}, [][]string{{"Привет", "Мир"}}, ';', "windows-1251"},
+		{"windows-1252 detected", "caf\xE9,na\xEFve text\n", CSVOptions{}, [][]string{{"café", "naïve text"}}, ',', "windows-1252"},
+		{"explicit encoding", "\xE9t\xE9\n", CSVOptions{Encoding: "iso-8859-1"}, [][]string{{"été"}}, ',', "iso-8859-1"},
+		{"explicit delimiter", "a;b|c\n", CSVOptions{Delimiter: '|'}, [][]string{{"a;b", "c"}}, '|', "utf-8"},
+		{"custom quote", "'a,b',say \"hi\",'it''s'\n", CSVOptions{Quote: '\''}, [][]string{{"a,b", `say "hi"`, "it's"}}, ',', "utf-8"},
+		{"ragged rows", "a,b,c\n1\n", CSVOptions{}, [][]string{{"a", "b", "c"}, {"1"}}, ',', "utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := NewCSVReader(strings.NewReader(tt.input), tt.opts)
+			assert.Nil(t, err)
+			var rows [][]string
+			for {
+				record, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+				assert.Nil(t, err)
+				rows = append(rows, record)
+			}
+			assert.Equal(t, tt.want, rows)
+			assert.Equal(t, tt.delimiter, reader.Delimiter)
+			assert.Equal(t, tt.encoding, reader.Encoding)
+		})
+	}
+
+	opts, err := ParseCSVOptions("semicolon", "'", "cp1251")
+	assert.Nil(t, err)
+	assert.Equal(t, CSVOptions{Delimiter: ';', Quote: '\'', Encoding: "cp1251"}, opts)
+	for _, bad := range [][3]string{{"ab", "", ""}, {"", "\n", ""}, {"", "", "klingon"}, {",", ",", ""}} {
+		_, err := ParseCSVOptions(bad[0], bad[1], bad[2])
+		assert.ErrorIs(t, err, ErrInvalidCSVOptions, bad)
+	}
+}
+
+func Test_ProcessAndSave_StreamsInBatches(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+	dir := t.TempDir()
+
+	// More rows than one batch, with a gap that must survive streaming.
+	f := excelize.NewFile()
+	total := importBatchSize*2 + 7
+	for r := 1; r <= total; r++ {
+		if r == 3 {
+			continue
+		}
+		assert.Nil(t, f.SetCellValue("Sheet1", "A"+strconv.Itoa(r), r))
+	}
+	_, err := f.NewSheet("Notes")
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetCellValue("Notes", "B2", "n"))
+	xlsxPath := filepath.Join(dir, "big.xlsx")
+	assert.Nil(t, f.SaveAs(xlsxPath))
+	assert.Nil(t, f.Close())
+
+	upload, err := os.Open(xlsxPath)
+	assert.Nil(t, err)
+	defer upload.Close()
+
+	wb, err := service.ProcessAndSave(upload, "big.xlsx", CSVOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Sheet1", "Notes"}, wb.Sheets)
+
+	var saved int64
+	db.Model(&models.SpreadsheetData{}).Where("filename = ? AND sheet_name = ?", "big.xlsx", "Sheet1").Count(&saved)
+	assert.Equal(t, int64(total), saved)
+	db.Model(&models.SpreadsheetData{}).Where("sheet_name = ?", "Notes").Count(&saved)
+	assert.Equal(t, int64(2), saved, "the leading empty row is kept")
+
+	var streamed [][]string
+	assert.Nil(t, wb.EachRow(0, func(row []string) error {
+		streamed = append(streamed, row)
+		return nil
+	}))
+	assert.Len(t, streamed, total)
+	assert.Equal(t, []string{"2"}, streamed[1])
+	assert.Nil(t, streamed[2])
+	assert.Equal(t, []string{strconv.Itoa(total)}, streamed[total-1])
+	assert.ErrorIs(t, wb.EachRow(5, func([]string) error { return nil }), ErrSheetNotFound)
+
+	assert.Nil(t, wb.Close())
+	_, err = os.Stat(wb.path)
+	assert.True(t, os.IsNotExist(err), "closing removes the temp copy")
+}
+
+func Test_ExportODS_RoundTrip(t *testing.T) {
+	state := json.RawMessage(`{
+		"sheetName": "Budget",
+		"data": {
+			"0,0": {"value": "Item & <cost>", "style": {"bold": true, "color": "#ff0000", "backgroundColor": "#FFFF00", "textAlign": "center", "verticalAlign": "middle", "wrapMode": "wrap", "borders": {"bottom": true, "color": "#0000FF", "style": "dashed"}}},
+			"0,1": {"value": "4", "style": {"numberFormat": "currency", "currencyCode": "EUR"}},
+			"0,2": {"value": "=SUM(B1:B2,\"a,b\")", "computed": 4.25},
+			"1,0": {"value": "2024-03-05"},
+			"1,1": {"value": "0.25", "style": {"numberFormat": "percent", "rotation": -45}},
+			"4,0": {"value": "line one\nline two"}
+		},
+		"columnWidths": {"0": 145},
+		"rowHeights": {"1": 40},
+		"mergedCells": [{"startRow": 2, "startCol": 0, "endRow": 2, "endCol": 2}],
+		"sheets": [{"name": "Notes/Q1", "data": {"1,1": {"value": "TRUE"}}}]
+	}`)
+
+	path := filepath.Join(t.TempDir(), "export.ods")
+	out, err := os.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, ExportODS(state, out))
+	assert.Nil(t, out.Close())
+
+	imported, err := ReadWorkbookState(path, "export.ods", CSVOptions{})
+	assert.Nil(t, err)
+	raw, _ := json.Marshal(imported)
+	var back struct {
+		SheetName    string                    `json:"sheetName"`
+		Data         map[string]map[string]any `json:"data"`
+		ColumnWidths map[string]int            `json:"columnWidths"`
+		RowHeights   map[string]int            `json:"rowHeights"`
+		MergedCells  []map[string]int          `json:"mergedCells"`
+		Sheets       []struct {
+			Name string                    `json:"name"`
+			Data map[string]map[string]any `json:"data"`
+		} `json:"sheets"`
+	}
+	assert.Nil(t, json.Unmarshal(raw, &back))
+
+	assert.Equal(t, "Budget", back.SheetName)
+	assert.Equal(t, "Item & <cost>", back.Data["0,0"]["value"])
+	assert.Equal(t, map[string]any{
+		"bold": true, "color": "#FF0000", "backgroundColor": "#FFFF00", "textAlign": "center",
+		"verticalAlign": "middle", "wrapMode": "wrap",
+		"borders": map[string]any{"bottom": true, "color": "#0000FF", "style": "dashed"},
+	}, back.Data["0,0"]["style"])
+	assert.Equal(t, map[string]any{"numberFormat": "currency", "currencyCode": "EUR"}, back.Data["0,1"]["style"])
+	assert.Equal(t, `=SUM(B1:B2,"a,b")`, back.Data["0,2"]["value"])
+	assert.Equal(t, "2024-03-05", back.Data["1,0"]["value"])
+	assert.Equal(t, map[string]any{"numberFormat": "percent", "rotation": -45.0}, back.Data["1,1"]["style"])
+	assert.Equal(t, "line one\nline two", back.Data["4,0"]["value"])
+	assert.Equal(t, map[string]int{"0": 145}, back.ColumnWidths)
+	assert.Equal(t, map[string]int{"1": 40}, back.RowHeights)
+	assert.Equal(t, []map[string]int{{"startRow": 2, "startCol": 0, "endRow": 2, "endCol": 2}}, back.MergedCells)
+	assert.Len(t, back.Sheets, 1)
+	assert.Equal(t, "Notes_Q1", back.Sheets[0].Name)
+	assert.Equal(t, "TRUE", back.Sheets[0].Data["1,1"]["value"])
+
+	assert.ErrorIs(t, ExportODS(json.RawMessage(`[1]`), io.Discard), ErrInvalidState)
+}
+
+func Test_ReadODS_LibreOfficeLayout(t *testing.T) {
+	content := `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:style="urn:oasis:names:tc:opendocument:xmlns:style:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:fo="urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0" xmlns:calcext="urn:org:documentfoundation:names:experimental:calc:xmlns:calcext:1.0">
+<office:automatic-styles>
+	<style:style style:name="co1" style:family="table-column"><style:table-column-properties style:column-width="2.258cm"/></style:style>
+	<style:style style:name="ce1" style:family="table-cell"><style:text-properties fo:font-style="italic" fo:font-size="14pt"/></style:style>
+</office:automatic-styles>
+<office:body><office:spreadsheet>
+<table:table table:name="Hisobot">
+	<table:table-column table:style-name="co1" table:number-columns-repeated="1024"/>
+	<table:table-row>
+		<table:table-cell office:value-type="string" calcext:value-type="string" table:number-columns-spanned="2" table:number-rows-spanned="1"><text:p>Jami<text:s text:c="2"/>summa</text:p><office:annotation><text:p>note</text:p></office:annotation></table:table-cell>
+		<table:covered-table-cell/>
+		<table:table-cell table:style-name="ce1" office:value-type="float" office:value="1.5"><text:p>1,5</text:p></table:table-cell>
+		<table:table-cell table:number-columns-repeated="1021"/>
+	</table:table-row>
+	<table:table-row table:number-rows-repeated="2"><table:table-cell table:number-columns-repeated="1024"/></table:table-row>
+	<table:table-row>
+		<table:table-cell table:formula="of:=[.C1]*2+SUM([$Hisobot.C1:.C2];1)" office:value-type="float" office:value="4"><text:p>4</text:p></table:table-cell>
+		<table:table-cell office:value-type="date" office:date-value="2024-03-05T10:30:00"><text:p>05.03.24</text:p></table:table-cell>
+		<table:table-cell office:value-type="boolean" office:boolean-value="true"><text:p>TRUE</text:p></table:table-cell>
+	</table:table-row>
+	<table:table-row table:number-rows-repeated="1048571"><table:table-cell table:number-columns-repeated="1024"/></table:table-row>
+</table:table>
+<table:table table:name="Bo'sh"><table:table-row><table:table-cell/></table:table-row></table:table>
+</office:spreadsheet></office:body>
+</office:document-content>`
+
+	path := filepath.Join(t.TempDir(), "report.ods")
+	out, err := os.Create(path)
+	assert.Nil(t, err)
+	zw := zip.NewWriter(out)
+	w, _ := zw.Create("content.xml")
+	_, _ = io.WriteString(w, content)
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, out.Close())
+
+	sheets, err := ReadWorkbook(path, "report.ods", CSVOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, sheets, 2)
+	assert.Equal(t, "Hisobot", sheets[0].Name)
+	assert.Equal(t, [][]string{
+		{"Jami  summa", "", "1.5"},
+		nil,
+		nil,
+		{"=C1*2+SUM(Hisobot!C1:C2,1)", "2024-03-05 10:30:00", "TRUE"},
+	}, sheets[0].Rows)
+	assert.Equal(t, "Bo'sh", sheets[1].Name)
+	assert.Empty(t, sheets[1].Rows)
+
+	state, err := ReadWorkbookState(path, "report.ods", CSVOptions{})
+	assert.Nil(t, err)
+	data := state["data"].(map[string]any)
+	assert.Len(t, data, 5)
+	assert.Equal(t, map[string]any{"value": "1.5", "style": map[string]any{"italic": true, "fontSize": 14.0}}, data["0,2"])
+	assert.Equal(t, []any{map[string]any{"startRow": 0, "startCol": 0, "endRow": 0, "endCol": 1}}, state["mergedCells"])
+	assert.Empty(t, state["columnWidths"])
+	assert.Equal(t, 100, state["rowCount"])
+}
+
+// writeTestXLS writes a BIFF8 workbook with two sheets in a minimal
+// version 3 compound file: FAT in sector 0, directory in sector 1 and the
+// Workbook stream from sector 2 on.
+func writeTestXLS(t *testing.T, path string) {
+	t.Helper()
+	record := func(typ uint16, data ...[]byte) []byte {
+		body := bytes.Join(data, nil)
+		out := binary.LittleEndian.AppendUint16(nil, typ)
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(body)))
+		return append(out, body...)
+	}
+	u16 := func(v int) []byte { return binary.LittleEndian.AppendUint16(nil, uint16(v)) }
+	u32 := func(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+	cell := func(row, col, xf int) []byte { return bytes.Join([][]byte{u16(row), u16(col), u16(xf)}, nil) }
+	ascii := func(cchBytes int, s string) []byte {
+		head := []byte{byte(len(s))}
+		if cchBytes == 2 {
+			head = u16(len(s))
+		}
+		return append(append(head, 0), s...)
+	}
+	wide := func(s string) []byte {
+		var out []byte
+		for _, u := range utf16.Encode([]rune(s)) {
+			out = binary.LittleEndian.AppendUint16(out, u)
+		}
+		return out
+	}
+	bof := func(dt int) []byte { return record(0x0809, u16(0x0600), u16(dt), make([]byte, 12)) }
+	eof := record(0x000A)
+
+	// The second shared string is split across SST and CONTINUE.
+	second := []rune("Narx (soʻm)")
+	sst := record(0x00FC, u32(2), u32(2), ascii(2, "Mahsulot"), u16(len(second)), []byte{1}, wide(string(second[:4])))
+	sst = append(sst, record(0x003C, []byte{1}, wide(string(second[4:])))...)
+
+	sheet1 := bytes.Join([][]byte{
+		bof(0x10),
+		record(0x00FD, cell(0, 0, 0), u32(0)),
+		record(0x00FD, cell(0, 1, 0), u32(1)),
+		record(0x027E, cell(1, 0, 0), u32(42<<2|2)),
+		record(0x0203, cell(1, 1, 0), binary.LittleEndian.AppendUint64(nil, math.Float64bits(1.5))),
+		record(0x00BD, u16(2), u16(0), u16(0), u32(12345<<2|3), u16(1), u32(45356<<2|2), u16(1)),
+		record(0x0006, cell(3, 0, 0), []byte{0, 0, 0, 0, 0, 0, 0xFF, 0xFF}, u16(0), u32(0)),
+		record(0x0207, ascii(2, "hisob")),
+		record(0x0006, cell(3, 1, 0), binary.LittleEndian.AppendUint64(nil, math.Float64bits(7)), u16(0), u32(0)),
+		record(0x0205, cell(4, 0, 0), []byte{1, 0}),
+		record(0x00E5, u16(1), u16(5), u16(5), u16(0), u16(2)),
+		eof,
+	}, nil)
+	sheet2 := bytes.Join([][]byte{bof(0x10), record(0x0204, cell(1, 1, 0), ascii(2, "Izoh")), eof}, nil)
+
+	globals := func(offsets ...int) []byte {
+		return bytes.Join([][]byte{
+			bof(0x05),
+			record(0x0022, u16(0)),
+			record(0x041E, u16(164), ascii(2, "dd.mm.yyyy")),
+			record(0x00E0, u16(0), u16(0), make([]byte, 16)),
+			record(0x00E0, u16(0), u16(164), make([]byte, 16)),
+			record(0x0085, u32(uint32(offsets[0])), []byte{0, 0}, ascii(1, "Narxlar")),
+			record(0x0085, u32(uint32(offsets[1])), []byte{0, 0}, ascii(1, "Izohlar")),
+			sst,
+			eof,
+		}, nil)
+	}
+	head := len(globals(0, 0))
+	stream := bytes.Join([][]byte{globals(head, head+len(sheet1)), sheet1, sheet2}, nil)
+	// Streams under 4096 bytes would live in the mini stream.
+	stream = append(stream, make([]byte, 4096)...)
+	sectors := (len(stream) + 511) / 512
+	stream = append(stream, make([]byte, sectors*512-len(stream))...)
+
+	const endOfChain, freeSect, fatSect, noStream = 0xFFFFFFFE, 0xFFFFFFFF, 0xFFFFFFFD, 0xFFFFFFFF
+	header := make([]byte, 512)
+	copy(header, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+	binary.LittleEndian.PutUint16(header[24:], 0x003E)
+	binary.LittleEndian.PutUint16(header[26:], 3)
+	binary.LittleEndian.PutUint16(header[28:], 0xFFFE)
+	binary.LittleEndian.PutUint16(header[30:], 9)
+	binary.LittleEndian.PutUint16(header[32:], 6)
+	binary.LittleEndian.PutUint32(header[44:], 1)
+	binary.LittleEndian.PutUint32(header[48:], 1)
+	binary.LittleEndian.PutUint32(header[56:], 4096)
+	binary.LittleEndian.PutUint32(header[60:], endOfChain)
+	binary.LittleEndian.PutUint32(header[68:], endOfChain)
+	for i := 76; i < 512; i += 4 {
+		binary.LittleEndian.PutUint32(header[i:], freeSect)
+	}
+	binary.LittleEndian.PutUint32(header[76:], 0)
+
+	fat := make([]byte, 512)
+	for i := 0; i < 128; i++ {
+		next := uint32(freeSect)
+		switch {
+		case i == 0:
+			next = fatSect
+		case i == 1 || i == 1+sectors:
+			next = endOfChain
+		case i < 1+sectors:
+			next = uint32(i + 1)
+		}
+		binary.LittleEndian.PutUint32(fat[i*4:], next)
+	}
+
+	dir := make([]byte, 512)
+	entry := func(i int, name string, typ byte, child, start uint32, size int) {
+		e := dir[i*128:]
+		copy(e, wide(name+"\x00"))
+		binary.LittleEndian.PutUint16(e[64:], uint16(len(name)*2+2))
+		e[66], e[67] = typ, 1
+		binary.LittleEndian.PutUint32(e[68:], noStream)
+		binary.LittleEndian.PutUint32(e[72:], noStream)
+		binary.LittleEndian.PutUint32(e[76:], child)
+		binary.LittleEndian.PutUint32(e[116:], start)
+		binary.LittleEndian.PutUint32(e[120:], uint32(size))
+	}
+	entry(0, "Root Entry", 5, 1, endOfChain, 0)
+	entry(1, "Workbook", 2, noStream, 2, len(stream))
+	for i := 2; i < 4; i++ {
+		binary.LittleEndian.PutUint32(dir[i*128+68:], noStream)
+		binary.LittleEndian.PutUint32(dir[i*128+72:], noStream)
+		binary.LittleEndian.PutUint32(dir[i*128+76:], noStream)
+	}
+
+	assert.Nil(t, os.WriteFile(path, bytes.Join([][]byte{header, fat, dir, stream}, nil), 0o644))
+}
+
+func Test_ReadXLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.xls")
+	writeTestXLS(t, path)
+
+	sheets, err := ReadWorkbook(path, "legacy.xls", CSVOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, sheets, 2)
+	assert.Equal(t, "Narxlar", sheets[0].Name)
+	assert.Equal(t, [][]string{
+		{"Mahsulot", "Narx (soʻm)"},
+		{"42", "1.5"},
+		{"123.45", "2024-03-05"},
+		{"hisob", "7"},
+		{"TRUE"},
+	}, sheets[0].Rows)
+	assert.Equal(t, "Izohlar", sheets[1].Name)
+	assert.Equal(t, [][]string{nil, {"", "Izoh"}}, sheets[1].Rows)
+
+	state, err := ReadWorkbookState(path, "legacy.xls", CSVOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"value": "Narx (soʻm)"}, state["data"].(map[string]any)["0,1"])
+	assert.Equal(t, []any{map[string]any{"startRow": 5, "startCol": 0, "endRow": 5, "endCol": 2}}, state["mergedCells"])
+	assert.Equal(t, []string{"Narxlar", "Izohlar"}, SheetNames(state))
+
+	// Cells past column IV and empty cells are dropped, not grown into.
+	var crafted xlsSheet
+	crafted.set(60000, 65535, "x")
+	crafted.set(2, 255, "")
+	assert.Empty(t, crafted.rows)
+	crafted.set(1, 255, "y")
+	assert.Len(t, crafted.rows, 2)
+	assert.Len(t, crafted.rows[1], biffMaxCols)
+
+	// Not an OLE file: the .xls extension falls back to excelize.
+	fake := filepath.Join(t.TempDir(), "fake.xls")
+	assert.Nil(t, os.WriteFile(fake, []byte("not a workbook"), 0o644))
+	_, err = OpenWorkbook(fake, "fake.xls", CSVOptions{})
+	assert.NotNil(t, err)
+}
+
+func Test_JobQueue_ImportAndConvert(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+	queue, err := NewJobQueue(service, t.TempDir(), 1)
+	assert.NoError(t, err)
+
+	upload := func(content string) string {
+		path := filepath.Join(t.TempDir(), "upload.csv")
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	path := upload("name;qty\nOlma;3\nNok;5\n")
+	job, err := queue.EnqueueImport(7, "Fruit", path, "fruit.csv", "", CSVOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, JobQueued, job.Status)
+	assert.Equal(t, JobOutputFile, job.Output)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "upload is moved into the queue")
+
+	claimed, err := queue.claim()
+	assert.NoError(t, err)
+	assert.Equal(t, job.ID, claimed.ID)
+	assert.Equal(t, 1, claimed.Attempts)
+	queue.run(claimed)
+
+	done, err := service.GetJob(7, job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, JobSucceeded, done.Status)
+	assert.EqualValues(t, 3, done.RowsProcessed)
+	assert.NotNil(t, done.FinishedAt)
+	if assert.NotNil(t, done.FileID) {
+		file, err := service.GetFile(7, *done.FileID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Fruit", file.Name)
+		assert.Contains(t, string(file.State), `"Olma"`)
+	}
+	_, err = os.Stat(job.UploadPath)
+	assert.True(t, os.IsNotExist(err), "upload is removed once the job is done")
+
+	_, err = service.GetJob(8, job.ID)
+	assert.Error(t, err, "jobs are private to their owner")
+
+	csvJob, err := queue.EnqueueImport(7, "Fruit", upload("a,b\n1,2\n"), "fruit.csv", JobOutputCSV, CSVOptions{})
+	assert.NoError(t, err)
+	claimed, err = queue.claim()
+	assert.NoError(t, err)
+	queue.run(claimed)
+	done, _ = service.GetJob(7, csvJob.ID)
+	assert.Equal(t, JobSucceeded, done.Status)
+	assert.Nil(t, done.FileID)
+	result, err := os.ReadFile(done.ResultPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a,b\n1,2\n", string(result))
+
+	broken, err := queue.EnqueueImport(7, "Broken", upload("x"), "broken.xlsx", "", CSVOptions{})
+	assert.NoError(t, err)
+	claimed, _ = queue.claim()
+	queue.run(claimed)
+	done, _ = service.GetJob(7, broken.ID)
+	assert.Equal(t, JobFailed, done.Status)
+	assert.NotEmpty(t, done.Error)
+
+	_, err = queue.EnqueueImport(7, "Doc", upload("x"), "notes.docx", "", CSVOptions{})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	claimed, err = queue.claim()
+	assert.NoError(t, err)
+	assert.Nil(t, claimed, "queue is empty")
+}
+
+func Test_JobQueue_RequeuesStaleJobs(t *testing.T) {
+	db := setupTestDB()
+	queue, err := NewJobQueue(&SpreadsheetService{DB: db}, t.TempDir(), 1)
+	assert.NoError(t, err)
+
+	stale := time.Now().Add(-jobStaleAfter - time.Minute)
+	lost := models.Job{UserID: 1, Status: JobRunning, Output: JobOutputFile, Name: "a", Filename: "a.csv", Attempts: 1}
+	dead := models.Job{UserID: 1, Status: JobRunning, Output: JobOutputFile, Name: "b", Filename: "b.csv", Attempts: jobMaxAttempts}
+	alive := models.Job{UserID: 1, Status: JobRunning, Output: JobOutputFile, Name: "c", Filename: "c.csv", Attempts: 1}
+	for _, job := range []*models.Job{&lost, &dead, &alive} {
+		assert.NoError(t, db.Create(job).Error)
+	}
+	db.Model(&models.Job{}).Where("id IN ?", []uint{lost.ID, dead.ID}).UpdateColumn("updated_at", stale)
+
+	queue.requeueStale()
+
+	status := func(id uint) models.Job {
+		var job models.Job
+		db.First(&job, id)
+		return job
+	}
+	assert.Equal(t, JobQueued, status(lost.ID).Status)
+	assert.Equal(t, JobFailed, status(dead.ID).Status)
+	assert.Equal(t, errJobInterrupted.Error(), status(dead.ID).Error)
+	assert.Equal(t, JobRunning, status(alive.ID).Status)
+}
+
+func Test_WorkbookReader_Convert(t *testing.T) {
+	dir := t.TempDir()
+	f := excelize.NewFile()
+	assert.Nil(t, f.SetSheetName("Sheet1", "Sotuv"))
+	rows := [][]any{
+		{"Hisobot 2024"},
+		nil,
+		{"Mahsulot", "Soni", "", "Mahsulot", "Izoh"},
+		{"Olma", 3, "x", "qizil"},
+		nil,
+		{"Nok", 5, nil, nil, nil, "ortiqcha"},
+	}
+	for r, row := range rows {
+		if row != nil {
+			assert.Nil(t, f.SetSheetRow("Sotuv", "A"+strconv.Itoa(r+1), &row))
+		}
+	}
+	_, err := f.NewSheet("2")
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetCellValue("2", "A1", 4))
+	assert.Nil(t, f.SetCellFormula("2", "B1", "A1*2"))
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	assert.Nil(t, err)
+	assert.Nil(t, f.SetCellStyle("2", "A1", "A1", bold))
+	path := filepath.Join(dir, "book.xlsx")
+	assert.Nil(t, f.SaveAs(path))
+	assert.Nil(t, f.Close())
+
+	wb, err := OpenWorkbook(path, "book.xlsx", CSVOptions{})
+	assert.Nil(t, err)
+	defer wb.Close()
+
+	index, err := wb.SheetIndex("sotuv")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, index)
+	index, err = wb.SheetIndex("2")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index, "names win over indexes")
+	index, err = wb.SheetIndex("1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+	_, err = wb.SheetIndex("7")
+	assert.ErrorIs(t, err, ErrSheetNotFound)
+
+	var out bytes.Buffer
+	assert.Nil(t, wb.Convert(0, TargetJSON, &out))
+	assert.JSONEq(t, `[
+		{"Mahsulot": "Olma", "Soni": "3", "C": "x", "Mahsulot_2": "qizil", "Izoh": ""},
+		{"Mahsulot": "Nok", "Soni": "5", "C": "", "Mahsulot_2": "", "Izoh": "", "F": "ortiqcha"}
+	]`, out.String())
+	assert.True(t, strings.HasPrefix(out.String(), `[{"Mahsulot":"Olma","Soni":"3"`), "keys keep column order")
+
+	out.Reset()
+	assert.Nil(t, wb.Convert(0, TargetNDJSON, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.JSONEq(t, `{"Mahsulot": "Olma", "Soni": "3", "C": "x", "Mahsulot_2": "qizil", "Izoh": ""}`, lines[0])
+
+	out.Reset()
+	assert.Nil(t, wb.Convert(0, TargetTSV, &out))
+	assert.True(t, strings.HasPrefix(out.String(), "Hisobot 2024\n\nMahsulot\tSoni\t\tMahsulot\tIzoh\n"))
+
+	out.Reset()
+	assert.Nil(t, wb.Convert(1, TargetXLSX, &out))
+	converted, err := excelize.OpenReader(&out)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2"}, converted.GetSheetList())
+	formula, _ := converted.GetCellFormula("2", "B1")
+	assert.Equal(t, "A1*2", formula)
+	value, _ := converted.GetCellValue("2", "B1")
+	assert.Equal(t, "8", value)
+	styleID, _ := converted.GetCellStyle("2", "A1")
+	style, _ := converted.GetStyle(styleID)
+	assert.True(t, style.Font != nil && style.Font.Bold)
+	converted.Close()
+
+	out.Reset()
+	assert.Nil(t, wb.Convert(1, TargetODS, &out))
+	odsPath := filepath.Join(dir, "out.ods")
+	assert.Nil(t, os.WriteFile(odsPath, out.Bytes(), 0o600))
+	state, err := readODSState(odsPath, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "2", state["sheetName"])
+	assert.Nil(t, state["sheets"])
+	data, _ := state["data"].(map[string]any)
+	assert.Equal(t, "=A1*2", formulaValue(data["0,1"]))
+
+	_, err = ParseConvertTarget("pdf")
+	assert.ErrorIs(t, err, ErrUnsupportedTarget)
+	target, err := ParseConvertTarget("")
+	assert.Nil(t, err)
+	assert.Equal(t, TargetCSV, target)
+}
+
+func formulaValue(cell any) string {
+	m, _ := cell.(map[string]any)
+	v, _ := m["value"].(string)
+	return v
+}
+
+func Test_DetectHeaderRow(t *testing.T) {
+	assert.Equal(t, 0, DetectHeaderRow([][]string{{"a", "b"}, {"1", "2"}}))
+	assert.Equal(t, 1, DetectHeaderRow([][]string{{"Title"}, {"Name", "Qty"}, {"x", "1"}}))
+	assert.Equal(t, 0, DetectHeaderRow(nil))
+}
+
+func Test_ParseRecordConditions(t *testing.T) {
+	conds, err := ParseRecordConditions([]string{"Order Total >= 10; Status != paid", `Code="007"`, "Note="})
+	assert.Nil(t, err)
+	assert.Equal(t, []RecordCondition{
+		{Field: "Order Total", Op: ">=", Value: 10.0},
+		{Field: "Status", Op: "!=", Value: "paid"},
+		{Field: "Code", Op: "=", Value: "007"},
+		{Field: "Note", Op: "=", Value: nil},
+	}, conds)
+
+	_, err = ParseRecordConditions([]string{">5"})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+	_, err = ParseRecordConditions([]string{"Amount!5"})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+
+	assert.Equal(t, []RecordSort{{Field: "Date", Desc: true}, {Field: "Name"}}, ParseRecordSort("-Date, +Name,"))
+}
+
+func Test_QuerySQL_TimeBudget(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := service.QuerySQL(ctx, 1, "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n) SELECT count(*) FROM n", 10)
+	assert.ErrorIs(t, err, ErrSQLTimeout)
+}
+
+func Test_CellStorage(t *testing.T) {
+	db := setupTestDB()
+	db.AutoMigrate(&models.SheetFileShare{})
+	service := &SpreadsheetService{DB: db}
+
+	bold := `{"bold": true}`
+	file, err := service.SaveFile(1, "Cells", json.RawMessage(`{"rowCount": 100, "data": {
+		"0,0": {"value": "Name", "style": `+bold+`}, "0,1": {"value": "Qty", "style": `+bold+`},
+		"1,0": {"value": "Olma"}, "1,1": {"value": "3"}, "2,1": {"value": "=B2*2"},
+		"5,5": {"value": ""}
+	}, "sheets": [{"name": "Q2", "data": {"0,0": {"value": "x"}}}]}`))
+	assert.Nil(t, err)
+
+	// The state row keeps the layout; cells are rows of their own.
+	var stored models.SheetFile
+	assert.Nil(t, db.First(&stored, file.ID).Error)
+	assert.JSONEq(t, `{"rowCount": 100, "data": {}, "sheets": [{"name": "Q2", "data": {}}]}`, string(stored.State))
+	var cells []models.SheetCell
+	assert.Nil(t, db.Order("sheet, row, col").Find(&cells).Error)
+	assert.Len(t, cells, 6)
+	assert.Equal(t, "6", string(cells[4].Computed))
+	assert.Equal(t, 1, cells[5].Sheet)
+	assert.Equal(t, *cells[0].StyleID, *cells[1].StyleID)
+	var styles int64
+	db.Model(&models.SheetStyle{}).Count(&styles)
+	assert.EqualValues(t, 1, styles)
+
+	loaded, err := service.GetFile(1, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(6), computedCells(t, loaded.State)["2,1"])
+	assert.Contains(t, string(loaded.State), `"0,0":{"computed":"Name","style":{"bold":true},"value":"Name"}`)
+
+	// A patch rewrites the edited cell and its dependents only.
+	before := map[string]models.SheetCell{}
+	for _, cell := range cells {
+		before[fmt.Sprintf("%d:%d,%d", cell.Sheet, cell.Row, cell.Col)] = cell
+	}
+	_, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 1, Col: 1, Value: "5"}, {Row: 1, Col: 0, Value: ""}})
+	assert.Nil(t, err)
+	cells = nil
+	assert.Nil(t, db.Order("sheet, row, col").Find(&cells).Error)
+	assert.Len(t, cells, 5)
+	after := map[string]models.SheetCell{}
+	for _, cell := range cells {
+		after[fmt.Sprintf("%d:%d,%d", cell.Sheet, cell.Row, cell.Col)] = cell
+	}
+	assert.NotContains(t, after, "0:1,0")
+	assert.Equal(t, "5", after["0:1,1"].Value)
+	assert.Equal(t, "10", string(after["0:2,1"].Computed))
+	assert.Equal(t, before["1:0,0"], after["1:0,0"])
+
+	// Range reads load only the cells inside the range.
+	ranged, _, err := service.GetFileRange(1, file.ID, "", CellRange{MinRow: 0, MaxRow: 0, MinCol: 0, MaxCol: 5})
+	assert.Nil(t, err)
+	var state struct {
+		Data map[string]any `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(ranged.State, &state))
+	assert.Len(t, state.Data, 2)
+	ranged, _, err = service.GetFileRange(1, file.ID, "Q2", CellRange{MinRow: 0, MaxRow: 9, MinCol: 0, MaxCol: 9})
+	assert.Nil(t, err)
+	assert.Contains(t, string(ranged.State), `"data":{"0,0":{"computed":"x","value":"x"}}`)
+
+	assert.Nil(t, service.DeleteFile(1, file.ID))
+	var left int64
+	db.Model(&models.SheetCell{}).Where("file_id = ?", file.ID).Count(&left)
+	assert.EqualValues(t, 0, left)
+}
+
+func Test_CellStorage_MigratesInlineState(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	// A file written before sheet_cells keeps its cells in the state.
+	legacy := models.SheetFile{UserID: 1, Name: "Old", Revision: 1, State: json.RawMessage(`{"data": {"0,0": {"value": "1"}, "0,1": {"value": "=A1+1", "computed": 2}}}`)}
+	assert.Nil(t, db.Create(&legacy).Error)
+	loaded, err := service.GetFile(1, legacy.ID)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(legacy.State), string(loaded.State))
+
+	patched, _, err := service.PatchFileCells(legacy.ID, []CellEdit{{Row: 0, Col: 0, Value: "4"}})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(5), computedCells(t, patched.State)["0,1"])
+
+	var stored models.SheetFile
+	assert.Nil(t, db.First(&stored, legacy.ID).Error)
+	assert.JSONEq(t, `{"data": {}, "activeCell": null, "selection": null}`, string(stored.State))
+	var count int64
+	db.Model(&models.SheetCell{}).Where("file_id = ?", legacy.ID).Count(&count)
+	assert.EqualValues(t, 2, count)
+	loaded, err = service.GetFile(1, legacy.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(5), computedCells(t, loaded.State)["0,1"])
+}
+
+func Test_PatchFileCells_LoadsTouchedCells(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db}
+
+	file, err := service.SaveFile(1, "Partial", json.RawMessage(`{"data": {
+		"0,0": {"value": "1"}, "1,0": {"value": "2"}, "2,0": {"value": "3"},
+		"0,1": {"value": "=SUM(A:A)"}, "0,2": {"value": "=B1*2"},
+		"20,5": {"value": "far"}, "30,6": {"value": "=F21&\"!\""}, "40,0": {"value": "4"}
+	}}`))
+	assert.Nil(t, err)
+
+	// A cold patch loads the formulas for the dependency graph and the
+	// column SUM reads; unrelated values stay in sheet_cells.
+	patched, _, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 1, Col: 0, Value: "20"}})
+	assert.Nil(t, err)
+	cells := computedCells(t, patched.State)
+	assert.Equal(t, float64(28), cells["0,1"])
+	assert.Equal(t, float64(56), cells["0,2"])
+	assert.NotContains(t, cells, "20,5")
+
+	// With the graph cached only the edited cell and its dependents load.
+	patched, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 20, Col: 5, Value: "near"}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"20,5": "near", "30,6": "near!"}, computedCells(t, patched.State))
+
+	loaded, err := service.GetFile(1, file.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{
+		"0,0": float64(1), "1,0": float64(20), "2,0": float64(3), "0,1": float64(28), "0,2": float64(56),
+		"20,5": "near", "30,6": "near!", "40,0": float64(4),
+	}, computedCells(t, loaded.State))
+}
+
+func Test_StateLimits_CellCount(t *testing.T) {
+	db := setupTestDB()
+	service := &SpreadsheetService{DB: db, StateLimits: StateLimits{MaxCells: 3}}
+
+	file, err := service.SaveFile(1, "Small", json.RawMessage(`{"data": {"0,0": {"value": "1"}, "0,1": {"value": "=A1*2"}}}`))
+	assert.Nil(t, err)
+
+	_, _, err = service.PatchFileCells(file.ID, []CellEdit{{Row: 1, Col: 0, Value: "a"}, {Row: 1, Col: 1, Value: "b"}})
+	assert.ErrorIs(t, err, ErrInvalidState)
+	assert.EqualError(t, err, "invalid state: more than 3 cells")
+	var count int64
+	db.Model(&models.SheetCell{}).Where("file_id = ?", file.ID).Count(&count)
+	assert.EqualValues(t, 2, count, "the patch is rolled back")
+
+	// Replacing a cell does not grow the file.
+	patched, _, err := service.PatchFileCells(file.ID, []CellEdit{{Row: 0, Col: 0, Value: "4"}, {Row: 0, Col: 1, Value: ""}, {Row: 2, Col: 0, Value: "x"}})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, patched.Revision)
+
+	_, _, err = service.ApplyRangeOp(file.ID, RangeOp{Op: RangeCopy, Range: CellRange{MinRow: 0, MaxRow: 2, MinCol: 0, MaxCol: 0}, ToRow: 0, ToCol: 1})
+	assert.ErrorIs(t, err, ErrInvalidState)
+
+	_, err = service.CreateBranch(file.ID, "draft")
+	assert.Nil(t, err)
+	_, _, err = service.PatchBranchCells(file.ID, "draft", []CellEdit{{Row: 5, Col: 0, Value: "a"}, {Row: 5, Col: 1, Value: "b"}})
+	assert.ErrorIs(t, err, ErrInvalidState)
+	_, _, err = service.PatchBranchCells(file.ID, "draft", []CellEdit{{Row: 5, Col: 0, Value: "a"}})
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "big.csv")
+	assert.Nil(t, os.WriteFile(path, []byte("a,b\nc,d\n"), 0o600))
+	_, err = service.ImportFile(1, "Big", path, "big.csv", CSVOptions{})
+	assert.ErrorIs(t, err, ErrInvalidState)
+}
+
+func Test_ValidateCellStyle(t *testing.T) {
+	assert.NoError(t, ValidateCellStyle(map[string]any{
+		"bold": true, "textAlign": "center", "backgroundColor": "#fff3bf", "fontSize": 14.0,
+		"numberFormat": "currency", "currencyCode": "UZS", "decimalPlaces": 2.0, "wrapMode": "wrap",
+		"rotation": -90.0, "borders": map[string]any{"top": true, "style": "dashed", "color": "#000"},
+	}, false))
+	assert.NoError(t, ValidateCellStyle(map[string]any{"bold": nil, "borders": map[string]any{"top": nil}}, true))
+
+	for _, bad := range []map[string]any{
+		{"bold": "yes"},
+		{"textAlign": "justify"},
+		{"numberFormat": "date"},
+		{"currencyCode": "usd"},
+		{"decimalPlaces": 1.5},
+		{"fontSize": 0.0},
+		{"borders": map[string]any{"style": "double"}},
+		{"borders": true},
+		{"shadow": true},
+		{"bold": nil},
+	} {
+		assert.ErrorIs(t, ValidateCellStyle(bad, false), ErrInvalidStyle, bad)
+	}
+}
+
+func Test_mergeStyle(t *testing.T) {
+	base := map[string]any{"bold": true, "color": "#111", "borders": map[string]any{"top": true, "left": true}}
+	merged := mergeStyle(base, map[string]any{"color": nil, "italic": true, "borders": map[string]any{"left": nil, "bottom": true}})
+	assert.Equal(t, map[string]any{"bold": true, "italic": true, "borders": map[string]any{"top": true, "bottom": true}}, merged)
+	assert.Equal(t, "#111", base["color"], "the base style is left alone")
+
+	assert.Empty(t, mergeStyle(map[string]any{"borders": map[string]any{"top": true}}, map[string]any{"borders": map[string]any{"top": nil}}))
+}
+
+func Test_Names(t *testing.T) {
+	for _, name := range []string{"Revenue", "_tax", "Q1.Sales", "Tushum2024", "ABCD1"} {
+		assert.NoError(t, checkName(name), name)
+	}
+	for _, name := range []string{"", "B2", "xfd1", "R1C1", "r", "C", "1Q", "Net Sales", "Sales!"} {
+		assert.Error(t, checkName(name), name)
+	}
+
+	state := json.RawMessage(`{
+		"data": {"0,0": {"value": "x"}},
+		"sheets": [{"name": "Q & A", "data": {}}],
+		"names": [
+			{"name": "Revenue", "ref": "Sheet1!B2:B200"},
+			{"name": "Notes", "ref": "'Q & A'!A1"},
+			{"name": "Gone", "ref": "Sheet1!#REF!"}
+		]
+	}`)
+	ref, found, err := ResolveName(state, " revenue ")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "Sheet1!B2:B200", ref)
+	_, found, _ = ResolveName(state, "B2:B200")
+	assert.False(t, found, "A1 ranges are never names")
+	_, found, err = ResolveName(state, "Gone")
+	assert.True(t, found)
+	assert.ErrorIs(t, err, ErrInvalidName)
+
+	var buf bytes.Buffer
+	assert.NoError(t, ExportODS(state, &buf))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	content, err := zr.Open("content.xml")
+	assert.NoError(t, err)
+	xml, _ := io.ReadAll(content)
+	assert.Contains(t, string(xml), `<table:named-range table:name="Revenue" table:base-cell-address="$&#39;Sheet1&#39;.$B$2" table:cell-range-address="$&#39;Sheet1&#39;.$B$2:.$B$200"/>`)
+	assert.Contains(t, string(xml), `table:name="Notes"`)
+	assert.NotContains(t, string(xml), `table:name="Gone"`)
+}
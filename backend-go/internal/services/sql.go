@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Errors of the SQL query API; their messages are meant for the client.
+var (
+	ErrInvalidSQL = errors.New("invalid query")
+	ErrSQLTimeout = errors.New("query exceeded its time budget")
+)
+
+// sqliteRecursive is SQLITE_RECURSIVE, which go-sqlite3 does not export.
+const sqliteRecursive = 33
+
+// sqlTablePattern matches the tables a query may read: sheet_12 is the
+// first sheet of file 12 and sheet_12_3 its third sheet.
+var sqlTablePattern = regexp.MustCompile(`(?i)\bsheet_(\d+)(?:_(\d+))?\b`)
+
+// SQLTable is a sheet referenced by a query.
+type SQLTable struct {
+	Name   string `json:"name"`
+	FileID uint   `json:"file_id"`
+	Sheet  string `json:"sheet"`
+	index  int
+}
+
+// SQLResult holds the rows of a query; Truncated means more rows matched
+// than the row budget allowed.
+type SQLResult struct {
+	Tables    []SQLTable `json:"tables"`
+	Columns   []string   `json:"columns"`
+	Rows      [][]any    `json:"rows"`
+	Truncated bool       `json:"truncated"`
+}
+
+// sqlTables lists the distinct tables named in a query.
+func sqlTables(query string) ([]SQLTable, error) {
+	var tables []SQLTable
+	seen := map[string]bool{}
+	for _, m := range sqlTablePattern.FindAllStringSubmatch(query, -1) {
+		id, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad table %s", ErrInvalidSQL, m[0])
+		}
+		index := 0
+		if m[2] != "" {
+			n, err := strconv.Atoi(m[2])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: sheets are numbered from 1 in %s", ErrInvalidSQL, m[0])
+			}
+			index = n - 1
+		}
+		name := strings.ToLower(m[0])
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		tables = append(tables, SQLTable{Name: name, FileID: uint(id), index: index})
+	}
+	return tables, nil
+}
+
+// QuerySQL runs a read-only SQL query over the sheets it names, each loaded
+// from its file's state as a table of header-mapped records with a "_row"
+// column. Every file must be accessible to the user. At most maxRows rows
+// are returned; the deadline of ctx bounds loading and running the query.
+func (s *SpreadsheetService) QuerySQL(ctx context.Context, userID uint, query string, maxRows int) (*SQLResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("%w: query is required", ErrInvalidSQL)
+	}
+	tables, err := sqlTables(query)
+	if err != nil {
+		return nil, err
+	}
+
+	sheets := make([]*SheetTable, len(tables))
+	for i := range tables {
+		file, _, err := s.GetFileAccess(userID, tables[i].FileID)
+		if err != nil {
+			return nil, err
+		}
+		state, err := DecodeState(file.State)
+		if err != nil {
+			return nil, err
+		}
+		names := StateSheetNames(state)
+		if tables[i].index >= len(names) {
+			return nil, fmt.Errorf("%w: %s", ErrSheetNotFound, tables[i].Name)
+		}
+		tables[i].Sheet = names[tables[i].index]
+		sheets[i] = NewSheetTable(StateSheets(state)[tables[i].index])
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// Each connection to :memory: is a database of its own.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for i, table := range tables {
+		if err := loadSQLTable(ctx, conn, table.Name, sheets[i]); err != nil {
+			return nil, sqlError(ctx, err)
+		}
+	}
+
+	// From here on the connection may only read.
+	err = conn.Raw(func(driverConn any) error {
+		sc, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return errors.New("unexpected sqlite connection")
+		}
+		sc.RegisterAuthorizer(func(op int, _, _, _ string) int {
+			switch op {
+			case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION, sqliteRecursive:
+				return sqlite3.SQLITE_OK
+			}
+			return sqlite3.SQLITE_DENY
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, sqlError(ctx, err)
+	}
+	defer rows.Close()
+
+	result := &SQLResult{Tables: tables, Rows: [][]any{}}
+	if result.Columns, err = rows.Columns(); err != nil {
+		return nil, sqlError(ctx, err)
+	}
+	for rows.Next() {
+		if len(result.Rows) == maxRows {
+			result.Truncated = true
+			break
+		}
+		values := make([]any, len(result.Columns))
+		ptrs := make([]any, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, sqlError(ctx, err)
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, sqlError(ctx, err)
+	}
+	return result, nil
+}
+
+// loadSQLTable creates a table with a "_row" column (the 1-based sheet row)
+// and one column per field. Numbers are stored as REAL, booleans as 1/0 and
+// everything else as text; empty cells are NULL.
+func loadSQLTable(ctx context.Context, conn *sql.Conn, name string, table *SheetTable) error {
+	columns := []string{quoteSQLName("_row")}
+	seen := map[string]int{"_row": 1}
+	if table != nil {
+		for _, field := range table.Fields {
+			// SQLite column names ignore case.
+			key := strings.ToLower(field)
+			if n := seen[key]; n > 0 {
+				seen[key] = n + 1
+				field = fmt.Sprintf("%s_%d", field, n+1)
+			}
+			seen[strings.ToLower(field)]++
+			columns = append(columns, quoteSQLName(field))
+		}
+	}
+
+	create := fmt.Sprintf("CREATE TABLE %s (%s)", quoteSQLName(name), strings.Join(columns, ", "))
+	if _, err := conn.ExecContext(ctx, create); err != nil {
+		return err
+	}
+	if table == nil {
+		return nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteSQLName(name), marks))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	args := make([]any, len(columns))
+	for _, row := range table.RecordRows() {
+		args[0] = row + 1
+		for col := table.MinCol; col <= table.MaxCol; col++ {
+			v := table.Value(row, col)
+			if b, ok := v.(bool); ok {
+				v = boolRank(b)
+			}
+			args[col-table.MinCol+1] = v
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func quoteSQLName(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlError reports an exhausted deadline as ErrSQLTimeout and SQLite's own
+// errors (syntax, unknown tables, writes) as ErrInvalidSQL.
+func sqlError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ErrSQLTimeout, ctx.Err())
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return fmt.Errorf("%w: %v", ErrInvalidSQL, err)
+	}
+	return err
+}
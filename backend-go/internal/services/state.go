@@ -0,0 +1,201 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+)
+
+// Defaults of StateLimits.
+const (
+	DefaultMaxStateCells = 500000
+	// DefaultMaxCellValueLength is Excel's limit on the text of a cell.
+	DefaultMaxCellValueLength = 32767
+)
+
+// StateLimits bounds what a client may store in a file; zero fields use the
+// defaults.
+type StateLimits struct {
+	MaxCells       int // cells across all sheets
+	MaxValueLength int // characters in one cell value
+}
+
+// WithDefaults fills the zero fields of l with the defaults.
+func (l StateLimits) WithDefaults() StateLimits {
+	if l.MaxCells <= 0 {
+		l.MaxCells = DefaultMaxStateCells
+	}
+	if l.MaxValueLength <= 0 {
+		l.MaxValueLength = DefaultMaxCellValueLength
+	}
+	return l
+}
+
+// checkCellCount fails with ErrInvalidState when a file would hold more
+// cells than the limit.
+func (l StateLimits) checkCellCount(cells int) error {
+	if limit := l.WithDefaults().MaxCells; cells > limit {
+		return fmt.Errorf("%w: more than %d cells", ErrInvalidState, limit)
+	}
+	return nil
+}
+
+// ValueFits reports whether a cell value is within the length limit.
+func (l StateLimits) ValueFits(value string) bool {
+	limit := l.WithDefaults().MaxValueLength
+	return len(value) <= limit || utf8.RuneCountInString(value) <= limit
+}
+
+// ValidateState checks a state submitted by a client against the editor's
+// SheetState model: field types, "row,col" cell keys, cell styles, sheet
+// names, sizes and merges, named ranges, and the limits. Fields the model does not know
+// are rejected. Errors wrap ErrInvalidState and name the offending field,
+// e.g. "invalid state: data.0,1.value must be a string".
+func ValidateState(raw json.RawMessage, limits StateLimits) error {
+	var state models.SheetState
+	if err := decodeStrict(raw, &state); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidState, jsonErrorMessage(err))
+	}
+	limits = limits.WithDefaults()
+
+	cells := 0
+	first := state.SheetName
+	if first == "" {
+		first = DefaultSheetName
+	}
+	names := map[string]bool{strings.ToLower(first): true}
+	for i, sheet := range append([]models.Sheet{state.Sheet}, state.Sheets...) {
+		path := ""
+		if i > 0 {
+			path = fmt.Sprintf("sheets.%d.", i-1)
+			name := strings.ToLower(strings.TrimSpace(sheet.Name))
+			if name == "" {
+				return fmt.Errorf("%w: %sname is required", ErrInvalidState, path)
+			}
+			if names[name] {
+				return fmt.Errorf("%w: %sname %q is used by another sheet", ErrInvalidState, path, sheet.Name)
+			}
+			names[name] = true
+		}
+		cells += len(sheet.Data)
+		if err := limits.checkCellCount(cells); err != nil {
+			return err
+		}
+		if err := validateSheet(sheet, limits); err != nil {
+			return fmt.Errorf("%w: %s%v", ErrInvalidState, path, err)
+		}
+	}
+
+	defined := map[string]bool{}
+	for i, named := range state.Names {
+		if err := checkName(named.Name); err != nil {
+			return fmt.Errorf("%w: names.%d.%v", ErrInvalidState, i, err)
+		}
+		if err := checkNameRef(named.Ref); err != nil {
+			return fmt.Errorf("%w: names.%d.%v", ErrInvalidState, i, err)
+		}
+		key := strings.ToLower(named.Name)
+		if defined[key] {
+			return fmt.Errorf("%w: names.%d.name %q is defined twice", ErrInvalidState, i, named.Name)
+		}
+		defined[key] = true
+	}
+	return nil
+}
+
+func validateSheet(sheet models.Sheet, limits StateLimits) error {
+	for id, cell := range sheet.Data {
+		if _, _, ok := formula.ParseCellID(id); !ok {
+			return fmt.Errorf("data has a bad cell key %q (want \"row,col\")", id)
+		}
+		if !limits.ValueFits(cell.Value) {
+			return fmt.Errorf("data.%s.value is longer than %d characters", id, limits.MaxValueLength)
+		}
+		switch cell.Computed.(type) {
+		case nil, string, float64, bool:
+		default:
+			return fmt.Errorf("data.%s.computed must be a string or number", id)
+		}
+		if cell.Style != nil {
+			if err := checkCellStyle(*cell.Style); err != nil {
+				return fmt.Errorf("data.%s.style.%v", id, err)
+			}
+		}
+	}
+
+	if sheet.RowCount < 0 {
+		return errors.New("rowCount must not be negative")
+	}
+	for field, sizes := range map[string]map[int]float64{"columnWidths": sheet.ColumnWidths, "rowHeights": sheet.RowHeights} {
+		for index, size := range sizes {
+			if index < 0 || size < 0 {
+				return fmt.Errorf("%s must hold sizes of at least 0 by index", field)
+			}
+		}
+	}
+	if f := sheet.FreezePosition; f != nil && (f.Rows < 0 || f.Cols < 0) {
+		return errors.New("freezePosition must not be negative")
+	}
+	for i, m := range sheet.MergedCells {
+		if m.StartRow < 0 || m.StartCol < 0 || m.EndRow < m.StartRow || m.EndCol < m.StartCol {
+			return fmt.Errorf("mergedCells.%d is not a range", i)
+		}
+	}
+	return nil
+}
+
+// decodeStrict decodes JSON into v, rejecting fields v does not have.
+func decodeStrict(raw []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the top-level value")
+	}
+	return nil
+}
+
+// jsonErrorMessage rewords a decoding error for a client, naming the field
+// by its path: "data.0,1.value must be a string".
+func jsonErrorMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "value"
+		}
+		return field + " must be " + jsonKind(typeErr.Type)
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at byte %d", syntaxErr.Offset)
+	}
+	return strings.TrimPrefix(err.Error(), "json: ")
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Uint, reflect.Uint64, reflect.Uint32:
+		return "an integer"
+	case reflect.Float64, reflect.Float32:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	}
+	return "an object"
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// VersionSourceStructure marks versions written by ApplyStructure.
+const VersionSourceStructure = "structure"
+
+// Structural operations and the dimensions they apply to.
+const (
+	StructureInsert = "insert"
+	StructureDelete = "delete"
+	StructureMove   = "move"
+
+	DimensionRows    = "rows"
+	DimensionColumns = "columns"
+)
+
+// maxSheetColumns is the column count of an Excel sheet; structural edits
+// never push cells past it.
+const maxSheetColumns = 1 << 14
+
+// ErrInvalidStructure is returned for a structural operation that cannot
+// be applied; its message is meant for the client.
+var ErrInvalidStructure = errors.New("invalid structure operation")
+
+// StructureOp inserts, deletes or moves Count rows or columns of a sheet
+// starting at Index (0-based). A move takes the block out and puts it back
+// in front of the row or column that was at To before the move.
+type StructureOp struct {
+	Op        string `json:"op"`
+	Dimension string `json:"dimension"`
+	Sheet     string `json:"sheet,omitempty"`
+	Index     int    `json:"index"`
+	Count     int    `json:"count"`
+	To        int    `json:"to,omitempty"`
+}
+
+// indexMap returns where each old index of the op's dimension goes, -1 for
+// a deleted one or one pushed off the sheet.
+func (op StructureOp) indexMap() (func(int) int, error) {
+	limit := formula.MaxRow + 1
+	switch op.Dimension {
+	case DimensionRows:
+	case DimensionColumns:
+		limit = maxSheetColumns
+	default:
+		return nil, fmt.Errorf("%w: dimension must be %q or %q", ErrInvalidStructure, DimensionRows, DimensionColumns)
+	}
+	if op.Index < 0 || op.Count < 1 || op.Index+op.Count > limit {
+		return nil, fmt.Errorf("%w: %s %d..%d are out of range", ErrInvalidStructure, op.Dimension, op.Index, op.Index+op.Count-1)
+	}
+
+	start, end, n := op.Index, op.Index+op.Count, op.Count
+	switch op.Op {
+	case StructureInsert:
+		return func(i int) int {
+			switch {
+			case i >= limit-n:
+				// Pushed off the end of the sheet.
+				return -1
+			case i >= start:
+				return i + n
+			}
+			return i
+		}, nil
+	case StructureDelete:
+		return func(i int) int {
+			switch {
+			case i >= end:
+				return i - n
+			case i >= start:
+				return -1
+			}
+			return i
+		}, nil
+	case StructureMove:
+		to := op.To
+		if to < 0 || to > limit || (to > start && to < end) {
+			return nil, fmt.Errorf("%w: cannot move %s %d..%d in front of %d", ErrInvalidStructure, op.Dimension, start, end-1, to)
+		}
+		return func(i int) int {
+			switch {
+			case i >= start && i < end && to > start:
+				return i + to - end
+			case i >= start && i < end:
+				return i - start + to
+			case to > start && i >= end && i < to:
+				return i - n
+			case to < start && i >= to && i < start:
+				return i + n
+			}
+			return i
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: op must be %q, %q or %q", ErrInvalidStructure, StructureInsert, StructureDelete, StructureMove)
+}
+
+// ApplyStructure applies a structural operation to a sheet in one locked
+// transaction: cells move to their new keys, formulas of the sheet follow
+// the cells they reference, and row heights or column widths, merged cells,
+// the frozen panes, the row count and the named ranges of the sheet are
+// shifted to match. The sheet is
+// recalculated and the result recorded as a version.
+func (s *SpreadsheetService) ApplyStructure(fileID uint, op StructureOp, ifMatch ...int64) (*models.SheetFile, error) {
+	mapIndex, err := op.indexMap()
+	if err != nil {
+		return nil, err
+	}
+
+	var file models.SheetFile
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", fileID).
+			First(&file).Error; err != nil {
+			return err
+		}
+		if !revisionMatches(file.Revision, ifMatch) {
+			return ErrRevisionMismatch
+		}
+		inline := hasInlineCells(file.State)
+		if err := loadCells(tx, &file, -1, nil); err != nil {
+			return err
+		}
+
+		var state map[string]any
+		if err := json.Unmarshal(file.State, &state); err != nil {
+			return fmt.Errorf("failed to decode file state: %w", err)
+		}
+		index, err := sheetIndex(state, op.Sheet)
+		if err != nil {
+			return err
+		}
+		sheets := map[int]bool{index: true}
+		var before map[cellKey]string
+		if !inline {
+			before = cellSnapshot(state, sheets)
+		}
+
+		sheet := stateSheetList(state)[index]
+		shiftSheet(sheet, op, mapIndex)
+		shiftNames(state, index, op, mapIndex)
+		if data, ok := sheet["data"].(map[string]any); ok && len(data) > 0 {
+			formula.Recalculate(data)
+		}
+
+		next, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode file state: %w", err)
+		}
+		file.State = next
+		file.Revision++
+		if inline {
+			err = saveFile(tx, &file)
+		} else {
+			err = saveCellChanges(tx, &file, state, before, sheets)
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkStoredCells(tx, file.ID, s.StateLimits); err != nil {
+			return err
+		}
+		return s.recordVersion(tx, &file, VersionSourceStructure)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// shiftSheet rewrites one sheet for a structural operation.
+func shiftSheet(sheet map[string]any, op StructureOp, mapIndex func(int) int) {
+	rows := op.Dimension == DimensionRows
+	refs := formula.RefMap{Col: mapIndex}
+	sizesKey := "columnWidths"
+	if rows {
+		refs = formula.RefMap{Row: mapIndex}
+		sizesKey = "rowHeights"
+	}
+
+	if data, ok := sheet["data"].(map[string]any); ok {
+		shifted := make(map[string]any, len(data))
+		for id, cell := range data {
+			row, col, ok := formula.ParseCellID(id)
+			if !ok {
+				shifted[id] = cell
+				continue
+			}
+			if rows {
+				row = mapIndex(row)
+			} else {
+				col = mapIndex(col)
+			}
+			if row < 0 || col < 0 {
+				continue
+			}
+			if m, ok := cell.(map[string]any); ok {
+				if raw, ok := m["value"].(string); ok {
+					if adjusted := formula.AdjustReferences(raw, refs); adjusted != raw {
+						m["value"] = adjusted
+					}
+				}
+			}
+			shifted[fmt.Sprintf("%d,%d", row, col)] = cell
+		}
+		sheet["data"] = shifted
+	}
+
+	if sizes, ok := sheet[sizesKey].(map[string]any); ok {
+		shifted := make(map[string]any, len(sizes))
+		for key, size := range sizes {
+			i, err := strconv.Atoi(key)
+			if err != nil {
+				shifted[key] = size
+				continue
+			}
+			if i = mapIndex(i); i >= 0 {
+				shifted[strconv.Itoa(i)] = size
+			}
+		}
+		sheet[sizesKey] = shifted
+	}
+
+	if merges, ok := sheet["mergedCells"].([]any); ok {
+		kept := make([]any, 0, len(merges))
+		for _, item := range merges {
+			if merge, ok := item.(map[string]any); !ok || shiftMerge(merge, rows, op.Op == StructureMove, mapIndex) {
+				kept = append(kept, item)
+			}
+		}
+		sheet["mergedCells"] = kept
+	}
+
+	if op.Op == StructureMove {
+		if count, ok := sheet["rowCount"].(float64); ok && rows && op.To > int(count) {
+			sheet["rowCount"] = op.To
+		}
+		return
+	}
+	if freeze, ok := sheet["freezePosition"].(map[string]any); ok {
+		key := "cols"
+		if rows {
+			key = "rows"
+		}
+		if frozen, ok := freeze[key].(float64); ok && frozen > 0 {
+			// Frozen rows or columns stay those in front of the same cell.
+			freeze[key] = mapBoundary(int(frozen), mapIndex)
+		}
+	}
+
+	if rows {
+		if count, ok := sheet["rowCount"].(float64); ok && count > 0 {
+			sheet["rowCount"] = max(mapBoundary(int(count), mapIndex), 1)
+		}
+	}
+}
+
+// mapBoundary returns how many indexes lie in front of the one that was at
+// n, counting those that still exist.
+func mapBoundary(n int, mapIndex func(int) int) int {
+	for i := n; i > 0; i-- {
+		if m := mapIndex(i - 1); m >= 0 {
+			return m + 1
+		}
+	}
+	return 0
+}
+
+// shiftMerge moves a merged area along the shifted dimension, growing it
+// over rows or columns inserted inside, and reports whether it is still a
+// merge: areas that lose all their cells, come apart in a move or shrink to
+// one cell are dropped.
+func shiftMerge(merge map[string]any, rows, move bool, mapIndex func(int) int) bool {
+	startKey, endKey := "startCol", "endCol"
+	if rows {
+		startKey, endKey = "startRow", "endRow"
+	}
+	start, ok1 := merge[startKey].(float64)
+	end, ok2 := merge[endKey].(float64)
+	if !ok1 || !ok2 {
+		return true
+	}
+	lo, hi, kept := -1, -1, 0
+	for i := int(min(start, end)); i <= int(max(start, end)); i++ {
+		m := mapIndex(i)
+		if m < 0 {
+			continue
+		}
+		if kept == 0 || m < lo {
+			lo = m
+		}
+		if m > hi {
+			hi = m
+		}
+		kept++
+	}
+	if kept == 0 || move && hi-lo+1 != kept {
+		return false
+	}
+	merge[startKey], merge[endKey] = lo, hi
+
+	if lo != hi {
+		return true
+	}
+	if rows {
+		return merge["startCol"] != merge["endCol"]
+	}
+	return merge["startRow"] != merge["endRow"]
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"converter-backend/internal/models"
+)
+
+// ErrInvalidStyle is returned for a style that does not fit the frontend's
+// CellStyle type; its message is meant for the client.
+var ErrInvalidStyle = errors.New("invalid style")
+
+// cellStyleEnums lists the allowed values of the CellStyle fields that are
+// string unions in shlyux/types.ts.
+var cellStyleEnums = map[string][]string{
+	"textAlign":     {"left", "center", "right"},
+	"numberFormat":  {"general", "number", "currency", "percent"},
+	"verticalAlign": {"top", "middle", "bottom"},
+	"wrapMode":      {"overflow", "wrap", "clip"},
+	"borders.style": {"solid", "dashed", "dotted"},
+}
+
+// ValidateCellStyle checks a style against the CellStyle type of the
+// frontend. A partial style is a patch to merge into another one, where
+// null removes a field.
+func ValidateCellStyle(style map[string]any, partial bool) error {
+	if !partial {
+		for _, key := range slices.Sorted(maps.Keys(style)) {
+			if style[key] == nil {
+				return fmt.Errorf("%w: %s must not be null", ErrInvalidStyle, key)
+			}
+		}
+		borders, _ := style["borders"].(map[string]any)
+		for _, key := range slices.Sorted(maps.Keys(borders)) {
+			if borders[key] == nil {
+				return fmt.Errorf("%w: borders.%s must not be null", ErrInvalidStyle, key)
+			}
+		}
+	}
+
+	raw, err := json.Marshal(style)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStyle, err)
+	}
+	var typed models.CellStyle
+	if err := decodeStrict(raw, &typed); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidStyle, jsonErrorMessage(err))
+	}
+	if err := checkCellStyle(typed); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStyle, err)
+	}
+	return nil
+}
+
+// checkCellStyle checks the values of a decoded style; the types were
+// checked by decoding it.
+func checkCellStyle(s models.CellStyle) error {
+	for _, field := range []struct{ key, value string }{
+		{"textAlign", s.TextAlign},
+		{"numberFormat", s.NumberFormat},
+		{"verticalAlign", s.VerticalAlign},
+		{"wrapMode", s.WrapMode},
+	} {
+		if field.value != "" && !slices.Contains(cellStyleEnums[field.key], field.value) {
+			return fmt.Errorf("%s must be one of %v", field.key, cellStyleEnums[field.key])
+		}
+	}
+	if len(s.Color) > 64 || len(s.BackgroundColor) > 64 {
+		return errors.New("colors must be at most 64 bytes")
+	}
+	if len(s.FontFamily) > 128 {
+		return errors.New("fontFamily must be at most 128 bytes")
+	}
+	// Intl.NumberFormat throws on anything but a three-letter code.
+	if s.CurrencyCode != "" && !isCurrencyCode(s.CurrencyCode) {
+		return errors.New("currencyCode must be a three-letter code such as USD")
+	}
+	if s.FontSize != nil && (*s.FontSize <= 0 || *s.FontSize > 400) {
+		return errors.New("fontSize must be a number between 0 and 400")
+	}
+	if s.DecimalPlaces != nil && (*s.DecimalPlaces < 0 || *s.DecimalPlaces > 20) {
+		return errors.New("decimalPlaces must be a whole number from 0 to 20")
+	}
+	if s.Rotation != nil && (*s.Rotation < -360 || *s.Rotation > 360) {
+		return errors.New("rotation must be a number of degrees from -360 to 360")
+	}
+	if b := s.Borders; b != nil {
+		if len(b.Color) > 64 {
+			return errors.New("borders.color must be at most 64 bytes")
+		}
+		if b.Style != "" && !slices.Contains(cellStyleEnums["borders.style"], b.Style) {
+			return fmt.Errorf("borders.style must be one of %v", cellStyleEnums["borders.style"])
+		}
+	}
+	return nil
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 'A' || s[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeStyle returns base with patch applied: null removes a field and
+// nested objects (borders) are merged the same way. Neither map is
+// modified, as cells may share style maps.
+func mergeStyle(base, patch map[string]any) map[string]any {
+	out := maps.Clone(base)
+	if out == nil {
+		out = map[string]any{}
+	}
+	for key, value := range patch {
+		switch v := value.(type) {
+		case nil:
+			delete(out, key)
+		case map[string]any:
+			current, _ := out[key].(map[string]any)
+			if merged := mergeStyle(current, v); len(merged) > 0 {
+				out[key] = merged
+			} else {
+				delete(out, key)
+			}
+		default:
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// styleMap converts a typed style to the map form of CellEdit.Style; an
+// empty map for none.
+func styleMap(style *models.CellStyle) map[string]any {
+	out := map[string]any{}
+	if style != nil {
+		raw, _ := json.Marshal(style)
+		_ = json.Unmarshal(raw, &out)
+	}
+	return out
+}
+
+// typedStyle converts a style map to the typed style; nil for an empty one.
+func typedStyle(style map[string]any) *models.CellStyle {
+	if len(style) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(style)
+	if err != nil {
+		return nil
+	}
+	var typed models.CellStyle
+	if json.Unmarshal(raw, &typed) != nil || typed == (models.CellStyle{}) {
+		return nil
+	}
+	return &typed
+}
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultMaxVersionsPerFile is used when SpreadsheetService.MaxVersionsPerFile is not set.
+const DefaultMaxVersionsPerFile = 50
+
+// Version sources recorded on SheetFileVersion.
+const (
+	VersionSourceSave    = "save"
+	VersionSourcePatch   = "patch"
+	VersionSourceRestore = "restore"
+)
+
+// CellValueDiff describes one cell whose raw value differs between two states.
+type CellValueDiff struct {
+	Sheet  string `json:"sheet,omitempty"` // "" is the first sheet
+	ID     string `json:"id"`              // "row,col"
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func (s *SpreadsheetService) maxVersions() int {
+	if s.MaxVersionsPerFile > 0 {
+		return s.MaxVersionsPerFile
+	}
+	return DefaultMaxVersionsPerFile
+}
+
+// Storage of a SheetFileVersion; a full snapshot has none.
+const (
+	versionStorageLive = "live"
+	versionStorageUndo = "undo"
+)
+
+// versionUndo is the state of an undo version: applied to the state of the
+// version after it, it gives the version's own.
+type versionUndo struct {
+	Layout json.RawMessage `json:"layout"`
+	Cells  []undoCell      `json:"cells"`
+}
+
+// undoCell is a cell as a version had it; Cell is nil for one it did not
+// have.
+type undoCell struct {
+	Sheet int              `json:"sheet"`
+	Row   int              `json:"row"`
+	Col   int              `json:"col"`
+	Cell  *models.CellData `json:"cell"`
+}
+
+// recordVersion snapshots file.State inside tx and prunes versions beyond
+// the retention limit. The caller must hold the file row lock (or have just
+// created the file) so version numbers cannot race.
+func (s *SpreadsheetService) recordVersion(tx *gorm.DB, file *models.SheetFile, source string) error {
+	return s.insertVersion(tx, file.ID, source, file.State, "")
+}
+
+// recordPatchVersion records a cell patch as the file's live version, from
+// the layout the patch wrote and the cells it changed as they were before.
+// The live version before it becomes the undo of the patch, so a patch
+// stores what it changed rather than the whole file.
+func (s *SpreadsheetService) recordPatchVersion(tx *gorm.DB, file *models.SheetFile, layout json.RawMessage, old []undoCell) error {
+	var live models.SheetFileVersion
+	if err := tx.Where("file_id = ? AND storage = ?", file.ID, versionStorageLive).Limit(1).Find(&live).Error; err != nil {
+		return err
+	}
+	if live.ID != 0 {
+		undo, err := json.Marshal(versionUndo{Layout: live.State, Cells: old})
+		if err != nil {
+			return fmt.Errorf("failed to encode version: %w", err)
+		}
+		if err := tx.Model(&live).Updates(map[string]any{"state": undo, "storage": versionStorageUndo}).Error; err != nil {
+			return err
+		}
+	}
+	return s.insertVersion(tx, file.ID, VersionSourcePatch, layout, versionStorageLive)
+}
+
+func (s *SpreadsheetService) insertVersion(tx *gorm.DB, fileID uint, source string, state json.RawMessage, storage string) error {
+	var latest int
+	if err := tx.Model(&models.SheetFileVersion{}).
+		Where("file_id = ?", fileID).
+		Select("COALESCE(MAX(version), 0)").
+		Scan(&latest).Error; err != nil {
+		return err
+	}
+
+	version := models.SheetFileVersion{
+		FileID:  fileID,
+		Version: latest + 1,
+		Source:  source,
+		State:   state,
+		Storage: storage,
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return err
+	}
+
+	// Undo versions only build on newer ones, so the oldest can go.
+	return tx.Where("file_id = ? AND version <= ?", fileID, version.Version-s.maxVersions()).
+		Delete(&models.SheetFileVersion{}).Error
+}
+
+// freezeLiveVersion turns the live version of a file, if it has one, into
+// a full snapshot. Every write that replaces cells without recording a
+// patch version calls it first.
+func freezeLiveVersion(tx *gorm.DB, fileID uint) error {
+	var live models.SheetFileVersion
+	if err := tx.Where("file_id = ? AND storage = ?", fileID, versionStorageLive).Limit(1).Find(&live).Error; err != nil {
+		return err
+	}
+	if live.ID == 0 {
+		return nil
+	}
+	state, err := versionState(tx, &live)
+	if err != nil {
+		return err
+	}
+	return tx.Model(&live).Updates(map[string]any{"state": state, "storage": ""}).Error
+}
+
+// versionState returns the full state of a version. A live version reads
+// the file's cells; an undo version is rebuilt from the first newer version
+// that is not one by undoing the patches in between.
+func versionState(tx *gorm.DB, v *models.SheetFileVersion) (json.RawMessage, error) {
+	switch v.Storage {
+	case "":
+		return v.State, nil
+	case versionStorageLive:
+		file := models.SheetFile{ID: v.FileID, State: v.State}
+		if err := loadCells(tx, &file, -1, nil); err != nil {
+			return nil, err
+		}
+		return file.State, nil
+	}
+
+	var base models.SheetFileVersion
+	if err := tx.Where("file_id = ? AND version > ? AND storage <> ?", v.FileID, v.Version, versionStorageUndo).
+		Order("version").
+		First(&base).Error; err != nil {
+		return nil, err
+	}
+	var undos []models.SheetFileVersion
+	if err := tx.Where("file_id = ? AND version >= ? AND version < ?", v.FileID, v.Version, base.Version).
+		Order("version desc").
+		Find(&undos).Error; err != nil {
+		return nil, err
+	}
+
+	raw, err := versionState(tx, &base)
+	if err != nil {
+		return nil, err
+	}
+	state, err := DecodeState(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, undo := range undos {
+		if state, err = applyUndo(state, undo.State); err != nil {
+			return nil, err
+		}
+	}
+	next, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode file state: %w", err)
+	}
+	return next, nil
+}
+
+// applyUndo turns the state of a version into that of the version before,
+// given the undo the earlier one stores.
+func applyUndo(state *models.SheetState, raw json.RawMessage) (*models.SheetState, error) {
+	var undo versionUndo
+	if err := json.Unmarshal(raw, &undo); err != nil {
+		return nil, fmt.Errorf("failed to decode version: %w", err)
+	}
+	prev, err := DecodeState(undo.Layout)
+	if err != nil {
+		return nil, err
+	}
+	sheets, prevSheets := StateSheets(state), StateSheets(prev)
+	for index, sheet := range prevSheets {
+		if index < len(sheets) {
+			sheet.Data = sheets[index].Data
+		}
+		if sheet.Data == nil {
+			sheet.Data = map[string]models.CellData{}
+		}
+	}
+	for _, cell := range undo.Cells {
+		if cell.Sheet < 0 || cell.Sheet >= len(prevSheets) {
+			continue
+		}
+		id := fmt.Sprintf("%d,%d", cell.Row, cell.Col)
+		if cell.Cell == nil {
+			delete(prevSheets[cell.Sheet].Data, id)
+		} else {
+			prevSheets[cell.Sheet].Data[id] = *cell.Cell
+		}
+	}
+	return prev, nil
+}
+
+// ListVersions returns a file's versions, newest first, without their state.
+func (s *SpreadsheetService) ListVersions(fileID uint) ([]models.SheetFileVersion, error) {
+	var versions []models.SheetFileVersion
+	err := s.DB.Select("id", "file_id", "version", "source", "created_at").
+		Where("file_id = ?", fileID).
+		Order("version desc").
+		Find(&versions).Error
+	return versions, err
+}
+
+// GetVersion returns one version of a file including its state.
+func (s *SpreadsheetService) GetVersion(fileID uint, version int) (*models.SheetFileVersion, error) {
+	var v models.SheetFileVersion
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		// Patches rewrite the cells and versions a version may be rebuilt
+		// from.
+		if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Select("id").
+			Where("id = ?", fileID).
+			First(&models.SheetFile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ? AND version = ?", fileID, version).First(&v).Error; err != nil {
+			return err
+		}
+		state, err := versionState(tx, &v)
+		if err != nil {
+			return err
+		}
+		v.State = state
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// RestoreVersion makes a past version the file's current state. The restore
+// itself is recorded as a new version, so it can be undone the same way.
+// ifMatch works as in UpdateFile.
+func (s *SpreadsheetService) RestoreVersion(fileID uint, version int, ifMatch ...int64) (*models.SheetFile, error) {
+	var file models.SheetFile
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", fileID).
+			First(&file).Error; err != nil {
+			return err
+		}
+		if !revisionMatches(file.Revision, ifMatch) {
+			return ErrRevisionMismatch
+		}
+
+		var v models.SheetFileVersion
+		if err := tx.Where("file_id = ? AND version = ?", fileID, version).First(&v).Error; err != nil {
+			return err
+		}
+
+		state, err := versionState(tx, &v)
+		if err != nil {
+			return err
+		}
+		file.State = state
+		file.Revision++
+		if err := saveFile(tx, &file); err != nil {
+			return err
+		}
+		return s.recordVersion(tx, &file, VersionSourceRestore)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// DiffStates compares the raw cell values of two states sheet by sheet.
+// Sheets are matched by name; diffs come in the sheet order of after (then
+// sheets only before has), each sheet ordered by row then column.
+func DiffStates(before, after json.RawMessage) ([]CellValueDiff, error) {
+	beforeSheets, err := stateCellValues(before)
+	if err != nil {
+		return nil, err
+	}
+	afterSheets, err := stateCellValues(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []CellValueDiff{}
+	diffSheet := func(sheet string, beforeValues, afterValues map[string]string) {
+		start := len(diffs)
+		add := func(id string) {
+			b, a := beforeValues[id], afterValues[id]
+			if b == a {
+				return
+			}
+			row, col, ok := formula.ParseCellID(id)
+			if !ok {
+				return
+			}
+			diffs = append(diffs, CellValueDiff{Sheet: sheet, ID: id, Row: row, Col: col, Before: b, After: a})
+		}
+		for id := range beforeValues {
+			add(id)
+		}
+		for id := range afterValues {
+			if _, seen := beforeValues[id]; !seen {
+				add(id)
+			}
+		}
+
+		sheetDiffs := diffs[start:]
+		sort.Slice(sheetDiffs, func(i, j int) bool {
+			if sheetDiffs[i].Row != sheetDiffs[j].Row {
+				return sheetDiffs[i].Row < sheetDiffs[j].Row
+			}
+			return sheetDiffs[i].Col < sheetDiffs[j].Col
+		})
+	}
+
+	// The first sheet is matched by position, as renaming it keeps it first.
+	matched := map[int]bool{}
+	for i, sheet := range afterSheets {
+		var beforeValues map[string]string
+		for j, candidate := range beforeSheets {
+			same := i == 0 && j == 0
+			if i > 0 && j > 0 {
+				same = strings.EqualFold(candidate.name, sheet.name)
+			}
+			if same && !matched[j] {
+				beforeValues = candidate.values
+				matched[j] = true
+				break
+			}
+		}
+		diffSheet(sheet.name, beforeValues, sheet.values)
+	}
+	for j, sheet := range beforeSheets {
+		if !matched[j] {
+			diffSheet(sheet.name, sheet.values, nil)
+		}
+	}
+	return diffs, nil
+}
+
+// sheetCellValues holds the raw cell values of one sheet by "row,col"; the
+// first sheet of a state has no name.
+type sheetCellValues struct {
+	name   string
+	values map[string]string
+}
+
+// stateCellValues reads the raw cell values of every sheet of a state.
+func stateCellValues(state json.RawMessage) ([]sheetCellValues, error) {
+	type sheetData struct {
+		Name string                    `json:"name"`
+		Data map[string]map[string]any `json:"data"`
+	}
+	var decoded struct {
+		sheetData
+		Sheets []sheetData `json:"sheets"`
+	}
+	if len(state) > 0 {
+		if err := json.Unmarshal(state, &decoded); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+		}
+	}
+	decoded.Name = ""
+	sheets := make([]sheetCellValues, 0, len(decoded.Sheets)+1)
+	for _, sheet := range append([]sheetData{decoded.sheetData}, decoded.Sheets...) {
+		values := make(map[string]string, len(sheet.Data))
+		for id, cell := range sheet.Data {
+			values[id] = formula.CellRawValue(cell)
+		}
+		sheets = append(sheets, sheetCellValues{name: sheet.Name, values: values})
+	}
+	return sheets, nil
+}
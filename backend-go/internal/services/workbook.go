@@ -0,0 +1,501 @@
+package services
+
+import (
+	"converter-backend/internal/formula"
+	"converter-backend/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// A file state is a workbook. Its first sheet lives in the top-level fields
+// the editor already understands (data, columnWidths, rowHeights, rowCount,
+// freezePosition, mergedCells) and is named by "sheetName". Further sheets
+// are objects with the same fields plus "name" in the "sheets" array:
+//
+//	{"sheetName": "Sheet1", "data": {...}, "sheets": [{"name": "Q2", "data": {...}}]}
+//
+// Sheet names are matched case-insensitively, as in Excel.
+
+// DefaultSheetName names the first sheet of states without "sheetName".
+const DefaultSheetName = "Sheet1"
+
+// ErrSheetNotFound is returned when a request names a sheet the workbook does not have.
+var ErrSheetNotFound = errors.New("sheet not found")
+
+// WorkbookSheet is one worksheet read by an importer.
+type WorkbookSheet struct {
+	Name string
+	Rows [][]string
+}
+
+// SheetNames lists the sheets of a decoded state in order.
+func SheetNames(state map[string]any) []string {
+	names := []string{firstSheetName(state)}
+	for _, sheet := range extraSheets(state) {
+		name, _ := sheet["name"].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+// FindSheet returns the sheet called name and its name as stored; "" selects
+// the first sheet, which is the state itself. The returned map is shared
+// with state.
+func FindSheet(state map[string]any, name string) (map[string]any, string, error) {
+	index, err := sheetIndex(state, name)
+	if err != nil {
+		return nil, "", err
+	}
+	if index == 0 {
+		return state, firstSheetName(state), nil
+	}
+	sheet := extraSheets(state)[index-1]
+	stored, _ := sheet["name"].(string)
+	return sheet, stored, nil
+}
+
+// sheetIndex resolves a sheet name to its position; 0 is the first sheet.
+func sheetIndex(state map[string]any, name string) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.EqualFold(name, firstSheetName(state)) {
+		return 0, nil
+	}
+	for i, sheet := range extraSheets(state) {
+		if sheetName, _ := sheet["name"].(string); strings.EqualFold(sheetName, name) {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrSheetNotFound, name)
+}
+
+// DecodeState decodes a stored state into the editor's typed model.
+func DecodeState(raw json.RawMessage) (*models.SheetState, error) {
+	var state models.SheetState
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+		}
+	}
+	return &state, nil
+}
+
+// StateSheets lists the sheets of a typed state by index; 0 is the state
+// itself. The sheets are shared with state.
+func StateSheets(state *models.SheetState) []*models.Sheet {
+	sheets := make([]*models.Sheet, 0, len(state.Sheets)+1)
+	sheets = append(sheets, &state.Sheet)
+	for i := range state.Sheets {
+		sheets = append(sheets, &state.Sheets[i])
+	}
+	return sheets
+}
+
+// StateSheetNames lists the sheet names of a typed state in order.
+func StateSheetNames(state *models.SheetState) []string {
+	first := state.SheetName
+	if first == "" {
+		first = DefaultSheetName
+	}
+	names := []string{first}
+	for _, sheet := range state.Sheets {
+		names = append(names, sheet.Name)
+	}
+	return names
+}
+
+// LookupSheet is FindSheet for a typed state: it returns the sheet called
+// name, its index and its name as stored.
+func LookupSheet(state *models.SheetState, name string) (*models.Sheet, int, string, error) {
+	names := StateSheetNames(state)
+	name = strings.TrimSpace(name)
+	for index, stored := range names {
+		if (name == "" && index == 0) || strings.EqualFold(stored, name) {
+			return StateSheets(state)[index], index, stored, nil
+		}
+	}
+	return nil, 0, "", fmt.Errorf("%w: %s", ErrSheetNotFound, name)
+}
+
+// IsFirstSheet reports whether name addresses the first sheet of a stored state.
+func IsFirstSheet(state json.RawMessage, name string) bool {
+	if strings.TrimSpace(name) == "" {
+		return true
+	}
+	var decoded struct {
+		SheetName string `json:"sheetName"`
+	}
+	_ = json.Unmarshal(state, &decoded)
+	first := decoded.SheetName
+	if first == "" {
+		first = DefaultSheetName
+	}
+	return strings.EqualFold(strings.TrimSpace(name), first)
+}
+
+// SplitSheetRef splits an optional sheet prefix off an A1 reference:
+// "Sheet2!A1:B2" and "'Q2 2024'!A1" name a sheet, "A1:B2" does not.
+// Quotes inside a quoted name are doubled, as in Excel.
+func SplitSheetRef(ref string) (sheet, rest string) {
+	ref = strings.TrimSpace(ref)
+	idx := strings.LastIndex(ref, "!")
+	if idx < 0 {
+		return "", ref
+	}
+	sheet = strings.TrimSpace(ref[:idx])
+	if len(sheet) >= 2 && strings.HasPrefix(sheet, "'") && strings.HasSuffix(sheet, "'") {
+		sheet = strings.ReplaceAll(sheet[1:len(sheet)-1], "''", "'")
+	}
+	return sheet, strings.TrimSpace(ref[idx+1:])
+}
+
+// SheetRef is the inverse of SplitSheetRef: it prefixes an A1 reference
+// with a sheet name, quoted when the name is not a plain identifier.
+func SheetRef(sheet, a1 string) string {
+	plain := sheet != "" && !unicode.IsDigit(rune(sheet[0]))
+	for _, r := range sheet {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' {
+			plain = false
+			break
+		}
+	}
+	if !plain {
+		sheet = "'" + strings.ReplaceAll(sheet, "'", "''") + "'"
+	}
+	return sheet + "!" + a1
+}
+
+func firstSheetName(state map[string]any) string {
+	if name, _ := state["sheetName"].(string); name != "" {
+		return name
+	}
+	return DefaultSheetName
+}
+
+func extraSheets(state map[string]any) []map[string]any {
+	list, _ := state["sheets"].([]any)
+	sheets := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		if sheet, ok := item.(map[string]any); ok {
+			sheets = append(sheets, sheet)
+		}
+	}
+	return sheets
+}
+
+// recalculateWorkbook evaluates the formulas of every sheet. Formulas only
+// see cells of their own sheet.
+func recalculateWorkbook(state map[string]any) {
+	if data, ok := state["data"].(map[string]any); ok && len(data) > 0 {
+		formula.Recalculate(data)
+	}
+	for _, sheet := range extraSheets(state) {
+		if data, ok := sheet["data"].(map[string]any); ok && len(data) > 0 {
+			formula.Recalculate(data)
+		}
+	}
+}
+
+// applyWorkbookEdits applies edits to the sheets they address and returns
+// the IDs of the edited cells by sheet index, for the caller to recalculate.
+func applyWorkbookEdits(state *models.SheetState, edits []CellEdit) (map[int][]string, error) {
+	bySheet := map[int][]CellEdit{}
+	for _, edit := range edits {
+		_, index, _, err := LookupSheet(state, edit.Sheet)
+		if err != nil {
+			return nil, err
+		}
+		bySheet[index] = append(bySheet[index], edit)
+	}
+
+	sheets := StateSheets(state)
+	changed := make(map[int][]string, len(bySheet))
+	for index, sheetEdits := range bySheet {
+		changed[index] = applyCellEdits(sheets[index], sheetEdits)
+	}
+	return changed, nil
+}
+
+// keepSheets carries the further sheets (and the first sheet's name) and
+// the named ranges of a stored state over to an incoming one that does not
+// mention them, so a client that only edits the first sheet does not delete
+// the others. A client deletes sheets by sending "sheets": [].
+func keepSheets(stored, incoming json.RawMessage) (json.RawMessage, error) {
+	var next map[string]json.RawMessage
+	if err := json.Unmarshal(incoming, &next); err != nil || next == nil {
+		return incoming, nil
+	}
+	var prev map[string]json.RawMessage
+	if err := json.Unmarshal(stored, &prev); err != nil || prev == nil {
+		return incoming, nil
+	}
+
+	changed := false
+	for _, key := range []string{"sheets", "sheetName", "names"} {
+		if _, ok := next[key]; ok {
+			continue
+		}
+		if v, ok := prev[key]; ok {
+			next[key] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return incoming, nil
+	}
+	return json.Marshal(next)
+}
+
+// NewWorkbookState builds a file state from imported sheets. Every row
+// becomes a state row and cells keep their text as raw value; formulas are
+// evaluated when the state is saved.
+func NewWorkbookState(sheets []WorkbookSheet) map[string]any {
+	if len(sheets) == 0 {
+		sheets = []WorkbookSheet{{Name: DefaultSheetName}}
+	}
+
+	names := make([]string, 0, len(sheets))
+	built := make([]map[string]any, 0, len(sheets))
+	for _, ws := range sheets {
+		data := map[string]any{}
+		for r, row := range ws.Rows {
+			for c, value := range row {
+				if value == "" {
+					continue
+				}
+				data[fmt.Sprintf("%d,%d", r, c)] = map[string]any{"value": value}
+			}
+		}
+		names = append(names, ws.Name)
+		built = append(built, map[string]any{
+			"data":         data,
+			"columnWidths": map[string]any{},
+			"rowHeights":   map[string]any{},
+			"rowCount":     max(len(ws.Rows), editorRowCount),
+		})
+	}
+	return assembleWorkbook(names, built)
+}
+
+// editorRowCount is the row count the editor starts new sheets with.
+const editorRowCount = 100
+
+// assembleWorkbook lays out built sheets as a state: the first one becomes
+// the top level, the rest go to "sheets" with their names.
+func assembleWorkbook(names []string, sheets []map[string]any) map[string]any {
+	state := sheets[0]
+	state["activeCell"] = map[string]any{"row": 0, "col": 0}
+	state["selection"] = nil
+	state["sheetName"] = names[0]
+
+	if len(sheets) > 1 {
+		rest := make([]any, 0, len(sheets)-1)
+		for i, sheet := range sheets[1:] {
+			sheet["name"] = names[i+1]
+			rest = append(rest, sheet)
+		}
+		state["sheets"] = rest
+	}
+	return state
+}
+
+// ReadWorkbook reads every worksheet of a spreadsheet file on disk into
+// memory. Large files should be read row by row with OpenWorkbook.
+func ReadWorkbook(path, filename string, csvOpts CSVOptions) ([]WorkbookSheet, error) {
+	return readWorkbook(path, filename, csvOpts, nil)
+}
+
+func readWorkbook(path, filename string, csvOpts CSVOptions, rows *rowCounter) ([]WorkbookSheet, error) {
+	wb, err := OpenWorkbook(path, filename, csvOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer wb.Close()
+
+	sheets := make([]WorkbookSheet, 0, len(wb.Sheets))
+	for i, name := range wb.Sheets {
+		sheet := WorkbookSheet{Name: name}
+		if err := wb.EachRow(i, func(row []string) error {
+			sheet.Rows = append(sheet.Rows, row)
+			rows.add(1)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		sheets = append(sheets, sheet)
+	}
+	return sheets, nil
+}
+
+// WorkbookReader streams the rows of a spreadsheet file without loading a
+// whole sheet. excelize keeps worksheets above its XML size limit in temp
+// files, so memory stays bounded by the widest row. Legacy .xls files are
+// the exception: BIFF8 is read whole, which its 65536-row limit keeps small.
+type WorkbookReader struct {
+	Sheets []string
+
+	path     string
+	filename string
+	csvOpts  CSVOptions
+	ods      bool
+	xls      []xlsSheet
+	xlsx     *excelize.File
+	onClose  func()
+}
+
+// OpenWorkbook opens a spreadsheet file on disk. filename picks the format by
+// extension; CSV and TSV files have one sheet and are parsed with csvOpts.
+func OpenWorkbook(path, filename string, csvOpts CSVOptions) (*WorkbookReader, error) {
+	wb, err := openWorkbook(path, filename, csvOpts)
+	if err != nil {
+		return nil, err
+	}
+	wb.filename = filename
+	return wb, nil
+}
+
+func openWorkbook(path, filename string, csvOpts CSVOptions) (*WorkbookReader, error) {
+	if isDelimitedFile(filename) {
+		if csvOpts.Delimiter == 0 && strings.ToLower(filepath.Ext(filename)) == ".tsv" {
+			csvOpts.Delimiter = '\t'
+		}
+		return &WorkbookReader{Sheets: []string{DefaultSheetName}, path: path, csvOpts: csvOpts}, nil
+	}
+	if isODSFile(filename) {
+		names, err := odsSheetNames(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			names = []string{DefaultSheetName}
+		}
+		return &WorkbookReader{Sheets: names, path: path, ods: true}, nil
+	}
+	if strings.ToLower(filepath.Ext(filename)) == ".xls" && isOLEFile(path) {
+		sheets, err := readXLS(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(sheets) == 0 {
+			sheets = []xlsSheet{{name: DefaultSheetName}}
+		}
+		names := make([]string, 0, len(sheets))
+		for _, s := range sheets {
+			names = append(names, s.name)
+		}
+		return &WorkbookReader{Sheets: names, path: path, xls: sheets}, nil
+	}
+
+	f, err := excelize.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &WorkbookReader{Sheets: f.GetSheetList(), path: path, xlsx: f}, nil
+}
+
+// EachRow calls fn with every row of the sheet at index, in order. Empty rows
+// between data come through as nil; trailing empty rows are dropped, as
+// excelize's GetRows does.
+func (w *WorkbookReader) EachRow(index int, fn func(row []string) error) error {
+	if index < 0 || index >= len(w.Sheets) {
+		return fmt.Errorf("%w: #%d", ErrSheetNotFound, index)
+	}
+	if w.ods {
+		return odsEachRow(w.path, index, fn)
+	}
+	if w.xls != nil {
+		for _, row := range w.xls[index].rows {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if w.xlsx == nil {
+		return w.eachCSVRow(fn)
+	}
+
+	name := w.Sheets[index]
+	rows, err := w.xlsx.Rows(name)
+	if err != nil {
+		return fmt.Errorf("failed to read sheet %q: %w", name, err)
+	}
+	defer rows.Close()
+
+	pendingEmpty := 0
+	for rows.Next() {
+		row, err := rows.Columns()
+		if err != nil {
+			return fmt.Errorf("failed to read sheet %q: %w", name, err)
+		}
+		if len(row) == 0 {
+			pendingEmpty++
+			continue
+		}
+		for ; pendingEmpty > 0; pendingEmpty-- {
+			if err := fn(nil); err != nil {
+				return err
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Error()
+}
+
+func (w *WorkbookReader) eachCSVRow(fn func(row []string) error) error {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader, err := NewCSVReader(f, w.csvOpts)
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// Close releases the workbook and runs the cleanup registered by its opener.
+func (w *WorkbookReader) Close() error {
+	var err error
+	if w.xlsx != nil {
+		err = w.xlsx.Close()
+	}
+	if w.onClose != nil {
+		w.onClose()
+	}
+	return err
+}
+
+func isDelimitedFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv", ".tsv", ".txt":
+		return true
+	}
+	return false
+}
+
+func isODSFile(filename string) bool {
+	return strings.ToLower(filepath.Ext(filename)) == ".ods"
+}
@@ -0,0 +1,542 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/richardlehane/mscfb"
+	"github.com/xuri/excelize/v2"
+)
+
+// Legacy .xls files are OLE2 compound documents whose "Workbook" stream
+// holds BIFF8 records: a globals substream (sheet list, shared strings,
+// number formats) followed by one substream per sheet. Formulas are read as
+// their cached results; Excel 95 (BIFF5) files are not supported.
+
+const (
+	biffBOF        = 0x0809
+	biffEOF        = 0x000A
+	biffContinue   = 0x003C
+	biffFilePass   = 0x002F
+	biffDateMode   = 0x0022
+	biffBoundSheet = 0x0085
+	biffSST        = 0x00FC
+	biffFormat     = 0x041E
+	biffXF         = 0x00E0
+	biffLabelSST   = 0x00FD
+	biffLabel      = 0x0204
+	biffRK         = 0x027E
+	biffMulRK      = 0x00BD
+	biffNumber     = 0x0203
+	biffBoolErr    = 0x0205
+	biffFormula    = 0x0006
+	biffString     = 0x0207
+	biffMergeCells = 0x00E5
+
+	biffVersion8 = 0x0600
+
+	// biffMaxCols is the width of a BIFF8 sheet (A:IV); its rows fit the
+	// 16-bit row field.
+	biffMaxCols = 256
+)
+
+var oleSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// xlsSheet is a worksheet read from a BIFF8 workbook.
+type xlsSheet struct {
+	name   string
+	rows   [][]string
+	merged []any
+}
+
+// set stores a cell value. Cells past the last BIFF8 column are dropped
+// rather than grown into, so a crafted record cannot allocate a huge row.
+func (s *xlsSheet) set(row, col int, value string) {
+	if value == "" || col < 0 || col >= biffMaxCols {
+		return
+	}
+	for len(s.rows) <= row {
+		s.rows = append(s.rows, nil)
+	}
+	for len(s.rows[row]) <= col {
+		s.rows[row] = append(s.rows[row], "")
+	}
+	s.rows[row][col] = value
+}
+
+// biffGlobals is what cell records refer to.
+type biffGlobals struct {
+	sst      []string
+	formats  map[uint16]string
+	xfFormat []uint16
+	date1904 bool
+	isDate   map[uint16]bool
+}
+
+// isOLEFile reports whether the file at path is an OLE2 compound document.
+func isOLEFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(oleSignature))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return bytes.Equal(head, oleSignature)
+}
+
+// readXLS reads every worksheet of a BIFF8 .xls file.
+func readXLS(path string) ([]xlsSheet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc, err := mscfb.New(f)
+	if err != nil {
+		return nil, err
+	}
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		switch entry.Name {
+		case "Workbook":
+			stream, err := io.ReadAll(entry)
+			if err != nil {
+				return nil, err
+			}
+			return parseBIFF(stream)
+		case "Book":
+			return nil, errors.New("Excel 95 (BIFF5) workbooks are not supported")
+		}
+	}
+	return nil, errors.New("no workbook stream in file")
+}
+
+// biffRecordAt returns the record at off and the offset of the next one.
+func biffRecordAt(stream []byte, off int) (typ uint16, data []byte, next int, ok bool) {
+	if off < 0 || off+4 > len(stream) {
+		return 0, nil, 0, false
+	}
+	typ = binary.LittleEndian.Uint16(stream[off:])
+	size := int(binary.LittleEndian.Uint16(stream[off+2:]))
+	next = off + 4 + size
+	if next > len(stream) {
+		return 0, nil, 0, false
+	}
+	return typ, stream[off+4 : next], next, true
+}
+
+// biffContinued collects data and the CONTINUE records after it.
+func biffContinued(stream []byte, data []byte, next int) ([][]byte, int) {
+	segs := [][]byte{data}
+	for {
+		typ, cont, after, ok := biffRecordAt(stream, next)
+		if !ok || typ != biffContinue {
+			return segs, next
+		}
+		segs = append(segs, cont)
+		next = after
+	}
+}
+
+func parseBIFF(stream []byte) ([]xlsSheet, error) {
+	typ, data, off, ok := biffRecordAt(stream, 0)
+	if !ok || typ != biffBOF || len(data) < 4 {
+		return nil, errors.New("not a BIFF workbook")
+	}
+	if binary.LittleEndian.Uint16(data) != biffVersion8 {
+		return nil, errors.New("only BIFF8 (Excel 97-2003) workbooks are supported")
+	}
+
+	g := &biffGlobals{formats: map[uint16]string{}, isDate: map[uint16]bool{}}
+	type boundSheet struct {
+		name   string
+		offset int
+	}
+	var bound []boundSheet
+
+	for {
+		typ, data, next, ok := biffRecordAt(stream, off)
+		if !ok {
+			return nil, errors.New("truncated workbook globals")
+		}
+		off = next
+		switch typ {
+		case biffEOF:
+		case biffFilePass:
+			return nil, errors.New("encrypted workbooks are not supported")
+		case biffDateMode:
+			g.date1904 = len(data) >= 2 && binary.LittleEndian.Uint16(data) == 1
+		case biffBoundSheet:
+			// Only worksheets; charts and macro sheets have no cells.
+			if len(data) < 8 || data[5] != 0 {
+				continue
+			}
+			r := biffReader{segs: [][]byte{data[6:]}}
+			name, ok := r.str(1)
+			if !ok {
+				return nil, errors.New("invalid sheet record")
+			}
+			bound = append(bound, boundSheet{name: name, offset: int(binary.LittleEndian.Uint32(data))})
+		case biffSST:
+			var segs [][]byte
+			segs, off = biffContinued(stream, data, next)
+			r := biffReader{segs: segs}
+			header, ok := r.bytes(8)
+			if !ok {
+				return nil, errors.New("invalid shared string table")
+			}
+			unique := int(binary.LittleEndian.Uint32(header[4:]))
+			g.sst = make([]string, 0, min(unique, 1<<16))
+			for len(g.sst) < unique {
+				s, ok := r.str(2)
+				if !ok {
+					break
+				}
+				g.sst = append(g.sst, s)
+			}
+		case biffFormat:
+			if len(data) < 2 {
+				continue
+			}
+			r := biffReader{segs: [][]byte{data[2:]}}
+			if s, ok := r.str(2); ok {
+				g.formats[binary.LittleEndian.Uint16(data)] = s
+			}
+		case biffXF:
+			if len(data) >= 4 {
+				g.xfFormat = append(g.xfFormat, binary.LittleEndian.Uint16(data[2:]))
+			}
+		}
+		if typ == biffEOF {
+			break
+		}
+	}
+
+	sheets := make([]xlsSheet, 0, len(bound))
+	for _, b := range bound {
+		sheet, err := parseBIFFSheet(stream, b.offset, g)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sheet %q: %w", b.name, err)
+		}
+		sheet.name = b.name
+		sheets = append(sheets, sheet)
+	}
+	return sheets, nil
+}
+
+func parseBIFFSheet(stream []byte, off int, g *biffGlobals) (xlsSheet, error) {
+	var sheet xlsSheet
+	typ, _, off, ok := biffRecordAt(stream, off)
+	if !ok || typ != biffBOF {
+		return sheet, errors.New("sheet does not start with BOF")
+	}
+
+	// A formula with a string result is followed by a STRING record.
+	pendingRow, pendingCol := -1, -1
+	depth := 0
+	for {
+		typ, data, next, ok := biffRecordAt(stream, off)
+		if !ok {
+			return sheet, errors.New("truncated sheet")
+		}
+		off = next
+
+		switch {
+		case typ == biffBOF:
+			depth++ // embedded chart
+			continue
+		case typ == biffEOF && depth > 0:
+			depth--
+			continue
+		case typ == biffEOF:
+			return sheet, nil
+		case depth > 0:
+			continue
+		case typ == biffMergeCells:
+			if len(data) < 2 {
+				continue
+			}
+			n := int(binary.LittleEndian.Uint16(data))
+			for i := 0; i < n && 2+i*8+8 <= len(data); i++ {
+				ref := data[2+i*8:]
+				if binary.LittleEndian.Uint16(ref[6:]) >= biffMaxCols {
+					continue
+				}
+				sheet.merged = append(sheet.merged, map[string]any{
+					"startRow": int(binary.LittleEndian.Uint16(ref)),
+					"endRow":   int(binary.LittleEndian.Uint16(ref[2:])),
+					"startCol": int(binary.LittleEndian.Uint16(ref[4:])),
+					"endCol":   int(binary.LittleEndian.Uint16(ref[6:])),
+				})
+			}
+			continue
+		case typ == biffString:
+			if pendingRow >= 0 {
+				var segs [][]byte
+				segs, off = biffContinued(stream, data, next)
+				r := biffReader{segs: segs}
+				if s, ok := r.str(2); ok {
+					sheet.set(pendingRow, pendingCol, s)
+				}
+				pendingRow, pendingCol = -1, -1
+			}
+			continue
+		case len(data) < 6:
+			continue
+		}
+
+		row := int(binary.LittleEndian.Uint16(data))
+		col := int(binary.LittleEndian.Uint16(data[2:]))
+		xf := binary.LittleEndian.Uint16(data[4:])
+		switch typ {
+		case biffLabelSST:
+			if len(data) >= 10 {
+				if i := int(binary.LittleEndian.Uint32(data[6:])); i < len(g.sst) {
+					sheet.set(row, col, g.sst[i])
+				}
+			}
+		case biffLabel:
+			r := biffReader{segs: [][]byte{data[6:]}}
+			if s, ok := r.str(2); ok {
+				sheet.set(row, col, s)
+			}
+		case biffNumber:
+			if len(data) >= 14 {
+				sheet.set(row, col, g.number(xf, math.Float64frombits(binary.LittleEndian.Uint64(data[6:]))))
+			}
+		case biffRK:
+			if len(data) >= 10 {
+				sheet.set(row, col, g.number(xf, biffRKValue(binary.LittleEndian.Uint32(data[6:]))))
+			}
+		case biffMulRK:
+			for i := 4; i+6 <= len(data)-2 && col < biffMaxCols; i += 6 {
+				cellXF := binary.LittleEndian.Uint16(data[i:])
+				sheet.set(row, col, g.number(cellXF, biffRKValue(binary.LittleEndian.Uint32(data[i+2:]))))
+				col++
+			}
+		case biffBoolErr:
+			if len(data) >= 8 {
+				sheet.set(row, col, biffBoolErrValue(data[6], data[7]))
+			}
+		case biffFormula:
+			if len(data) < 14 {
+				continue
+			}
+			result := data[6:14]
+			if result[6] != 0xFF || result[7] != 0xFF {
+				sheet.set(row, col, g.number(xf, math.Float64frombits(binary.LittleEndian.Uint64(result))))
+				continue
+			}
+			switch result[0] {
+			case 0:
+				pendingRow, pendingCol = row, col
+			case 1:
+				sheet.set(row, col, biffBoolErrValue(result[2], 0))
+			case 2:
+				sheet.set(row, col, biffBoolErrValue(result[2], 1))
+			}
+		}
+	}
+}
+
+// number formats a numeric cell; date formats become ISO dates as in the
+// XLSX importer.
+func (g *biffGlobals) number(xf uint16, v float64) string {
+	if int(xf) < len(g.xfFormat) {
+		format := g.xfFormat[xf]
+		isDate, ok := g.isDate[format]
+		if !ok {
+			style := &excelize.Style{NumFmt: int(format)}
+			if custom, ok := g.formats[format]; ok {
+				style = &excelize.Style{CustomNumFmt: &custom}
+			}
+			isDate = isDateNumFmt(style)
+			g.isDate[format] = isDate
+		}
+		if isDate {
+			if s, ok := excelDateText(v, g.date1904); ok {
+				return s
+			}
+		}
+	}
+	if abs := math.Abs(v); abs != 0 && (abs >= 1e15 || abs < 1e-6) {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// biffRKValue decodes an RK number: a 30-bit integer or the high bits of a
+// double, optionally divided by 100.
+func biffRKValue(rk uint32) float64 {
+	var v float64
+	if rk&2 != 0 {
+		v = float64(int32(rk) >> 2)
+	} else {
+		v = math.Float64frombits(uint64(rk&^3) << 32)
+	}
+	if rk&1 != 0 {
+		v /= 100
+	}
+	return v
+}
+
+func biffBoolErrValue(value, isError byte) string {
+	if isError == 0 {
+		if value != 0 {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	switch value {
+	case 0x00:
+		return "#NULL!"
+	case 0x07:
+		return "#DIV/0!"
+	case 0x0F:
+		return "#VALUE!"
+	case 0x17:
+		return "#REF!"
+	case 0x1D:
+		return "#NAME?"
+	case 0x24:
+		return "#NUM!"
+	}
+	return "#N/A"
+}
+
+// biffReader reads a record together with its CONTINUE records. Values never
+// straddle records, except the characters of a string, which restart after
+// the break with a new flags byte.
+type biffReader struct {
+	segs [][]byte
+	seg  int
+	pos  int
+}
+
+func (r *biffReader) next() bool {
+	for r.seg < len(r.segs) && r.pos >= len(r.segs[r.seg]) {
+		r.seg++
+		r.pos = 0
+	}
+	return r.seg < len(r.segs)
+}
+
+func (r *biffReader) bytes(n int) ([]byte, bool) {
+	if !r.next() || r.pos+n > len(r.segs[r.seg]) {
+		return nil, false
+	}
+	b := r.segs[r.seg][r.pos : r.pos+n]
+	r.pos += n
+	return b, true
+}
+
+func (r *biffReader) skip(n int) bool {
+	for n > 0 {
+		if !r.next() {
+			return false
+		}
+		k := min(n, len(r.segs[r.seg])-r.pos)
+		r.pos += k
+		n -= k
+	}
+	return true
+}
+
+// str reads an XLUnicodeString whose character count takes cchBytes bytes.
+func (r *biffReader) str(cchBytes int) (string, bool) {
+	head, ok := r.bytes(cchBytes + 1)
+	if !ok {
+		return "", false
+	}
+	cch := int(head[0])
+	if cchBytes == 2 {
+		cch = int(binary.LittleEndian.Uint16(head))
+	}
+	flags := head[cchBytes]
+
+	runs, ext := 0, 0
+	if flags&0x08 != 0 {
+		b, ok := r.bytes(2)
+		if !ok {
+			return "", false
+		}
+		runs = int(binary.LittleEndian.Uint16(b))
+	}
+	if flags&0x04 != 0 {
+		b, ok := r.bytes(4)
+		if !ok {
+			return "", false
+		}
+		ext = int(binary.LittleEndian.Uint32(b))
+	}
+
+	wide := flags&0x01 != 0
+	units := make([]uint16, 0, cch)
+	for len(units) < cch {
+		if r.pos >= len(r.segs[r.seg]) {
+			r.seg, r.pos = r.seg+1, 0
+			b, ok := r.bytes(1)
+			if !ok {
+				return "", false
+			}
+			wide = b[0]&0x01 != 0
+		}
+		s := r.segs[r.seg][r.pos:]
+		if wide {
+			n := min(cch-len(units), len(s)/2)
+			if n == 0 {
+				return "", false
+			}
+			for i := 0; i < n; i++ {
+				units = append(units, binary.LittleEndian.Uint16(s[i*2:]))
+			}
+			r.pos += n * 2
+		} else {
+			n := min(cch-len(units), len(s))
+			for i := 0; i < n; i++ {
+				units = append(units, uint16(s[i]))
+			}
+			r.pos += n
+		}
+	}
+	if !r.skip(runs*4 + ext) {
+		return "", false
+	}
+	return string(utf16.Decode(units)), true
+}
+
+// readXLSState reads a .xls file into a workbook state: values, dates and
+// merged cells. BIFF styles and sizes are not carried over.
+func readXLSState(path string, counter *rowCounter) (map[string]any, error) {
+	sheets, err := readXLS(path)
+	if err != nil {
+		return nil, err
+	}
+	built := make([]WorkbookSheet, 0, len(sheets))
+	for _, s := range sheets {
+		built = append(built, WorkbookSheet{Name: s.name, Rows: s.rows})
+		counter.add(len(s.rows))
+	}
+	state := NewWorkbookState(built)
+	for i, s := range sheets {
+		if len(s.merged) == 0 {
+			continue
+		}
+		if i == 0 {
+			state["mergedCells"] = s.merged
+		} else {
+			extraSheets(state)[i-1]["mergedCells"] = s.merged
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,354 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"converter-backend/internal/formula"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// The XLSX importer reads cell values through excelize's row iterator, and
+// what excelize only offers per cell or per sheet (formulas, style IDs,
+// sizes, merges and panes) from one streaming pass over the worksheet XML
+// alongside it. Neither loads a whole worksheet into memory.
+
+// Sheet defaults as excelize reports them.
+const (
+	xlsxDefaultColWidth  = 9.140625
+	xlsxDefaultRowHeight = 15
+)
+
+// xlsxCellMeta is what a worksheet holds about a cell besides its value.
+type xlsxCellMeta struct {
+	formula string // without '='
+	styleID int
+}
+
+// xlsxRow is a <row> of a worksheet; row and columns are 1-based.
+type xlsxRow struct {
+	row       int
+	height    float64
+	hasHeight bool
+	cells     map[int]xlsxCellMeta
+}
+
+type xlsxColSpan struct {
+	min, max int
+	width    float64
+}
+
+type xlsxSharedFormula struct {
+	text     string
+	row, col int
+}
+
+// xlsxSheetStream reads a worksheet part row by row. The layout before
+// <sheetData> is read when it is opened, the merged cells after it once
+// the last row is read.
+type xlsxSheetStream struct {
+	d      *xml.Decoder
+	closer io.Closer
+	done   bool
+	row    int // last row read
+
+	defaultColWidth  float64
+	defaultRowHeight float64
+	cols             []xlsxColSpan
+	frozen           bool
+	xSplit, ySplit   int
+	merges           []string
+	shared           map[string]xlsxSharedFormula
+}
+
+// xlsxSheetParts maps the sheet names of an XLSX package onto their
+// worksheet parts, as the workbook and its relationships list them.
+func xlsxSheetParts(z *zip.Reader) (map[string]string, error) {
+	files := make(map[string]*zip.File, len(z.File))
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+	type relationships struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Type   string `xml:"Type,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	decode := func(name string, v any) error {
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("%s not found", name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return xml.NewDecoder(r).Decode(v)
+	}
+	resolve := func(base, target string) string {
+		if strings.HasPrefix(target, "/") {
+			return strings.TrimPrefix(target, "/")
+		}
+		return path.Join(path.Dir(base), target)
+	}
+
+	workbook := "xl/workbook.xml"
+	var root relationships
+	if decode("_rels/.rels", &root) == nil {
+		for _, rel := range root.Rels {
+			if strings.HasSuffix(rel.Type, "/officeDocument") {
+				workbook = resolve("", rel.Target)
+			}
+		}
+	}
+	var wb struct {
+		Sheets []struct {
+			Name string     `xml:"name,attr"`
+			Attr []xml.Attr `xml:",any,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decode(workbook, &wb); err != nil {
+		return nil, err
+	}
+	var rels relationships
+	if err := decode(path.Join(path.Dir(workbook), "_rels", path.Base(workbook)+".rels"), &rels); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string, len(rels.Rels))
+	for _, rel := range rels.Rels {
+		targets[rel.ID] = resolve(workbook, rel.Target)
+	}
+
+	parts := make(map[string]string, len(wb.Sheets))
+	for _, sheet := range wb.Sheets {
+		for _, a := range sheet.Attr {
+			if a.Name.Local == "id" {
+				parts[sheet.Name] = targets[a.Value]
+			}
+		}
+	}
+	return parts, nil
+}
+
+// openXLSXSheet opens a worksheet part and reads it up to its rows. A
+// missing part reads as an empty sheet.
+func openXLSXSheet(z *zip.Reader, part string) (*xlsxSheetStream, error) {
+	s := &xlsxSheetStream{
+		defaultColWidth:  xlsxDefaultColWidth,
+		defaultRowHeight: xlsxDefaultRowHeight,
+		shared:           map[string]xlsxSharedFormula{},
+	}
+	var file *zip.File
+	for _, f := range z.File {
+		if f.Name == part {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		s.done = true
+		return s, nil
+	}
+	r, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	s.d, s.closer = xml.NewDecoder(r), r
+
+	for {
+		tok, err := s.d.Token()
+		if err == io.EOF {
+			s.done = true
+			return s, nil
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		t, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch t.Name.Local {
+		case "sheetData":
+			return s, nil
+		case "pane":
+			s.frozen = xlsxAttr(t, "state") == "frozen"
+			s.xSplit = int(xlsxFloatAttr(t, "xSplit"))
+			s.ySplit = int(xlsxFloatAttr(t, "ySplit"))
+		case "sheetFormatPr":
+			if width := xlsxFloatAttr(t, "defaultColWidth"); width > 0 {
+				s.defaultColWidth = width
+			}
+			if xlsxAttr(t, "customHeight") == "1" || xlsxAttr(t, "customHeight") == "true" {
+				s.defaultRowHeight = xlsxFloatAttr(t, "defaultRowHeight")
+			}
+		case "col":
+			width := xlsxFloatAttr(t, "width")
+			lo, _ := strconv.Atoi(xlsxAttr(t, "min"))
+			hi, _ := strconv.Atoi(xlsxAttr(t, "max"))
+			if width > 0 && lo > 0 && hi >= lo {
+				s.cols = append(s.cols, xlsxColSpan{min: lo, max: hi, width: width})
+			}
+		}
+	}
+}
+
+func (s *xlsxSheetStream) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// colWidth returns the width of a 1-based column, as excelize's
+// GetColWidth does.
+func (s *xlsxSheetStream) colWidth(col int) float64 {
+	width := 0.0
+	for _, span := range s.cols {
+		if span.min <= col && col <= span.max {
+			width = span.width
+		}
+	}
+	if width == 0 {
+		return s.defaultColWidth
+	}
+	return width
+}
+
+// next reads the next <row>; ok is false after the last one.
+func (s *xlsxSheetStream) next() (row xlsxRow, ok bool, err error) {
+	for !s.done {
+		tok, err := s.d.Token()
+		if err == io.EOF {
+			s.done = true
+			break
+		}
+		if err != nil {
+			return row, false, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				return s.readRow(t)
+			case "mergeCell":
+				s.merges = append(s.merges, xlsxAttr(t, "ref"))
+			}
+		case xml.EndElement:
+			if t.Name.Local == "worksheet" {
+				s.done = true
+			}
+		}
+	}
+	return row, false, nil
+}
+
+// readRow consumes a <row> up to its end element.
+func (s *xlsxSheetStream) readRow(start xml.StartElement) (xlsxRow, bool, error) {
+	s.row++
+	if r, err := strconv.Atoi(xlsxAttr(start, "r")); err == nil && r > 0 {
+		s.row = r
+	}
+	row := xlsxRow{row: s.row, cells: map[int]xlsxCellMeta{}}
+	if ht := xlsxAttr(start, "ht"); ht != "" {
+		row.height, _ = strconv.ParseFloat(ht, 64)
+		row.hasHeight = true
+	}
+
+	col := 0
+	for {
+		tok, err := s.d.Token()
+		if err != nil {
+			return row, false, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "c" {
+				if err := s.d.Skip(); err != nil {
+					return row, false, err
+				}
+				continue
+			}
+			col++
+			if c, _, err := excelize.CellNameToCoordinates(xlsxAttr(t, "r")); err == nil {
+				col = c
+			}
+			meta, err := s.readCell(t, row.row, col)
+			if err != nil {
+				return row, false, err
+			}
+			if meta.formula != "" || meta.styleID != 0 {
+				row.cells[col] = meta
+			}
+		case xml.EndElement:
+			if t.Name.Local == "row" {
+				return row, true, nil
+			}
+		}
+	}
+}
+
+// readCell consumes a <c> and returns its formula and style. A cell of a
+// shared formula gets the formula of the shared range's first cell,
+// shifted as filling it down or across would.
+func (s *xlsxSheetStream) readCell(start xml.StartElement, row, col int) (xlsxCellMeta, error) {
+	var meta xlsxCellMeta
+	meta.styleID, _ = strconv.Atoi(xlsxAttr(start, "s"))
+	for {
+		tok, err := s.d.Token()
+		if err != nil {
+			return meta, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "f" {
+				if err := s.d.Skip(); err != nil {
+					return meta, err
+				}
+				continue
+			}
+			var text string
+			if err := s.d.DecodeElement(&text, &t); err != nil {
+				return meta, err
+			}
+			meta.formula = text
+			if xlsxAttr(t, "t") != "shared" {
+				continue
+			}
+			si := xlsxAttr(t, "si")
+			if text != "" {
+				s.shared[si] = xlsxSharedFormula{text: text, row: row, col: col}
+			} else if master, ok := s.shared[si]; ok {
+				shifted := formula.OffsetReferences("="+master.text, row-master.row, col-master.col)
+				meta.formula = strings.TrimPrefix(shifted, "=")
+			}
+		case xml.EndElement:
+			if t.Name.Local == "c" {
+				return meta, nil
+			}
+		}
+	}
+}
+
+func xlsxAttr(t xml.StartElement, local string) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func xlsxFloatAttr(t xml.StartElement, local string) float64 {
+	v, _ := strconv.ParseFloat(xlsxAttr(t, local), 64)
+	return v
+}
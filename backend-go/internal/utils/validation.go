@@ -25,7 +25,7 @@ func ValidateFile(file multipart.File) error {
 	contentType := http.DetectContentType(buffer)
 
 	// Magic numbers/signatures
-	// ZIP (xlsx is a zip): PK..
+	// ZIP (xlsx and ods are zips): PK..
 	isZip := bytes.HasPrefix(buffer, []byte{0x50, 0x4B, 0x03, 0x04})
 
 	// OLE2 (xls): D0 CF 11 E0
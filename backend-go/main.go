@@ -9,20 +9,16 @@ import (
 	"converter-backend/internal/models"
 	"converter-backend/internal/services"
 	"converter-backend/internal/utils"
-	"encoding/csv"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/xuri/excelize/v2"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -56,10 +52,24 @@ func main() {
 	// Initialize services
 	emailService := services.NewEmailService(&cfg.Email)
 	spreadsheetService := services.NewSpreadsheetService(cfg.DBConfig.DSN)
+	spreadsheetService.MaxVersionsPerFile = cfg.History.MaxVersionsPerFile
+	stateLimits := services.StateLimits{MaxCells: cfg.State.MaxCells, MaxValueLength: cfg.State.MaxValueLength}
+	spreadsheetService.StateLimits = stateLimits
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandlerWithEmail(db, emailService)
 	fileHandler := handlers.NewFileHandler(spreadsheetService)
+	fileHandler.MaxUploadSizeMB = cfg.FileUpload.MaxSizeMB
+	fileHandler.MaxJobUploadSizeMB = cfg.FileUpload.ConvertMaxSizeMB
+	fileHandler.StateLimits = stateLimits
+	jobQueue, err := services.NewJobQueue(spreadsheetService, cfg.Jobs.Dir, cfg.Jobs.Workers)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to initialize job queue: %v", err))
+		os.Exit(1)
+	}
+	fileHandler.Jobs = jobQueue
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	jobQueue.Start(jobsCtx)
 	aiHandler := handlers.NewAIHandlerWithDB(db)
 
 	// Initialize rate limiters
@@ -73,8 +83,8 @@ func main() {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     cfg.AllowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key"},
-		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "X-Db-Saved", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "If-Match"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "ETag", "Location", "X-Db-Saved", "X-Sheet-Names", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -114,16 +124,49 @@ func main() {
 			// File management
 			protected.GET("/files", fileHandler.List)
 			protected.POST("/files", fileHandler.Save)
+			protected.POST("/files/import", fileHandler.Import)
 			protected.GET("/files/:id", fileHandler.Get)
 			protected.DELETE("/files/:id", fileHandler.Delete)
 			protected.GET("/files/:id/cells", fileHandler.GetCells)
+			protected.GET("/files/:id/sheets", fileHandler.ListSheets)
 			protected.PATCH("/files/:id/cells", fileHandler.PatchCells)
 			protected.GET("/files/:id/schema", fileHandler.GetSchema)
+			protected.GET("/files/:id/records", fileHandler.GetRecords)
+			protected.GET("/files/:id/query", fileHandler.QueryRecords)
+			protected.POST("/files/:id/structure", fileHandler.ApplyStructure)
+			protected.POST("/files/:id/ranges/:a1/ops", fileHandler.ApplyRangeOp)
+			protected.PATCH("/files/:id/ranges/:a1/style", fileHandler.PatchRangeStyle)
+			protected.GET("/files/:id/names", fileHandler.ListNames)
+			protected.POST("/files/:id/names", fileHandler.CreateName)
+			protected.GET("/files/:id/names/:name", fileHandler.GetName)
+			protected.PUT("/files/:id/names/:name", fileHandler.UpdateName)
+			protected.DELETE("/files/:id/names/:name", fileHandler.DeleteName)
+			protected.POST("/sql", fileHandler.QuerySQL)
+			protected.POST("/files/:id/records", fileHandler.AppendRecords)
+			protected.PUT("/files/:id/records", fileHandler.UpsertRecords)
+			protected.DELETE("/files/:id/records", fileHandler.DeleteRecords)
+			protected.GET("/files/:id/export", fileHandler.Export)
+			protected.GET("/files/:id/versions", fileHandler.ListVersions)
+			protected.GET("/files/:id/versions/diff", fileHandler.DiffVersions)
+			protected.GET("/files/:id/versions/:version", fileHandler.GetVersion)
+			protected.POST("/files/:id/versions/:version/restore", fileHandler.RestoreVersion)
+			protected.GET("/files/:id/branches", fileHandler.ListBranches)
+			protected.POST("/files/:id/branches", fileHandler.CreateBranch)
+			protected.GET("/files/:id/branches/:branch", fileHandler.GetBranch)
+			protected.DELETE("/files/:id/branches/:branch", fileHandler.DeleteBranch)
+			protected.GET("/files/:id/branches/:branch/cells", fileHandler.GetBranchCells)
+			protected.PATCH("/files/:id/branches/:branch/cells", fileHandler.PatchBranchCells)
+			protected.POST("/files/:id/branches/:branch/merge", fileHandler.MergeBranch)
 			protected.POST("/files/:id/realtime/token", fileHandler.FileRealtimeToken)
 			protected.GET("/files/:id/shares", fileHandler.ListShares)
 			protected.POST("/files/:id/shares", fileHandler.CreateShare)
 			protected.DELETE("/files/:id/shares/:userId", fileHandler.DeleteShare)
 
+			// Background imports
+			protected.POST("/jobs/import", fileHandler.CreateImportJob)
+			protected.GET("/jobs/:id", fileHandler.GetJob)
+			protected.GET("/jobs/:id/download", fileHandler.DownloadJobResult)
+
 			// AI endpoints
 			protected.GET("/ai/gemini-key", aiHandler.GetGeminiAPIKey)
 			protected.POST("/ai/gemini-key", aiHandler.SetGeminiAPIKey)
@@ -146,27 +189,58 @@ func main() {
 		legacyProtected.GET("/me", authHandler.Me)
 		legacyProtected.GET("/files", fileHandler.List)
 		legacyProtected.POST("/files", fileHandler.Save)
+		legacyProtected.POST("/files/import", fileHandler.Import)
 		legacyProtected.GET("/files/:id", fileHandler.Get)
 		legacyProtected.DELETE("/files/:id", fileHandler.Delete)
 		legacyProtected.POST("/realtime/token", authHandler.GenerateRealtimeToken)
 		legacyProtected.GET("/files/:id/cells", fileHandler.GetCells)
+		legacyProtected.GET("/files/:id/sheets", fileHandler.ListSheets)
 		legacyProtected.PATCH("/files/:id/cells", fileHandler.PatchCells)
 		legacyProtected.POST("/files/:id/realtime/token", fileHandler.FileRealtimeToken)
 		legacyProtected.GET("/files/:id/schema", fileHandler.GetSchema)
+		legacyProtected.GET("/files/:id/records", fileHandler.GetRecords)
+		legacyProtected.GET("/files/:id/query", fileHandler.QueryRecords)
+		legacyProtected.POST("/files/:id/structure", fileHandler.ApplyStructure)
+		legacyProtected.POST("/files/:id/ranges/:a1/ops", fileHandler.ApplyRangeOp)
+		legacyProtected.PATCH("/files/:id/ranges/:a1/style", fileHandler.PatchRangeStyle)
+		legacyProtected.GET("/files/:id/names", fileHandler.ListNames)
+		legacyProtected.POST("/files/:id/names", fileHandler.CreateName)
+		legacyProtected.GET("/files/:id/names/:name", fileHandler.GetName)
+		legacyProtected.PUT("/files/:id/names/:name", fileHandler.UpdateName)
+		legacyProtected.DELETE("/files/:id/names/:name", fileHandler.DeleteName)
+		legacyProtected.POST("/sql", fileHandler.QuerySQL)
+		legacyProtected.POST("/files/:id/records", fileHandler.AppendRecords)
+		legacyProtected.PUT("/files/:id/records", fileHandler.UpsertRecords)
+		legacyProtected.DELETE("/files/:id/records", fileHandler.DeleteRecords)
+		legacyProtected.GET("/files/:id/export", fileHandler.Export)
+		legacyProtected.GET("/files/:id/versions", fileHandler.ListVersions)
+		legacyProtected.GET("/files/:id/versions/diff", fileHandler.DiffVersions)
+		legacyProtected.GET("/files/:id/versions/:version", fileHandler.GetVersion)
+		legacyProtected.POST("/files/:id/versions/:version/restore", fileHandler.RestoreVersion)
+		legacyProtected.GET("/files/:id/branches", fileHandler.ListBranches)
+		legacyProtected.POST("/files/:id/branches", fileHandler.CreateBranch)
+		legacyProtected.GET("/files/:id/branches/:branch", fileHandler.GetBranch)
+		legacyProtected.DELETE("/files/:id/branches/:branch", fileHandler.DeleteBranch)
+		legacyProtected.GET("/files/:id/branches/:branch/cells", fileHandler.GetBranchCells)
+		legacyProtected.PATCH("/files/:id/branches/:branch/cells", fileHandler.PatchBranchCells)
+		legacyProtected.POST("/files/:id/branches/:branch/merge", fileHandler.MergeBranch)
 		legacyProtected.GET("/files/:id/shares", fileHandler.ListShares)
 		legacyProtected.POST("/files/:id/shares", fileHandler.CreateShare)
 		legacyProtected.DELETE("/files/:id/shares/:userId", fileHandler.DeleteShare)
+		legacyProtected.POST("/jobs/import", fileHandler.CreateImportJob)
+		legacyProtected.GET("/jobs/:id", fileHandler.GetJob)
+		legacyProtected.GET("/jobs/:id/download", fileHandler.DownloadJobResult)
 	}
 
 	// File conversion endpoint (can be used with or without auth)
 	r.POST("/convert", func(c *gin.Context) {
 		// Check file size before processing
-		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.FileUpload.MaxSizeMB*1024*1024)
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.FileUpload.ConvertMaxSizeMB*1024*1024)
 
 		file, header, err := c.Request.FormFile("file")
 		if err != nil {
 			if err.Error() == "http: request body too large" {
-				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large. Maximum size is %dMB", cfg.FileUpload.MaxSizeMB)})
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large. Maximum size is %dMB", cfg.FileUpload.ConvertMaxSizeMB)})
 				return
 			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
@@ -176,7 +250,7 @@ func main() {
 
 		// Validate file type
 		if err := utils.ValidateFile(file); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file type. Only Excel (.xlsx, .xls) and CSV files are allowed"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file type. Only Excel (.xlsx, .xls), OpenDocument (.ods) and CSV files are allowed"})
 			return
 		}
 
@@ -200,54 +274,25 @@ func main() {
 		}
 		tmpFile.Close()
 
-		ext := strings.ToLower(filepath.Ext(filename))
-		var rows [][]string
-
-		if ext == ".csv" {
-			rows, err = readCSVRows(tmpFile.Name())
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to read CSV file: %v", err))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse CSV file"})
-				return
-			}
-		} else {
-			// Open Excel file
-			f, err := excelize.OpenFile(tmpFile.Name())
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to open Excel file: %v", err))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse Excel file"})
-				return
-			}
-			defer f.Close()
-
-			// Get rows
-			sheetName := f.GetSheetName(0)
-			rows, err = f.GetRows(sheetName)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to read rows: %v", err))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read Excel data"})
-				return
-			}
+		csvOpts, err := services.ParseCSVOptions(
+			c.DefaultPostForm("delimiter", c.Query("delimiter")),
+			c.DefaultPostForm("quote", c.Query("quote")),
+			c.DefaultPostForm("encoding", c.Query("encoding")),
+		)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
-		// Set headers for CSV download
-		c.Header("Content-Description", "File Transfer")
-		c.Header("Content-Transfer-Encoding", "binary")
-		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", filename))
-		c.Header("Content-Type", "text/csv")
-		c.Header("X-Db-Saved", "true")
-
-		// Stream CSV response
-		writer := csv.NewWriter(c.Writer)
-		for _, row := range rows {
-			if err := writer.Write(row); err != nil {
-				logger.Error(fmt.Sprintf("Error writing CSV row: %v", err))
-				return
-			}
+		wb, err := services.OpenWorkbook(tmpFile.Name(), filename, csvOpts)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to read workbook: %v", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse file"})
+			return
 		}
-		writer.Flush()
+		defer wb.Close()
 
-		logger.Info(fmt.Sprintf("Successfully converted file: %s (%d rows)", filename, len(rows)))
+		handlers.WriteConversion(c, wb, filename)
 	})
 
 	// Create HTTP server
@@ -280,6 +325,11 @@ func main() {
 		logger.Error(fmt.Sprintf("Server forced to shutdown: %v", err))
 	}
 
+	// Let running jobs finish; ones cut off by a forced stop are queued
+	// again on the next start.
+	stopJobs()
+	jobQueue.Wait()
+
 	logger.Info("Server stopped gracefully")
 }
 
@@ -313,34 +363,10 @@ func initDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
 	}
 
 	// Auto migrate schema
-	if err := db.AutoMigrate(&models.User{}, &models.SpreadsheetData{}, &models.SheetFile{}, &models.SheetFileShare{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.SpreadsheetData{}, &models.SheetFile{}, &models.SheetFileShare{}, &models.SheetFileVersion{}, &models.SheetFileBranch{}, &models.Job{}, &models.SheetCell{}, &models.SheetStyle{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %v", err)
 	}
 
 	logger.Info("Database migration completed successfully")
 	return db, nil
 }
-
-// readCSVRows loads a CSV file from disk into [][]string while preserving empty fields.
-func readCSVRows(path string) ([][]string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	reader := csv.NewReader(f)
-	reader.FieldsPerRecord = -1 // allow variable columns per row
-	var rows [][]string
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		rows = append(rows, record)
-	}
-	return rows, nil
-}